@@ -0,0 +1,36 @@
+package v1beta1
+
+// Condition types of the EmergencyAccount status.
+const (
+	// ConditionReady is true if a verified token is available, all stores are healthy, and all access checks passed.
+	ConditionReady = "Ready"
+	// ConditionTokensVerified is true if at least one token was verified in all stores.
+	ConditionTokensVerified = "TokensVerified"
+	// ConditionStoresHealthy is true if the most recent token could be stored in and verified from all stores.
+	ConditionStoresHealthy = "StoresHealthy"
+	// ConditionRotationBlocked is true if a new token is required but can't be created yet.
+	ConditionRotationBlocked = "RotationBlocked"
+	// ConditionAccessVerified is true if the ServiceAccount passed all configured access checks.
+	ConditionAccessVerified = "AccessVerified"
+	// ConditionValidityClamped is true if the API server granted a shorter validity than requested for the last issued credential.
+	ConditionValidityClamped = "ValidityClamped"
+)
+
+// Condition reasons of the EmergencyAccount status.
+const (
+	ReasonReady                   = "Ready"
+	ReasonReconcileFailed         = "ReconcileFailed"
+	ReasonTokensVerified          = "TokensVerified"
+	ReasonNoVerifiedTokens        = "NoVerifiedTokens"
+	ReasonNoTokens                = "NoTokens"
+	ReasonStoresHealthy           = "StoresHealthy"
+	ReasonStoreVerificationFailed = "StoreVerificationFailed"
+	ReasonStoreFailed             = "StoreFailed"
+	ReasonMinRecreateInterval     = "MinRecreateInterval"
+	ReasonNotBlocked              = "NotBlocked"
+	ReasonAccessVerified          = "AccessVerified"
+	ReasonAccessDenied            = "AccessDenied"
+	ReasonNoAccessChecks          = "NoAccessChecks"
+	ReasonValidityClamped         = "ValidityClamped"
+	ReasonValidityGranted         = "ValidityGranted"
+)
@@ -1,6 +1,8 @@
 package v1beta1
 
 import (
+	corev1 "k8s.io/api/core/v1"
+	rbacv1 "k8s.io/api/rbac/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/types"
 )
@@ -15,6 +17,7 @@ type EmergencyAccountSpec struct {
 
 	// MinValidityDurationLeft is the minimum duration the token must be valid.
 	// A new token is created if the current token is not valid for this duration anymore.
+	// Scaled down if the API server grants a shorter validity than requested, see `status.grantedValidityDuration`.
 	// +kubebuilder:validation:Type=string
 	// +kubebuilder:validation:Format=duration
 	// +kubebuilder:default:="168h"
@@ -32,11 +35,84 @@ type EmergencyAccountSpec struct {
 	// +kubebuilder:default:="5m"
 	MinRecreateInterval metav1.Duration `json:"minRecreateInterval,omitempty"`
 
+	// CredentialType is the type of the issued credentials.
+	// `ServiceAccountToken` issues tokens for a ServiceAccount with the name of the EmergencyAccount.
+	// `ClientCertificate` issues client certificates for the user configured in `clientCertificate` through the CertificateSigningRequest API.
+	// Client certificates are signed by the `kubernetes.io/kube-apiserver-client` signer and can't be revoked before they expire.
+	// +kubebuilder:validation:Optional
+	// +kubebuilder:validation:Enum=ServiceAccountToken;ClientCertificate
+	// +kubebuilder:default=ServiceAccountToken
+	CredentialType CredentialType `json:"credentialType,omitempty"`
+	// ServiceAccountToken configures the issued tokens if the credential type is `ServiceAccountToken`.
+	// +kubebuilder:validation:Optional
+	ServiceAccountToken ServiceAccountTokenSpec `json:"serviceAccountToken,omitempty"`
+	// ClientCertificate configures the issued client certificates if the credential type is `ClientCertificate`.
+	// +kubebuilder:validation:Optional
+	ClientCertificate ClientCertificateSpec `json:"clientCertificate,omitempty"`
+
+	// ExpiredTokenRetention defines how long expired tokens are kept in the status.
+	// +kubebuilder:default:={}
+	// +kubebuilder:validation:Optional
+	ExpiredTokenRetention ExpiredTokenRetentionSpec `json:"expiredTokenRetention,omitempty"`
+
+	// Permissions defines the permissions granted to the ServiceAccount or the client certificate user of the EmergencyAccount.
+	// The controller creates and reconciles the required (Cluster)Roles and (Cluster)RoleBindings.
+	// The validating webhook rejects permissions the requesting user is not allowed to grant.
+	// +kubebuilder:validation:Optional
+	Permissions PermissionsSpec `json:"permissions,omitempty"`
+
+	// AccessChecks is a list of accesses the ServiceAccount or the client certificate user of the EmergencyAccount must have.
+	// The checks are evaluated with SubjectAccessReviews on every check and reported through the `AccessVerified` condition.
+	// +kubebuilder:validation:Optional
+	AccessChecks []AccessCheckSpec `json:"accessChecks,omitempty"`
+
 	// TokenStore defines the stores the created tokens are stored in.
 	// +kubebuilder:validation:MinItems=1
 	TokenStores []TokenStoreSpec `json:"tokenStores,omitempty"`
 }
 
+// CredentialType is the type of the issued credentials.
+type CredentialType string
+
+const (
+	// CredentialTypeServiceAccountToken issues ServiceAccount tokens using the TokenRequest API.
+	CredentialTypeServiceAccountToken CredentialType = "ServiceAccountToken"
+	// CredentialTypeClientCertificate issues client certificates using the CertificateSigningRequest API.
+	CredentialTypeClientCertificate CredentialType = "ClientCertificate"
+)
+
+// ServiceAccountTokenSpec configures the issued ServiceAccount tokens.
+type ServiceAccountTokenSpec struct {
+	// Audiences are the intended audiences of the issued tokens.
+	// Defaults to the audiences of the API server if empty.
+	// Required for clusters with an issuer audience differing from the API server default.
+	// Tokens issued for other audiences do not count towards the required validity.
+	// +kubebuilder:validation:Optional
+	Audiences []string `json:"audiences,omitempty"`
+	// BindToSecret binds every issued token to a Secret owned by the EmergencyAccount.
+	// Deleting the Secret of a token revokes the token.
+	// The Secret is named after the token and labeled with the UID of the token.
+	// +kubebuilder:validation:Optional
+	BindToSecret bool `json:"bindToSecret,omitempty"`
+}
+
+// ClientCertificateSpec configures the issued client certificates.
+type ClientCertificateSpec struct {
+	// Username is the name of the user the certificate authenticates as.
+	// It is set as the common name of the certificate.
+	// Permissions are bound to this user.
+	// +kubebuilder:validation:Optional
+	Username string `json:"username,omitempty"`
+	// Groups are the groups of the user.
+	// They are set as the organizations of the certificate.
+	// +kubebuilder:validation:Optional
+	Groups []string `json:"groups,omitempty"`
+	// AllowSystemIdentity allows a username or groups with the `system:` prefix reserved for Kubernetes components, for example `system:masters`.
+	// The controller approves the certificates itself, a certificate for such an identity can bypass RBAC and can't be revoked before it expires.
+	// +kubebuilder:validation:Optional
+	AllowSystemIdentity bool `json:"allowSystemIdentity,omitempty"`
+}
+
 // EmergencyAccountStatus defines the observed state of EmergencyAccount
 type EmergencyAccountStatus struct {
 	// LastTokenCreationTimestamp is the timestamp when the last token was created.
@@ -47,6 +123,130 @@ type EmergencyAccountStatus struct {
 	// It is used to detect changes in the token store configuration.
 	// A change in the configuration triggers the creation of a new token.
 	LastTokenStoreHashes []TokenStoreHash `json:"lastTokenStoreConfigurationHashes,omitempty"`
+
+	// GrantedValidityDuration is the validity the API server granted for the last issued credential if it is shorter than the requested `validityDuration`.
+	// The API server caps the validity of tokens with `--service-account-max-token-expiration`, the kube-controller-manager the validity of certificates with `--cluster-signing-duration`.
+	// `minValidityDurationLeft` is scaled down by the same ratio to not issue a new credential on every check.
+	// +kubebuilder:validation:Optional
+	GrantedValidityDuration *metav1.Duration `json:"grantedValidityDuration,omitempty"`
+
+	// LastRevocation records the last revocation of all tokens triggered through the revoke annotation.
+	// +kubebuilder:validation:Optional
+	LastRevocation *RevocationStatus `json:"lastRevocation,omitempty"`
+
+	// VerifiedTokensValidUntil is the latest expiration timestamp of the verified tokens.
+	// +kubebuilder:validation:Optional
+	VerifiedTokensValidUntil *metav1.Time `json:"verifiedTokensValidUntil,omitempty"`
+
+	// Conditions represent the latest available observations of the EmergencyAccount's state.
+	// +listType=map
+	// +listMapKey=type
+	// +kubebuilder:validation:Optional
+	Conditions []metav1.Condition `json:"conditions,omitempty"`
+}
+
+// RevocationStatus records a revocation of all tokens.
+type RevocationStatus struct {
+	// Nonce is the value of the revoke annotation that triggered the revocation.
+	Nonce string `json:"nonce"`
+	// Timestamp is the time the controller revoked the tokens.
+	Timestamp metav1.Time `json:"timestamp"`
+	// TriggeredBy is the user that set the revoke annotation as recorded by the mutating webhook.
+	// Without the webhook it is the field manager that set the annotation, for example `kubectl-annotate`.
+	// Empty if neither could be determined.
+	// +kubebuilder:validation:Optional
+	TriggeredBy string `json:"triggeredBy,omitempty"`
+	// TriggeredTimestamp is the time the revoke annotation was set according to the managed fields of the EmergencyAccount.
+	// +kubebuilder:validation:Optional
+	TriggeredTimestamp *metav1.Time `json:"triggeredTimestamp,omitempty"`
+	// ServiceAccountUID is the UID of the deleted ServiceAccount.
+	// The recreated ServiceAccount must have a different UID to invalidate the revoked tokens.
+	// +kubebuilder:validation:Optional
+	ServiceAccountUID types.UID `json:"serviceAccountUID,omitempty"`
+}
+
+// ExpiredTokenRetentionSpec defines how long expired tokens are kept in the status.
+// Expired tokens are removed from the status if they exceed any of the given limits.
+type ExpiredTokenRetentionSpec struct {
+	// MaxCount is the maximum number of expired tokens kept in the status.
+	// The most recently expired tokens are kept.
+	// A value of 0 disables the limit.
+	// +kubebuilder:default:=10
+	// +kubebuilder:validation:Minimum=0
+	// +kubebuilder:validation:Optional
+	MaxCount int `json:"maxCount,omitempty"`
+	// MaxAge is the maximum duration an expired token is kept in the status after its expiration.
+	// A value of 0 disables the limit.
+	// +kubebuilder:validation:Type=string
+	// +kubebuilder:validation:Format=duration
+	// +kubebuilder:validation:Optional
+	MaxAge metav1.Duration `json:"maxAge,omitempty"`
+	// StoreDeletionGracePeriod is the duration after its expiration an expired token is deleted from stores supporting deletion.
+	// Expired tokens are kept in the status until they are deleted from all stores supporting deletion.
+	// +kubebuilder:validation:Type=string
+	// +kubebuilder:validation:Format=duration
+	// +kubebuilder:default:="24h"
+	// +kubebuilder:validation:Optional
+	StoreDeletionGracePeriod metav1.Duration `json:"storeDeletionGracePeriod,omitempty"`
+}
+
+// PermissionsSpec defines the permissions granted to the ServiceAccount of the EmergencyAccount.
+type PermissionsSpec struct {
+	// ClusterRoles is a list of ClusterRoles bound cluster-wide to the ServiceAccount using ClusterRoleBindings.
+	// +kubebuilder:validation:Optional
+	ClusterRoles []string `json:"clusterRoles,omitempty"`
+	// Rules are granted cluster-wide to the ServiceAccount.
+	// The controller manages a ClusterRole with the rules and binds it using a ClusterRoleBinding.
+	// +kubebuilder:validation:Optional
+	Rules []rbacv1.PolicyRule `json:"rules,omitempty"`
+	// Namespaced is a list of permissions granted in specific namespaces using RoleBindings.
+	// Every namespace can only be listed once.
+	// +kubebuilder:validation:Optional
+	// +listType=map
+	// +listMapKey=namespace
+	Namespaced []NamespacedPermissionsSpec `json:"namespaced,omitempty"`
+}
+
+// NamespacedPermissionsSpec defines the permissions granted to the ServiceAccount in a specific namespace.
+type NamespacedPermissionsSpec struct {
+	// Namespace is the namespace the permissions are granted in.
+	// +kubebuilder:validation:Required
+	Namespace string `json:"namespace"`
+	// ClusterRoles is a list of ClusterRoles bound in the namespace to the ServiceAccount using RoleBindings.
+	// +kubebuilder:validation:Optional
+	ClusterRoles []string `json:"clusterRoles,omitempty"`
+	// Rules are granted in the namespace to the ServiceAccount.
+	// The controller manages a Role with the rules and binds it using a RoleBinding.
+	// +kubebuilder:validation:Optional
+	Rules []rbacv1.PolicyRule `json:"rules,omitempty"`
+}
+
+// AccessCheckSpec describes an access the ServiceAccount of the EmergencyAccount must have.
+type AccessCheckSpec struct {
+	// ClusterAdmin checks for cluster-admin equivalent access.
+	// The ServiceAccount must be allowed all verbs on all resources and all non-resource URLs.
+	// If set, the other fields are ignored.
+	// +kubebuilder:validation:Optional
+	ClusterAdmin bool `json:"clusterAdmin,omitempty"`
+
+	// Verb is the verb to check, e.g. `get`, `list`, `delete` or `*`.
+	// +kubebuilder:validation:Optional
+	Verb string `json:"verb,omitempty"`
+	// Group is the API group of the resource to check. Empty for the core API group.
+	// +kubebuilder:validation:Optional
+	Group string `json:"group,omitempty"`
+	// Resource is the resource to check, e.g. `pods` or `*`.
+	// +kubebuilder:validation:Optional
+	Resource string `json:"resource,omitempty"`
+	// Subresource is the subresource to check.
+	// +kubebuilder:validation:Optional
+	Subresource string `json:"subresource,omitempty"`
+	// Namespace is the namespace to check. Empty checks all namespaces and cluster scoped resources.
+	// +kubebuilder:validation:Optional
+	Namespace string `json:"namespace,omitempty"`
+	// Name is the name of the resource to check. Empty checks all names.
+	// +kubebuilder:validation:Optional
+	Name string `json:"name,omitempty"`
 }
 
 // TokenStore defines the store the created tokens are stored in
@@ -56,25 +256,79 @@ type TokenStoreSpec struct {
 	// +kubebuilder:validation:Required
 	Name string `json:"name"`
 	// Type defines the type of the store to use.
-	// Currently `secret`, `s3`, and `log` stores are supported.
+	// Currently `secret`, `remoteSecret`, `s3`, `vault`, `webhook`, and `log` stores are supported.
 	// The stores can be further configured in the corresponding storeSpec.
 	// +kubebuilder:validation:Required
-	// +kubebuilder:validation:Enum=secret;log;s3
+	// +kubebuilder:validation:Enum=secret;remoteSecret;log;s3;vault;webhook
 	Type string `json:"type"`
 
 	// SecretSpec configures the secret store.
 	// The secret store saves the tokens in a secret in the same namespace as the EmergencyAccount.
 	SecretSpec SecretStoreSpec `json:"secretStore,omitempty"`
+	// RemoteSecretSpec configures the remote secret store.
+	// The remote secret store saves the tokens in a secret in a namespace on a different cluster.
+	RemoteSecretSpec RemoteSecretStoreSpec `json:"remoteSecretStore,omitempty"`
 	// LogSpec configures the log store.
 	// The log store outputs the token to the log but does not store it anywhere.
 	LogSpec LogStoreSpec `json:"logStore,omitempty"`
 	// S3Spec configures the S3 store.
 	// The S3 store saves the tokens in an S3 bucket.
 	S3Spec S3StoreSpec `json:"s3Store,omitempty"`
+	// VaultSpec configures the Vault store.
+	// The Vault store saves the tokens in a HashiCorp Vault KV version 2 secrets engine.
+	VaultSpec VaultStoreSpec `json:"vaultStore,omitempty"`
+	// WebhookSpec configures the webhook store.
+	// The webhook store sends the tokens to an HTTPS endpoint.
+	WebhookSpec WebhookStoreSpec `json:"webhookStore,omitempty"`
+
+	// Output configures the format of the payload written to the store.
+	// +kubebuilder:validation:Optional
+	// +kubebuilder:default:={}
+	Output OutputSpec `json:"output,omitempty"`
+	// Encryption configures the encryption of the payload written to the store.
+	// If set, the store holds an encrypted envelope instead of the payload, the token can then only be read by the recipients.
+	// The controller can't authenticate encrypted tokens, it only verifies that the store still holds the encrypted envelope.
+	// Until a token is stored in every store it is kept in a secret in the namespace of the EmergencyAccount to retry failing stores.
+	// If every store encrypts, the secret only holds the encrypted envelopes and failing stores are retried up to 10 times.
+	// Otherwise the secret holds the plain token and failing stores are retried only once, the secret is deleted right after.
+	// +kubebuilder:validation:Optional
+	Encryption EncryptionSpec `json:"encryption,omitempty"`
+}
+
+// OutputFormat is the format of the payload written to a store.
+type OutputFormat string
+
+const (
+	// OutputFormatToken writes the bare token.
+	OutputFormatToken OutputFormat = "token"
+	// OutputFormatKubeconfig writes a kubeconfig using the token as user credential.
+	OutputFormatKubeconfig OutputFormat = "kubeconfig"
+)
+
+// OutputSpec configures the format of the payload written to a store.
+type OutputSpec struct {
+	// Format is the format of the payload.
+	// `token` writes the bare token, `kubeconfig` writes a complete kubeconfig using the token as user credential.
+	// +kubebuilder:validation:Optional
+	// +kubebuilder:validation:Enum=token;kubeconfig
+	// +kubebuilder:default=token
+	Format OutputFormat `json:"format,omitempty"`
+	// Kubeconfig configures the kubeconfig if the format is `kubeconfig`.
+	// +kubebuilder:validation:Optional
+	Kubeconfig KubeconfigOutputSpec `json:"kubeconfig,omitempty"`
+}
+
+// KubeconfigOutputSpec configures the rendered kubeconfig.
+// The CA bundle is taken from the `kube-root-ca.crt` ConfigMap in the namespace of the EmergencyAccount.
+type KubeconfigOutputSpec struct {
+	// Servers are the URLs of the API server.
+	// A cluster and context is added for every server, the first server is used for the current context.
+	// +kubebuilder:validation:Optional
+	Servers []string `json:"servers,omitempty"`
 }
 
 // S3StoreSpec configures the S3 store.
-// The S3 store saves the tokens in an S3 bucket with optional encryption using PGP public keys.
+// The S3 store saves the tokens in an S3 bucket with optional encryption using PGP public keys or age recipients.
 type S3StoreSpec struct {
 	// ObjectNameTemplate is the template for the object name to use.
 	// Sprig functions can be used to generate the object name.
@@ -92,6 +346,10 @@ type S3StoreSpec struct {
 	S3 S3Spec `json:"s3"`
 	// Encryption defines the encryption settings for the S3 store.
 	// If not set, the tokens are stored unencrypted.
+	// Encrypted tokens are stored in a versioned JSON envelope listing the fingerprint, key ID, and user ID of every recipient,
+	// and non-secret metadata like the EmergencyAccount, the token UID, and the expiration of the token.
+	// Deprecated: Use the encryption block of the token store instead, it is supported by all store types.
+	// Can't be combined with the encryption block of the token store.
 	// +kubebuilder:validation:Optional
 	Encryption S3EncryptionSpec `json:"encryption,omitempty"`
 }
@@ -102,10 +360,19 @@ type S3Spec struct {
 	// Bucket is the S3 bucket to use.
 	Bucket string `json:"bucket"`
 
+	// CredentialsSecretRef references a secret in the namespace of the EmergencyAccount holding the S3 credentials.
+	// A change of the referenced secret's content triggers the creation of a new token, just like a change of the store configuration.
+	// +kubebuilder:validation:Optional
+	CredentialsSecretRef *S3CredentialsSecretRef `json:"credentialsSecretRef,omitempty"`
+
 	// AccessKeyId and SecretAccessKey are the S3 credentials to use.
-	AccessKeyId string `json:"accessKeyId"`
+	// Deprecated: Use CredentialsSecretRef instead. Ignored if CredentialsSecretRef is set.
+	// +kubebuilder:validation:Optional
+	AccessKeyId string `json:"accessKeyId,omitempty"`
 	// SecretAccessKey is the S3 secret access key to use.
-	SecretAccessKey string `json:"secretAccessKey"`
+	// Deprecated: Use CredentialsSecretRef instead. Ignored if CredentialsSecretRef is set.
+	// +kubebuilder:validation:Optional
+	SecretAccessKey string `json:"secretAccessKey,omitempty"`
 
 	// Region is the AWS region to use.
 	Region string `json:"region,omitempty"`
@@ -113,18 +380,299 @@ type S3Spec struct {
 	Insecure bool `json:"insecure,omitempty"`
 }
 
-type S3EncryptionSpec struct {
+// S3CredentialsSecretRef references a secret holding S3 credentials.
+type S3CredentialsSecretRef struct {
+	// Name is the name of the secret.
+	// The secret must be in the same namespace as the EmergencyAccount.
+	// +kubebuilder:validation:Required
+	Name string `json:"name"`
+	// AccessKeyIdKey is the key in the secret holding the S3 access key id.
+	// +kubebuilder:default:="accessKeyId"
+	// +kubebuilder:validation:Optional
+	AccessKeyIdKey string `json:"accessKeyIdKey,omitempty"`
+	// SecretAccessKeyKey is the key in the secret holding the S3 secret access key.
+	// +kubebuilder:default:="secretAccessKey"
+	// +kubebuilder:validation:Optional
+	SecretAccessKeyKey string `json:"secretAccessKeyKey,omitempty"`
+}
+
+// VaultStoreSpec configures the Vault store.
+// The Vault store writes the tokens to a KV version 2 secrets engine, the version of the written secret is recorded as the reference of the token.
+type VaultStoreSpec struct {
+	// PathTemplate is the template for the path of the secret in the KV secrets engine.
+	// The path is relative to the mount of the secrets engine.
+	// Sprig functions can be used to generate the path.
+	// If not set, the path is the name of the EmergencyAccount.
+	// The name of the EmergencyAccount can be accessed with `{{ .Name }}`.
+	// The namespace of the EmergencyAccount can be accessed with `{{ .Namespace }}`.
+	// The full EmergencyAccount object can be accessed with `{{ .EmergencyAccount }}`.
+	// Additional context can be passed with the `pathTemplateContext` field and is accessible with `{{ .Context.<key> }}`.
+	// +kubebuilder:validation:Optional
+	PathTemplate string `json:"pathTemplate,omitempty"`
+	// PathTemplateContext is the additional context to use for the path template.
+	// +kubebuilder:validation:Optional
+	PathTemplateContext map[string]string `json:"pathTemplateContext,omitempty"`
+
+	Vault VaultSpec `json:"vault"`
+}
+
+type VaultSpec struct {
+	// Address is the https URL of the Vault server.
+	// +kubebuilder:validation:Required
+	Address string `json:"address"`
+	// Namespace is the Vault Enterprise namespace to use.
+	// +kubebuilder:validation:Optional
+	Namespace string `json:"namespace,omitempty"`
+	// Mount is the mount path of the KV version 2 secrets engine.
+	// +kubebuilder:default:="secret"
+	// +kubebuilder:validation:Optional
+	Mount string `json:"mount,omitempty"`
+	// Key is the key of the token in the data of the written secret.
+	// +kubebuilder:default:="token"
+	// +kubebuilder:validation:Optional
+	Key string `json:"key,omitempty"`
+
+	// CABundle is a PEM encoded CA bundle to verify the certificate of the Vault server.
+	// The system CAs are trusted if not set.
+	// +kubebuilder:validation:Optional
+	CABundle string `json:"caBundle,omitempty"`
+	// Insecure skips the verification of the certificate of the Vault server.
+	// +kubebuilder:validation:Optional
+	Insecure bool `json:"insecure,omitempty"`
+
+	// Auth configures the authentication against Vault.
+	// Exactly one of `tokenSecretRef` and `appRole` must be set.
+	// +kubebuilder:validation:Required
+	Auth VaultAuthSpec `json:"auth"`
+}
+
+// VaultAuthSpec configures the authentication against Vault.
+// The credentials are read from secrets in the namespace of the EmergencyAccount.
+// A change of the referenced secret's content triggers the creation of a new token, just like a change of the store configuration.
+type VaultAuthSpec struct {
+	// TokenSecretRef references a secret holding a Vault token.
+	// +kubebuilder:validation:Optional
+	TokenSecretRef *VaultTokenSecretRef `json:"tokenSecretRef,omitempty"`
+	// AppRole configures the AppRole auth method.
+	// +kubebuilder:validation:Optional
+	AppRole *VaultAppRoleAuthSpec `json:"appRole,omitempty"`
+}
+
+// VaultTokenSecretRef references a secret holding a Vault token.
+type VaultTokenSecretRef struct {
+	// Name is the name of the secret.
+	// The secret must be in the same namespace as the EmergencyAccount.
+	// +kubebuilder:validation:Required
+	Name string `json:"name"`
+	// TokenKey is the key in the secret holding the Vault token.
+	// +kubebuilder:default:="token"
+	// +kubebuilder:validation:Optional
+	TokenKey string `json:"tokenKey,omitempty"`
+}
+
+// VaultAppRoleAuthSpec configures the AppRole auth method.
+type VaultAppRoleAuthSpec struct {
+	// Mount is the mount path of the AppRole auth method.
+	// +kubebuilder:default:="approle"
+	// +kubebuilder:validation:Optional
+	Mount string `json:"mount,omitempty"`
+	// SecretRef references a secret holding the role ID and the secret ID.
+	// +kubebuilder:validation:Required
+	SecretRef VaultAppRoleSecretRef `json:"secretRef"`
+}
+
+// VaultAppRoleSecretRef references a secret holding AppRole credentials.
+type VaultAppRoleSecretRef struct {
+	// Name is the name of the secret.
+	// The secret must be in the same namespace as the EmergencyAccount.
+	// +kubebuilder:validation:Required
+	Name string `json:"name"`
+	// RoleIDKey is the key in the secret holding the role ID.
+	// +kubebuilder:default:="roleId"
+	// +kubebuilder:validation:Optional
+	RoleIDKey string `json:"roleIdKey,omitempty"`
+	// SecretIDKey is the key in the secret holding the secret ID.
+	// +kubebuilder:default:="secretId"
+	// +kubebuilder:validation:Optional
+	SecretIDKey string `json:"secretIdKey,omitempty"`
+}
+
+// WebhookStoreSpec configures the webhook store.
+// The webhook store POSTs a JSON payload holding the token and its metadata to an HTTPS endpoint.
+// The request is signed with an HMAC-SHA256 of the body in the `X-Emergency-Credentials-Signature` header, formatted as `sha256=<hex>`.
+// The endpoint must answer with a JSON object holding the reference of the token in the `ref` field.
+type WebhookStoreSpec struct {
+	// URL is the HTTPS endpoint the tokens are POSTed to.
+	// +kubebuilder:validation:Required
+	URL string `json:"url"`
+	// RetrieveURL is an optional HTTPS endpoint to retrieve stored tokens from.
+	// If set, the controller verifies the stored tokens with a GET request with the reference in the `ref` query parameter.
+	// The request is signed with an HMAC-SHA256 of the reference, the endpoint must answer with the JSON payload of the token.
+	// +kubebuilder:validation:Optional
+	RetrieveURL string `json:"retrieveUrl,omitempty"`
+	// Headers are additional headers added to every request.
+	// +kubebuilder:validation:Optional
+	Headers map[string]string `json:"headers,omitempty"`
+
+	// SigningSecretRef references a secret holding the HMAC key the requests are signed with.
+	// +kubebuilder:validation:Required
+	SigningSecretRef WebhookSigningSecretRef `json:"signingSecretRef"`
+	// ClientCertificateSecretRef references a `kubernetes.io/tls` secret holding the client certificate for mutual TLS.
+	// The `ca.crt` key of the secret is trusted in addition to the `caBundle` if present.
+	// +kubebuilder:validation:Optional
+	ClientCertificateSecretRef *WebhookClientCertificateSecretRef `json:"clientCertificateSecretRef,omitempty"`
+	// CABundle is a PEM encoded CA bundle to verify the certificate of the endpoint.
+	// The system CAs are trusted if neither the CA bundle nor a `ca.crt` in the client certificate secret is set.
+	// +kubebuilder:validation:Optional
+	CABundle string `json:"caBundle,omitempty"`
+}
+
+// WebhookSigningSecretRef references a secret holding the HMAC key of the webhook store.
+type WebhookSigningSecretRef struct {
+	// Name is the name of the secret.
+	// The secret must be in the same namespace as the EmergencyAccount.
+	// +kubebuilder:validation:Required
+	Name string `json:"name"`
+	// Key is the key in the secret holding the HMAC key.
+	// +kubebuilder:default:="secret"
+	// +kubebuilder:validation:Optional
+	Key string `json:"key,omitempty"`
+}
+
+// WebhookClientCertificateSecretRef references a `kubernetes.io/tls` secret holding a client certificate.
+type WebhookClientCertificateSecretRef struct {
+	// Name is the name of the secret.
+	// The secret must be in the same namespace as the EmergencyAccount.
+	// +kubebuilder:validation:Required
+	Name string `json:"name"`
+}
+
+// EncryptionScheme is the scheme used to encrypt tokens.
+type EncryptionScheme string
+
+const (
+	// EncryptionSchemePGP encrypts tokens with PGP public keys.
+	EncryptionSchemePGP EncryptionScheme = "PGP"
+	// EncryptionSchemeAge encrypts tokens with age recipients.
+	EncryptionSchemeAge EncryptionScheme = "Age"
+)
+
+// S3EncryptionSpec configures the encryption of the S3 store.
+// Deprecated: Use EncryptionSpec in the encryption block of the token store instead.
+type S3EncryptionSpec = EncryptionSpec
+
+// EncryptionSpec configures the encryption of the tokens written to a store.
+// Encrypted tokens are written as a versioned JSON envelope holding the token encrypted for every recipient,
+// together with non-secret metadata like the EmergencyAccount, the token UID, and the expiration of the token.
+type EncryptionSpec struct {
 	// Encrypt defines if the tokens should be encrypted.
 	// If not set, the tokens are stored unencrypted.
 	Encrypt bool `json:"encrypt,omitempty"`
+	// Scheme is the encryption scheme to use.
+	// `PGP` encrypts the tokens with the keys in `pgpKeys`, `Age` encrypts the tokens with the recipients in `ageRecipients`.
+	// +kubebuilder:validation:Optional
+	// +kubebuilder:validation:Enum=PGP;Age
+	// +kubebuilder:default=PGP
+	Scheme EncryptionScheme `json:"scheme,omitempty"`
 	// PGPKeys is a list of PGP public keys to encrypt the tokens with.
-	// At least one key must be given if encryption is enabled.
+	// At least one key must be given if encryption is enabled with the `PGP` scheme.
 	PGPKeys []string `json:"pgpKeys,omitempty"`
+	// AgeRecipients is a list of age recipients to encrypt the tokens with.
+	// Every entry may contain multiple recipients, one per line, in the format of an age recipients file.
+	// Native X25519 recipients (`age1...`) and SSH public keys (`ssh-ed25519` and `ssh-rsa`) are supported.
+	// Empty lines and lines starting with `#` are ignored.
+	// At least one recipient must be given if encryption is enabled with the `Age` scheme.
+	AgeRecipients []string `json:"ageRecipients,omitempty"`
+	// Threshold splits the token with Shamir's secret sharing into one share per recipient if set.
+	// Every share is encrypted for a single recipient, any `threshold` shares reconstruct the token.
+	// No single recipient can obtain the token on their own.
+	// Must be at least 2 and must not exceed the number of recipients.
+	// +kubebuilder:validation:Optional
+	// +kubebuilder:validation:Minimum=0
+	Threshold int `json:"threshold,omitempty"`
 }
 
 // SecretStoreSpec configures the secret store.
 // The secret store saves the tokens in a secret in the same namespace as the EmergencyAccount.
-type SecretStoreSpec struct{}
+type SecretStoreSpec struct {
+	// NameTemplate is the template for the name of the secret.
+	// Sprig functions can be used to generate the name.
+	// If not set, the secret is named `<name>-<expiration unix timestamp>`, every token is stored in its own secret.
+	// The name of the EmergencyAccount can be accessed with `{{ .Name }}`.
+	// The namespace of the EmergencyAccount can be accessed with `{{ .Namespace }}`.
+	// The full EmergencyAccount object can be accessed with `{{ .EmergencyAccount }}`.
+	// The expiration of the token can be accessed with `{{ .ExpirationTimestamp }}`.
+	// Additional context can be passed with the `nameTemplateContext` field and is accessible with `{{ .Context.<key> }}`.
+	// A stable name like `{{ .Name }}-current` overwrites the secret with every new token, the previous tokens are then reported as no longer stored.
+	// +kubebuilder:validation:Optional
+	NameTemplate string `json:"nameTemplate,omitempty"`
+	// NameTemplateContext is the additional context to use for the name template.
+	// +kubebuilder:validation:Optional
+	NameTemplateContext map[string]string `json:"nameTemplateContext,omitempty"`
+	// Namespace is the namespace the secret is created in.
+	// If not set, the secret is created in the namespace of the EmergencyAccount.
+	// Secrets in other namespaces can't be owned by the EmergencyAccount, the EmergencyAccount is recorded in an annotation instead.
+	// The controller must be allowed to manage secrets in the namespace and be started with the namespace in `--secret-namespaces`.
+	// +kubebuilder:validation:Optional
+	Namespace string `json:"namespace,omitempty"`
+	// Labels are added to the secret.
+	// +kubebuilder:validation:Optional
+	Labels map[string]string `json:"labels,omitempty"`
+	// Key is the key of the token in the data of the secret.
+	// +kubebuilder:default:="token"
+	// +kubebuilder:validation:Optional
+	Key string `json:"key,omitempty"`
+	// Type is the type of the secret.
+	// The type of an existing secret can't be changed.
+	// +kubebuilder:default:="Opaque"
+	// +kubebuilder:validation:Optional
+	Type corev1.SecretType `json:"type,omitempty"`
+	// Replication configures additional namespaces the secret is copied into.
+	// +kubebuilder:validation:Optional
+	Replication SecretReplicationSpec `json:"replication,omitempty"`
+}
+
+// SecretReplicationSpec configures the namespaces a secret is copied into.
+// The copies have the same name, data, type, and labels as the secret.
+// Copies can't be owned by the EmergencyAccount, they are labeled with the name and namespace of the EmergencyAccount instead.
+// The controller keeps the copies in sync, verifies them alongside the secret, and deletes them with the secret or the EmergencyAccount.
+// Replication must be enabled with `--enable-secret-replication`, the controller must be allowed to manage secrets in all namespaces.
+type SecretReplicationSpec struct {
+	// Namespaces is a list of namespaces the secret is copied into.
+	// +kubebuilder:validation:Optional
+	Namespaces []string `json:"namespaces,omitempty"`
+	// NamespaceSelector selects additional namespaces the secret is copied into by their labels.
+	// Copies in namespaces no longer selected are deleted.
+	// +kubebuilder:validation:Optional
+	NamespaceSelector *metav1.LabelSelector `json:"namespaceSelector,omitempty"`
+}
+
+// RemoteSecretStoreSpec configures the remote secret store.
+// The remote secret store saves the tokens in a secret in a namespace on a different cluster, for example a management cluster.
+// The secrets are named `<cluster>-<namespace>-<name>-<expiration unix timestamp>`, the namespace can hold the tokens of multiple clusters.
+// Earlier versions named the secrets `<name>-<expiration unix timestamp>`, these secrets are still read and deleted through the references in the status.
+// Secrets annotated with another EmergencyAccount or cluster are never overwritten or deleted.
+type RemoteSecretStoreSpec struct {
+	// Namespace is the namespace on the remote cluster the secrets are created in.
+	// +kubebuilder:validation:Required
+	Namespace string `json:"namespace"`
+	// KubeconfigSecretRef references a secret holding the kubeconfig to access the remote cluster.
+	// +kubebuilder:validation:Required
+	KubeconfigSecretRef RemoteKubeconfigSecretRef `json:"kubeconfigSecretRef"`
+}
+
+// RemoteKubeconfigSecretRef references a secret holding a kubeconfig.
+type RemoteKubeconfigSecretRef struct {
+	// Name is the name of the secret.
+	// The secret must be in the same namespace as the EmergencyAccount.
+	// A change of the referenced secret's content triggers the creation of a new token, just like a change of the store configuration.
+	// +kubebuilder:validation:Required
+	Name string `json:"name"`
+	// Key is the key in the secret holding the kubeconfig.
+	// +kubebuilder:default:="kubeconfig"
+	// +kubebuilder:validation:Optional
+	Key string `json:"key,omitempty"`
+}
 
 // LogStoreSpec configures the log store.
 // The log store outputs the token to the log but does not store it anywhere.
@@ -142,8 +690,41 @@ type TokenStatus struct {
 	Refs []TokenStatusRef `json:"refs,omitempty"`
 	// ExpirationTimestamp is the timestamp when the token expires
 	ExpirationTimestamp metav1.Time `json:"expirationTimestamp"`
+	// Phase is the phase of the token issuance.
+	// `Issuing` if the token is being issued and stored, `Issued` if the issuance is complete.
+	// Tokens left in the `Issuing` phase are resumed or cleaned up by the controller.
+	// An empty phase is treated as `Issued`.
+	// +kubebuilder:validation:Optional
+	// +kubebuilder:validation:Enum=Issuing;Issued
+	Phase TokenPhase `json:"phase,omitempty"`
+	// CredentialType is the type of the credential.
+	// An empty type is treated as `ServiceAccountToken`.
+	// +kubebuilder:validation:Optional
+	CredentialType CredentialType `json:"credentialType,omitempty"`
+	// Audiences are the audiences the token was issued for.
+	// Empty if the token was issued for the default audiences of the API server.
+	// +kubebuilder:validation:Optional
+	Audiences []string `json:"audiences,omitempty"`
+	// Revoked is true if the token was revoked through the revoke annotation.
+	// Revoked tokens are deleted from the stores supporting deletion and are not verified anymore.
+	// +kubebuilder:validation:Optional
+	Revoked bool `json:"revoked,omitempty"`
+	// BoundSecretName is the name of the Secret the token is bound to.
+	// Deleting the Secret revokes the token.
+	// +kubebuilder:validation:Optional
+	BoundSecretName string `json:"boundSecretName,omitempty"`
 }
 
+// TokenPhase is the phase of the token issuance.
+type TokenPhase string
+
+const (
+	// TokenPhaseIssuing means the token is being issued and stored.
+	TokenPhaseIssuing TokenPhase = "Issuing"
+	// TokenPhaseIssued means the token was issued and stored.
+	TokenPhaseIssued TokenPhase = "Issued"
+)
+
 type TokenStatusRef struct {
 	// Ref is a reference to the token. The used storage should be able to uniquely identify the token.
 	// If no ref is given, the token is not checked for validity.
@@ -152,8 +733,40 @@ type TokenStatusRef struct {
 
 	// Store is the name of the store the token is stored in.
 	Store string `json:"store"`
+
+	// State is the outcome of storing the token in the store.
+	// `Stored` if the token was stored successfully, `Pending` if storing failed and is retried, `Failed` if storing failed and is not retried anymore.
+	// An empty state is treated as `Stored`.
+	// +kubebuilder:validation:Optional
+	// +kubebuilder:validation:Enum=Stored;Pending;Failed
+	State TokenStoreState `json:"state,omitempty"`
+	// Error is the error of the last failed attempt to store the token.
+	// +kubebuilder:validation:Optional
+	Error string `json:"error,omitempty"`
+	// Attempts is the number of attempts to store the token.
+	// +kubebuilder:validation:Optional
+	Attempts int `json:"attempts,omitempty"`
+	// LastAttemptTimestamp is the timestamp of the last attempt to store the token.
+	// +kubebuilder:validation:Optional
+	LastAttemptTimestamp metav1.Time `json:"lastAttemptTimestamp,omitempty"`
+
+	// Deleted is true if the token was deleted from the store after expiration.
+	// +kubebuilder:validation:Optional
+	Deleted bool `json:"deleted,omitempty"`
 }
 
+// TokenStoreState is the outcome of storing a token in a store.
+type TokenStoreState string
+
+const (
+	// TokenStoreStateStored means the token was stored successfully.
+	TokenStoreStateStored TokenStoreState = "Stored"
+	// TokenStoreStatePending means storing the token failed and is retried.
+	TokenStoreStatePending TokenStoreState = "Pending"
+	// TokenStoreStateFailed means storing the token failed and is not retried anymore.
+	TokenStoreStateFailed TokenStoreState = "Failed"
+)
+
 type TokenStoreHash struct {
 	// Name is the name of the store.
 	Name string `json:"name"`
@@ -163,6 +776,10 @@ type TokenStoreHash struct {
 
 //+kubebuilder:object:root=true
 //+kubebuilder:subresource:status
+//+kubebuilder:printcolumn:name="Ready",type="string",JSONPath=".status.conditions[?(@.type==\"Ready\")].status"
+//+kubebuilder:printcolumn:name="Valid Until",type="string",JSONPath=".status.verifiedTokensValidUntil"
+//+kubebuilder:printcolumn:name="Reason",type="string",JSONPath=".status.conditions[?(@.type==\"Ready\")].reason",priority=1
+//+kubebuilder:printcolumn:name="Age",type="date",JSONPath=".metadata.creationTimestamp"
 
 // EmergencyAccount is the Schema for the emergencyaccounts API
 type EmergencyAccount struct {
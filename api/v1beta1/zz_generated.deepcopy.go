@@ -5,9 +5,46 @@
 package v1beta1
 
 import (
+	rbacv1 "k8s.io/api/rbac/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1"
 	runtime "k8s.io/apimachinery/pkg/runtime"
 )
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *AccessCheckSpec) DeepCopyInto(out *AccessCheckSpec) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new AccessCheckSpec.
+func (in *AccessCheckSpec) DeepCopy() *AccessCheckSpec {
+	if in == nil {
+		return nil
+	}
+	out := new(AccessCheckSpec)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *ClientCertificateSpec) DeepCopyInto(out *ClientCertificateSpec) {
+	*out = *in
+	if in.Groups != nil {
+		in, out := &in.Groups, &out.Groups
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ClientCertificateSpec.
+func (in *ClientCertificateSpec) DeepCopy() *ClientCertificateSpec {
+	if in == nil {
+		return nil
+	}
+	out := new(ClientCertificateSpec)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *EmergencyAccount) DeepCopyInto(out *EmergencyAccount) {
 	*out = *in
@@ -74,6 +111,15 @@ func (in *EmergencyAccountSpec) DeepCopyInto(out *EmergencyAccountSpec) {
 	out.MinValidityDurationLeft = in.MinValidityDurationLeft
 	out.CheckInterval = in.CheckInterval
 	out.MinRecreateInterval = in.MinRecreateInterval
+	in.ServiceAccountToken.DeepCopyInto(&out.ServiceAccountToken)
+	in.ClientCertificate.DeepCopyInto(&out.ClientCertificate)
+	out.ExpiredTokenRetention = in.ExpiredTokenRetention
+	in.Permissions.DeepCopyInto(&out.Permissions)
+	if in.AccessChecks != nil {
+		in, out := &in.AccessChecks, &out.AccessChecks
+		*out = make([]AccessCheckSpec, len(*in))
+		copy(*out, *in)
+	}
 	if in.TokenStores != nil {
 		in, out := &in.TokenStores, &out.TokenStores
 		*out = make([]TokenStoreSpec, len(*in))
@@ -109,6 +155,27 @@ func (in *EmergencyAccountStatus) DeepCopyInto(out *EmergencyAccountStatus) {
 		*out = make([]TokenStoreHash, len(*in))
 		copy(*out, *in)
 	}
+	if in.GrantedValidityDuration != nil {
+		in, out := &in.GrantedValidityDuration, &out.GrantedValidityDuration
+		*out = new(v1.Duration)
+		**out = **in
+	}
+	if in.LastRevocation != nil {
+		in, out := &in.LastRevocation, &out.LastRevocation
+		*out = new(RevocationStatus)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.VerifiedTokensValidUntil != nil {
+		in, out := &in.VerifiedTokensValidUntil, &out.VerifiedTokensValidUntil
+		*out = (*in).DeepCopy()
+	}
+	if in.Conditions != nil {
+		in, out := &in.Conditions, &out.Conditions
+		*out = make([]v1.Condition, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
 }
 
 // DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new EmergencyAccountStatus.
@@ -121,6 +188,68 @@ func (in *EmergencyAccountStatus) DeepCopy() *EmergencyAccountStatus {
 	return out
 }
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *EncryptionSpec) DeepCopyInto(out *EncryptionSpec) {
+	*out = *in
+	if in.PGPKeys != nil {
+		in, out := &in.PGPKeys, &out.PGPKeys
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	if in.AgeRecipients != nil {
+		in, out := &in.AgeRecipients, &out.AgeRecipients
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new EncryptionSpec.
+func (in *EncryptionSpec) DeepCopy() *EncryptionSpec {
+	if in == nil {
+		return nil
+	}
+	out := new(EncryptionSpec)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *ExpiredTokenRetentionSpec) DeepCopyInto(out *ExpiredTokenRetentionSpec) {
+	*out = *in
+	out.MaxAge = in.MaxAge
+	out.StoreDeletionGracePeriod = in.StoreDeletionGracePeriod
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ExpiredTokenRetentionSpec.
+func (in *ExpiredTokenRetentionSpec) DeepCopy() *ExpiredTokenRetentionSpec {
+	if in == nil {
+		return nil
+	}
+	out := new(ExpiredTokenRetentionSpec)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *KubeconfigOutputSpec) DeepCopyInto(out *KubeconfigOutputSpec) {
+	*out = *in
+	if in.Servers != nil {
+		in, out := &in.Servers, &out.Servers
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new KubeconfigOutputSpec.
+func (in *KubeconfigOutputSpec) DeepCopy() *KubeconfigOutputSpec {
+	if in == nil {
+		return nil
+	}
+	out := new(KubeconfigOutputSpec)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *LogStoreSpec) DeepCopyInto(out *LogStoreSpec) {
 	*out = *in
@@ -144,21 +273,144 @@ func (in *LogStoreSpec) DeepCopy() *LogStoreSpec {
 }
 
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
-func (in *S3EncryptionSpec) DeepCopyInto(out *S3EncryptionSpec) {
+func (in *NamespacedPermissionsSpec) DeepCopyInto(out *NamespacedPermissionsSpec) {
 	*out = *in
-	if in.PGPKeys != nil {
-		in, out := &in.PGPKeys, &out.PGPKeys
+	if in.ClusterRoles != nil {
+		in, out := &in.ClusterRoles, &out.ClusterRoles
 		*out = make([]string, len(*in))
 		copy(*out, *in)
 	}
+	if in.Rules != nil {
+		in, out := &in.Rules, &out.Rules
+		*out = make([]rbacv1.PolicyRule, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new NamespacedPermissionsSpec.
+func (in *NamespacedPermissionsSpec) DeepCopy() *NamespacedPermissionsSpec {
+	if in == nil {
+		return nil
+	}
+	out := new(NamespacedPermissionsSpec)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *OutputSpec) DeepCopyInto(out *OutputSpec) {
+	*out = *in
+	in.Kubeconfig.DeepCopyInto(&out.Kubeconfig)
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new OutputSpec.
+func (in *OutputSpec) DeepCopy() *OutputSpec {
+	if in == nil {
+		return nil
+	}
+	out := new(OutputSpec)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *PermissionsSpec) DeepCopyInto(out *PermissionsSpec) {
+	*out = *in
+	if in.ClusterRoles != nil {
+		in, out := &in.ClusterRoles, &out.ClusterRoles
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	if in.Rules != nil {
+		in, out := &in.Rules, &out.Rules
+		*out = make([]rbacv1.PolicyRule, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+	if in.Namespaced != nil {
+		in, out := &in.Namespaced, &out.Namespaced
+		*out = make([]NamespacedPermissionsSpec, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new PermissionsSpec.
+func (in *PermissionsSpec) DeepCopy() *PermissionsSpec {
+	if in == nil {
+		return nil
+	}
+	out := new(PermissionsSpec)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *RemoteKubeconfigSecretRef) DeepCopyInto(out *RemoteKubeconfigSecretRef) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new RemoteKubeconfigSecretRef.
+func (in *RemoteKubeconfigSecretRef) DeepCopy() *RemoteKubeconfigSecretRef {
+	if in == nil {
+		return nil
+	}
+	out := new(RemoteKubeconfigSecretRef)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *RemoteSecretStoreSpec) DeepCopyInto(out *RemoteSecretStoreSpec) {
+	*out = *in
+	out.KubeconfigSecretRef = in.KubeconfigSecretRef
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new RemoteSecretStoreSpec.
+func (in *RemoteSecretStoreSpec) DeepCopy() *RemoteSecretStoreSpec {
+	if in == nil {
+		return nil
+	}
+	out := new(RemoteSecretStoreSpec)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *RevocationStatus) DeepCopyInto(out *RevocationStatus) {
+	*out = *in
+	in.Timestamp.DeepCopyInto(&out.Timestamp)
+	if in.TriggeredTimestamp != nil {
+		in, out := &in.TriggeredTimestamp, &out.TriggeredTimestamp
+		*out = (*in).DeepCopy()
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new RevocationStatus.
+func (in *RevocationStatus) DeepCopy() *RevocationStatus {
+	if in == nil {
+		return nil
+	}
+	out := new(RevocationStatus)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *S3CredentialsSecretRef) DeepCopyInto(out *S3CredentialsSecretRef) {
+	*out = *in
 }
 
-// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new S3EncryptionSpec.
-func (in *S3EncryptionSpec) DeepCopy() *S3EncryptionSpec {
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new S3CredentialsSecretRef.
+func (in *S3CredentialsSecretRef) DeepCopy() *S3CredentialsSecretRef {
 	if in == nil {
 		return nil
 	}
-	out := new(S3EncryptionSpec)
+	out := new(S3CredentialsSecretRef)
 	in.DeepCopyInto(out)
 	return out
 }
@@ -166,6 +418,11 @@ func (in *S3EncryptionSpec) DeepCopy() *S3EncryptionSpec {
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *S3Spec) DeepCopyInto(out *S3Spec) {
 	*out = *in
+	if in.CredentialsSecretRef != nil {
+		in, out := &in.CredentialsSecretRef, &out.CredentialsSecretRef
+		*out = new(S3CredentialsSecretRef)
+		**out = **in
+	}
 }
 
 // DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new S3Spec.
@@ -188,7 +445,7 @@ func (in *S3StoreSpec) DeepCopyInto(out *S3StoreSpec) {
 			(*out)[key] = val
 		}
 	}
-	out.S3 = in.S3
+	in.S3.DeepCopyInto(&out.S3)
 	in.Encryption.DeepCopyInto(&out.Encryption)
 }
 
@@ -202,9 +459,49 @@ func (in *S3StoreSpec) DeepCopy() *S3StoreSpec {
 	return out
 }
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *SecretReplicationSpec) DeepCopyInto(out *SecretReplicationSpec) {
+	*out = *in
+	if in.Namespaces != nil {
+		in, out := &in.Namespaces, &out.Namespaces
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	if in.NamespaceSelector != nil {
+		in, out := &in.NamespaceSelector, &out.NamespaceSelector
+		*out = new(v1.LabelSelector)
+		(*in).DeepCopyInto(*out)
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new SecretReplicationSpec.
+func (in *SecretReplicationSpec) DeepCopy() *SecretReplicationSpec {
+	if in == nil {
+		return nil
+	}
+	out := new(SecretReplicationSpec)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *SecretStoreSpec) DeepCopyInto(out *SecretStoreSpec) {
 	*out = *in
+	if in.NameTemplateContext != nil {
+		in, out := &in.NameTemplateContext, &out.NameTemplateContext
+		*out = make(map[string]string, len(*in))
+		for key, val := range *in {
+			(*out)[key] = val
+		}
+	}
+	if in.Labels != nil {
+		in, out := &in.Labels, &out.Labels
+		*out = make(map[string]string, len(*in))
+		for key, val := range *in {
+			(*out)[key] = val
+		}
+	}
+	in.Replication.DeepCopyInto(&out.Replication)
 }
 
 // DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new SecretStoreSpec.
@@ -217,15 +514,42 @@ func (in *SecretStoreSpec) DeepCopy() *SecretStoreSpec {
 	return out
 }
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *ServiceAccountTokenSpec) DeepCopyInto(out *ServiceAccountTokenSpec) {
+	*out = *in
+	if in.Audiences != nil {
+		in, out := &in.Audiences, &out.Audiences
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ServiceAccountTokenSpec.
+func (in *ServiceAccountTokenSpec) DeepCopy() *ServiceAccountTokenSpec {
+	if in == nil {
+		return nil
+	}
+	out := new(ServiceAccountTokenSpec)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *TokenStatus) DeepCopyInto(out *TokenStatus) {
 	*out = *in
 	if in.Refs != nil {
 		in, out := &in.Refs, &out.Refs
 		*out = make([]TokenStatusRef, len(*in))
-		copy(*out, *in)
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
 	}
 	in.ExpirationTimestamp.DeepCopyInto(&out.ExpirationTimestamp)
+	if in.Audiences != nil {
+		in, out := &in.Audiences, &out.Audiences
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
 }
 
 // DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new TokenStatus.
@@ -241,6 +565,7 @@ func (in *TokenStatus) DeepCopy() *TokenStatus {
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *TokenStatusRef) DeepCopyInto(out *TokenStatusRef) {
 	*out = *in
+	in.LastAttemptTimestamp.DeepCopyInto(&out.LastAttemptTimestamp)
 }
 
 // DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new TokenStatusRef.
@@ -271,9 +596,14 @@ func (in *TokenStoreHash) DeepCopy() *TokenStoreHash {
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *TokenStoreSpec) DeepCopyInto(out *TokenStoreSpec) {
 	*out = *in
-	out.SecretSpec = in.SecretSpec
+	in.SecretSpec.DeepCopyInto(&out.SecretSpec)
+	out.RemoteSecretSpec = in.RemoteSecretSpec
 	in.LogSpec.DeepCopyInto(&out.LogSpec)
 	in.S3Spec.DeepCopyInto(&out.S3Spec)
+	in.VaultSpec.DeepCopyInto(&out.VaultSpec)
+	in.WebhookSpec.DeepCopyInto(&out.WebhookSpec)
+	in.Output.DeepCopyInto(&out.Output)
+	in.Encryption.DeepCopyInto(&out.Encryption)
 }
 
 // DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new TokenStoreSpec.
@@ -285,3 +615,171 @@ func (in *TokenStoreSpec) DeepCopy() *TokenStoreSpec {
 	in.DeepCopyInto(out)
 	return out
 }
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *VaultAppRoleAuthSpec) DeepCopyInto(out *VaultAppRoleAuthSpec) {
+	*out = *in
+	out.SecretRef = in.SecretRef
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new VaultAppRoleAuthSpec.
+func (in *VaultAppRoleAuthSpec) DeepCopy() *VaultAppRoleAuthSpec {
+	if in == nil {
+		return nil
+	}
+	out := new(VaultAppRoleAuthSpec)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *VaultAppRoleSecretRef) DeepCopyInto(out *VaultAppRoleSecretRef) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new VaultAppRoleSecretRef.
+func (in *VaultAppRoleSecretRef) DeepCopy() *VaultAppRoleSecretRef {
+	if in == nil {
+		return nil
+	}
+	out := new(VaultAppRoleSecretRef)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *VaultAuthSpec) DeepCopyInto(out *VaultAuthSpec) {
+	*out = *in
+	if in.TokenSecretRef != nil {
+		in, out := &in.TokenSecretRef, &out.TokenSecretRef
+		*out = new(VaultTokenSecretRef)
+		**out = **in
+	}
+	if in.AppRole != nil {
+		in, out := &in.AppRole, &out.AppRole
+		*out = new(VaultAppRoleAuthSpec)
+		**out = **in
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new VaultAuthSpec.
+func (in *VaultAuthSpec) DeepCopy() *VaultAuthSpec {
+	if in == nil {
+		return nil
+	}
+	out := new(VaultAuthSpec)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *VaultSpec) DeepCopyInto(out *VaultSpec) {
+	*out = *in
+	in.Auth.DeepCopyInto(&out.Auth)
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new VaultSpec.
+func (in *VaultSpec) DeepCopy() *VaultSpec {
+	if in == nil {
+		return nil
+	}
+	out := new(VaultSpec)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *VaultStoreSpec) DeepCopyInto(out *VaultStoreSpec) {
+	*out = *in
+	if in.PathTemplateContext != nil {
+		in, out := &in.PathTemplateContext, &out.PathTemplateContext
+		*out = make(map[string]string, len(*in))
+		for key, val := range *in {
+			(*out)[key] = val
+		}
+	}
+	in.Vault.DeepCopyInto(&out.Vault)
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new VaultStoreSpec.
+func (in *VaultStoreSpec) DeepCopy() *VaultStoreSpec {
+	if in == nil {
+		return nil
+	}
+	out := new(VaultStoreSpec)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *VaultTokenSecretRef) DeepCopyInto(out *VaultTokenSecretRef) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new VaultTokenSecretRef.
+func (in *VaultTokenSecretRef) DeepCopy() *VaultTokenSecretRef {
+	if in == nil {
+		return nil
+	}
+	out := new(VaultTokenSecretRef)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *WebhookClientCertificateSecretRef) DeepCopyInto(out *WebhookClientCertificateSecretRef) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new WebhookClientCertificateSecretRef.
+func (in *WebhookClientCertificateSecretRef) DeepCopy() *WebhookClientCertificateSecretRef {
+	if in == nil {
+		return nil
+	}
+	out := new(WebhookClientCertificateSecretRef)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *WebhookSigningSecretRef) DeepCopyInto(out *WebhookSigningSecretRef) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new WebhookSigningSecretRef.
+func (in *WebhookSigningSecretRef) DeepCopy() *WebhookSigningSecretRef {
+	if in == nil {
+		return nil
+	}
+	out := new(WebhookSigningSecretRef)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *WebhookStoreSpec) DeepCopyInto(out *WebhookStoreSpec) {
+	*out = *in
+	if in.Headers != nil {
+		in, out := &in.Headers, &out.Headers
+		*out = make(map[string]string, len(*in))
+		for key, val := range *in {
+			(*out)[key] = val
+		}
+	}
+	out.SigningSecretRef = in.SigningSecretRef
+	if in.ClientCertificateSecretRef != nil {
+		in, out := &in.ClientCertificateSecretRef, &out.ClientCertificateSecretRef
+		*out = new(WebhookClientCertificateSecretRef)
+		**out = **in
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new WebhookStoreSpec.
+func (in *WebhookStoreSpec) DeepCopy() *WebhookStoreSpec {
+	if in == nil {
+		return nil
+	}
+	out := new(WebhookStoreSpec)
+	in.DeepCopyInto(out)
+	return out
+}
@@ -0,0 +1,85 @@
+// Command combine-shares reconstructs a token split with Shamir's secret sharing from its decrypted shares.
+//
+// The token is split if the encryption of a token store has a threshold configured.
+// Every custodian decrypts their share from the envelope, for example with `gpg --decrypt` or `age --decrypt`.
+// The decrypted shares are passed as files, or one share per line on stdin, and the token is written to stdout.
+// The tool does not access the network, it can be run on an offline machine.
+//
+//	combine-shares share-1.txt share-2.txt share-3.txt > token
+package main
+
+import (
+	"bufio"
+	"encoding/base64"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/appuio/emergency-credentials-controller/pkg/shamir"
+)
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [share-file...]\n\nReconstructs a token from its decrypted shares.\nReads one share per line from stdin if no files are given.\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	shares, err := readShares(flag.Args(), os.Stdin)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	token, err := combine(shares)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	fmt.Println(token)
+}
+
+// readShares reads the shares from the given files, or one share per line from stdin if no files are given.
+func readShares(files []string, stdin io.Reader) ([]string, error) {
+	if len(files) == 0 {
+		var shares []string
+		s := bufio.NewScanner(stdin)
+		for s.Scan() {
+			if line := strings.TrimSpace(s.Text()); line != "" {
+				shares = append(shares, line)
+			}
+		}
+		if err := s.Err(); err != nil {
+			return nil, fmt.Errorf("unable to read shares from stdin: %w", err)
+		}
+		return shares, nil
+	}
+
+	shares := make([]string, 0, len(files))
+	for _, f := range files {
+		b, err := os.ReadFile(f)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read share: %w", err)
+		}
+		shares = append(shares, strings.TrimSpace(string(b)))
+	}
+	return shares, nil
+}
+
+// combine decodes the base64 encoded shares and reconstructs the token.
+func combine(shares []string) (string, error) {
+	decoded := make([][]byte, 0, len(shares))
+	for i, s := range shares {
+		b, err := base64.StdEncoding.DecodeString(s)
+		if err != nil {
+			return "", fmt.Errorf("unable to decode share %d: %w", i+1, err)
+		}
+		decoded = append(decoded, b)
+	}
+	token, err := shamir.Combine(decoded)
+	if err != nil {
+		return "", fmt.Errorf("unable to combine shares: %w", err)
+	}
+	return string(token), nil
+}
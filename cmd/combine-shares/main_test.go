@@ -0,0 +1,44 @@
+package main
+
+import (
+	"encoding/base64"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/appuio/emergency-credentials-controller/pkg/shamir"
+)
+
+func Test_combine(t *testing.T) {
+	const token = "eyJhbGciOiJSUzI1NiJ9.break-glass"
+	parts, err := shamir.Split([]byte(token), 3, 2)
+	require.NoError(t, err)
+	shares := make([]string, len(parts))
+	for i, p := range parts {
+		shares[i] = base64.StdEncoding.EncodeToString(p)
+	}
+
+	read, err := readShares(nil, strings.NewReader(shares[2]+"\n\n"+shares[0]+"\n"))
+	require.NoError(t, err)
+	combined, err := combine(read)
+	require.NoError(t, err)
+	require.Equal(t, token, combined)
+
+	dir := t.TempDir()
+	files := []string{filepath.Join(dir, "a"), filepath.Join(dir, "b")}
+	require.NoError(t, os.WriteFile(files[0], []byte(shares[1]+"\n"), 0o600))
+	require.NoError(t, os.WriteFile(files[1], []byte(shares[2]), 0o600))
+	read, err = readShares(files, nil)
+	require.NoError(t, err)
+	combined, err = combine(read)
+	require.NoError(t, err)
+	require.Equal(t, token, combined)
+
+	_, err = combine([]string{shares[0], "not base64!"})
+	require.ErrorContains(t, err, "unable to decode share 2")
+	_, err = combine(shares[:1])
+	require.ErrorContains(t, err, "at least two shares")
+}
@@ -0,0 +1,305 @@
+// Command recover-credentials recovers the credentials of an EmergencyAccount from an encrypted token envelope.
+//
+// The envelope is read from the S3 bucket written by the S3 store, or from a local file.
+// The object name is rendered with the same object name template rules as the S3 store.
+// Templates referencing fields of the EmergencyAccount other than the name and the namespace can't be rendered, use `-object` instead.
+//
+// The envelope is decrypted with a local private key file: an armored PGP private key, an age identity file, or an OpenSSH ed25519 or RSA private key.
+// Encrypted private keys are unlocked with the passphrase in the `EMERGENCY_CREDENTIALS_PASSPHRASE` environment variable.
+// The expiration of the credential is validated and a ready-to-use kubeconfig is written.
+// Warnings about stale or mismatching copies, detected from the envelope metadata, are written to stderr.
+//
+//	recover-credentials -endpoint s3.example.com -bucket emergency -namespace kube-system -name emergency \
+//	  -identity ~/.ssh/id_ed25519 -server https://api.example.com:6443 -output kubeconfig
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	emcv1beta1 "github.com/appuio/emergency-credentials-controller/api/v1beta1"
+	"github.com/appuio/emergency-credentials-controller/controllers/stores"
+	"github.com/appuio/emergency-credentials-controller/pkg/utils"
+)
+
+// PassphraseEnvVar is the environment variable holding the passphrase of the private key.
+const PassphraseEnvVar = "EMERGENCY_CREDENTIALS_PASSPHRASE"
+
+// options are the command line options of the recovery.
+type options struct {
+	s3         emcv1beta1.S3StoreSpec
+	object     string
+	file       string
+	name       string
+	namespace  string
+	cluster    string
+	identity   string
+	passphrase string
+	servers    []string
+	caFile     string
+	output     string
+	share      bool
+
+	minValidity        time.Duration
+	now                func() time.Time
+	minioClientFactory stores.MinioClientFactory
+}
+
+func main() {
+	o := options{
+		s3: emcv1beta1.S3StoreSpec{
+			ObjectNameTemplateContext: map[string]string{},
+		},
+		now:                time.Now,
+		minioClientFactory: stores.DefaultClientFactory,
+		passphrase:         os.Getenv(PassphraseEnvVar),
+	}
+	flag.StringVar(&o.s3.S3.Endpoint, "endpoint", "", "The S3 endpoint to read the envelope from.")
+	flag.StringVar(&o.s3.S3.Bucket, "bucket", "", "The S3 bucket to read the envelope from.")
+	flag.StringVar(&o.s3.S3.Region, "region", "", "The AWS region of the S3 bucket.")
+	flag.BoolVar(&o.s3.S3.Insecure, "insecure", false, "Use an insecure connection to the S3 endpoint.")
+	flag.StringVar(&o.s3.S3.AccessKeyId, "access-key-id", os.Getenv("AWS_ACCESS_KEY_ID"), "The S3 access key id. Defaults to $AWS_ACCESS_KEY_ID.")
+	flag.StringVar(&o.s3.S3.SecretAccessKey, "secret-access-key", os.Getenv("AWS_SECRET_ACCESS_KEY"), "The S3 secret access key. Defaults to $AWS_SECRET_ACCESS_KEY.")
+	flag.StringVar(&o.s3.ObjectNameTemplate, "object-name-template", "", "The object name template of the S3 store. Defaults to the name of the EmergencyAccount.")
+	flag.Var(mapFlag(o.s3.ObjectNameTemplateContext), "object-name-template-context", "Additional context of the object name template as key=value. Can be repeated.")
+	flag.StringVar(&o.object, "object", "", "The name of the object to read. Overrides the object name template.")
+	flag.StringVar(&o.file, "file", "", "Read the envelope from a local file instead of S3.")
+	flag.StringVar(&o.name, "name", "", "The name of the EmergencyAccount.")
+	flag.StringVar(&o.namespace, "namespace", "", "The namespace of the EmergencyAccount.")
+	flag.StringVar(&o.cluster, "cluster", "", "The expected cluster name recorded in the envelope. Not checked if empty.")
+	flag.StringVar(&o.identity, "identity", "", "The private key file to decrypt the envelope with.")
+	flag.Var((*sliceFlag)(&o.servers), "server", "The URL of the API server. Can be repeated, the first server is used for the current context.")
+	flag.StringVar(&o.caFile, "certificate-authority", "", "The CA bundle of the API server. The system CAs are trusted if not set.")
+	flag.StringVar(&o.output, "output", "-", "The file to write the kubeconfig to, - for stdout.")
+	flag.BoolVar(&o.share, "share", false, "Write the decrypted share of a token split with secret sharing, to be combined with combine-shares.")
+	flag.DurationVar(&o.minValidity, "min-validity", time.Hour, "Warn if the credential expires within this duration.")
+	flag.Parse()
+
+	if err := run(context.Background(), o, os.Stdout, os.Stderr); err != nil {
+		fmt.Fprintln(os.Stderr, "error:", err)
+		os.Exit(1)
+	}
+}
+
+// run recovers the credential and writes the kubeconfig, or the decrypted share, to the output.
+func run(ctx context.Context, o options, stdout, stderr io.Writer) error {
+	if o.name == "" || o.namespace == "" {
+		return errors.New("-name and -namespace are required")
+	}
+	if o.identity == "" {
+		return errors.New("-identity is required")
+	}
+
+	envelope, err := readEnvelope(ctx, o)
+	if err != nil {
+		return err
+	}
+	var et stores.EncryptedToken
+	if err := json.Unmarshal(envelope, &et); err != nil {
+		return fmt.Errorf("unable to unmarshal encrypted token: %w", err)
+	}
+
+	key, err := os.ReadFile(o.identity)
+	if err != nil {
+		return fmt.Errorf("unable to read private key: %w", err)
+	}
+	id, err := loadIdentity(key, []byte(o.passphrase))
+	if err != nil {
+		return err
+	}
+	decrypted, err := decryptToken(et, id)
+	if err != nil {
+		return err
+	}
+
+	if et.Threshold > 0 {
+		if !o.share {
+			return fmt.Errorf("the token is split into shares, %d shares are required to reconstruct it: decrypt your share with -share and combine the shares with combine-shares", et.Threshold)
+		}
+		return writeOutput(o.output, stdout, []byte(decrypted+"\n"))
+	}
+	if o.share {
+		return errors.New("the token is not split into shares, omit -share")
+	}
+
+	credential := decrypted
+	isKubeconfig := !strings.Contains(decrypted, "-----BEGIN CERTIFICATE-----")
+	if isKubeconfig {
+		if _, err := utils.ParseJWTWithoutVerify(decrypted); err == nil {
+			isKubeconfig = false
+		}
+	}
+	if isKubeconfig {
+		credential, err = utils.CredentialFromKubeconfig([]byte(decrypted))
+		if err != nil {
+			return fmt.Errorf("decrypted payload is neither a token, a client certificate, nor a kubeconfig: %w", err)
+		}
+	}
+
+	expiration, err := credentialExpiration(credential)
+	if err != nil {
+		return err
+	}
+	for _, w := range staleWarnings(o, et, expiration) {
+		fmt.Fprintln(stderr, "warning:", w)
+	}
+	if !expiration.After(o.now()) {
+		return fmt.Errorf("credential expired at %s", expiration.Format(time.RFC3339))
+	}
+
+	if isKubeconfig && len(o.servers) == 0 {
+		return writeOutput(o.output, stdout, []byte(decrypted))
+	}
+	if len(o.servers) == 0 {
+		return errors.New("-server is required to write a kubeconfig")
+	}
+	var ca []byte
+	if o.caFile != "" {
+		ca, err = os.ReadFile(o.caFile)
+		if err != nil {
+			return fmt.Errorf("unable to read CA bundle: %w", err)
+		}
+	}
+	kc, err := utils.NewKubeconfig(o.name, o.namespace, o.servers, ca, credential)
+	if err != nil {
+		return err
+	}
+	return writeOutput(o.output, stdout, kc)
+}
+
+// readEnvelope reads the envelope from the local file or from the S3 bucket.
+func readEnvelope(ctx context.Context, o options) ([]byte, error) {
+	if o.file != "" {
+		b, err := os.ReadFile(o.file)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read envelope: %w", err)
+		}
+		return b, nil
+	}
+
+	object := o.object
+	if object == "" {
+		var err error
+		object, err = stores.NewS3Store(o.s3).ObjectName(emcv1beta1.EmergencyAccount{
+			ObjectMeta: metav1.ObjectMeta{Name: o.name, Namespace: o.namespace},
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	cli, err := o.minioClientFactory(ctx, nil, o.namespace, o.s3)
+	if err != nil {
+		return nil, fmt.Errorf("unable to create S3 client: %w", err)
+	}
+	obj, err := cli.GetObject(ctx, o.s3.S3.Bucket, object, minio.GetObjectOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("unable to get object %q: %w", object, err)
+	}
+	defer obj.Close()
+	b, err := io.ReadAll(obj)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read object %q: %w", object, err)
+	}
+	return b, nil
+}
+
+// credentialExpiration returns the expiration of the token or client certificate.
+func credentialExpiration(credential string) (time.Time, error) {
+	if strings.Contains(credential, "-----BEGIN CERTIFICATE-----") {
+		cert, err := utils.ParseClientCertificate([]byte(credential))
+		if err != nil {
+			return time.Time{}, err
+		}
+		return cert.Leaf.NotAfter, nil
+	}
+	t, err := utils.ParseJWTWithoutVerify(credential)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("unable to parse token: %w", err)
+	}
+	exp, err := t.Claims.GetExpirationTime()
+	if err != nil {
+		return time.Time{}, fmt.Errorf("unable to get expiration time from token: %w", err)
+	}
+	if exp == nil {
+		return time.Time{}, errors.New("token has no expiration time")
+	}
+	return exp.Time, nil
+}
+
+// staleWarnings compares the envelope metadata with the requested EmergencyAccount and the recovered credential.
+// A mismatch hints at a stale copy, for example an object the controller failed to overwrite, or an envelope of another account.
+func staleWarnings(o options, et stores.EncryptedToken, expiration time.Time) []string {
+	var warnings []string
+	if et.Version == 0 {
+		return append(warnings, "envelope has no metadata, unable to detect a stale copy")
+	}
+	md := et.Metadata
+	if md.Namespace != o.namespace || md.EmergencyAccount != o.name {
+		warnings = append(warnings, fmt.Sprintf("envelope belongs to EmergencyAccount %s/%s, expected %s/%s", md.Namespace, md.EmergencyAccount, o.namespace, o.name))
+	}
+	if o.cluster != "" && md.Cluster != o.cluster {
+		warnings = append(warnings, fmt.Sprintf("envelope belongs to cluster %q, expected %q", md.Cluster, o.cluster))
+	}
+	if md.ExpirationTimestamp != nil && !md.ExpirationTimestamp.Equal(expiration) {
+		warnings = append(warnings, fmt.Sprintf("credential expires at %s, but the envelope records %s, the envelope might have been tampered with",
+			expiration.Format(time.RFC3339), md.ExpirationTimestamp.Format(time.RFC3339)))
+	}
+	if now := o.now(); expiration.After(now) && expiration.Sub(now) < o.minValidity {
+		warnings = append(warnings, fmt.Sprintf("credential expires in %s, the controller might not have replaced this copy", expiration.Sub(now).Round(time.Second)))
+	}
+	return warnings
+}
+
+// writeOutput writes the data to the output file, or to stdout if the output is `-`.
+func writeOutput(output string, stdout io.Writer, data []byte) error {
+	if output == "-" {
+		_, err := stdout.Write(data)
+		return err
+	}
+	if err := os.WriteFile(output, data, 0o600); err != nil {
+		return fmt.Errorf("unable to write output: %w", err)
+	}
+	return nil
+}
+
+// sliceFlag is a repeatable string flag.
+type sliceFlag []string
+
+func (f *sliceFlag) String() string {
+	return strings.Join(*f, ",")
+}
+
+func (f *sliceFlag) Set(v string) error {
+	*f = append(*f, v)
+	return nil
+}
+
+// mapFlag is a repeatable key=value flag.
+type mapFlag map[string]string
+
+func (f mapFlag) String() string {
+	kvs := make([]string, 0, len(f))
+	for k, v := range f {
+		kvs = append(kvs, k+"="+v)
+	}
+	return strings.Join(kvs, ",")
+}
+
+func (f mapFlag) Set(v string) error {
+	k, val, ok := strings.Cut(v, "=")
+	if !ok {
+		return fmt.Errorf("expected key=value, got %q", v)
+	}
+	f[k] = val
+	return nil
+}
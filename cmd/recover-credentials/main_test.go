@@ -0,0 +1,346 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"filippo.io/age"
+	"github.com/ProtonMail/gopenpgp/v2/crypto"
+	"github.com/ProtonMail/gopenpgp/v2/helper"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/minio/minio-go/v7"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ssh"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/clientcmd"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	emcv1beta1 "github.com/appuio/emergency-credentials-controller/api/v1beta1"
+	"github.com/appuio/emergency-credentials-controller/controllers/stores"
+)
+
+var now = time.Date(2023, 10, 30, 12, 0, 0, 0, time.UTC)
+
+func Test_run(t *testing.T) {
+	expiration := now.Add(12 * time.Hour)
+	token := testToken(t, expiration)
+	ageID, err := age.GenerateX25519Identity()
+	require.NoError(t, err)
+	ageKey := writeFile(t, "age.txt", "# test\n"+ageID.String()+"\n")
+
+	bucket := &bucketMock{}
+	storeToken(t, bucket, emcv1beta1.EncryptionSpec{
+		Encrypt:       true,
+		Scheme:        emcv1beta1.EncryptionSchemeAge,
+		AgeRecipients: []string{ageID.Recipient().String()},
+	}, token, expiration)
+
+	o := testOptions(bucket, ageKey)
+	stdout, stderr := new(bytes.Buffer), new(bytes.Buffer)
+	require.NoError(t, run(context.Background(), o, stdout, stderr))
+	require.Empty(t, stderr.String())
+
+	kc, err := clientcmd.Load(stdout.Bytes())
+	require.NoError(t, err)
+	require.Equal(t, "emergency-0", kc.CurrentContext)
+	require.Equal(t, "https://api.example.com:6443", kc.Clusters["emergency-0"].Server)
+	require.Equal(t, token, kc.AuthInfos["kube-system/emergency"].Token)
+
+	// A copy of another account, or a copy close to expiring, is reported
+	o.namespace = "other"
+	o.object = "c-test/kube-system/emergency"
+	o.now = func() time.Time { return expiration.Add(-time.Minute) }
+	stdout.Reset()
+	require.NoError(t, run(context.Background(), o, stdout, stderr))
+	require.Contains(t, stderr.String(), "envelope belongs to EmergencyAccount kube-system/emergency, expected other/emergency")
+	require.Contains(t, stderr.String(), "credential expires in 1m0s")
+
+	// An expired credential is rejected
+	o = testOptions(bucket, ageKey)
+	o.now = func() time.Time { return expiration.Add(time.Second) }
+	require.ErrorContains(t, run(context.Background(), o, io.Discard, io.Discard), "credential expired")
+}
+
+func Test_run_PGP(t *testing.T) {
+	const passphrase = "passphrase"
+	expiration := now.Add(12 * time.Hour)
+	token := testToken(t, expiration)
+	privateKey, publicKey := generatePGPKey(t, "test", passphrase)
+	_, otherPublicKey := generatePGPKey(t, "other", "other")
+
+	bucket := &bucketMock{}
+	storeToken(t, bucket, emcv1beta1.EncryptionSpec{
+		Encrypt: true,
+		PGPKeys: []string{otherPublicKey, publicKey},
+	}, token, expiration.Add(time.Hour))
+
+	o := testOptions(bucket, writeFile(t, "key.asc", privateKey))
+	require.ErrorContains(t, run(context.Background(), o, io.Discard, io.Discard), "a passphrase is required")
+
+	o.passphrase = passphrase
+	stdout, stderr := new(bytes.Buffer), new(bytes.Buffer)
+	require.NoError(t, run(context.Background(), o, stdout, stderr))
+	require.Contains(t, stderr.String(), "the envelope might have been tampered with")
+	kc, err := clientcmd.Load(stdout.Bytes())
+	require.NoError(t, err)
+	require.Equal(t, token, kc.AuthInfos["kube-system/emergency"].Token)
+}
+
+func Test_run_SSHShares(t *testing.T) {
+	expiration := now.Add(12 * time.Hour)
+	token := testToken(t, expiration)
+
+	var recipients []string
+	var keyFiles []string
+	for i := range 3 {
+		pub, priv, err := ed25519.GenerateKey(rand.Reader)
+		require.NoError(t, err)
+		sshPub, err := ssh.NewPublicKey(pub)
+		require.NoError(t, err)
+		recipients = append(recipients, string(ssh.MarshalAuthorizedKey(sshPub)))
+		block, err := ssh.MarshalPrivateKey(priv, "")
+		require.NoError(t, err)
+		keyFiles = append(keyFiles, writeFile(t, fmt.Sprintf("id_ed25519_%d", i), string(pem.EncodeToMemory(block))))
+	}
+
+	bucket := &bucketMock{}
+	storeToken(t, bucket, emcv1beta1.EncryptionSpec{
+		Encrypt:       true,
+		Scheme:        emcv1beta1.EncryptionSchemeAge,
+		AgeRecipients: []string{strings.Join(recipients, "")},
+		Threshold:     2,
+	}, token, expiration)
+
+	o := testOptions(bucket, keyFiles[1])
+	require.ErrorContains(t, run(context.Background(), o, io.Discard, io.Discard), "2 shares are required")
+
+	o.share = true
+	stdout := new(bytes.Buffer)
+	require.NoError(t, run(context.Background(), o, stdout, io.Discard))
+	require.NotEmpty(t, strings.TrimSpace(stdout.String()))
+	require.NotContains(t, stdout.String(), token)
+}
+
+func Test_run_File(t *testing.T) {
+	ageID, err := age.GenerateX25519Identity()
+	require.NoError(t, err)
+	o := options{
+		name:      "emergency",
+		namespace: "kube-system",
+		identity:  writeFile(t, "age.txt", ageID.String()),
+		file:      writeFile(t, "envelope.json", `{"secrets":[]}`),
+		output:    "-",
+		now:       func() time.Time { return now },
+	}
+	require.ErrorContains(t, run(context.Background(), o, io.Discard, io.Discard), "envelope does not contain a Age encrypted secret")
+}
+
+func Test_decryptToken_Recipients(t *testing.T) {
+	ageIDs := make([]*age.X25519Identity, 3)
+	recipients := make([]string, 3)
+	for i := range ageIDs {
+		id, err := age.GenerateX25519Identity()
+		require.NoError(t, err)
+		ageIDs[i], recipients[i] = id, id.Recipient().String()
+	}
+	privateKey, publicKey := generatePGPKey(t, "test", "passphrase")
+	_, otherPublicKey := generatePGPKey(t, "other", "other")
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	sshPub, err := ssh.NewPublicKey(pub)
+	require.NoError(t, err)
+	block, err := ssh.MarshalPrivateKey(priv, "")
+	require.NoError(t, err)
+
+	tcs := map[string]struct {
+		enc        emcv1beta1.EncryptionSpec
+		key        string
+		passphrase string
+	}{
+		"age": {
+			enc: emcv1beta1.EncryptionSpec{Encrypt: true, Scheme: emcv1beta1.EncryptionSchemeAge, AgeRecipients: recipients},
+			key: ageIDs[2].String(),
+		},
+		"SSH": {
+			enc: emcv1beta1.EncryptionSpec{Encrypt: true, Scheme: emcv1beta1.EncryptionSchemeAge, AgeRecipients: []string{recipients[0], string(ssh.MarshalAuthorizedKey(sshPub))}},
+			key: string(pem.EncodeToMemory(block)),
+		},
+		"PGP": {
+			enc:        emcv1beta1.EncryptionSpec{Encrypt: true, PGPKeys: []string{otherPublicKey, publicKey}},
+			key:        privateKey,
+			passphrase: "passphrase",
+		},
+	}
+	for name, tc := range tcs {
+		t.Run(name, func(t *testing.T) {
+			bucket := &bucketMock{}
+			storeToken(t, bucket, tc.enc, "token", now.Add(time.Hour))
+			var et stores.EncryptedToken
+			require.NoError(t, json.Unmarshal(bucket.objects["c-test/kube-system/emergency"], &et))
+			require.Greater(t, len(et.Secrets), 1)
+
+			id, err := loadIdentity([]byte(tc.key), []byte(tc.passphrase))
+			require.NoError(t, err)
+			var matching []int
+			for i, secret := range et.Secrets {
+				if id.matches(secret) {
+					matching = append(matching, i)
+				}
+			}
+			require.Equal(t, []int{len(et.Secrets) - 1}, matching, "should only match the secret encrypted for the key")
+
+			// Secrets of other recipients are not decrypted
+			for i := range et.Secrets[:len(et.Secrets)-1] {
+				et.Secrets[i].Data = "corrupted"
+			}
+			plain, err := decryptToken(et, id)
+			require.NoError(t, err)
+			require.Equal(t, "token", plain)
+
+			// The secret of the key is not found if the recipient does not match
+			et.Secrets = et.Secrets[:len(et.Secrets)-1]
+			_, err = decryptToken(et, id)
+			require.ErrorContains(t, err, "does not contain a secret encrypted for the given key")
+		})
+	}
+}
+
+func Test_decryptToken_Unversioned(t *testing.T) {
+	id, err := age.GenerateX25519Identity()
+	require.NoError(t, err)
+	other, err := age.GenerateX25519Identity()
+	require.NoError(t, err)
+	bucket := &bucketMock{}
+	storeToken(t, bucket, emcv1beta1.EncryptionSpec{
+		Encrypt:       true,
+		Scheme:        emcv1beta1.EncryptionSchemeAge,
+		AgeRecipients: []string{other.Recipient().String(), id.Recipient().String()},
+	}, "token", now.Add(time.Hour))
+	var et stores.EncryptedToken
+	require.NoError(t, json.Unmarshal(bucket.objects["c-test/kube-system/emergency"], &et))
+
+	// Envelopes without a version don't record the recipients
+	et.Version = 0
+	for i := range et.Secrets {
+		et.Secrets[i].Recipient = ""
+	}
+	ai, err := loadIdentity([]byte(id.String()), nil)
+	require.NoError(t, err)
+	plain, err := decryptToken(et, ai)
+	require.NoError(t, err)
+	require.Equal(t, "token", plain)
+}
+
+func testOptions(bucket *bucketMock, identity string) options {
+	return options{
+		s3: emcv1beta1.S3StoreSpec{
+			S3:                 emcv1beta1.S3Spec{Bucket: "bucket"},
+			ObjectNameTemplate: "{{ .Context.cluster }}/{{ .Namespace }}/{{ .Name }}",
+			ObjectNameTemplateContext: map[string]string{
+				"cluster": "c-test",
+			},
+		},
+		name:               "emergency",
+		namespace:          "kube-system",
+		identity:           identity,
+		servers:            []string{"https://api.example.com:6443"},
+		output:             "-",
+		minValidity:        time.Hour,
+		now:                func() time.Time { return now },
+		minioClientFactory: bucket.ClientFactory,
+	}
+}
+
+// storeToken stores the token with the S3 store like the controller would.
+func storeToken(t *testing.T, bucket *bucketMock, enc emcv1beta1.EncryptionSpec, token string, expiration time.Time) {
+	t.Helper()
+
+	st := stores.WithEncryption(stores.NewS3StoreWithClientFactory(testOptions(bucket, "").s3, bucket.ClientFactory), enc)
+	st.(stores.MetadataInjector).InjectTokenMetadata(stores.TokenMetadata{
+		Cluster:             "c-test",
+		UID:                 "token-uid",
+		ExpirationTimestamp: expiration,
+	})
+	_, err := st.StoreToken(context.Background(), emcv1beta1.EmergencyAccount{
+		ObjectMeta: metav1.ObjectMeta{Name: "emergency", Namespace: "kube-system"},
+	}, token)
+	require.NoError(t, err)
+	require.Contains(t, bucket.objects, "c-test/kube-system/emergency")
+}
+
+func testToken(t *testing.T, expiration time.Time) string {
+	t.Helper()
+	token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.RegisteredClaims{
+		Subject:   "system:serviceaccount:kube-system:emergency",
+		ExpiresAt: jwt.NewNumericDate(expiration),
+	}).SignedString([]byte("secret"))
+	require.NoError(t, err)
+	return token
+}
+
+// generatePGPKey generates a PGP key pair and returns the armored private and public key.
+func generatePGPKey(t *testing.T, name, passphrase string) (privateKey, publicKey string) {
+	t.Helper()
+	privateKey, err := helper.GenerateKey(name, name+"@test.ch", []byte(passphrase), "x25519", 0)
+	require.NoError(t, err)
+	k, err := crypto.NewKeyFromArmored(privateKey)
+	require.NoError(t, err)
+	publicKey, err = k.GetArmoredPublicKey()
+	require.NoError(t, err)
+	return privateKey, publicKey
+}
+
+func writeFile(t *testing.T, name, content string) string {
+	t.Helper()
+	p := filepath.Join(t.TempDir(), name)
+	require.NoError(t, os.WriteFile(p, []byte(content), 0o600))
+	return p
+}
+
+// bucketMock is an in-memory S3 bucket.
+type bucketMock struct {
+	objects map[string][]byte
+}
+
+func (b *bucketMock) ClientFactory(context.Context, client.Client, string, emcv1beta1.S3StoreSpec) (stores.MinioClient, error) {
+	return b, nil
+}
+
+func (b *bucketMock) PutObject(_ context.Context, _ string, objectName string, reader io.Reader, _ int64, _ minio.PutObjectOptions) (minio.UploadInfo, error) {
+	data, err := io.ReadAll(reader)
+	if err != nil {
+		return minio.UploadInfo{}, err
+	}
+	if b.objects == nil {
+		b.objects = map[string][]byte{}
+	}
+	b.objects[objectName] = data
+	return minio.UploadInfo{Key: objectName}, nil
+}
+
+func (b *bucketMock) GetObject(_ context.Context, _ string, objectName string, _ minio.GetObjectOptions) (io.ReadCloser, error) {
+	data, ok := b.objects[objectName]
+	if !ok {
+		return nil, fmt.Errorf("object %q not found", objectName)
+	}
+	return io.NopCloser(bytes.NewReader(data)), nil
+}
+
+func (b *bucketMock) StatObject(_ context.Context, _ string, objectName string, _ minio.StatObjectOptions) (minio.ObjectInfo, error) {
+	data, ok := b.objects[objectName]
+	if !ok {
+		return minio.ObjectInfo{}, fmt.Errorf("object %q not found", objectName)
+	}
+	return minio.ObjectInfo{Key: objectName, Size: int64(len(data))}, nil
+}
@@ -0,0 +1,110 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	authorizationv1 "k8s.io/api/authorization/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+
+	emcv1beta1 "github.com/appuio/emergency-credentials-controller/api/v1beta1"
+)
+
+//+kubebuilder:rbac:groups=authorization.k8s.io,resources=subjectaccessreviews,verbs=create
+
+// verifyAccess evaluates the access checks of the EmergencyAccount for the identity of the credentials using SubjectAccessReviews.
+// The result is reported through the AccessVerified condition and the failed access checks metric.
+func (r *EmergencyAccountReconciler) verifyAccess(ctx context.Context, instance *emcv1beta1.EmergencyAccount, id identity) {
+	l := log.FromContext(ctx).WithName("EmergencyAccountReconciler.verifyAccess")
+
+	if len(instance.Spec.AccessChecks) == 0 {
+		failedAccessChecks.WithLabelValues(instance.Name).Set(0)
+		r.setCondition(instance, emcv1beta1.ConditionAccessVerified, metav1.ConditionTrue, emcv1beta1.ReasonNoAccessChecks, "No access checks configured")
+		return
+	}
+
+	failed := []string{}
+	for _, check := range instance.Spec.AccessChecks {
+		for _, sar := range subjectAccessReviews(check, id) {
+			desc := describeAccess(sar.Spec)
+			if err := r.Client.Create(ctx, &sar); err != nil {
+				failed = append(failed, fmt.Sprintf("%s: unable to create SubjectAccessReview: %s", desc, err))
+				continue
+			}
+			if !sar.Status.Allowed {
+				reason := sar.Status.Reason
+				if sar.Status.EvaluationError != "" {
+					reason = strings.TrimSpace(reason + " " + sar.Status.EvaluationError)
+				}
+				failed = append(failed, fmt.Sprintf("%s: denied %s", desc, reason))
+			}
+		}
+	}
+
+	failedAccessChecks.WithLabelValues(instance.Name).Set(float64(len(failed)))
+	if len(failed) > 0 {
+		l.Info("access checks failed", "failed", failed)
+		r.setCondition(instance, emcv1beta1.ConditionAccessVerified, metav1.ConditionFalse, emcv1beta1.ReasonAccessDenied, strings.Join(failed, "; "))
+		return
+	}
+	r.setCondition(instance, emcv1beta1.ConditionAccessVerified, metav1.ConditionTrue, emcv1beta1.ReasonAccessVerified,
+		fmt.Sprintf("All %d access checks passed", len(instance.Spec.AccessChecks)))
+}
+
+// subjectAccessReviews returns the SubjectAccessReviews required to evaluate the access check for the identity.
+func subjectAccessReviews(check emcv1beta1.AccessCheckSpec, id identity) []authorizationv1.SubjectAccessReview {
+	spec := authorizationv1.SubjectAccessReviewSpec{
+		User:   id.User,
+		Groups: id.Groups,
+		UID:    id.UID,
+	}
+
+	if check.ClusterAdmin {
+		resourceSpec := *spec.DeepCopy()
+		resourceSpec.ResourceAttributes = &authorizationv1.ResourceAttributes{
+			Verb:     "*",
+			Group:    "*",
+			Resource: "*",
+		}
+		nonResourceSpec := *spec.DeepCopy()
+		nonResourceSpec.NonResourceAttributes = &authorizationv1.NonResourceAttributes{
+			Verb: "*",
+			Path: "*",
+		}
+		return []authorizationv1.SubjectAccessReview{{Spec: resourceSpec}, {Spec: nonResourceSpec}}
+	}
+
+	spec.ResourceAttributes = &authorizationv1.ResourceAttributes{
+		Verb:        check.Verb,
+		Group:       check.Group,
+		Resource:    check.Resource,
+		Subresource: check.Subresource,
+		Namespace:   check.Namespace,
+		Name:        check.Name,
+	}
+	return []authorizationv1.SubjectAccessReview{{Spec: spec}}
+}
+
+// describeAccess returns a human readable description of the access reviewed.
+func describeAccess(spec authorizationv1.SubjectAccessReviewSpec) string {
+	if na := spec.NonResourceAttributes; na != nil {
+		return fmt.Sprintf("%s nonResourceURL %q", na.Verb, na.Path)
+	}
+	ra := spec.ResourceAttributes
+	res := ra.Resource
+	if ra.Subresource != "" {
+		res += "/" + ra.Subresource
+	}
+	if ra.Group != "" {
+		res += "." + ra.Group
+	}
+	if ra.Name != "" {
+		res += " " + ra.Name
+	}
+	if ra.Namespace != "" {
+		res += " in namespace " + ra.Namespace
+	}
+	return ra.Verb + " " + res
+}
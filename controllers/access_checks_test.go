@@ -0,0 +1,110 @@
+package controllers
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/go-logr/logr/testr"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+	authorizationv1 "k8s.io/api/authorization/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/metrics"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	emcv1beta1 "github.com/appuio/emergency-credentials-controller/api/v1beta1"
+)
+
+func Test_EmergencyAccountReconciler_Reconcile_AccessChecks(t *testing.T) {
+	ctx := log.IntoContext(context.Background(), testr.New(t))
+	clock := &mockClock{now: time.Date(2022, 12, 4, 22, 45, 0, 0, time.UTC)}
+
+	ea := &emcv1beta1.EmergencyAccount{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:       "access-checks",
+			Namespace:  "test",
+			Finalizers: []string{EmergencyAccountFinalizer},
+		},
+		Spec: emcv1beta1.EmergencyAccountSpec{
+			ValidityDuration:        metav1.Duration{Duration: 24 * time.Hour},
+			MinValidityDurationLeft: metav1.Duration{Duration: 12 * time.Hour},
+			MinRecreateInterval:     metav1.Duration{Duration: 5 * time.Minute},
+			AccessChecks: []emcv1beta1.AccessCheckSpec{
+				{ClusterAdmin: true},
+				{Verb: "delete", Resource: "pods", Namespace: "kube-system"},
+			},
+			TokenStores: []emcv1beta1.TokenStoreSpec{
+				{
+					Name: "testlog",
+					Type: "log",
+				},
+			},
+		},
+	}
+
+	c, control := fakeClient(t, clock, ea)
+
+	subject := &EmergencyAccountReconciler{
+		Client: c,
+		Scheme: c.Scheme(),
+		Clock:  clock,
+	}
+
+	var reviewed []authorizationv1.SubjectAccessReviewSpec
+	control.deniedAccess = func(spec authorizationv1.SubjectAccessReviewSpec) bool {
+		reviewed = append(reviewed, spec)
+		return false
+	}
+	_, err := subject.Reconcile(ctx, reconcile.Request{NamespacedName: client.ObjectKeyFromObject(ea)})
+	require.NoError(t, err)
+	require.NoError(t, c.Get(ctx, client.ObjectKeyFromObject(ea), ea))
+	requireCondition(t, ea, emcv1beta1.ConditionAccessVerified, metav1.ConditionTrue)
+	requireCondition(t, ea, emcv1beta1.ConditionReady, metav1.ConditionTrue)
+	require.Equal(t, 0.0, testutil.ToFloat64(failedAccessChecks.WithLabelValues(ea.Name)))
+	require.Len(t, reviewed, 3, "cluster admin check requires a resource and a non-resource review")
+	for _, spec := range reviewed {
+		require.Equal(t, "system:serviceaccount:test:access-checks", spec.User)
+		require.Contains(t, spec.Groups, "system:serviceaccounts:test")
+	}
+
+	// Cluster admin access removed
+	control.deniedAccess = func(spec authorizationv1.SubjectAccessReviewSpec) bool {
+		return spec.ResourceAttributes == nil || spec.ResourceAttributes.Verb == "*"
+	}
+	clock.Advance(time.Minute)
+	_, err = subject.Reconcile(ctx, reconcile.Request{NamespacedName: client.ObjectKeyFromObject(ea)})
+	require.NoError(t, err)
+	require.NoError(t, c.Get(ctx, client.ObjectKeyFromObject(ea), ea))
+	cond := requireCondition(t, ea, emcv1beta1.ConditionAccessVerified, metav1.ConditionFalse)
+	require.Contains(t, cond.Message, `* nonResourceURL "*"`)
+	require.NotContains(t, cond.Message, "delete pods")
+	requireCondition(t, ea, emcv1beta1.ConditionReady, metav1.ConditionFalse)
+	require.Equal(t, 2.0, testutil.ToFloat64(failedAccessChecks.WithLabelValues(ea.Name)))
+
+	// Metrics are removed on deletion
+	require.NoError(t, c.Delete(ctx, ea))
+	_, err = subject.Reconcile(ctx, reconcile.Request{NamespacedName: client.ObjectKeyFromObject(ea)})
+	require.NoError(t, err)
+	ml, err := testutil.GatherAndCount(metrics.Registry, MetricsNamespace+"_failed_access_checks")
+	require.NoError(t, err)
+	require.Equal(t, 0, ml, "metric should be removed")
+}
+
+func Test_describeAccess(t *testing.T) {
+	require.Equal(t, "get deployments/scale.apps web in namespace prod", describeAccess(authorizationv1.SubjectAccessReviewSpec{
+		ResourceAttributes: &authorizationv1.ResourceAttributes{
+			Verb:        "get",
+			Group:       "apps",
+			Resource:    "deployments",
+			Subresource: "scale",
+			Name:        "web",
+			Namespace:   "prod",
+		},
+	}))
+	require.Equal(t, `get nonResourceURL "/healthz"`, describeAccess(authorizationv1.SubjectAccessReviewSpec{
+		NonResourceAttributes: &authorizationv1.NonResourceAttributes{Verb: "get", Path: "/healthz"},
+	}))
+}
@@ -0,0 +1,71 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+
+	"golang.org/x/exp/slices"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+
+	emcv1beta1 "github.com/appuio/emergency-credentials-controller/api/v1beta1"
+)
+
+// BoundTokenUIDLabel is set on secrets tokens are bound to.
+// It contains the UID of the token in the EmergencyAccount status.
+const BoundTokenUIDLabel = "emergency-credentials-controller.appuio.ch/bound-token-uid"
+
+// boundSecretName returns the name of the secret the token is bound to.
+func boundSecretName(instance *emcv1beta1.EmergencyAccount, uid types.UID) string {
+	return fmt.Sprintf("%s-bound-%s", instance.Name, uid)
+}
+
+// createBoundSecret creates the secret the token is bound to.
+// The secret holds no data, deleting it revokes the token.
+func (r *EmergencyAccountReconciler) createBoundSecret(ctx context.Context, instance *emcv1beta1.EmergencyAccount, ts *emcv1beta1.TokenStatus) (*corev1.Secret, error) {
+	s := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      ts.BoundSecretName,
+			Namespace: instance.Namespace,
+		},
+	}
+	op, err := controllerutil.CreateOrUpdate(ctx, r.Client, s, func() error {
+		s.Labels = managedLabels(instance)
+		s.Labels[BoundTokenUIDLabel] = string(ts.UID)
+		return controllerutil.SetControllerReference(instance, s, r.Scheme)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("unable to create or update bound secret: %w (op: %s)", err, op)
+	}
+	return s, nil
+}
+
+// deleteUnusedBoundSecrets deletes the bound secrets of tokens no longer in the status, revoked, or expired.
+// It must be called with the persisted status of the EmergencyAccount, otherwise a token still tracked could be revoked.
+func (r *EmergencyAccountReconciler) deleteUnusedBoundSecrets(ctx context.Context, instance *emcv1beta1.EmergencyAccount) error {
+	l := log.FromContext(ctx).WithName("EmergencyAccountReconciler.deleteUnusedBoundSecrets")
+
+	var secrets corev1.SecretList
+	if err := r.List(ctx, &secrets, client.InNamespace(instance.Namespace), client.MatchingLabels(managedLabels(instance)), client.HasLabels{BoundTokenUIDLabel}); err != nil {
+		return fmt.Errorf("unable to list bound secrets: %w", err)
+	}
+	now := r.Clock.Now()
+	for _, s := range secrets.Items {
+		uid := types.UID(s.Labels[BoundTokenUIDLabel])
+		if slices.ContainsFunc(instance.Status.Tokens, func(ts emcv1beta1.TokenStatus) bool {
+			return ts.UID == uid && !ts.Revoked && (ts.Phase == emcv1beta1.TokenPhaseIssuing || !ts.ExpirationTimestamp.Time.Before(now))
+		}) {
+			continue
+		}
+		if err := r.Delete(ctx, &s); err != nil && !apierrors.IsNotFound(err) {
+			return fmt.Errorf("unable to delete bound secret %q: %w", s.Name, err)
+		}
+		l.Info("deleted bound secret", "token", uid)
+	}
+	return nil
+}
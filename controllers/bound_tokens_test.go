@@ -0,0 +1,91 @@
+package controllers
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/go-logr/logr/testr"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	emcv1beta1 "github.com/appuio/emergency-credentials-controller/api/v1beta1"
+)
+
+func Test_EmergencyAccountReconciler_Reconcile_AudiencesAndBoundSecrets(t *testing.T) {
+	ctx := log.IntoContext(context.Background(), testr.New(t))
+	clock := &mockClock{now: time.Date(2022, 12, 4, 22, 45, 0, 0, time.UTC)}
+
+	ea := &emcv1beta1.EmergencyAccount{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:       "test",
+			Namespace:  "test",
+			Finalizers: []string{EmergencyAccountFinalizer},
+		},
+		Spec: emcv1beta1.EmergencyAccountSpec{
+			ValidityDuration:        metav1.Duration{Duration: 24 * time.Hour},
+			MinValidityDurationLeft: metav1.Duration{Duration: 12 * time.Hour},
+			MinRecreateInterval:     metav1.Duration{Duration: 5 * time.Minute},
+			ServiceAccountToken: emcv1beta1.ServiceAccountTokenSpec{
+				Audiences:    []string{"https://issuer.example.com"},
+				BindToSecret: true,
+			},
+			TokenStores: []emcv1beta1.TokenStoreSpec{
+				{
+					Name: "testsecret",
+					Type: "secret",
+				},
+			},
+		},
+	}
+
+	c, control := fakeClient(t, clock, ea)
+
+	subject := &EmergencyAccountReconciler{
+		Client: c,
+		Scheme: c.Scheme(),
+		Clock:  clock,
+	}
+	reconcileOnce := func() {
+		t.Helper()
+		_, err := subject.Reconcile(ctx, reconcile.Request{NamespacedName: client.ObjectKeyFromObject(ea)})
+		require.NoError(t, err)
+		require.NoError(t, c.Get(ctx, client.ObjectKeyFromObject(ea), ea))
+	}
+
+	reconcileOnce()
+	require.Len(t, ea.Status.Tokens, 1)
+	ts := ea.Status.Tokens[0]
+	require.Equal(t, []string{"https://issuer.example.com"}, ts.Audiences)
+	require.Equal(t, boundSecretName(ea, ts.UID), ts.BoundSecretName)
+	requireCondition(t, ea, emcv1beta1.ConditionTokensVerified, metav1.ConditionTrue)
+
+	var bound corev1.Secret
+	require.NoError(t, c.Get(ctx, types.NamespacedName{Name: ts.BoundSecretName, Namespace: ea.Namespace}, &bound))
+	require.Equal(t, string(ts.UID), bound.Labels[BoundTokenUIDLabel])
+	require.Equal(t, []string{"https://issuer.example.com"}, control.lastTokenRequest.Audiences)
+	require.NotNil(t, control.lastTokenRequest.BoundObjectRef)
+	require.Equal(t, "Secret", control.lastTokenRequest.BoundObjectRef.Kind)
+	require.Equal(t, bound.Name, control.lastTokenRequest.BoundObjectRef.Name)
+	require.Equal(t, []string{"https://issuer.example.com"}, control.lastTokenReview.Audiences)
+
+	// Tokens for other audiences do not count towards the required validity
+	ea.Spec.ServiceAccountToken.Audiences = []string{"https://other.example.com"}
+	require.NoError(t, c.Update(ctx, ea))
+	clock.Advance(10 * time.Minute)
+	reconcileOnce()
+	require.Len(t, ea.Status.Tokens, 2, "should create a token for the new audiences")
+	require.Equal(t, []string{"https://other.example.com"}, ea.Status.Tokens[1].Audiences)
+
+	// The bound secret of an expired token is deleted
+	clock.Advance(23*time.Hour + 55*time.Minute)
+	reconcileOnce()
+	require.True(t, apierrors.IsNotFound(c.Get(ctx, client.ObjectKeyFromObject(&bound), &bound)), "should delete bound secret of expired token")
+	require.NoError(t, c.Get(ctx, types.NamespacedName{Name: ea.Status.Tokens[1].BoundSecretName, Namespace: ea.Namespace}, &bound))
+}
@@ -0,0 +1,303 @@
+package controllers
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"strings"
+	"time"
+
+	"golang.org/x/exp/slices"
+	certificatesv1 "k8s.io/api/certificates/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/utils/ptr"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+
+	emcv1beta1 "github.com/appuio/emergency-credentials-controller/api/v1beta1"
+	"github.com/appuio/emergency-credentials-controller/pkg/utils"
+)
+
+// The controller approves the CertificateSigningRequests it creates itself.
+//+kubebuilder:rbac:groups=certificates.k8s.io,resources=certificatesigningrequests,verbs=get;list;watch;create;delete
+//+kubebuilder:rbac:groups=certificates.k8s.io,resources=certificatesigningrequests/approval,verbs=update
+//+kubebuilder:rbac:groups=certificates.k8s.io,resources=signers,verbs=approve,resourceNames=kubernetes.io/kube-apiserver-client
+// The client CA of the API server is read from kube-system, namespaced Roles are moved into the namespace of the controller by kustomize.
+//+kubebuilder:rbac:groups="",resources=configmaps,verbs=get,resourceNames=extension-apiserver-authentication
+
+const (
+	// pendingCertificateKeySecretKey is the key of the private key in the pending token secret while the certificate is requested.
+	pendingCertificateKeySecretKey = "key"
+	// pendingCertificateRequestAnnotation holds the name of the CertificateSigningRequest in the pending token secret.
+	pendingCertificateRequestAnnotation = "emergency-credentials-controller.appuio.ch/certificate-signing-request"
+
+	// certificateIssuanceTimeout is the time after which a certificate request not yet issued is abandoned.
+	certificateIssuanceTimeout = 10 * time.Minute
+	// certificatePollInterval is the interval in which a certificate request not yet issued is checked.
+	certificatePollInterval = 5 * time.Second
+
+	// systemIdentityPrefix is the prefix of usernames and groups reserved for Kubernetes components.
+	systemIdentityPrefix = "system:"
+)
+
+const (
+	// ClientCAConfigMapNamespace is the namespace of the ConfigMap containing the client CA bundle of the API server.
+	ClientCAConfigMapNamespace = "kube-system"
+	// ClientCAConfigMapName is the name of the ConfigMap containing the client CA bundle of the API server.
+	// It is published by the API server and holds the CAs client certificates are authenticated against.
+	ClientCAConfigMapName = "extension-apiserver-authentication"
+	// ClientCAConfigMapKey is the key of the client CA bundle in the client CA ConfigMap.
+	ClientCAConfigMapKey = "client-ca-file"
+)
+
+// credentialTypeOf returns the credential type of the token, defaulting to ServiceAccount tokens.
+func credentialTypeOf(ts emcv1beta1.TokenStatus) emcv1beta1.CredentialType {
+	if ts.CredentialType == "" {
+		return emcv1beta1.CredentialTypeServiceAccountToken
+	}
+	return ts.CredentialType
+}
+
+// specCredentialType returns the configured credential type, defaulting to ServiceAccount tokens.
+func specCredentialType(instance *emcv1beta1.EmergencyAccount) emcv1beta1.CredentialType {
+	if instance.Spec.CredentialType == "" {
+		return emcv1beta1.CredentialTypeServiceAccountToken
+	}
+	return instance.Spec.CredentialType
+}
+
+// certificateRequestName returns the name of the CertificateSigningRequest for the token.
+// CertificateSigningRequests are cluster scoped, the name includes the namespace of the EmergencyAccount.
+func certificateRequestName(instance *emcv1beta1.EmergencyAccount, uid types.UID) string {
+	return fmt.Sprintf("emergencyaccount-%s-%s-%s", instance.Namespace, instance.Name, uid)
+}
+
+// requestCertificate generates a private key and requests a client certificate for it.
+// The private key is saved in the pending token secret so the issuance can be resumed once the certificate is signed.
+// The issuance is completed right away if the certificate is signed immediately.
+func (r *EmergencyAccountReconciler) requestCertificate(ctx context.Context, instance *emcv1beta1.EmergencyAccount, ts *emcv1beta1.TokenStatus) error {
+	l := log.FromContext(ctx).WithName("EmergencyAccountReconciler.requestCertificate")
+
+	if ids := systemIdentities(instance.Spec.ClientCertificate); len(ids) > 0 && !instance.Spec.ClientCertificate.AllowSystemIdentity {
+		return fmt.Errorf("refusing to request a certificate for reserved identities %v without allowSystemIdentity", ids)
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return fmt.Errorf("unable to generate private key: %w", err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return fmt.Errorf("unable to marshal private key: %w", err)
+	}
+	csrDER, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject: pkix.Name{
+			CommonName:   instance.Spec.ClientCertificate.Username,
+			Organization: instance.Spec.ClientCertificate.Groups,
+		},
+	}, key)
+	if err != nil {
+		return fmt.Errorf("unable to create certificate request: %w", err)
+	}
+
+	csrName := certificateRequestName(instance, ts.UID)
+	s := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      pendingTokenSecretName(instance, ts.UID),
+			Namespace: instance.Namespace,
+		},
+	}
+	op, err := controllerutil.CreateOrUpdate(ctx, r.Client, s, func() error {
+		s.Labels = managedLabels(instance)
+		s.Labels[PendingTokenUIDLabel] = string(ts.UID)
+		s.Annotations = map[string]string{pendingCertificateRequestAnnotation: csrName}
+		s.Data = map[string][]byte{pendingCertificateKeySecretKey: pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})}
+		return controllerutil.SetControllerReference(instance, s, r.Scheme)
+	})
+	if err != nil {
+		return fmt.Errorf("unable to create or update pending token secret: %w (op: %s)", err, op)
+	}
+
+	csr := &certificatesv1.CertificateSigningRequest{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:   csrName,
+			Labels: managedLabels(instance),
+		},
+		Spec: certificatesv1.CertificateSigningRequestSpec{
+			Request:           pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: csrDER}),
+			SignerName:        certificatesv1.KubeAPIServerClientSignerName,
+			ExpirationSeconds: ptr.To(int32(instance.Spec.ValidityDuration.Seconds())),
+			Usages:            []certificatesv1.KeyUsage{certificatesv1.UsageDigitalSignature, certificatesv1.UsageClientAuth},
+		},
+	}
+	if err := r.Create(ctx, csr); err != nil {
+		return fmt.Errorf("unable to create CertificateSigningRequest: %w", err)
+	}
+	l.Info("certificate requested", "token", ts.UID, "certificateSigningRequest", csrName)
+
+	_, err = r.continueCertificateIssuance(ctx, instance, ts, *s)
+	return err
+}
+
+// continueCertificateIssuance approves the CertificateSigningRequest of the token and completes the issuance once the certificate is signed.
+// Returns true if the issuance was completed.
+// Returns an error if the request was denied, failed, or was not signed in time, the issuance should then be abandoned.
+func (r *EmergencyAccountReconciler) continueCertificateIssuance(ctx context.Context, instance *emcv1beta1.EmergencyAccount, ts *emcv1beta1.TokenStatus, s corev1.Secret) (bool, error) {
+	l := log.FromContext(ctx).WithName("EmergencyAccountReconciler.continueCertificateIssuance")
+
+	var csr certificatesv1.CertificateSigningRequest
+	if err := r.Get(ctx, types.NamespacedName{Name: s.Annotations[pendingCertificateRequestAnnotation]}, &csr); err != nil {
+		return false, fmt.Errorf("unable to get CertificateSigningRequest: %w", err)
+	}
+	for _, cond := range csr.Status.Conditions {
+		if (cond.Type == certificatesv1.CertificateDenied || cond.Type == certificatesv1.CertificateFailed) && cond.Status == corev1.ConditionTrue {
+			return false, fmt.Errorf("CertificateSigningRequest %q %s: %s", csr.Name, cond.Type, cond.Message)
+		}
+	}
+
+	if !slices.ContainsFunc(csr.Status.Conditions, func(cond certificatesv1.CertificateSigningRequestCondition) bool {
+		return cond.Type == certificatesv1.CertificateApproved && cond.Status == corev1.ConditionTrue
+	}) {
+		csr.Status.Conditions = append(csr.Status.Conditions, certificatesv1.CertificateSigningRequestCondition{
+			Type:           certificatesv1.CertificateApproved,
+			Status:         corev1.ConditionTrue,
+			Reason:         "EmergencyAccountApproved",
+			Message:        fmt.Sprintf("Approved by the controller for EmergencyAccount %s/%s", instance.Namespace, instance.Name),
+			LastUpdateTime: metav1.NewTime(r.Clock.Now()),
+		})
+		if err := r.SubResource("approval").Update(ctx, &csr); err != nil {
+			return false, fmt.Errorf("unable to approve CertificateSigningRequest: %w", err)
+		}
+		l.Info("approved certificate signing request", "token", ts.UID, "certificateSigningRequest", csr.Name)
+	}
+
+	if len(csr.Status.Certificate) == 0 {
+		if instance.Status.LastTokenCreationTimestamp.Add(certificateIssuanceTimeout).Before(r.Clock.Now()) {
+			return false, fmt.Errorf("CertificateSigningRequest %q not signed within %s", csr.Name, certificateIssuanceTimeout)
+		}
+		l.Info("waiting for the certificate to be signed", "token", ts.UID, "certificateSigningRequest", csr.Name)
+		return false, nil
+	}
+
+	bundle := string(csr.Status.Certificate) + string(s.Data[pendingCertificateKeySecretKey])
+	cert, err := utils.ParseClientCertificate([]byte(bundle))
+	if err != nil {
+		return false, fmt.Errorf("unable to parse signed certificate: %w", err)
+	}
+	l.Info("certificate signed", "token", ts.UID, "expirationTimestamp", cert.Leaf.NotAfter)
+	r.recordGrantedValidity(instance, cert.Leaf.NotAfter)
+
+	// The certificate replaces the private key in the pending token secret to be able to resume storing it if interrupted
+	if err := r.savePendingToken(ctx, instance, ts.UID, bundle, cert.Leaf.NotAfter); err != nil {
+		return false, fmt.Errorf("unable to save certificate: %w", err)
+	}
+	r.deleteCertificateRequest(ctx, csr.Name)
+
+	r.completeIssuance(ctx, instance, ts, pendingToken{token: bundle}, cert.Leaf.NotAfter)
+	return true, nil
+}
+
+// deleteCertificateRequest deletes the CertificateSigningRequest with the given name.
+// Errors are logged only, the garbage collector of the kube-controller-manager removes stale requests.
+func (r *EmergencyAccountReconciler) deleteCertificateRequest(ctx context.Context, name string) {
+	l := log.FromContext(ctx).WithName("EmergencyAccountReconciler.deleteCertificateRequest")
+
+	csr := &certificatesv1.CertificateSigningRequest{ObjectMeta: metav1.ObjectMeta{Name: name}}
+	if err := r.Delete(ctx, csr); err != nil && !apierrors.IsNotFound(err) {
+		l.Error(err, "unable to delete CertificateSigningRequest", "certificateSigningRequest", name)
+	}
+}
+
+// deleteCertificateRequests deletes all CertificateSigningRequests of the EmergencyAccount.
+func (r *EmergencyAccountReconciler) deleteCertificateRequests(ctx context.Context, instance *emcv1beta1.EmergencyAccount) error {
+	var csrs certificatesv1.CertificateSigningRequestList
+	if err := r.List(ctx, &csrs, client.MatchingLabels(managedLabels(instance))); err != nil {
+		return fmt.Errorf("unable to list CertificateSigningRequests: %w", err)
+	}
+	for _, csr := range csrs.Items {
+		if err := r.Delete(ctx, &csr); err != nil && !apierrors.IsNotFound(err) {
+			return fmt.Errorf("unable to delete CertificateSigningRequest %q: %w", csr.Name, err)
+		}
+	}
+	return nil
+}
+
+// systemIdentities returns the username and groups of the client certificate reserved for Kubernetes components.
+func systemIdentities(spec emcv1beta1.ClientCertificateSpec) []string {
+	var ids []string
+	for _, id := range append([]string{spec.Username}, spec.Groups...) {
+		if strings.HasPrefix(id, systemIdentityPrefix) {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+// verifyCertificate verifies the client certificate retrieved from a store is signed by the client CA of the API server and matches the token and the configured user.
+func (r *EmergencyAccountReconciler) verifyCertificate(ctx context.Context, instance *emcv1beta1.EmergencyAccount, ts emcv1beta1.TokenStatus, credential string) error {
+	cert, err := utils.ParseClientCertificate([]byte(credential))
+	if err != nil {
+		return err
+	}
+	ca, err := r.clientCABundle(ctx)
+	if err != nil {
+		return err
+	}
+	roots := x509.NewCertPool()
+	if !roots.AppendCertsFromPEM([]byte(ca)) {
+		return fmt.Errorf("no certificates found in CA bundle")
+	}
+	intermediates := x509.NewCertPool()
+	for _, der := range cert.Certificate[1:] {
+		c, err := x509.ParseCertificate(der)
+		if err != nil {
+			return fmt.Errorf("unable to parse certificate chain: %w", err)
+		}
+		intermediates.AddCert(c)
+	}
+	if _, err := cert.Leaf.Verify(x509.VerifyOptions{
+		Roots:         roots,
+		Intermediates: intermediates,
+		CurrentTime:   r.Clock.Now(),
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}); err != nil {
+		return fmt.Errorf("certificate not signed by the client CA: %w", err)
+	}
+	if cn := cert.Leaf.Subject.CommonName; cn != instance.Spec.ClientCertificate.Username {
+		return fmt.Errorf("certificate is issued for user %q, expected %q", cn, instance.Spec.ClientCertificate.Username)
+	}
+	if !cert.Leaf.NotAfter.Equal(ts.ExpirationTimestamp.Time) {
+		return fmt.Errorf("certificate expires at %s, expected %s", cert.Leaf.NotAfter, ts.ExpirationTimestamp.Time)
+	}
+	return nil
+}
+
+// clientCABundle returns the CA bundle client certificates are verified against.
+// The configured bundle takes precedence over the client CA published by the API server.
+func (r *EmergencyAccountReconciler) clientCABundle(ctx context.Context) (string, error) {
+	if r.ClientCABundle != "" {
+		return r.ClientCABundle, nil
+	}
+	var reader client.Reader = r.Client
+	if r.APIReader != nil {
+		reader = r.APIReader
+	}
+	var cm corev1.ConfigMap
+	if err := reader.Get(ctx, types.NamespacedName{Name: ClientCAConfigMapName, Namespace: ClientCAConfigMapNamespace}, &cm); err != nil {
+		return "", fmt.Errorf("unable to get client CA bundle: %w", err)
+	}
+	ca, ok := cm.Data[ClientCAConfigMapKey]
+	if !ok {
+		return "", fmt.Errorf("ConfigMap %q does not contain key %q", ClientCAConfigMapName, ClientCAConfigMapKey)
+	}
+	return ca, nil
+}
@@ -0,0 +1,374 @@
+package controllers
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/go-logr/logr/testr"
+	"github.com/stretchr/testify/require"
+	certificatesv1 "k8s.io/api/certificates/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	emcv1beta1 "github.com/appuio/emergency-credentials-controller/api/v1beta1"
+	"github.com/appuio/emergency-credentials-controller/pkg/utils"
+)
+
+func Test_EmergencyAccountReconciler_Reconcile_ClientCertificate(t *testing.T) {
+	ctx := log.IntoContext(context.Background(), testr.New(t))
+	clock := &mockClock{now: time.Date(2022, 12, 4, 22, 45, 0, 0, time.UTC)}
+
+	ea := &emcv1beta1.EmergencyAccount{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:       "test",
+			Namespace:  "test",
+			Finalizers: []string{EmergencyAccountFinalizer},
+		},
+		Spec: emcv1beta1.EmergencyAccountSpec{
+			ValidityDuration:        metav1.Duration{Duration: 24 * time.Hour},
+			MinValidityDurationLeft: metav1.Duration{Duration: 12 * time.Hour},
+			MinRecreateInterval:     metav1.Duration{Duration: time.Second},
+			CredentialType:          emcv1beta1.CredentialTypeClientCertificate,
+			ClientCertificate: emcv1beta1.ClientCertificateSpec{
+				Username: "emergency-admin",
+				Groups:   []string{"emergency-admins"},
+			},
+			TokenStores: []emcv1beta1.TokenStoreSpec{
+				{
+					Name: "testsecret",
+					Type: "secret",
+				},
+			},
+		},
+	}
+
+	c, control := fakeClient(t, clock, ea)
+
+	subject := &EmergencyAccountReconciler{
+		Client: c,
+		Scheme: c.Scheme(),
+		Clock:  clock,
+	}
+	reconcileOnce := func() reconcile.Result {
+		t.Helper()
+		res, err := subject.Reconcile(ctx, reconcile.Request{NamespacedName: client.ObjectKeyFromObject(ea)})
+		require.NoError(t, err)
+		require.NoError(t, c.Get(ctx, client.ObjectKeyFromObject(ea), ea))
+		return res
+	}
+
+	// The certificate is requested and approved
+	res := reconcileOnce()
+	require.Equal(t, certificatePollInterval, res.RequeueAfter)
+	require.Len(t, ea.Status.Tokens, 1)
+	ts := ea.Status.Tokens[0]
+	require.Equal(t, emcv1beta1.TokenPhaseIssuing, ts.Phase)
+	require.Equal(t, emcv1beta1.CredentialTypeClientCertificate, ts.CredentialType)
+	requireCondition(t, ea, emcv1beta1.ConditionRotationBlocked, metav1.ConditionFalse)
+
+	var csr certificatesv1.CertificateSigningRequest
+	require.NoError(t, c.Get(ctx, types.NamespacedName{Name: certificateRequestName(ea, ts.UID)}, &csr))
+	require.Equal(t, certificatesv1.KubeAPIServerClientSignerName, csr.Spec.SignerName)
+	require.Equal(t, int32(24*60*60), *csr.Spec.ExpirationSeconds)
+	require.Equal(t, certificatesv1.CertificateApproved, csr.Status.Conditions[0].Type)
+	require.Equal(t, "test", csr.Labels[EmergencyAccountNameLabel])
+
+	var sa corev1.ServiceAccount
+	require.True(t, apierrors.IsNotFound(c.Get(ctx, client.ObjectKeyFromObject(ea), &sa)), "should not create a ServiceAccount")
+
+	// Waiting for the certificate does not request a new one
+	clock.Advance(time.Minute)
+	reconcileOnce()
+	require.Len(t, ea.Status.Tokens, 1)
+	require.Equal(t, emcv1beta1.TokenPhaseIssuing, ea.Status.Tokens[0].Phase)
+
+	// The signed certificate is stored
+	signCertificateRequest(t, c, clock, ea.Namespace, &csr)
+	reconcileOnce()
+	require.Len(t, ea.Status.Tokens, 1)
+	ts = ea.Status.Tokens[0]
+	require.Equal(t, emcv1beta1.TokenPhaseIssued, ts.Phase)
+	require.Equal(t, emcv1beta1.TokenStoreStateStored, ts.Refs[0].State)
+	requireCondition(t, ea, emcv1beta1.ConditionTokensVerified, metav1.ConditionTrue)
+	require.Equal(t, 0, control.tokenRequests, "should not request a token")
+	require.True(t, apierrors.IsNotFound(c.Get(ctx, client.ObjectKeyFromObject(&csr), &csr)), "should delete the CertificateSigningRequest")
+
+	var secret corev1.Secret
+	require.NoError(t, c.Get(ctx, types.NamespacedName{Name: ts.Refs[0].Ref, Namespace: ea.Namespace}, &secret))
+	cert, err := utils.ParseClientCertificate(secret.Data["token"])
+	require.NoError(t, err)
+	require.Equal(t, "emergency-admin", cert.Leaf.Subject.CommonName)
+	require.Equal(t, []string{"emergency-admins"}, cert.Leaf.Subject.Organization)
+	require.True(t, ts.ExpirationTimestamp.Time.Equal(cert.Leaf.NotAfter))
+
+	// A changed username invalidates the certificate
+	ea.Spec.ClientCertificate.Username = "other-admin"
+	require.NoError(t, c.Update(ctx, ea))
+	reconcileOnce()
+	requireCondition(t, ea, emcv1beta1.ConditionTokensVerified, metav1.ConditionFalse)
+	require.Len(t, ea.Status.Tokens, 2, "should request a new certificate")
+	require.Equal(t, emcv1beta1.TokenPhaseIssuing, ea.Status.Tokens[1].Phase)
+}
+
+func Test_EmergencyAccountReconciler_Reconcile_ClientCertificate_Abandoned(t *testing.T) {
+	ctx := log.IntoContext(context.Background(), testr.New(t))
+	clock := &mockClock{now: time.Date(2022, 12, 4, 22, 45, 0, 0, time.UTC)}
+
+	ea := &emcv1beta1.EmergencyAccount{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:       "test",
+			Namespace:  "test",
+			Finalizers: []string{EmergencyAccountFinalizer},
+		},
+		Spec: emcv1beta1.EmergencyAccountSpec{
+			ValidityDuration:        metav1.Duration{Duration: 24 * time.Hour},
+			MinValidityDurationLeft: metav1.Duration{Duration: 12 * time.Hour},
+			MinRecreateInterval:     metav1.Duration{Duration: time.Second},
+			CredentialType:          emcv1beta1.CredentialTypeClientCertificate,
+			ClientCertificate: emcv1beta1.ClientCertificateSpec{
+				Username: "emergency-admin",
+			},
+			TokenStores: []emcv1beta1.TokenStoreSpec{
+				{
+					Name: "testsecret",
+					Type: "secret",
+				},
+			},
+		},
+	}
+
+	c, _ := fakeClient(t, clock, ea)
+
+	subject := &EmergencyAccountReconciler{
+		Client: c,
+		Scheme: c.Scheme(),
+		Clock:  clock,
+	}
+	reconcileOnce := func() {
+		t.Helper()
+		_, err := subject.Reconcile(ctx, reconcile.Request{NamespacedName: client.ObjectKeyFromObject(ea)})
+		require.NoError(t, err)
+		require.NoError(t, c.Get(ctx, client.ObjectKeyFromObject(ea), ea))
+	}
+
+	// A request not signed in time is removed
+	reconcileOnce()
+	require.Len(t, ea.Status.Tokens, 1)
+	firstCSR := certificateRequestName(ea, ea.Status.Tokens[0].UID)
+	clock.Advance(certificateIssuanceTimeout + time.Second)
+	reconcileOnce()
+	var csr certificatesv1.CertificateSigningRequest
+	require.True(t, apierrors.IsNotFound(c.Get(ctx, types.NamespacedName{Name: firstCSR}, &csr)), "should delete the CertificateSigningRequest")
+	require.Len(t, ea.Status.Tokens, 1, "should request a new certificate")
+	require.NotEqual(t, firstCSR, certificateRequestName(ea, ea.Status.Tokens[0].UID))
+
+	// A denied request is removed
+	require.NoError(t, c.Get(ctx, types.NamespacedName{Name: certificateRequestName(ea, ea.Status.Tokens[0].UID)}, &csr))
+	csr.Status.Conditions = append(csr.Status.Conditions, certificatesv1.CertificateSigningRequestCondition{
+		Type:   certificatesv1.CertificateDenied,
+		Status: corev1.ConditionTrue,
+	})
+	require.NoError(t, c.Status().Update(ctx, &csr))
+	clock.Advance(time.Second)
+	reconcileOnce()
+	require.True(t, apierrors.IsNotFound(c.Get(ctx, client.ObjectKeyFromObject(&csr), &csr)), "should delete the CertificateSigningRequest")
+	require.Len(t, ea.Status.Tokens, 1, "should request a new certificate")
+	require.NotEqual(t, csr.Name, certificateRequestName(ea, ea.Status.Tokens[0].UID))
+
+	// Deleting the EmergencyAccount deletes the CertificateSigningRequests
+	require.NoError(t, c.Delete(ctx, ea))
+	_, err := subject.Reconcile(ctx, reconcile.Request{NamespacedName: client.ObjectKeyFromObject(ea)})
+	require.NoError(t, err)
+	var csrs certificatesv1.CertificateSigningRequestList
+	require.NoError(t, c.List(ctx, &csrs))
+	require.Empty(t, csrs.Items)
+}
+
+func Test_EmergencyAccountReconciler_Reconcile_ClientCertificate_SystemIdentity(t *testing.T) {
+	ctx := log.IntoContext(context.Background(), testr.New(t))
+	clock := &mockClock{now: time.Date(2022, 12, 4, 22, 45, 0, 0, time.UTC)}
+
+	ea := &emcv1beta1.EmergencyAccount{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:       "test",
+			Namespace:  "test",
+			Finalizers: []string{EmergencyAccountFinalizer},
+		},
+		Spec: emcv1beta1.EmergencyAccountSpec{
+			ValidityDuration:        metav1.Duration{Duration: 24 * time.Hour},
+			MinValidityDurationLeft: metav1.Duration{Duration: 12 * time.Hour},
+			MinRecreateInterval:     metav1.Duration{Duration: time.Second},
+			CredentialType:          emcv1beta1.CredentialTypeClientCertificate,
+			ClientCertificate: emcv1beta1.ClientCertificateSpec{
+				Username: "emergency-admin",
+				Groups:   []string{"system:masters"},
+			},
+			TokenStores: []emcv1beta1.TokenStoreSpec{
+				{
+					Name: "testsecret",
+					Type: "secret",
+				},
+			},
+		},
+	}
+
+	c, _ := fakeClient(t, clock, ea)
+
+	subject := &EmergencyAccountReconciler{
+		Client: c,
+		Scheme: c.Scheme(),
+		Clock:  clock,
+	}
+
+	_, err := subject.Reconcile(ctx, reconcile.Request{NamespacedName: client.ObjectKeyFromObject(ea)})
+	require.ErrorContains(t, err, "system:masters")
+	var csrs certificatesv1.CertificateSigningRequestList
+	require.NoError(t, c.List(ctx, &csrs))
+	require.Empty(t, csrs.Items, "should not request a certificate for a reserved identity")
+
+	require.NoError(t, c.Get(ctx, client.ObjectKeyFromObject(ea), ea))
+	ea.Spec.ClientCertificate.AllowSystemIdentity = true
+	require.NoError(t, c.Update(ctx, ea))
+	clock.Advance(time.Second)
+	_, err = subject.Reconcile(ctx, reconcile.Request{NamespacedName: client.ObjectKeyFromObject(ea)})
+	require.NoError(t, err)
+	require.NoError(t, c.List(ctx, &csrs))
+	require.Len(t, csrs.Items, 1, "should request a certificate if allowed")
+}
+
+func Test_EmergencyAccountReconciler_verifyCertificate(t *testing.T) {
+	ctx := log.IntoContext(context.Background(), testr.New(t))
+	clock := &mockClock{now: time.Date(2022, 12, 4, 22, 45, 0, 0, time.UTC)}
+
+	ea := &emcv1beta1.EmergencyAccount{
+		ObjectMeta: metav1.ObjectMeta{Name: "test", Namespace: "test"},
+		Spec: emcv1beta1.EmergencyAccountSpec{
+			ClientCertificate: emcv1beta1.ClientCertificateSpec{Username: "emergency-admin"},
+		},
+	}
+	ca, caKey := newTestCA(t, clock)
+	servingCA, servingKey := newTestCA(t, clock)
+	c, _ := fakeClient(t, clock, ea, &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: ClientCAConfigMapName, Namespace: ClientCAConfigMapNamespace},
+		Data:       map[string]string{ClientCAConfigMapKey: string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.Raw}))},
+	}, &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: RootCAConfigMapName, Namespace: ea.Namespace},
+		Data:       map[string]string{RootCAConfigMapKey: string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: servingCA.Raw}))},
+	})
+	subject := &EmergencyAccountReconciler{Client: c, Scheme: c.Scheme(), Clock: clock}
+
+	notAfter := clock.Now().Add(24 * time.Hour)
+	ts := emcv1beta1.TokenStatus{ExpirationTimestamp: metav1.NewTime(notAfter)}
+
+	require.NoError(t, subject.verifyCertificate(ctx, ea, ts, issueTestCertificate(t, clock, ca, caKey, "emergency-admin", notAfter)))
+
+	otherCA, otherKey := newTestCA(t, clock)
+	require.ErrorContains(t,
+		subject.verifyCertificate(ctx, ea, ts, issueTestCertificate(t, clock, otherCA, otherKey, "emergency-admin", notAfter)),
+		"not signed by the client CA")
+	require.ErrorContains(t,
+		subject.verifyCertificate(ctx, ea, ts, issueTestCertificate(t, clock, servingCA, servingKey, "emergency-admin", notAfter)),
+		"not signed by the client CA", "the serving CA of the API server should not be trusted for client certificates")
+	require.ErrorContains(t,
+		subject.verifyCertificate(ctx, ea, ts, issueTestCertificate(t, clock, ca, caKey, "other-admin", notAfter)),
+		"expected \"emergency-admin\"")
+
+	subject.ClientCABundle = string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: otherCA.Raw}))
+	require.NoError(t,
+		subject.verifyCertificate(ctx, ea, ts, issueTestCertificate(t, clock, otherCA, otherKey, "emergency-admin", notAfter)),
+		"the configured client CA bundle should take precedence")
+	require.ErrorContains(t,
+		subject.verifyCertificate(ctx, ea, ts, issueTestCertificate(t, clock, ca, caKey, "emergency-admin", notAfter)),
+		"not signed by the client CA")
+}
+
+// issueTestCertificate returns a PEM bundle of a client certificate signed by the CA and its private key.
+func issueTestCertificate(t *testing.T, clock Clock, ca *x509.Certificate, caKey *ecdsa.PrivateKey, username string, notAfter time.Time) string {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	der, err := x509.CreateCertificate(rand.Reader, &x509.Certificate{
+		SerialNumber: big.NewInt(3),
+		Subject:      pkix.Name{CommonName: username},
+		NotBefore:    clock.Now(),
+		NotAfter:     notAfter,
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}, ca, &key.PublicKey, caKey)
+	require.NoError(t, err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+	return string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})) +
+		string(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}))
+}
+
+// signCertificateRequest signs the CertificateSigningRequest with a throwaway CA like the kube-controller-manager would.
+// The CA is published in the client CA ConfigMap, the root CA ConfigMap of the namespace holds a different serving CA.
+func signCertificateRequest(t *testing.T, c client.Client, clock Clock, namespace string, csr *certificatesv1.CertificateSigningRequest) {
+	t.Helper()
+
+	ca, caKey := newTestCA(t, clock)
+	servingCA, _ := newTestCA(t, clock)
+	require.NoError(t, c.Create(context.Background(), &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: ClientCAConfigMapName, Namespace: ClientCAConfigMapNamespace},
+		Data:       map[string]string{ClientCAConfigMapKey: string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.Raw}))},
+	}))
+	require.NoError(t, c.Create(context.Background(), &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: RootCAConfigMapName, Namespace: namespace},
+		Data:       map[string]string{RootCAConfigMapKey: string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: servingCA.Raw}))},
+	}))
+
+	block, _ := pem.Decode(csr.Spec.Request)
+	require.NotNil(t, block)
+	req, err := x509.ParseCertificateRequest(block.Bytes)
+	require.NoError(t, err)
+	der, err := x509.CreateCertificate(rand.Reader, &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      req.Subject,
+		NotBefore:    clock.Now(),
+		NotAfter:     clock.Now().Add(time.Duration(*csr.Spec.ExpirationSeconds) * time.Second),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}, ca, req.PublicKey, caKey)
+	require.NoError(t, err)
+
+	require.NoError(t, c.Get(context.Background(), client.ObjectKeyFromObject(csr), csr))
+	csr.Status.Certificate = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	require.NoError(t, c.Status().Update(context.Background(), csr))
+}
+
+// newTestCA returns a throwaway CA certificate and its key.
+func newTestCA(t *testing.T, clock Clock) (*x509.Certificate, *ecdsa.PrivateKey) {
+	t.Helper()
+
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "kube-apiserver-client"},
+		NotBefore:             clock.Now().Add(-time.Hour),
+		NotAfter:              clock.Now().Add(365 * 24 * time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &caKey.PublicKey, caKey)
+	require.NoError(t, err)
+	ca, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	return ca, caKey
+}
@@ -0,0 +1,80 @@
+package controllers
+
+import (
+	"fmt"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	emcv1beta1 "github.com/appuio/emergency-credentials-controller/api/v1beta1"
+)
+
+// setCondition sets the condition on the instance.
+// The transition time is only updated if the status changes.
+func (r *EmergencyAccountReconciler) setCondition(instance *emcv1beta1.EmergencyAccount, typ string, status metav1.ConditionStatus, reason, message string) {
+	meta.SetStatusCondition(&instance.Status.Conditions, metav1.Condition{
+		Type:               typ,
+		Status:             status,
+		Reason:             reason,
+		Message:            message,
+		ObservedGeneration: instance.Generation,
+		LastTransitionTime: metav1.NewTime(r.Clock.Now()),
+	})
+}
+
+// setVerificationConditions sets the TokensVerified and StoresHealthy conditions from the token verification results.
+func (r *EmergencyAccountReconciler) setVerificationConditions(instance *emcv1beta1.EmergencyAccount, verified, failed []tokenVerification) {
+	if len(verified) > 0 {
+		r.setCondition(instance, emcv1beta1.ConditionTokensVerified, metav1.ConditionTrue, emcv1beta1.ReasonTokensVerified,
+			fmt.Sprintf("%d of %d tokens verified", len(verified), len(verified)+len(failed)))
+	} else if len(failed) == 0 {
+		r.setCondition(instance, emcv1beta1.ConditionTokensVerified, metav1.ConditionFalse, emcv1beta1.ReasonNoTokens, "No tokens created yet")
+	} else {
+		r.setCondition(instance, emcv1beta1.ConditionTokensVerified, metav1.ConditionFalse, emcv1beta1.ReasonNoVerifiedTokens, verificationMessage(failed))
+	}
+
+	// The health of the stores is determined by the most recent token.
+	var latest *tokenVerification
+	for _, tvs := range [][]tokenVerification{verified, failed} {
+		for i := range tvs {
+			if latest == nil || tvs[i].tokenRef.ExpirationTimestamp.After(latest.tokenRef.ExpirationTimestamp.Time) {
+				latest = &tvs[i]
+			}
+		}
+	}
+	switch {
+	case latest == nil:
+		r.setCondition(instance, emcv1beta1.ConditionStoresHealthy, metav1.ConditionUnknown, emcv1beta1.ReasonNoTokens, "No tokens created yet")
+	case len(latest.failedStores) > 0:
+		r.setCondition(instance, emcv1beta1.ConditionStoresHealthy, metav1.ConditionFalse, emcv1beta1.ReasonStoreVerificationFailed,
+			fmt.Sprintf("Stores %s failed verification: %s", strings.Join(latest.failedStores, ", "), verificationMessage([]tokenVerification{*latest})))
+	default:
+		r.setCondition(instance, emcv1beta1.ConditionStoresHealthy, metav1.ConditionTrue, emcv1beta1.ReasonStoresHealthy, "Most recent token verified in all stores")
+	}
+}
+
+// setReadyCondition sets the Ready condition from the TokensVerified, StoresHealthy, and AccessVerified conditions.
+func (r *EmergencyAccountReconciler) setReadyCondition(instance *emcv1beta1.EmergencyAccount) {
+	for _, typ := range []string{emcv1beta1.ConditionTokensVerified, emcv1beta1.ConditionStoresHealthy, emcv1beta1.ConditionAccessVerified} {
+		c := meta.FindStatusCondition(instance.Status.Conditions, typ)
+		if c == nil {
+			r.setCondition(instance, emcv1beta1.ConditionReady, metav1.ConditionUnknown, emcv1beta1.ReasonNoTokens, fmt.Sprintf("Condition %s not yet set", typ))
+			return
+		}
+		if c.Status != metav1.ConditionTrue {
+			r.setCondition(instance, emcv1beta1.ConditionReady, metav1.ConditionFalse, c.Reason, c.Message)
+			return
+		}
+	}
+	r.setCondition(instance, emcv1beta1.ConditionReady, metav1.ConditionTrue, emcv1beta1.ReasonReady, "Verified token available in all stores")
+}
+
+// verificationMessage joins the verification errors of the given tokens.
+func verificationMessage(tvs []tokenVerification) string {
+	msgs := make([]string, len(tvs))
+	for i, tv := range tvs {
+		msgs[i] = tv.String()
+	}
+	return strings.Join(msgs, "; ")
+}
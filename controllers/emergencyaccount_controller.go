@@ -4,22 +4,33 @@ import (
 	"context"
 	"crypto/sha256"
 	"encoding/gob"
+	"errors"
 	"fmt"
 	"time"
 
+	"go.uber.org/multierr"
+	"golang.org/x/exp/maps"
 	"golang.org/x/exp/slices"
 	authenticationv1 "k8s.io/api/authentication/v1"
+	certificatesv1 "k8s.io/api/certificates/v1"
 	corev1 "k8s.io/api/core/v1"
+	rbacv1 "k8s.io/api/rbac/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
 	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
 	"k8s.io/apimachinery/pkg/util/uuid"
+	"k8s.io/client-go/tools/events"
 	"k8s.io/utils/integer"
 	"k8s.io/utils/ptr"
 	ctrl "sigs.k8s.io/controller-runtime"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
 	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
 
 	emcv1beta1 "github.com/appuio/emergency-credentials-controller/api/v1beta1"
 	"github.com/appuio/emergency-credentials-controller/controllers/stores"
@@ -35,8 +46,25 @@ type Clock interface {
 type EmergencyAccountReconciler struct {
 	client.Client
 	Scheme *runtime.Scheme
+	// ClusterName is the name of the cluster recorded in the metadata of stored tokens.
+	ClusterName string
+	// Recorder records events for the EmergencyAccounts.
+	// Events are not recorded if nil.
+	Recorder events.EventRecorder
+	// ClientCABundle is the PEM encoded CA bundle issued client certificates are verified against.
+	// If empty, the client CA of the API server is read from the extension-apiserver-authentication ConfigMap.
+	ClientCABundle string
+	// APIReader reads objects not cached by the manager, like the client CA ConfigMap.
+	// The client is used if nil.
+	APIReader client.Reader
+	// SecretReplication enables copying the secrets of the secret store into other namespaces.
+	// The controller needs permissions to manage secrets in all namespaces.
+	SecretReplication bool
 
 	Clock Clock
+
+	// storeFactory creates the stores from their spec, stores.FromSpec is used if nil.
+	storeFactory func(emcv1beta1.TokenStoreSpec) (stores.TokenStorer, error)
 }
 
 //+kubebuilder:rbac:groups=cluster.appuio.io,resources=emergencyaccounts,verbs=get;list;watch;create;update;patch;delete,namespace="system"
@@ -67,6 +95,16 @@ func (r *EmergencyAccountReconciler) Reconcile(ctx context.Context, req ctrl.Req
 	if instance.DeletionTimestamp != nil {
 		l.Info("EmergencyAccount resource is being deleted")
 		deleteVerifiedTokensValidUntil(instance.Name)
+		deleteFailedAccessChecks(instance.Name)
+		if err := r.deleteManagedPermissions(ctx, instance, nil); err != nil {
+			return ctrl.Result{}, fmt.Errorf("unable to delete permissions: %w", err)
+		}
+		if err := r.deleteCertificateRequests(ctx, instance); err != nil {
+			return ctrl.Result{}, fmt.Errorf("unable to delete certificate requests: %w", err)
+		}
+		if err := r.deleteReplicatedSecrets(ctx, instance); err != nil {
+			return ctrl.Result{}, fmt.Errorf("unable to delete replicated secrets: %w", err)
+		}
 		if controllerutil.RemoveFinalizer(instance, EmergencyAccountFinalizer) {
 			if err := r.Update(ctx, instance); err != nil {
 				return ctrl.Result{}, fmt.Errorf("unable to remove finalizer: %w", err)
@@ -82,76 +120,190 @@ func (r *EmergencyAccountReconciler) Reconcile(ctx context.Context, req ctrl.Req
 		return ctrl.Result{}, nil
 	}
 
-	sa, err := r.reconcileSA(ctx, instance)
+	origStatus := instance.Status.DeepCopy()
+	res, err := r.reconcileAccount(ctx, instance)
 	if err != nil {
-		return ctrl.Result{}, fmt.Errorf("unable to reconcile ServiceAccount: %w", err)
+		r.setCondition(instance, emcv1beta1.ConditionReady, metav1.ConditionFalse, emcv1beta1.ReasonReconcileFailed, err.Error())
+	} else {
+		r.setReadyCondition(instance)
+	}
+	if !equality.Semantic.DeepEqual(origStatus, &instance.Status) {
+		if uerr := r.Client.Status().Update(ctx, instance); uerr != nil {
+			return ctrl.Result{}, multierr.Combine(err, fmt.Errorf("unable to update status: %w", uerr))
+		}
+	}
+	return res, err
+}
+
+// reconcileAccount reconciles the ServiceAccount and the tokens of the EmergencyAccount.
+// Changes are made to the status of the given instance, the caller is responsible for persisting them.
+func (r *EmergencyAccountReconciler) reconcileAccount(ctx context.Context, instance *emcv1beta1.EmergencyAccount) (ctrl.Result, error) {
+	l := log.FromContext(ctx).WithName("EmergencyAccountReconciler.reconcileAccount")
+
+	if revocationRequested(instance) {
+		if err := r.revokeTokens(ctx, instance); err != nil {
+			return ctrl.Result{}, fmt.Errorf("unable to revoke tokens: %w", err)
+		}
 	}
 
+	var sa *corev1.ServiceAccount
+	id := clientCertificateIdentity(instance.Spec.ClientCertificate)
+	if specCredentialType(instance) == emcv1beta1.CredentialTypeServiceAccountToken {
+		var err error
+		sa, err = r.reconcileSA(ctx, instance)
+		if err != nil {
+			return ctrl.Result{}, fmt.Errorf("unable to reconcile ServiceAccount: %w", err)
+		}
+		// A stale cache could still return the deleted ServiceAccount, tokens issued for it would be invalid
+		if rv := instance.Status.LastRevocation; rv != nil && rv.ServiceAccountUID != "" && rv.ServiceAccountUID == sa.UID {
+			return ctrl.Result{}, fmt.Errorf("revoked ServiceAccount %q not yet recreated", sa.UID)
+		}
+		id = serviceAccountIdentity(sa)
+	}
+	if err := r.reconcilePermissions(ctx, instance, id); err != nil {
+		return ctrl.Result{}, fmt.Errorf("unable to reconcile permissions: %w", err)
+	}
+	r.verifyAccess(ctx, instance, id)
+
+	if err := r.deleteUnusedBoundSecrets(ctx, instance); err != nil {
+		return ctrl.Result{}, fmt.Errorf("unable to delete unused bound secrets: %w", err)
+	}
+	resumed, err := r.reconcilePendingTokens(ctx, instance)
+	if err != nil {
+		return ctrl.Result{}, fmt.Errorf("unable to reconcile pending tokens: %w", err)
+	}
+	r.deleteExpiredTokens(ctx, instance)
+	if r.pruneStatus(instance) {
+		l.Info("pruned status", "ntokens", len(instance.Status.Tokens))
+	}
+	r.retryPendingStores(ctx, instance)
+
+	// The new hashes are only persisted after a token was stored with the new configuration.
+	storeHashes := make([]emcv1beta1.TokenStoreHash, 0, len(instance.Spec.TokenStores))
 	var configChanged bool
 	for _, store := range instance.Spec.TokenStores {
 		refI := slices.IndexFunc(instance.Status.LastTokenStoreHashes, func(ref emcv1beta1.TokenStoreHash) bool {
 			return store.Name == ref.Name
 		})
-		hw := sha256.New()
-		if err := gob.NewEncoder(hw).Encode(store); err != nil {
+		hsh, err := r.storeConfigHash(ctx, instance, store)
+		if err != nil {
 			return ctrl.Result{}, fmt.Errorf("unable to hash store configuration: %w", err)
 		}
-		hsh := fmt.Sprintf("%x", hw.Sum(nil))
+		storeHashes = append(storeHashes, emcv1beta1.TokenStoreHash{
+			Name:   store.Name,
+			Sha256: hsh,
+		})
 		if refI >= 0 && instance.Status.LastTokenStoreHashes[refI].Sha256 == hsh {
 			continue
 		}
 		l.Info("store configuration changed", "store", store.Name, "hash", hsh)
-		configChanged = configChanged || true
-		if refI == -1 {
-			instance.Status.LastTokenStoreHashes = append(instance.Status.LastTokenStoreHashes, emcv1beta1.TokenStoreHash{
-				Name:   store.Name,
-				Sha256: hsh,
-			})
-		} else {
-			instance.Status.LastTokenStoreHashes[refI].Sha256 = hsh
-		}
+		configChanged = true
 	}
-
-	verified, failedVerification := r.verifyTokens(ctx, instance)
-	if len(failedVerification) > 0 {
-		us := make([]string, len(failedVerification))
-		for i, tv := range failedVerification {
-			us[i] = tv.String()
-		}
-		l.Info("unverified tokens found", "tokens", us)
+	// A resumed token was stored with the current configuration
+	if resumed {
+		instance.Status.LastTokenStoreHashes = storeHashes
+		configChanged = false
 	}
-	l.Info("verified tokens found", "ntokens", len(verified))
 
-	// Update metrics
-	validUntilUnix := int64(0)
-	for _, tv := range verified {
-		validUntilUnix = integer.Int64Max(validUntilUnix, tv.tokenRef.ExpirationTimestamp.Unix())
+	verified, _ := r.verifyAndReport(ctx, instance)
+
+	if hasIssuingTokens(instance) {
+		l.Info("waiting for the client certificate to be signed")
+		r.setCondition(instance, emcv1beta1.ConditionRotationBlocked, metav1.ConditionFalse, emcv1beta1.ReasonNotBlocked, "Waiting for the client certificate to be issued")
+		return r.requeueResult(instance), nil
 	}
-	verifiedTokensValidUntil.WithLabelValues(instance.Name).Set(float64(validUntilUnix))
 
 	nValidityLeft := 0
 	for _, tv := range verified {
-		if tv.tokenRef.ExpirationTimestamp.Time.After(r.Clock.Now().Add(instance.Spec.MinValidityDurationLeft.Duration)) {
+		if !matchesCredentialSpec(instance, tv.tokenRef) {
+			continue
+		}
+		if tv.tokenRef.ExpirationTimestamp.Time.After(r.Clock.Now().Add(minValidityDurationLeft(instance))) {
 			nValidityLeft++
 		}
 	}
 	if nValidityLeft > 0 && !configChanged {
 		l.Info("enough tokens have validity left, not creating new one", "ntokens", nValidityLeft)
-		return ctrl.Result{RequeueAfter: instance.Spec.CheckInterval.Duration}, nil
+		r.setCondition(instance, emcv1beta1.ConditionRotationBlocked, metav1.ConditionFalse, emcv1beta1.ReasonNotBlocked, "No new token required")
+		return r.requeueResult(instance), nil
+	}
+	// A token still being stored with enough validity left is retried instead of creating a new one
+	if retryIn, pending := r.nextStoreRetry(instance); pending && !configChanged &&
+		instance.Status.Tokens[len(instance.Status.Tokens)-1].ExpirationTimestamp.Time.After(r.Clock.Now().Add(minValidityDurationLeft(instance))) {
+		l.Info("storing the latest token is pending for some stores, retrying instead of creating a new one", "retryIn", retryIn)
+		r.setCondition(instance, emcv1beta1.ConditionRotationBlocked, metav1.ConditionFalse, emcv1beta1.ReasonNotBlocked, "Storing the latest token is retried")
+		return r.requeueResult(instance), nil
 	}
 	l.Info("not enough tokens have validity left or store config changed, creating new one")
 
-	if instance.Status.LastTokenCreationTimestamp.Add(instance.Spec.MinRecreateInterval.Duration).After(r.Clock.Now()) {
+	// A token is issued right away after a revocation
+	onlyRevoked := instance.Status.LastRevocation != nil && !slices.ContainsFunc(instance.Status.Tokens, func(ts emcv1beta1.TokenStatus) bool {
+		return !ts.Revoked
+	})
+	if !onlyRevoked && instance.Status.LastTokenCreationTimestamp.Add(instance.Spec.MinRecreateInterval.Duration).After(r.Clock.Now()) {
 		l.Info("last token creation too recent, not creating a new one")
 		requeueIn := instance.Status.LastTokenCreationTimestamp.Add(instance.Spec.MinRecreateInterval.Duration).Sub(r.Clock.Now())
+		r.setCondition(instance, emcv1beta1.ConditionRotationBlocked, metav1.ConditionTrue, emcv1beta1.ReasonMinRecreateInterval,
+			fmt.Sprintf("New token required but last token was created less than %s ago, retrying in %s", instance.Spec.MinRecreateInterval.Duration, requeueIn.Round(time.Second)))
 		return ctrl.Result{RequeueAfter: requeueIn}, nil
 	}
+	r.setCondition(instance, emcv1beta1.ConditionRotationBlocked, metav1.ConditionFalse, emcv1beta1.ReasonNotBlocked, "New token created")
 
 	if err := r.createAndStoreToken(ctx, instance, sa); err != nil {
+		r.setCondition(instance, emcv1beta1.ConditionStoresHealthy, metav1.ConditionFalse, emcv1beta1.ReasonStoreFailed, err.Error())
 		return ctrl.Result{}, fmt.Errorf("unable to create and store token: %w", err)
 	}
+	// A requested certificate is stored with the then current configuration once it is signed
+	if !hasIssuingTokens(instance) {
+		instance.Status.LastTokenStoreHashes = storeHashes
+	}
+
+	// Verify the new token right away to report the current state
+	r.verifyAndReport(ctx, instance)
+
+	return r.requeueResult(instance), nil
+}
+
+// requeueResult requeues after the check interval or earlier if a pending store needs to be retried or a certificate is waited for.
+func (r *EmergencyAccountReconciler) requeueResult(instance *emcv1beta1.EmergencyAccount) ctrl.Result {
+	requeueIn := instance.Spec.CheckInterval.Duration
+	if retryIn, pending := r.nextStoreRetry(instance); pending && (requeueIn == 0 || retryIn < requeueIn) {
+		requeueIn = retryIn
+	}
+	if hasIssuingTokens(instance) && (requeueIn == 0 || certificatePollInterval < requeueIn) {
+		requeueIn = certificatePollInterval
+	}
+	return ctrl.Result{RequeueAfter: requeueIn}
+}
+
+// verifyAndReport verifies the tokens and reports the result through logs, metrics, and status conditions.
+func (r *EmergencyAccountReconciler) verifyAndReport(ctx context.Context, instance *emcv1beta1.EmergencyAccount) (verified []tokenVerification, failed []tokenVerification) {
+	l := log.FromContext(ctx).WithName("EmergencyAccountReconciler.verifyAndReport")
+
+	verified, failed = r.verifyTokens(ctx, instance)
+	if len(failed) > 0 {
+		us := make([]string, len(failed))
+		for i, tv := range failed {
+			us[i] = tv.String()
+		}
+		l.Info("unverified tokens found", "tokens", us)
+	}
+	l.Info("verified tokens found", "ntokens", len(verified))
+
+	// Update metrics
+	validUntilUnix := int64(0)
+	for _, tv := range verified {
+		validUntilUnix = integer.Int64Max(validUntilUnix, tv.tokenRef.ExpirationTimestamp.Unix())
+	}
+	verifiedTokensValidUntil.WithLabelValues(instance.Name).Set(float64(validUntilUnix))
 
-	return ctrl.Result{RequeueAfter: instance.Spec.CheckInterval.Duration}, nil
+	instance.Status.VerifiedTokensValidUntil = nil
+	if validUntilUnix > 0 {
+		instance.Status.VerifiedTokensValidUntil = ptr.To(metav1.Unix(validUntilUnix, 0))
+	}
+	r.setVerificationConditions(instance, verified, failed)
+
+	return verified, failed
 }
 
 func (r *EmergencyAccountReconciler) reconcileSA(ctx context.Context, instance *emcv1beta1.EmergencyAccount) (*corev1.ServiceAccount, error) {
@@ -174,15 +326,204 @@ func (r *EmergencyAccountReconciler) reconcileSA(ctx context.Context, instance *
 	return sa, nil
 }
 
+// storeFromSpec creates the store from the spec and injects the client and the cluster name if the store supports it.
+func (r *EmergencyAccountReconciler) storeFromSpec(spec emcv1beta1.TokenStoreSpec) (stores.TokenStorer, error) {
+	newStore := stores.FromSpec
+	if r.storeFactory != nil {
+		newStore = r.storeFactory
+	}
+	if !r.SecretReplication && secretReplicationConfigured(spec) {
+		return nil, errSecretReplicationDisabled
+	}
+	st, err := newStore(spec)
+	if err != nil {
+		return nil, err
+	}
+	if ij, ok := st.(stores.ClientInjector); ok {
+		ij.InjectClient(r.Client)
+	}
+	if mi, ok := st.(stores.MetadataInjector); ok {
+		mi.InjectTokenMetadata(stores.TokenMetadata{Cluster: r.ClusterName})
+	}
+	return st, nil
+}
+
+// errSecretReplicationDisabled is returned for secret stores configuring replication if it is not enabled.
+var errSecretReplicationDisabled = errors.New("secret replication is not enabled, the controller must be started with --enable-secret-replication")
+
+// secretReplicationConfigured returns true if the store is a secret store copying its secrets into other namespaces.
+func secretReplicationConfigured(spec emcv1beta1.TokenStoreSpec) bool {
+	return spec.Type == "secret" && (len(spec.SecretSpec.Replication.Namespaces) > 0 || spec.SecretSpec.Replication.NamespaceSelector != nil)
+}
+
+// deleteExpiredTokens deletes revoked tokens and tokens expired for longer than the grace period from the stores supporting deletion.
+// Successful deletions are marked in the token references.
+func (r *EmergencyAccountReconciler) deleteExpiredTokens(ctx context.Context, instance *emcv1beta1.EmergencyAccount) {
+	l := log.FromContext(ctx).WithName("EmergencyAccountReconciler.deleteExpiredTokens")
+
+	deleteBefore := r.Clock.Now().Add(-instance.Spec.ExpiredTokenRetention.StoreDeletionGracePeriod.Duration)
+	for i := range instance.Status.Tokens {
+		ts := &instance.Status.Tokens[i]
+		if !ts.Revoked && !ts.ExpirationTimestamp.Time.Before(deleteBefore) {
+			continue
+		}
+		for j := range ts.Refs {
+			ref := &ts.Refs[j]
+			if ref.Deleted || ref.Ref == "" {
+				continue
+			}
+			td, ok := r.tokenDeleterFor(instance, ref.Store)
+			if !ok {
+				continue
+			}
+			if err := td.DeleteToken(ctx, *instance, ref.Ref); err != nil {
+				l.Error(err, "unable to delete expired token", "token", ts.UID, "store", ref.Store)
+				continue
+			}
+			ref.Deleted = true
+		}
+	}
+}
+
+// deleteReplicatedSecrets deletes the copies of secrets the secret stores replicated into other namespaces.
+// The copies can't be owned by the EmergencyAccount and are not garbage collected.
+func (r *EmergencyAccountReconciler) deleteReplicatedSecrets(ctx context.Context, instance *emcv1beta1.EmergencyAccount) error {
+	l := log.FromContext(ctx).WithName("EmergencyAccountReconciler.deleteReplicatedSecrets")
+
+	replicas, err := stores.ListReplicas(ctx, r.Client, *instance)
+	if err != nil {
+		return err
+	}
+	var errs []error
+	for i := range replicas {
+		s := &replicas[i]
+		if err := r.Delete(ctx, s); err != nil && !apierrors.IsNotFound(err) {
+			errs = append(errs, fmt.Errorf("unable to delete secret %s/%s: %w", s.Namespace, s.Name, err))
+			continue
+		}
+		l.Info("deleted replicated secret", "secret", s.Name, "namespace", s.Namespace)
+	}
+	return multierr.Combine(errs...)
+}
+
+// tokenDeleterFor returns the store with the given name if it is configured and supports deletion.
+func (r *EmergencyAccountReconciler) tokenDeleterFor(instance *emcv1beta1.EmergencyAccount, storeName string) (stores.TokenDeleter, bool) {
+	i := slices.IndexFunc(instance.Spec.TokenStores, func(store emcv1beta1.TokenStoreSpec) bool {
+		return store.Name == storeName
+	})
+	if i == -1 {
+		return nil, false
+	}
+	st, err := r.storeFromSpec(instance.Spec.TokenStores[i])
+	if err != nil {
+		return nil, false
+	}
+	td, ok := st.(stores.TokenDeleter)
+	return td, ok
+}
+
+// pruneStatus removes expired tokens exceeding the retention policy and the configuration hashes of removed stores from the status.
+// Tokens still pending deletion from a store are kept.
+// Returns true if the status was changed.
+func (r *EmergencyAccountReconciler) pruneStatus(instance *emcv1beta1.EmergencyAccount) bool {
+	retention := instance.Spec.ExpiredTokenRetention
+	now := r.Clock.Now()
+
+	expired := make([]emcv1beta1.TokenStatus, 0, len(instance.Status.Tokens))
+	for _, ts := range instance.Status.Tokens {
+		// Tokens being issued have no expiration timestamp yet
+		if ts.Phase == emcv1beta1.TokenPhaseIssuing || !ts.ExpirationTimestamp.Time.Before(now) {
+			continue
+		}
+		if slices.ContainsFunc(ts.Refs, func(ref emcv1beta1.TokenStatusRef) bool {
+			if ref.Deleted || ref.Ref == "" {
+				return false
+			}
+			_, ok := r.tokenDeleterFor(instance, ref.Store)
+			return ok
+		}) {
+			continue
+		}
+		expired = append(expired, ts)
+	}
+	// Most recently expired first
+	slices.SortStableFunc(expired, func(a, b emcv1beta1.TokenStatus) int {
+		return b.ExpirationTimestamp.Time.Compare(a.ExpirationTimestamp.Time)
+	})
+	prune := map[types.UID]bool{}
+	for i, ts := range expired {
+		if retention.MaxCount > 0 && i >= retention.MaxCount {
+			prune[ts.UID] = true
+		}
+		if retention.MaxAge.Duration > 0 && ts.ExpirationTimestamp.Add(retention.MaxAge.Duration).Before(now) {
+			prune[ts.UID] = true
+		}
+	}
+
+	nTokens := len(instance.Status.Tokens)
+	instance.Status.Tokens = slices.DeleteFunc(instance.Status.Tokens, func(ts emcv1beta1.TokenStatus) bool {
+		return prune[ts.UID]
+	})
+
+	nHashes := len(instance.Status.LastTokenStoreHashes)
+	instance.Status.LastTokenStoreHashes = slices.DeleteFunc(instance.Status.LastTokenStoreHashes, func(h emcv1beta1.TokenStoreHash) bool {
+		return !slices.ContainsFunc(instance.Spec.TokenStores, func(store emcv1beta1.TokenStoreSpec) bool {
+			return store.Name == h.Name
+		})
+	})
+
+	return nTokens != len(instance.Status.Tokens) || nHashes != len(instance.Status.LastTokenStoreHashes)
+}
+
+// storeConfigHash returns the hash of the store configuration.
+// The content of secrets referenced by the store is part of the configuration.
+func (r *EmergencyAccountReconciler) storeConfigHash(ctx context.Context, instance *emcv1beta1.EmergencyAccount, store emcv1beta1.TokenStoreSpec) (string, error) {
+	hw := sha256.New()
+	if err := gob.NewEncoder(hw).Encode(store); err != nil {
+		return "", fmt.Errorf("unable to encode store configuration: %w", err)
+	}
+
+	st, err := stores.FromSpec(store)
+	if err != nil {
+		return "", fmt.Errorf("unable to create store %q: %w", store.Name, err)
+	}
+	if sr, ok := st.(stores.SecretReferencer); ok {
+		for _, name := range sr.ReferencedSecrets() {
+			var secret corev1.Secret
+			if err := r.Get(ctx, types.NamespacedName{Name: name, Namespace: instance.Namespace}, &secret); err != nil {
+				return "", fmt.Errorf("unable to get referenced secret %q: %w", name, err)
+			}
+			// gob encodes maps in random order
+			keys := maps.Keys(secret.Data)
+			slices.Sort(keys)
+			for _, k := range keys {
+				fmt.Fprintf(hw, "%s:%d:", k, len(secret.Data[k]))
+				hw.Write(secret.Data[k])
+			}
+		}
+	}
+
+	return fmt.Sprintf("%x", hw.Sum(nil)), nil
+}
+
 type tokenVerification struct {
-	tokenRef emcv1beta1.TokenStatus
-	errs     []error
+	tokenRef     emcv1beta1.TokenStatus
+	errs         []error
+	failedStores []string
 }
 
 func (tv *tokenVerification) AddError(err error) {
 	tv.errs = append(tv.errs, err)
 }
 
+// AddStoreError adds an error and marks the store as failed.
+func (tv *tokenVerification) AddStoreError(store string, err error) {
+	tv.AddError(err)
+	if !slices.Contains(tv.failedStores, store) {
+		tv.failedStores = append(tv.failedStores, store)
+	}
+}
+
 func (tv *tokenVerification) Verified() bool {
 	return len(tv.errs) == 0
 }
@@ -203,6 +544,14 @@ func (r *EmergencyAccountReconciler) verifyTokens(ctx context.Context, instance
 		tv := &tvs[i]
 		l := l.WithValues("token", ts.UID)
 
+		if ts.Phase == emcv1beta1.TokenPhaseIssuing {
+			tv.AddError(fmt.Errorf("token issuance not completed"))
+			continue
+		}
+		if ts.Revoked {
+			tv.AddError(fmt.Errorf("token revoked"))
+			continue
+		}
 		if ts.ExpirationTimestamp.Time.Before(r.Clock.Now()) {
 			tv.AddError(fmt.Errorf("token expired"))
 			continue
@@ -212,41 +561,73 @@ func (r *EmergencyAccountReconciler) verifyTokens(ctx context.Context, instance
 				return store.Name == ref.Store
 			})
 			if refI == -1 {
-				tv.AddError(fmt.Errorf("reference not found for %q", store.Name))
+				tv.AddStoreError(store.Name, fmt.Errorf("reference not found for %q", store.Name))
 				continue
 			}
 			ref := ts.Refs[refI]
+			switch ref.State {
+			case emcv1beta1.TokenStoreStatePending:
+				tv.AddStoreError(store.Name, fmt.Errorf("storing token in store %q pending: %s", store.Name, ref.Error))
+				continue
+			case emcv1beta1.TokenStoreStateFailed:
+				tv.AddStoreError(store.Name, fmt.Errorf("storing token in store %q failed: %s", store.Name, ref.Error))
+				continue
+			}
 
-			st, err := stores.FromSpec(store)
+			if supersededRef(instance, i, ref) {
+				l.Info("token was overwritten by a newer token in the store, not verifying", "store", store.Name, "ref", ref.Ref)
+				continue
+			}
+
+			st, err := r.storeFromSpec(store)
 			if err != nil {
-				tv.AddError(fmt.Errorf("unable to create store %q: %w", store.Name, err))
+				tv.AddStoreError(store.Name, fmt.Errorf("unable to create store %q: %w", store.Name, err))
 				continue
 			}
+			if tsy, ok := st.(stores.TokenSyncer); ok {
+				if err := tsy.SyncToken(ctx, *instance, ref.Ref); err != nil {
+					tv.AddStoreError(store.Name, fmt.Errorf("store %q unable to sync token: %w", store.Name, err))
+					continue
+				}
+			}
 			str, ok := st.(stores.TokenRetriever)
 			if !ok {
 				l.Info("store does not support token retrieval, not verifying token integrity", "store", store.Name)
 				continue
 			}
-			if ij, ok := st.(stores.ClientInjector); ok {
-				ij.InjectClient(r.Client)
+			payload, err := str.RetrieveToken(ctx, *instance, ref.Ref)
+			if errors.Is(err, stores.ErrTokenNotRetrievable) {
+				l.Info("store verified token integrity but can not retrieve token, not verifying token authentication", "store", store.Name, "reason", err.Error())
+				continue
+			}
+			if err != nil {
+				tv.AddStoreError(store.Name, fmt.Errorf("store %q unable to retrieve token: %w", store.Name, err))
+				continue
 			}
-			token, err := str.RetrieveToken(ctx, *instance, ref.Ref)
+			token, err := tokenFromPayload(store, payload)
 			if err != nil {
-				tv.AddError(fmt.Errorf("store %q unable to retrieve token: %w", store.Name, err))
+				tv.AddStoreError(store.Name, fmt.Errorf("unable to extract token from store %q: %w", store.Name, err))
+				continue
+			}
+			if credentialTypeOf(ts) == emcv1beta1.CredentialTypeClientCertificate {
+				if err := r.verifyCertificate(ctx, instance, ts, token); err != nil {
+					tv.AddStoreError(store.Name, fmt.Errorf("client certificate from store %q not valid: %w", store.Name, err))
+				}
 				continue
 			}
 			rv := authenticationv1.TokenReview{
 				Spec: authenticationv1.TokenReviewSpec{
-					Token: token,
+					Token:     token,
+					Audiences: ts.Audiences,
 				},
 			}
 			err = r.Client.Create(ctx, &rv)
 			if err != nil {
-				tv.AddError(fmt.Errorf("unable to create TokenReview: %w", err))
+				tv.AddStoreError(store.Name, fmt.Errorf("unable to create TokenReview for store %q: %w", store.Name, err))
 				continue
 			}
 			if !rv.Status.Authenticated {
-				tv.AddError(fmt.Errorf("token not authenticated: %s", rv.Status.Error))
+				tv.AddStoreError(store.Name, fmt.Errorf("token from store %q not authenticated: %s", store.Name, rv.Status.Error))
 			}
 		}
 	}
@@ -264,49 +645,148 @@ func (r *EmergencyAccountReconciler) verifyTokens(ctx context.Context, instance
 	return verifiedTokens, failedVerification
 }
 
+// supersededRef returns true if a newer token than the token at index i was stored at the same location in the store of the reference.
+// Stores with a stable object name overwrite the previous token on every rotation, the previous token can't be verified anymore.
+func supersededRef(instance *emcv1beta1.EmergencyAccount, i int, ref emcv1beta1.TokenStatusRef) bool {
+	for _, newer := range instance.Status.Tokens[i+1:] {
+		if slices.ContainsFunc(newer.Refs, func(nr emcv1beta1.TokenStatusRef) bool {
+			return nr.Store == ref.Store && nr.Ref != "" && nr.Ref != ref.Ref &&
+				stores.RefLocation(nr.Ref) == stores.RefLocation(ref.Ref)
+		}) {
+			return true
+		}
+	}
+	return false
+}
+
 func (r *EmergencyAccountReconciler) createAndStoreToken(ctx context.Context, instance *emcv1beta1.EmergencyAccount, sa *corev1.ServiceAccount) error {
 	l := log.FromContext(ctx).WithName("EmergencyAccountReconciler.createAndStoreToken")
 
+	ts, err := r.recordIssuanceIntent(ctx, instance, uuid.NewUUID())
+	if err != nil {
+		return err
+	}
+	uid := ts.UID
+
+	if credentialTypeOf(*ts) == emcv1beta1.CredentialTypeClientCertificate {
+		if err := r.requestCertificate(ctx, instance, ts); err != nil {
+			abandonIssuance(instance, uid)
+			r.deleteCertificateRequest(ctx, certificateRequestName(instance, uid))
+			return fmt.Errorf("unable to request client certificate: %w", err)
+		}
+		return nil
+	}
+
 	tr := authenticationv1.TokenRequest{
 		Spec: authenticationv1.TokenRequestSpec{
 			ExpirationSeconds: ptr.To(int64(instance.Spec.ValidityDuration.Seconds())),
+			Audiences:         ts.Audiences,
 		},
 	}
+	if ts.BoundSecretName != "" {
+		bs, err := r.createBoundSecret(ctx, instance, ts)
+		if err != nil {
+			abandonIssuance(instance, uid)
+			return err
+		}
+		tr.Spec.BoundObjectRef = &authenticationv1.BoundObjectReference{
+			Kind:       "Secret",
+			APIVersion: "v1",
+			Name:       bs.Name,
+			UID:        bs.UID,
+		}
+	}
 
-	err := r.Client.SubResource("token").Create(ctx, sa, &tr)
+	err = r.Client.SubResource("token").Create(ctx, sa, &tr)
 	if err != nil {
+		abandonIssuance(instance, uid)
 		return fmt.Errorf("unable to create TokenRequest: %w", err)
 	}
 
-	l.Info("token created", "expirationTimestamp", tr.Status.ExpirationTimestamp)
+	l.Info("token created", "token", uid, "expirationTimestamp", tr.Status.ExpirationTimestamp)
+	r.recordGrantedValidity(instance, tr.Status.ExpirationTimestamp.Time)
 
-	status := emcv1beta1.TokenStatus{
-		UID:                 uuid.NewUUID(),
-		ExpirationTimestamp: tr.Status.ExpirationTimestamp,
-		Refs:                make([]emcv1beta1.TokenStatusRef, 0, len(instance.Spec.TokenStores)),
+	// The token is saved before storing it to be able to resume storing it if interrupted
+	if err := r.savePendingToken(ctx, instance, uid, tr.Status.Token, tr.Status.ExpirationTimestamp.Time); err != nil {
+		abandonIssuance(instance, uid)
+		return fmt.Errorf("unable to save token: %w", err)
 	}
-	for _, s := range instance.Spec.TokenStores {
-		st, err := stores.FromSpec(s)
-		if err != nil {
-			return fmt.Errorf("unable to create store: %w", err)
-		}
-		if ij, ok := st.(stores.ClientInjector); ok {
-			ij.InjectClient(r.Client)
+
+	r.completeIssuance(ctx, instance, ts, pendingToken{token: tr.Status.Token}, tr.Status.ExpirationTimestamp.Time)
+
+	return nil
+}
+
+// storeToken stores the token in the store and records the outcome in the given reference.
+// The envelope saved for the store is stored if the token was saved encrypted.
+func (r *EmergencyAccountReconciler) storeToken(ctx context.Context, instance *emcv1beta1.EmergencyAccount, spec emcv1beta1.TokenStoreSpec, ts *emcv1beta1.TokenStatus, pt pendingToken, ref *emcv1beta1.TokenStatusRef) {
+	l := log.FromContext(ctx).WithName("EmergencyAccountReconciler.storeToken")
+
+	ref.Attempts++
+	ref.LastAttemptTimestamp = metav1.NewTime(r.Clock.Now())
+
+	st, err := r.storeFromSpec(spec)
+	if err != nil {
+		ref.State = emcv1beta1.TokenStoreStatePending
+		ref.Error = fmt.Sprintf("unable to create store: %s", err)
+		l.Error(err, "unable to create store", "store", spec.Name)
+		return
+	}
+	r.injectTokenMetadata(st, ts.UID, ts.ExpirationTimestamp.Time)
+
+	if envelope, ok := pt.envelopes[spec.Name]; ok {
+		es, ok := st.(stores.EnvelopeStorer)
+		if !ok {
+			ref.State = emcv1beta1.TokenStoreStateFailed
+			ref.Error = "token was saved encrypted but store does not encrypt tokens"
+			return
 		}
-		ref, err := st.StoreToken(ctx, *instance, tr.Status.Token)
+		stored, err := es.StoreEnvelope(ctx, *instance, envelope)
 		if err != nil {
-			return fmt.Errorf("unable to store token: %w", err)
+			ref.State = emcv1beta1.TokenStoreStatePending
+			ref.Error = fmt.Sprintf("unable to store token: %s", err)
+			l.Error(err, "unable to store token", "store", spec.Name, "attempts", ref.Attempts)
+			return
 		}
-		status.Refs = append(status.Refs, emcv1beta1.TokenStatusRef{
-			Ref:   ref,
-			Store: s.Name,
-		})
+		ref.State = emcv1beta1.TokenStoreStateStored
+		ref.Error = ""
+		ref.Ref = stored
+		return
+	}
+	if pt.token == "" {
+		ref.State = emcv1beta1.TokenStoreStateFailed
+		ref.Error = "token was saved encrypted without an envelope for the store"
+		return
 	}
 
-	instance.Status.LastTokenCreationTimestamp = metav1.Time{Time: r.Clock.Now()}
-	instance.Status.Tokens = append(instance.Status.Tokens, status)
+	payload, err := r.renderPayload(ctx, instance, spec, pt.token)
+	if err != nil {
+		ref.State = emcv1beta1.TokenStoreStatePending
+		ref.Error = fmt.Sprintf("unable to render payload: %s", err)
+		l.Error(err, "unable to render payload", "store", spec.Name)
+		return
+	}
+	stored, err := st.StoreToken(ctx, *instance, payload)
+	if err != nil {
+		ref.State = emcv1beta1.TokenStoreStatePending
+		ref.Error = fmt.Sprintf("unable to store token: %s", err)
+		l.Error(err, "unable to store token", "store", spec.Name, "attempts", ref.Attempts)
+		return
+	}
+	ref.State = emcv1beta1.TokenStoreStateStored
+	ref.Error = ""
+	ref.Ref = stored
+}
 
-	return r.Client.Status().Update(ctx, instance)
+// injectTokenMetadata injects the metadata of the token into the store if it supports it.
+func (r *EmergencyAccountReconciler) injectTokenMetadata(st stores.TokenStorer, uid types.UID, expiration time.Time) {
+	if mi, ok := st.(stores.MetadataInjector); ok {
+		mi.InjectTokenMetadata(stores.TokenMetadata{
+			Cluster:             r.ClusterName,
+			UID:                 uid,
+			ExpirationTimestamp: expiration,
+		})
+	}
 }
 
 // SetupWithManager sets up the controller with the Manager.
@@ -314,5 +794,70 @@ func (r *EmergencyAccountReconciler) SetupWithManager(mgr ctrl.Manager) error {
 	return ctrl.NewControllerManagedBy(mgr).
 		For(&emcv1beta1.EmergencyAccount{}).
 		Owns(&corev1.ServiceAccount{}).
+		Owns(&corev1.Secret{}).
+		Watches(&corev1.Secret{}, handler.EnqueueRequestsFromMapFunc(r.mapReferencedSecret)).
+		Watches(&corev1.Secret{}, handler.EnqueueRequestsFromMapFunc(r.mapManagedObject)).
+		Watches(&corev1.Namespace{}, handler.EnqueueRequestsFromMapFunc(r.mapNamespace)).
+		Watches(&rbacv1.ClusterRole{}, handler.EnqueueRequestsFromMapFunc(r.mapManagedObject)).
+		Watches(&rbacv1.ClusterRoleBinding{}, handler.EnqueueRequestsFromMapFunc(r.mapManagedObject)).
+		Watches(&rbacv1.Role{}, handler.EnqueueRequestsFromMapFunc(r.mapManagedObject)).
+		Watches(&rbacv1.RoleBinding{}, handler.EnqueueRequestsFromMapFunc(r.mapManagedObject)).
+		Watches(&certificatesv1.CertificateSigningRequest{}, handler.EnqueueRequestsFromMapFunc(r.mapManagedObject)).
 		Complete(r)
 }
+
+// mapNamespace maps a namespace to the EmergencyAccounts whose secret stores select it for replication.
+// Updates are mapped with the old and the new labels, namespaces no longer selected are mapped as well.
+func (r *EmergencyAccountReconciler) mapNamespace(ctx context.Context, obj client.Object) []reconcile.Request {
+	l := log.FromContext(ctx).WithName("EmergencyAccountReconciler.mapNamespace")
+
+	if !r.SecretReplication {
+		return nil
+	}
+	var eas emcv1beta1.EmergencyAccountList
+	if err := r.List(ctx, &eas); err != nil {
+		l.Error(err, "unable to list EmergencyAccounts")
+		return nil
+	}
+
+	nsLabels := labels.Set(obj.GetLabels())
+	var reqs []reconcile.Request
+	for _, ea := range eas.Items {
+		if slices.ContainsFunc(ea.Spec.TokenStores, func(store emcv1beta1.TokenStoreSpec) bool {
+			if store.Type != "secret" || store.SecretSpec.Replication.NamespaceSelector == nil {
+				return false
+			}
+			sel, err := metav1.LabelSelectorAsSelector(store.SecretSpec.Replication.NamespaceSelector)
+			return err == nil && sel.Matches(nsLabels)
+		}) {
+			reqs = append(reqs, reconcile.Request{NamespacedName: client.ObjectKeyFromObject(&ea)})
+		}
+	}
+	return reqs
+}
+
+// mapReferencedSecret maps a secret to the EmergencyAccounts whose stores reference it.
+func (r *EmergencyAccountReconciler) mapReferencedSecret(ctx context.Context, obj client.Object) []reconcile.Request {
+	l := log.FromContext(ctx).WithName("EmergencyAccountReconciler.mapReferencedSecret")
+
+	var eas emcv1beta1.EmergencyAccountList
+	if err := r.List(ctx, &eas, client.InNamespace(obj.GetNamespace())); err != nil {
+		l.Error(err, "unable to list EmergencyAccounts")
+		return nil
+	}
+
+	var reqs []reconcile.Request
+	for _, ea := range eas.Items {
+		if slices.ContainsFunc(ea.Spec.TokenStores, func(store emcv1beta1.TokenStoreSpec) bool {
+			st, err := stores.FromSpec(store)
+			if err != nil {
+				return false
+			}
+			sr, ok := st.(stores.SecretReferencer)
+			return ok && slices.Contains(sr.ReferencedSecrets(), obj.GetName())
+		}) {
+			reqs = append(reqs, reconcile.Request{NamespacedName: client.ObjectKeyFromObject(&ea)})
+		}
+	}
+	return reqs
+}
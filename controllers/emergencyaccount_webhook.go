@@ -0,0 +1,204 @@
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strings"
+
+	"golang.org/x/exp/slices"
+	admissionv1 "k8s.io/api/admission/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+
+	emcv1beta1 "github.com/appuio/emergency-credentials-controller/api/v1beta1"
+	"github.com/appuio/emergency-credentials-controller/controllers/stores"
+)
+
+//+kubebuilder:webhook:path=/validate-cluster-appuio-io-v1beta1-emergencyaccount,mutating=false,failurePolicy=fail,sideEffects=None,groups=cluster.appuio.io,resources=emergencyaccounts,verbs=create;update,versions=v1beta1,name=vemergencyaccount.kb.io,admissionReviewVersions=v1
+//+kubebuilder:webhook:path=/mutate-cluster-appuio-io-v1beta1-emergencyaccount,mutating=true,failurePolicy=fail,sideEffects=None,groups=cluster.appuio.io,resources=emergencyaccounts,verbs=create;update,versions=v1beta1,name=memergencyaccount.kb.io,admissionReviewVersions=v1
+
+// EmergencyAccountValidator validates EmergencyAccount resources.
+// It rejects configurations that would only fail at reconcile time.
+type EmergencyAccountValidator struct {
+	// Namespace is the namespace the controller watches.
+	Namespace string
+	// SecretNamespaces are the additional namespaces the secret store can write to.
+	// Secrets are only cached in these namespaces and in the namespace of the controller.
+	SecretNamespaces []string
+	// SecretReplication is true if the secret store can copy secrets into other namespaces.
+	SecretReplication bool
+	// Client is used to review the access of the requesting user with SubjectAccessReviews and to read the referenced ClusterRoles.
+	Client client.Client
+}
+
+var _ admission.Validator[*emcv1beta1.EmergencyAccount] = &EmergencyAccountValidator{}
+
+// EmergencyAccountDefaulter mutates EmergencyAccount resources.
+// It records the user requesting a revocation in the RevokeRequestedByAnnotation.
+type EmergencyAccountDefaulter struct{}
+
+var _ admission.Defaulter[*emcv1beta1.EmergencyAccount] = &EmergencyAccountDefaulter{}
+
+// SetupWebhookWithManager sets up the validating and mutating webhooks with the Manager.
+func (v *EmergencyAccountValidator) SetupWebhookWithManager(mgr ctrl.Manager) error {
+	return ctrl.NewWebhookManagedBy(mgr, &emcv1beta1.EmergencyAccount{}).
+		WithValidator(v).
+		WithDefaulter(&EmergencyAccountDefaulter{}).
+		Complete()
+}
+
+// Default records the requesting user if the revoke annotation changed.
+func (d *EmergencyAccountDefaulter) Default(ctx context.Context, obj *emcv1beta1.EmergencyAccount) error {
+	req, err := admission.RequestFromContext(ctx)
+	if err != nil {
+		return fmt.Errorf("unable to get admission request: %w", err)
+	}
+	var old emcv1beta1.EmergencyAccount
+	if req.Operation == admissionv1.Update {
+		if err := json.Unmarshal(req.OldObject.Raw, &old); err != nil {
+			return fmt.Errorf("unable to unmarshal old EmergencyAccount: %w", err)
+		}
+	}
+	return stampRevocationRequester(obj, old.Annotations, req.UserInfo.Username)
+}
+
+// ValidateCreate validates the EmergencyAccount on creation.
+func (v *EmergencyAccountValidator) ValidateCreate(ctx context.Context, obj *emcv1beta1.EmergencyAccount) (admission.Warnings, error) {
+	return nil, v.validate(ctx, obj)
+}
+
+// ValidateUpdate validates the EmergencyAccount on update if the spec changed.
+// Objects being deleted and updates of the metadata or status are always allowed, the controller must be able to remove its finalizer from objects created before a validation rule existed.
+// The requesting user must be able to grant all permissions on every change of the spec, the spec controls where the credentials are stored.
+func (v *EmergencyAccountValidator) ValidateUpdate(ctx context.Context, oldObj, newObj *emcv1beta1.EmergencyAccount) (admission.Warnings, error) {
+	if newObj.DeletionTimestamp != nil || equality.Semantic.DeepEqual(oldObj.Spec, newObj.Spec) {
+		return nil, nil
+	}
+	return nil, v.validate(ctx, newObj)
+}
+
+// ValidateDelete allows all deletions.
+func (v *EmergencyAccountValidator) ValidateDelete(_ context.Context, _ *emcv1beta1.EmergencyAccount) (admission.Warnings, error) {
+	return nil, nil
+}
+
+// validate returns an invalid error listing all problems of the EmergencyAccount spec.
+// Permissions the requesting user can't grant are reported as forbidden.
+func (v *EmergencyAccountValidator) validate(ctx context.Context, instance *emcv1beta1.EmergencyAccount) error {
+	req, err := admission.RequestFromContext(ctx)
+	if err != nil {
+		return fmt.Errorf("unable to get admission request: %w", err)
+	}
+
+	specPath := field.NewPath("spec")
+	var errs field.ErrorList
+
+	if instance.Spec.MinValidityDurationLeft.Duration >= instance.Spec.ValidityDuration.Duration {
+		errs = append(errs, field.Invalid(specPath.Child("minValidityDurationLeft"), instance.Spec.MinValidityDurationLeft.Duration.String(),
+			"must be shorter than validityDuration, otherwise a new token is created on every check"))
+	}
+
+	if instance.Spec.CredentialType == emcv1beta1.CredentialTypeClientCertificate && instance.Spec.ClientCertificate.Username == "" {
+		errs = append(errs, field.Required(specPath.Child("clientCertificate", "username"), "a username is required for the ClientCertificate credential type"))
+	}
+	// The controller approves the certificates itself, reserved identities could bypass RBAC with a certificate that can't be revoked.
+	if cc := instance.Spec.ClientCertificate; instance.Spec.CredentialType == emcv1beta1.CredentialTypeClientCertificate && !cc.AllowSystemIdentity {
+		ccPath := specPath.Child("clientCertificate")
+		if strings.HasPrefix(cc.Username, systemIdentityPrefix) {
+			errs = append(errs, field.Forbidden(ccPath.Child("username"), "usernames with the system: prefix are reserved, set allowSystemIdentity to allow"))
+		}
+		for i, g := range cc.Groups {
+			if strings.HasPrefix(g, systemIdentityPrefix) {
+				errs = append(errs, field.Forbidden(ccPath.Child("groups").Index(i), "groups with the system: prefix are reserved, set allowSystemIdentity to allow"))
+			}
+		}
+	}
+
+	// Namespaced permissions are granted through a Role and RoleBinding named after the EmergencyAccount, a second entry would overwrite the first.
+	namespaces := map[string]bool{}
+	for i, np := range instance.Spec.Permissions.Namespaced {
+		if namespaces[np.Namespace] {
+			errs = append(errs, field.Duplicate(specPath.Child("permissions", "namespaced").Index(i).Child("namespace"), np.Namespace))
+		}
+		namespaces[np.Namespace] = true
+	}
+
+	names := map[string]bool{}
+	for i, store := range instance.Spec.TokenStores {
+		storePath := specPath.Child("tokenStores").Index(i)
+		if names[store.Name] {
+			errs = append(errs, field.Duplicate(storePath.Child("name"), store.Name))
+		}
+		names[store.Name] = true
+
+		if store.Output.Format == emcv1beta1.OutputFormatKubeconfig {
+			serversPath := storePath.Child("output", "kubeconfig", "servers")
+			if len(store.Output.Kubeconfig.Servers) == 0 {
+				errs = append(errs, field.Required(serversPath, "at least one server is required for the kubeconfig output format"))
+			}
+			for j, server := range store.Output.Kubeconfig.Servers {
+				if u, err := url.Parse(server); err != nil || u.Scheme != "https" || u.Host == "" {
+					errs = append(errs, field.Invalid(serversPath.Index(j), server, "must be an https URL"))
+				}
+			}
+		}
+
+		// The manager only caches secrets in the configured namespaces, the secret store can't read secrets in other namespaces.
+		if ns := store.SecretSpec.Namespace; store.Type == "secret" && ns != "" && ns != instance.Namespace && !v.isSecretNamespace(ns) {
+			errs = append(errs, field.NotSupported(storePath.Child("secretStore", "namespace"), ns, v.secretNamespaces(instance)))
+		}
+
+		if !v.SecretReplication && secretReplicationConfigured(store) {
+			errs = append(errs, field.Forbidden(storePath.Child("secretStore", "replication"), errSecretReplicationDisabled.Error()))
+		}
+
+		if store.Encryption.Encrypt && store.Type == "s3" && store.S3Spec.Encryption.Encrypt {
+			errs = append(errs, field.Forbidden(storePath.Child("s3Store", "encryption"), "can't be combined with the encryption of the token store"))
+			continue
+		}
+
+		st, err := stores.FromSpec(store)
+		if err != nil {
+			errs = append(errs, field.Invalid(storePath.Child("type"), store.Type, err.Error()))
+			continue
+		}
+		if sv, ok := st.(stores.SpecValidator); ok {
+			if err := sv.ValidateSpec(); err != nil {
+				errs = append(errs, field.Invalid(storePath, store.Name, err.Error()))
+			}
+		}
+	}
+
+	escalationErrs, err := v.checkEscalation(ctx, req.UserInfo, instance)
+	if err != nil {
+		return fmt.Errorf("unable to check the permissions of user %q: %w", req.UserInfo.Username, err)
+	}
+	errs = append(errs, escalationErrs...)
+
+	if len(errs) == 0 {
+		return nil
+	}
+	return apierrors.NewInvalid(emcv1beta1.GroupVersion.WithKind("EmergencyAccount").GroupKind(), instance.Name, errs)
+}
+
+// isSecretNamespace returns true if the secret store can write to the namespace.
+func (v *EmergencyAccountValidator) isSecretNamespace(ns string) bool {
+	return ns == v.Namespace || slices.Contains(v.SecretNamespaces, ns)
+}
+
+// secretNamespaces returns the namespaces the secret store of the EmergencyAccount can write to.
+func (v *EmergencyAccountValidator) secretNamespaces(instance *emcv1beta1.EmergencyAccount) []string {
+	namespaces := []string{instance.Namespace}
+	for _, ns := range append([]string{v.Namespace}, v.SecretNamespaces...) {
+		if ns != "" && !slices.Contains(namespaces, ns) {
+			namespaces = append(namespaces, ns)
+		}
+	}
+	return namespaces
+}
@@ -0,0 +1,458 @@
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/exp/slices"
+	admissionv1 "k8s.io/api/admission/v1"
+	authenticationv1 "k8s.io/api/authentication/v1"
+	authorizationv1 "k8s.io/api/authorization/v1"
+	rbacv1 "k8s.io/api/rbac/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+
+	emcv1beta1 "github.com/appuio/emergency-credentials-controller/api/v1beta1"
+)
+
+func Test_EmergencyAccountValidator(t *testing.T) {
+	valid := func() *emcv1beta1.EmergencyAccount {
+		return &emcv1beta1.EmergencyAccount{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      "test",
+				Namespace: "test",
+			},
+			Spec: emcv1beta1.EmergencyAccountSpec{
+				ValidityDuration:        metav1.Duration{Duration: 24 * time.Hour},
+				MinValidityDurationLeft: metav1.Duration{Duration: 12 * time.Hour},
+				TokenStores: []emcv1beta1.TokenStoreSpec{
+					{
+						Name: "testsecret",
+						Type: "secret",
+					},
+					{
+						Name: "tests3",
+						Type: "s3",
+						S3Spec: emcv1beta1.S3StoreSpec{
+							ObjectNameTemplate: "em-{{ .Name | sha256sum }}",
+						},
+					},
+				},
+			},
+		}
+	}
+
+	tcs := map[string]struct {
+		mutate   func(*emcv1beta1.EmergencyAccount)
+		errMsgs  []string
+		errCount int
+	}{
+		"valid": {
+			mutate: func(*emcv1beta1.EmergencyAccount) {},
+		},
+		"min validity left not shorter than validity": {
+			mutate: func(ea *emcv1beta1.EmergencyAccount) {
+				ea.Spec.MinValidityDurationLeft = ea.Spec.ValidityDuration
+			},
+			errMsgs: []string{"spec.minValidityDurationLeft", "must be shorter than validityDuration"},
+		},
+		"duplicate store names": {
+			mutate: func(ea *emcv1beta1.EmergencyAccount) {
+				ea.Spec.TokenStores[1].Name = "testsecret"
+			},
+			errMsgs: []string{"spec.tokenStores[1].name", "Duplicate value"},
+		},
+		"secret store in configured namespace": {
+			mutate: func(ea *emcv1beta1.EmergencyAccount) {
+				ea.Spec.TokenStores[0].SecretSpec.Namespace = "backup"
+			},
+		},
+		"secret store in controller namespace": {
+			mutate: func(ea *emcv1beta1.EmergencyAccount) {
+				ea.Spec.TokenStores[0].SecretSpec.Namespace = "emergency-credentials-controller"
+			},
+		},
+		"secret store in unknown namespace": {
+			mutate: func(ea *emcv1beta1.EmergencyAccount) {
+				ea.Spec.TokenStores[0].SecretSpec.Namespace = "other"
+			},
+			errMsgs: []string{"spec.tokenStores[0].secretStore.namespace", `Unsupported value: "other"`, `"test", "emergency-credentials-controller", "backup"`},
+		},
+		"secret replication": {
+			mutate: func(ea *emcv1beta1.EmergencyAccount) {
+				ea.Spec.TokenStores[0].SecretSpec.Replication.Namespaces = []string{"app"}
+			},
+		},
+		"unknown store type": {
+			mutate: func(ea *emcv1beta1.EmergencyAccount) {
+				ea.Spec.TokenStores[0].Type = "unknown"
+			},
+			errMsgs: []string{"spec.tokenStores[0].type", "unknown token store type"},
+		},
+		"invalid store configuration": {
+			mutate: func(ea *emcv1beta1.EmergencyAccount) {
+				ea.Spec.TokenStores[1].S3Spec.ObjectNameTemplate = "{{ .Name"
+				ea.Spec.TokenStores[1].S3Spec.Encryption.Encrypt = true
+			},
+			errMsgs: []string{"spec.tokenStores[1]", "unable to parse file name template"},
+		},
+		"invalid store encryption": {
+			mutate: func(ea *emcv1beta1.EmergencyAccount) {
+				ea.Spec.TokenStores[0].Encryption.Encrypt = true
+				ea.Spec.TokenStores[0].Encryption.Scheme = emcv1beta1.EncryptionSchemeAge
+			},
+			errMsgs: []string{"spec.tokenStores[0]", "no age recipients given"},
+		},
+		"store encryption combined with S3 encryption": {
+			mutate: func(ea *emcv1beta1.EmergencyAccount) {
+				ea.Spec.TokenStores[1].Encryption.Encrypt = true
+				ea.Spec.TokenStores[1].S3Spec.Encryption.Encrypt = true
+			},
+			errMsgs:  []string{"spec.tokenStores[1].s3Store.encryption", "can't be combined"},
+			errCount: 1,
+		},
+		"kubeconfig without servers": {
+			mutate: func(ea *emcv1beta1.EmergencyAccount) {
+				ea.Spec.TokenStores[0].Output.Format = emcv1beta1.OutputFormatKubeconfig
+			},
+			errMsgs: []string{"spec.tokenStores[0].output.kubeconfig.servers", "at least one server is required"},
+		},
+		"kubeconfig with invalid server": {
+			mutate: func(ea *emcv1beta1.EmergencyAccount) {
+				ea.Spec.TokenStores[0].Output.Format = emcv1beta1.OutputFormatKubeconfig
+				ea.Spec.TokenStores[0].Output.Kubeconfig.Servers = []string{"https://api.example.com:6443", "api.example.com"}
+			},
+			errMsgs:  []string{"spec.tokenStores[0].output.kubeconfig.servers[1]", "must be an https URL"},
+			errCount: 1,
+		},
+		"client certificate without username": {
+			mutate: func(ea *emcv1beta1.EmergencyAccount) {
+				ea.Spec.CredentialType = emcv1beta1.CredentialTypeClientCertificate
+			},
+			errMsgs: []string{"spec.clientCertificate.username", "a username is required"},
+		},
+		"client certificate with username": {
+			mutate: func(ea *emcv1beta1.EmergencyAccount) {
+				ea.Spec.CredentialType = emcv1beta1.CredentialTypeClientCertificate
+				ea.Spec.ClientCertificate.Username = "emergency-admin"
+			},
+		},
+		"client certificate with system identity": {
+			mutate: func(ea *emcv1beta1.EmergencyAccount) {
+				ea.Spec.CredentialType = emcv1beta1.CredentialTypeClientCertificate
+				ea.Spec.ClientCertificate.Username = "system:admin"
+				ea.Spec.ClientCertificate.Groups = []string{"emergency-admins", "system:masters"}
+			},
+			errMsgs:  []string{"spec.clientCertificate.username", "spec.clientCertificate.groups[1]", "reserved"},
+			errCount: 2,
+		},
+		"client certificate with allowed system identity": {
+			mutate: func(ea *emcv1beta1.EmergencyAccount) {
+				ea.Spec.CredentialType = emcv1beta1.CredentialTypeClientCertificate
+				ea.Spec.ClientCertificate.Username = "emergency-admin"
+				ea.Spec.ClientCertificate.Groups = []string{"system:masters"}
+				ea.Spec.ClientCertificate.AllowSystemIdentity = true
+			},
+		},
+		"duplicate namespaced permissions": {
+			mutate: func(ea *emcv1beta1.EmergencyAccount) {
+				ea.Spec.Permissions.Namespaced = []emcv1beta1.NamespacedPermissionsSpec{
+					{Namespace: "app", ClusterRoles: []string{"view"}},
+					{Namespace: "other", ClusterRoles: []string{"view"}},
+					{Namespace: "app", ClusterRoles: []string{"admin"}},
+				}
+			},
+			errMsgs:  []string{"spec.permissions.namespaced[2].namespace", "Duplicate value"},
+			errCount: 1,
+		},
+		"all errors are reported": {
+			mutate: func(ea *emcv1beta1.EmergencyAccount) {
+				ea.Spec.MinValidityDurationLeft = ea.Spec.ValidityDuration
+				ea.Spec.TokenStores[1].Name = "testsecret"
+				ea.Spec.TokenStores[1].S3Spec.Encryption.Encrypt = true
+			},
+			errMsgs:  []string{"spec.minValidityDurationLeft", "spec.tokenStores[1].name", "no PGP public keys given"},
+			errCount: 3,
+		},
+	}
+
+	c, _ := fakeClient(t, &mockClock{})
+	subject := &EmergencyAccountValidator{
+		Namespace:         "emergency-credentials-controller",
+		SecretNamespaces:  []string{"backup"},
+		SecretReplication: true,
+		Client:            c,
+	}
+	ctx := admission.NewContextWithRequest(context.Background(), admission.Request{AdmissionRequest: admissionv1.AdmissionRequest{
+		UserInfo: authenticationv1.UserInfo{Username: "jane"},
+	}})
+	for name, tc := range tcs {
+		t.Run(name, func(t *testing.T) {
+			ea := valid()
+			tc.mutate(ea)
+
+			_, createErr := subject.ValidateCreate(ctx, ea)
+			_, updateErr := subject.ValidateUpdate(ctx, valid(), ea)
+			for _, err := range []error{createErr, updateErr} {
+				if len(tc.errMsgs) == 0 {
+					require.NoError(t, err)
+					continue
+				}
+				require.True(t, apierrors.IsInvalid(err), "expected invalid error, got %v", err)
+				for _, msg := range tc.errMsgs {
+					require.ErrorContains(t, err, msg)
+				}
+				if tc.errCount > 0 {
+					var se *apierrors.StatusError
+					require.ErrorAs(t, err, &se)
+					require.Len(t, se.ErrStatus.Details.Causes, tc.errCount)
+				}
+			}
+		})
+	}
+
+	_, err := subject.ValidateDelete(ctx, valid())
+	require.NoError(t, err)
+
+	replicating := valid()
+	replicating.Spec.TokenStores[0].SecretSpec.Replication.Namespaces = []string{"app"}
+	_, err = (&EmergencyAccountValidator{Client: c}).ValidateCreate(ctx, replicating)
+	require.ErrorContains(t, err, "spec.tokenStores[0].secretStore.replication")
+	require.ErrorContains(t, err, "--enable-secret-replication")
+
+	invalid := valid()
+	invalid.Finalizers = []string{EmergencyAccountFinalizer}
+	invalid.Spec.TokenStores[0].Type = "unknown"
+	unchanged := invalid.DeepCopy()
+	unchanged.Annotations = map[string]string{"example.com/updated": "true"}
+	_, err = subject.ValidateUpdate(ctx, invalid, unchanged)
+	require.NoError(t, err, "should not validate updates leaving the spec unchanged")
+
+	deleting := invalid.DeepCopy()
+	deleting.DeletionTimestamp = &metav1.Time{Time: time.Date(2023, 10, 30, 17, 57, 0, 0, time.UTC)}
+	removed := deleting.DeepCopy()
+	removed.Finalizers = nil
+	_, err = subject.ValidateUpdate(ctx, deleting, removed)
+	require.NoError(t, err, "should allow removing the finalizer from an invalid object being deleted")
+	removed.Spec.TokenStores[0].Name = "changed"
+	_, err = subject.ValidateUpdate(ctx, deleting, removed)
+	require.NoError(t, err, "should not validate objects being deleted")
+
+	_, err = subject.ValidateCreate(context.Background(), valid())
+	require.ErrorContains(t, err, "unable to get admission request")
+}
+
+func Test_EmergencyAccountValidator_Escalation(t *testing.T) {
+	valid := func() *emcv1beta1.EmergencyAccount {
+		return &emcv1beta1.EmergencyAccount{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      "test",
+				Namespace: "test",
+			},
+			Spec: emcv1beta1.EmergencyAccountSpec{
+				ValidityDuration:        metav1.Duration{Duration: 24 * time.Hour},
+				MinValidityDurationLeft: metav1.Duration{Duration: 12 * time.Hour},
+				TokenStores: []emcv1beta1.TokenStoreSpec{
+					{Name: "log", Type: "log"},
+				},
+			},
+		}
+	}
+	viewPods := rbacv1.PolicyRule{APIGroups: []string{""}, Resources: []string{"pods", "pods/log"}, Verbs: []string{"get", "list"}}
+	view := &rbacv1.ClusterRole{
+		ObjectMeta: metav1.ObjectMeta{Name: "view"},
+		Rules:      []rbacv1.PolicyRule{viewPods},
+	}
+	denyVerb := func(verbs ...string) func(authorizationv1.SubjectAccessReviewSpec) bool {
+		return func(spec authorizationv1.SubjectAccessReviewSpec) bool {
+			if spec.NonResourceAttributes != nil {
+				return slices.Contains(verbs, spec.NonResourceAttributes.Verb)
+			}
+			return slices.Contains(verbs, spec.ResourceAttributes.Verb)
+		}
+	}
+
+	tcs := map[string]struct {
+		mutate  func(*emcv1beta1.EmergencyAccount)
+		denied  func(authorizationv1.SubjectAccessReviewSpec) bool
+		errMsgs []string
+	}{
+		"allowed to bind ClusterRole": {
+			mutate: func(ea *emcv1beta1.EmergencyAccount) {
+				ea.Spec.Permissions.ClusterRoles = []string{"cluster-admin"}
+			},
+			denied: func(spec authorizationv1.SubjectAccessReviewSpec) bool {
+				ra := spec.ResourceAttributes
+				return ra == nil || ra.Verb != "bind" || ra.Resource != "clusterroles" || ra.Name != "cluster-admin"
+			},
+		},
+		"holds all permissions of ClusterRole": {
+			mutate: func(ea *emcv1beta1.EmergencyAccount) {
+				ea.Spec.Permissions.ClusterRoles = []string{"view"}
+			},
+			denied: denyVerb("bind"),
+		},
+		"missing permission of ClusterRole": {
+			mutate: func(ea *emcv1beta1.EmergencyAccount) {
+				ea.Spec.Permissions.ClusterRoles = []string{"view"}
+			},
+			denied: func(spec authorizationv1.SubjectAccessReviewSpec) bool {
+				ra := spec.ResourceAttributes
+				return ra.Verb == "bind" || ra.Subresource == "log"
+			},
+			errMsgs: []string{"spec.permissions.clusterRoles[0]", `user "jane" is not allowed to bind ClusterRole "view"`, "missing get pods/log"},
+		},
+		"missing ClusterRole": {
+			mutate: func(ea *emcv1beta1.EmergencyAccount) {
+				ea.Spec.Permissions.ClusterRoles = []string{"missing"}
+			},
+			denied:  denyVerb("bind"),
+			errMsgs: []string{"spec.permissions.clusterRoles[0]", "does not exist"},
+		},
+		"ClusterRole bound in namespace": {
+			mutate: func(ea *emcv1beta1.EmergencyAccount) {
+				ea.Spec.Permissions.Namespaced = []emcv1beta1.NamespacedPermissionsSpec{
+					{Namespace: "prod", ClusterRoles: []string{"admin"}},
+					{Namespace: "kube-system", ClusterRoles: []string{"admin"}},
+				}
+			},
+			denied: func(spec authorizationv1.SubjectAccessReviewSpec) bool {
+				return spec.ResourceAttributes.Namespace != "prod"
+			},
+			errMsgs: []string{"spec.permissions.namespaced[1].clusterRoles[0]", `bind ClusterRole "admin", which does not exist`},
+		},
+		"holds all rules": {
+			mutate: func(ea *emcv1beta1.EmergencyAccount) {
+				ea.Spec.Permissions.Rules = []rbacv1.PolicyRule{viewPods, {NonResourceURLs: []string{"/healthz"}, Verbs: []string{"get"}}}
+			},
+			denied: denyVerb("escalate", "bind"),
+		},
+		"missing rule": {
+			mutate: func(ea *emcv1beta1.EmergencyAccount) {
+				ea.Spec.Permissions.Rules = []rbacv1.PolicyRule{viewPods, {NonResourceURLs: []string{"/metrics"}, Verbs: []string{"get"}}}
+			},
+			denied: func(spec authorizationv1.SubjectAccessReviewSpec) bool {
+				return spec.NonResourceAttributes != nil || spec.ResourceAttributes.Verb == "escalate"
+			},
+			errMsgs: []string{"spec.permissions.rules", "not allowed to escalate clusterroles", `missing get nonResourceURL "/metrics"`},
+		},
+		"allowed to escalate and bind": {
+			mutate: func(ea *emcv1beta1.EmergencyAccount) {
+				ea.Spec.Permissions.Rules = []rbacv1.PolicyRule{{APIGroups: []string{"*"}, Resources: []string{"*"}, Verbs: []string{"*"}}}
+			},
+			denied: func(spec authorizationv1.SubjectAccessReviewSpec) bool {
+				ra := spec.ResourceAttributes
+				return ra.Resource != "clusterroles" || ra.Name != "emergencyaccount:test:test"
+			},
+		},
+		"allowed to escalate but not to bind in namespace": {
+			mutate: func(ea *emcv1beta1.EmergencyAccount) {
+				ea.Spec.Permissions.Namespaced = []emcv1beta1.NamespacedPermissionsSpec{
+					{Namespace: "prod", Rules: []rbacv1.PolicyRule{{NonResourceURLs: []string{"/metrics"}, Verbs: []string{"get"}}, viewPods}},
+				}
+			},
+			denied: func(spec authorizationv1.SubjectAccessReviewSpec) bool {
+				require.Nil(t, spec.NonResourceAttributes, "should not check NonResourceURLs of namespaced rules")
+				return spec.ResourceAttributes.Verb == "bind" || spec.ResourceAttributes.Subresource == "log"
+			},
+			errMsgs: []string{"spec.permissions.namespaced[0].rules", "not allowed to bind roles", "missing get pods/log in namespace prod"},
+		},
+		"impersonation": {
+			mutate: func(ea *emcv1beta1.EmergencyAccount) {
+				ea.Spec.CredentialType = emcv1beta1.CredentialTypeClientCertificate
+				ea.Spec.ClientCertificate = emcv1beta1.ClientCertificateSpec{Username: "admin", Groups: []string{"ops", "admins"}}
+			},
+			denied: func(spec authorizationv1.SubjectAccessReviewSpec) bool {
+				ra := spec.ResourceAttributes
+				return ra.Verb == "impersonate" && ra.Name != "ops"
+			},
+			errMsgs: []string{"spec.clientCertificate.username", `not allowed to impersonate user "admin"`, "spec.clientCertificate.groups[1]", `not allowed to impersonate group "admins"`},
+		},
+	}
+
+	for name, tc := range tcs {
+		t.Run(name, func(t *testing.T) {
+			c, control := fakeClient(t, &mockClock{}, view)
+			var reviewed []authorizationv1.SubjectAccessReviewSpec
+			control.deniedAccess = func(spec authorizationv1.SubjectAccessReviewSpec) bool {
+				reviewed = append(reviewed, spec)
+				return tc.denied(spec)
+			}
+			subject := &EmergencyAccountValidator{Client: c}
+			ctx := admission.NewContextWithRequest(context.Background(), admission.Request{AdmissionRequest: admissionv1.AdmissionRequest{
+				UserInfo: authenticationv1.UserInfo{
+					Username: "jane",
+					UID:      "1234",
+					Groups:   []string{"devs"},
+					Extra:    map[string]authenticationv1.ExtraValue{"scopes": {"all"}},
+				},
+			}})
+
+			ea := valid()
+			tc.mutate(ea)
+			_, createErr := subject.ValidateCreate(ctx, ea)
+			_, updateErr := subject.ValidateUpdate(ctx, valid(), ea)
+			require.NotEmpty(t, reviewed)
+			for _, spec := range reviewed {
+				require.Equal(t, "jane", spec.User)
+				require.Equal(t, "1234", spec.UID)
+				require.Equal(t, []string{"devs"}, spec.Groups)
+				require.Equal(t, map[string]authorizationv1.ExtraValue{"scopes": {"all"}}, spec.Extra)
+			}
+			for _, err := range []error{createErr, updateErr} {
+				if len(tc.errMsgs) == 0 {
+					require.NoError(t, err)
+					continue
+				}
+				require.True(t, apierrors.IsInvalid(err), "expected invalid error, got %v", err)
+				for _, msg := range tc.errMsgs {
+					require.ErrorContains(t, err, msg)
+				}
+			}
+		})
+	}
+
+	t.Run("spec change of privileged EmergencyAccount", func(t *testing.T) {
+		c, control := fakeClient(t, &mockClock{}, view)
+		control.deniedAccess = denyVerb("bind", "list")
+		subject := &EmergencyAccountValidator{Client: c}
+		ctx := admission.NewContextWithRequest(context.Background(), admission.Request{AdmissionRequest: admissionv1.AdmissionRequest{
+			UserInfo: authenticationv1.UserInfo{Username: "jane"},
+		}})
+
+		old := valid()
+		old.Spec.Permissions.ClusterRoles = []string{"view"}
+		redirected := old.DeepCopy()
+		redirected.Spec.TokenStores[0].Name = "redirected"
+		_, err := subject.ValidateUpdate(ctx, old, redirected)
+		require.ErrorContains(t, err, "spec.permissions.clusterRoles[0]", "should not allow users without the permissions to change where the credentials are stored")
+
+		annotated := old.DeepCopy()
+		annotated.Annotations = map[string]string{"example.com/note": "true"}
+		_, err = subject.ValidateUpdate(ctx, old, annotated)
+		require.NoError(t, err, "should allow metadata changes")
+	})
+}
+
+func Test_EmergencyAccountDefaulter(t *testing.T) {
+	old := &emcv1beta1.EmergencyAccount{ObjectMeta: metav1.ObjectMeta{Name: "test", Namespace: "test"}}
+	oldRaw, err := json.Marshal(old)
+	require.NoError(t, err)
+	ctx := admission.NewContextWithRequest(context.Background(), admission.Request{AdmissionRequest: admissionv1.AdmissionRequest{
+		Operation: admissionv1.Update,
+		UserInfo:  authenticationv1.UserInfo{Username: "jane"},
+		OldObject: runtime.RawExtension{Raw: oldRaw},
+	}})
+
+	ea := old.DeepCopy()
+	ea.Annotations = map[string]string{RevokeAnnotation: "leak-1"}
+	require.NoError(t, (&EmergencyAccountDefaulter{}).Default(ctx, ea))
+	require.Equal(t, "jane", revocationRequester(ea))
+
+	require.Error(t, (&EmergencyAccountDefaulter{}).Default(context.Background(), ea), "should fail without an admission request")
+}
@@ -0,0 +1,205 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	authenticationv1 "k8s.io/api/authentication/v1"
+	authorizationv1 "k8s.io/api/authorization/v1"
+	rbacv1 "k8s.io/api/rbac/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	emcv1beta1 "github.com/appuio/emergency-credentials-controller/api/v1beta1"
+)
+
+// checkEscalation returns an error for every permission of the EmergencyAccount the requesting user could not grant themselves.
+// The controller is allowed to bind and escalate, without this check anyone allowed to edit an EmergencyAccount could issue credentials with more permissions than they hold.
+// The checks follow the RBAC privilege escalation prevention of Kubernetes:
+//   - ClusterRoles can be referenced if the user is allowed to bind them or holds all of their permissions.
+//   - Rules can be granted if the user holds all of them or is allowed to escalate and bind (Cluster)Roles.
+//   - Client certificates can be issued for users and groups the user is allowed to impersonate.
+func (v *EmergencyAccountValidator) checkEscalation(ctx context.Context, user authenticationv1.UserInfo, instance *emcv1beta1.EmergencyAccount) (field.ErrorList, error) {
+	ec := escalationChecker{client: v.Client, user: user}
+	permsPath := field.NewPath("spec", "permissions")
+	perms := instance.Spec.Permissions
+	roleName := permissionObjectName(instance, "")
+
+	var errs field.ErrorList
+	for i, cr := range perms.ClusterRoles {
+		fErr, err := ec.checkClusterRole(ctx, permsPath.Child("clusterRoles").Index(i), "", cr)
+		if err != nil {
+			return nil, err
+		}
+		errs = append(errs, fErr...)
+	}
+	if len(perms.Rules) > 0 {
+		fErr, err := ec.checkRules(ctx, permsPath.Child("rules"), "", roleName, perms.Rules)
+		if err != nil {
+			return nil, err
+		}
+		errs = append(errs, fErr...)
+	}
+	for i, np := range perms.Namespaced {
+		npPath := permsPath.Child("namespaced").Index(i)
+		for j, cr := range np.ClusterRoles {
+			fErr, err := ec.checkClusterRole(ctx, npPath.Child("clusterRoles").Index(j), np.Namespace, cr)
+			if err != nil {
+				return nil, err
+			}
+			errs = append(errs, fErr...)
+		}
+		if len(np.Rules) > 0 {
+			fErr, err := ec.checkRules(ctx, npPath.Child("rules"), np.Namespace, roleName, np.Rules)
+			if err != nil {
+				return nil, err
+			}
+			errs = append(errs, fErr...)
+		}
+	}
+
+	if instance.Spec.CredentialType == emcv1beta1.CredentialTypeClientCertificate {
+		ccPath := field.NewPath("spec", "clientCertificate")
+		cc := instance.Spec.ClientCertificate
+		type impersonation struct {
+			path *field.Path
+			kind string
+			name string
+		}
+		impersonations := []impersonation{{ccPath.Child("username"), "user", cc.Username}}
+		for i, g := range cc.Groups {
+			impersonations = append(impersonations, impersonation{ccPath.Child("groups").Index(i), "group", g})
+		}
+		for _, imp := range impersonations {
+			allowed, err := ec.allowed(ctx, authorizationv1.ResourceAttributes{Verb: "impersonate", Resource: imp.kind + "s", Name: imp.name})
+			if err != nil {
+				return nil, err
+			}
+			if !allowed {
+				errs = append(errs, field.Forbidden(imp.path, fmt.Sprintf("user %q is not allowed to impersonate %s %q", user.Username, imp.kind, imp.name)))
+			}
+		}
+	}
+
+	return errs, nil
+}
+
+// escalationChecker reviews the access of the requesting user.
+type escalationChecker struct {
+	client client.Client
+	user   authenticationv1.UserInfo
+}
+
+// checkClusterRole checks if the user can bind the ClusterRole in the namespace, or cluster-wide if the namespace is empty.
+func (ec escalationChecker) checkClusterRole(ctx context.Context, p *field.Path, namespace, name string) (field.ErrorList, error) {
+	bind, err := ec.allowed(ctx, authorizationv1.ResourceAttributes{Verb: "bind", Group: rbacv1.GroupName, Resource: "clusterroles", Name: name, Namespace: namespace})
+	if err != nil || bind {
+		return nil, err
+	}
+
+	var cr rbacv1.ClusterRole
+	if err := ec.client.Get(ctx, types.NamespacedName{Name: name}, &cr); err != nil {
+		if apierrors.IsNotFound(err) {
+			return field.ErrorList{field.Forbidden(p, fmt.Sprintf("user %q is not allowed to bind ClusterRole %q, which does not exist", ec.user.Username, name))}, nil
+		}
+		return nil, fmt.Errorf("unable to get ClusterRole %q: %w", name, err)
+	}
+	denied, err := ec.deniedRules(ctx, namespace, cr.Rules)
+	if err != nil || denied == "" {
+		return nil, err
+	}
+	return field.ErrorList{field.Forbidden(p, fmt.Sprintf("user %q is not allowed to bind ClusterRole %q and does not hold all of its permissions: missing %s", ec.user.Username, name, denied))}, nil
+}
+
+// checkRules checks if the user holds all rules or is allowed to escalate and bind the (Cluster)Role granting them.
+func (ec escalationChecker) checkRules(ctx context.Context, p *field.Path, namespace, roleName string, rules []rbacv1.PolicyRule) (field.ErrorList, error) {
+	denied, err := ec.deniedRules(ctx, namespace, rules)
+	if err != nil || denied == "" {
+		return nil, err
+	}
+
+	resource := "roles"
+	if namespace == "" {
+		resource = "clusterroles"
+	}
+	for _, verb := range []string{"escalate", "bind"} {
+		allowed, err := ec.allowed(ctx, authorizationv1.ResourceAttributes{Verb: verb, Group: rbacv1.GroupName, Resource: resource, Name: roleName, Namespace: namespace})
+		if err != nil {
+			return nil, err
+		}
+		if !allowed {
+			return field.ErrorList{field.Forbidden(p, fmt.Sprintf("user %q does not hold all rules and is not allowed to %s %s: missing %s", ec.user.Username, verb, resource, denied))}, nil
+		}
+	}
+	return nil, nil
+}
+
+// deniedRules returns a description of the first access granted by the rules the user doesn't hold, or an empty string if the user holds all rules.
+// The rules are checked cluster-wide if the namespace is empty, NonResourceURLs are only granted cluster-wide.
+func (ec escalationChecker) deniedRules(ctx context.Context, namespace string, rules []rbacv1.PolicyRule) (string, error) {
+	for _, rule := range rules {
+		for _, verb := range rule.Verbs {
+			for _, url := range rule.NonResourceURLs {
+				if namespace != "" {
+					break
+				}
+				spec := ec.spec()
+				spec.NonResourceAttributes = &authorizationv1.NonResourceAttributes{Verb: verb, Path: url}
+				allowed, err := ec.review(ctx, spec)
+				if err != nil || !allowed {
+					return describeAccess(spec), err
+				}
+			}
+			names := rule.ResourceNames
+			if len(names) == 0 {
+				names = []string{""}
+			}
+			for _, group := range rule.APIGroups {
+				for _, res := range rule.Resources {
+					resource, subresource, _ := strings.Cut(res, "/")
+					for _, name := range names {
+						ra := authorizationv1.ResourceAttributes{Verb: verb, Group: group, Resource: resource, Subresource: subresource, Name: name, Namespace: namespace}
+						allowed, err := ec.allowed(ctx, ra)
+						if err != nil || !allowed {
+							return describeAccess(authorizationv1.SubjectAccessReviewSpec{ResourceAttributes: &ra}), err
+						}
+					}
+				}
+			}
+		}
+	}
+	return "", nil
+}
+
+// allowed reviews the access to the resource.
+func (ec escalationChecker) allowed(ctx context.Context, ra authorizationv1.ResourceAttributes) (bool, error) {
+	spec := ec.spec()
+	spec.ResourceAttributes = &ra
+	return ec.review(ctx, spec)
+}
+
+// review creates a SubjectAccessReview for the spec.
+func (ec escalationChecker) review(ctx context.Context, spec authorizationv1.SubjectAccessReviewSpec) (bool, error) {
+	sar := authorizationv1.SubjectAccessReview{Spec: spec}
+	if err := ec.client.Create(ctx, &sar); err != nil {
+		return false, fmt.Errorf("unable to create SubjectAccessReview: %w", err)
+	}
+	return sar.Status.Allowed, nil
+}
+
+// spec returns a SubjectAccessReviewSpec for the requesting user.
+func (ec escalationChecker) spec() authorizationv1.SubjectAccessReviewSpec {
+	extra := make(map[string]authorizationv1.ExtraValue, len(ec.user.Extra))
+	for k, v := range ec.user.Extra {
+		extra[k] = authorizationv1.ExtraValue(v)
+	}
+	return authorizationv1.SubjectAccessReviewSpec{
+		User:   ec.user.Username,
+		Groups: ec.user.Groups,
+		UID:    ec.user.UID,
+		Extra:  extra,
+	}
+}
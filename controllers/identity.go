@@ -0,0 +1,49 @@
+package controllers
+
+import (
+	"fmt"
+
+	rbacv1 "k8s.io/api/rbac/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	emcv1beta1 "github.com/appuio/emergency-credentials-controller/api/v1beta1"
+)
+
+// identity is the user the issued credentials authenticate as.
+type identity struct {
+	// User is the name of the authenticated user.
+	User string
+	// UID is the UID of the authenticated user, if any.
+	UID string
+	// Groups are the groups of the authenticated user.
+	Groups []string
+	// Subject is the RBAC subject permissions are bound to.
+	Subject rbacv1.Subject
+}
+
+// serviceAccountIdentity returns the identity of an authenticated ServiceAccount token.
+func serviceAccountIdentity(sa client.Object) identity {
+	return identity{
+		User:   fmt.Sprintf("system:serviceaccount:%s:%s", sa.GetNamespace(), sa.GetName()),
+		UID:    string(sa.GetUID()),
+		Groups: []string{"system:serviceaccounts", "system:serviceaccounts:" + sa.GetNamespace(), "system:authenticated"},
+		Subject: rbacv1.Subject{
+			Kind:      rbacv1.ServiceAccountKind,
+			Name:      sa.GetName(),
+			Namespace: sa.GetNamespace(),
+		},
+	}
+}
+
+// clientCertificateIdentity returns the identity of an authenticated client certificate.
+func clientCertificateIdentity(spec emcv1beta1.ClientCertificateSpec) identity {
+	return identity{
+		User:   spec.Username,
+		Groups: append(append([]string{}, spec.Groups...), "system:authenticated"),
+		Subject: rbacv1.Subject{
+			Kind:     rbacv1.UserKind,
+			APIGroup: rbacv1.GroupName,
+			Name:     spec.Username,
+		},
+	}
+}
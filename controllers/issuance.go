@@ -0,0 +1,162 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"golang.org/x/exp/slices"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+
+	emcv1beta1 "github.com/appuio/emergency-credentials-controller/api/v1beta1"
+)
+
+// Tokens are issued in two phases to never lose track of a token stored in a store:
+//
+//  1. The intent to issue a token is persisted as a token in the `Issuing` phase.
+//  2. The token is requested and saved in a pending token secret.
+//     Client certificates are requested through a CertificateSigningRequest, the private key is saved until the certificate is signed.
+//  3. The token is stored in the stores and the token is marked as `Issued`.
+//
+// Issuance interrupted after the token was saved is resumed, otherwise the intent is removed.
+// Certificates not yet signed are waited for, failed or timed out certificate requests are removed.
+// Pending token secrets are deleted once the status no longer references them as pending.
+
+// reconcilePendingTokens resumes or cleans up interrupted token issuances and deletes pending token secrets no longer required.
+// It must be called with the persisted status of the EmergencyAccount, before any changes to the tokens in the status are made.
+// Returns true if an issuance was completed, the token is then stored with the current store configuration.
+func (r *EmergencyAccountReconciler) reconcilePendingTokens(ctx context.Context, instance *emcv1beta1.EmergencyAccount) (bool, error) {
+	l := log.FromContext(ctx).WithName("EmergencyAccountReconciler.reconcilePendingTokens")
+
+	secrets, err := r.listPendingTokens(ctx, instance)
+	if err != nil {
+		return false, err
+	}
+	pending := make(map[types.UID]corev1.Secret, len(secrets))
+	for _, s := range secrets {
+		uid := types.UID(s.Labels[PendingTokenUIDLabel])
+		i := slices.IndexFunc(instance.Status.Tokens, func(ts emcv1beta1.TokenStatus) bool {
+			return ts.UID == uid
+		})
+		if i >= 0 && (instance.Status.Tokens[i].Phase == emcv1beta1.TokenPhaseIssuing || hasPendingRefs(instance.Status.Tokens[i])) {
+			pending[uid] = s
+			continue
+		}
+		if err := r.Delete(ctx, &s); err != nil && !apierrors.IsNotFound(err) {
+			return false, fmt.Errorf("unable to delete pending token secret %q: %w", s.Name, err)
+		}
+		l.Info("deleted pending token secret", "token", uid)
+	}
+
+	var interrupted []types.UID
+	resumed := false
+	for i := range instance.Status.Tokens {
+		ts := &instance.Status.Tokens[i]
+		if ts.Phase != emcv1beta1.TokenPhaseIssuing {
+			continue
+		}
+		s, ok := pending[ts.UID]
+		if !ok {
+			l.Info("token issuance interrupted before the token was saved, removing it", "token", ts.UID)
+			interrupted = append(interrupted, ts.UID)
+			continue
+		}
+		if !hasPendingTokenData(s) && s.Annotations[pendingCertificateRequestAnnotation] != "" {
+			done, err := r.continueCertificateIssuance(ctx, instance, ts, s)
+			if err != nil {
+				l.Error(err, "certificate issuance failed, removing it", "token", ts.UID)
+				r.deleteCertificateRequest(ctx, s.Annotations[pendingCertificateRequestAnnotation])
+				interrupted = append(interrupted, ts.UID)
+				continue
+			}
+			resumed = resumed || done
+			continue
+		}
+		pt, exp, err := pendingTokenFromSecret(s)
+		if err != nil {
+			return false, fmt.Errorf("unable to load pending token %q: %w", ts.UID, err)
+		}
+		l.Info("resuming interrupted token issuance", "token", ts.UID)
+		r.completeIssuance(ctx, instance, ts, pt, exp)
+		resumed = true
+	}
+	instance.Status.Tokens = slices.DeleteFunc(instance.Status.Tokens, func(ts emcv1beta1.TokenStatus) bool {
+		return slices.Contains(interrupted, ts.UID)
+	})
+
+	return resumed, nil
+}
+
+// recordIssuanceIntent persists a token in the `Issuing` phase before the token is requested.
+// Returns a pointer to the token in the status of the instance.
+func (r *EmergencyAccountReconciler) recordIssuanceIntent(ctx context.Context, instance *emcv1beta1.EmergencyAccount, uid types.UID) (*emcv1beta1.TokenStatus, error) {
+	lastCreation := instance.Status.LastTokenCreationTimestamp
+
+	instance.Status.LastTokenCreationTimestamp = metav1.Time{Time: r.Clock.Now()}
+	ts := emcv1beta1.TokenStatus{
+		UID:            uid,
+		Phase:          emcv1beta1.TokenPhaseIssuing,
+		CredentialType: instance.Spec.CredentialType,
+	}
+	if credentialTypeOf(ts) == emcv1beta1.CredentialTypeServiceAccountToken {
+		ts.Audiences = instance.Spec.ServiceAccountToken.Audiences
+		if instance.Spec.ServiceAccountToken.BindToSecret {
+			ts.BoundSecretName = boundSecretName(instance, uid)
+		}
+	}
+	instance.Status.Tokens = append(instance.Status.Tokens, ts)
+	if err := r.Client.Status().Update(ctx, instance); err != nil {
+		instance.Status.LastTokenCreationTimestamp = lastCreation
+		instance.Status.Tokens = instance.Status.Tokens[:len(instance.Status.Tokens)-1]
+		return nil, fmt.Errorf("unable to persist token issuance: %w", err)
+	}
+	return &instance.Status.Tokens[len(instance.Status.Tokens)-1], nil
+}
+
+// matchesCredentialSpec returns true if the token was issued with the current credential configuration.
+// Tokens issued with another configuration are kept until they expire but do not count towards the required validity.
+func matchesCredentialSpec(instance *emcv1beta1.EmergencyAccount, ts emcv1beta1.TokenStatus) bool {
+	if credentialTypeOf(ts) != specCredentialType(instance) {
+		return false
+	}
+	if credentialTypeOf(ts) == emcv1beta1.CredentialTypeServiceAccountToken {
+		return slices.Equal(ts.Audiences, instance.Spec.ServiceAccountToken.Audiences)
+	}
+	return true
+}
+
+// hasIssuingTokens returns true if the issuance of a token is not yet completed.
+func hasIssuingTokens(instance *emcv1beta1.EmergencyAccount) bool {
+	return slices.ContainsFunc(instance.Status.Tokens, func(ts emcv1beta1.TokenStatus) bool {
+		return ts.Phase == emcv1beta1.TokenPhaseIssuing
+	})
+}
+
+// abandonIssuance removes a token in the `Issuing` phase from the status.
+func abandonIssuance(instance *emcv1beta1.EmergencyAccount, uid types.UID) {
+	instance.Status.Tokens = slices.DeleteFunc(instance.Status.Tokens, func(ts emcv1beta1.TokenStatus) bool {
+		return ts.UID == uid && ts.Phase == emcv1beta1.TokenPhaseIssuing
+	})
+}
+
+// completeIssuance stores the token in all stores and marks the token as issued.
+func (r *EmergencyAccountReconciler) completeIssuance(ctx context.Context, instance *emcv1beta1.EmergencyAccount, ts *emcv1beta1.TokenStatus, pt pendingToken, expiration time.Time) {
+	l := log.FromContext(ctx).WithName("EmergencyAccountReconciler.completeIssuance")
+
+	ts.ExpirationTimestamp = metav1.Time{Time: expiration}
+	ts.Refs = make([]emcv1beta1.TokenStatusRef, 0, len(instance.Spec.TokenStores))
+	for _, s := range instance.Spec.TokenStores {
+		ref := emcv1beta1.TokenStatusRef{Store: s.Name}
+		r.storeToken(ctx, instance, s, ts, pt, &ref)
+		ts.Refs = append(ts.Refs, ref)
+	}
+	ts.Phase = emcv1beta1.TokenPhaseIssued
+
+	if hasPendingRefs(*ts) {
+		l.Info("storing token failed for some stores, retrying later", "token", ts.UID)
+	}
+}
@@ -0,0 +1,144 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/go-logr/logr/testr"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/exp/slices"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	emcv1beta1 "github.com/appuio/emergency-credentials-controller/api/v1beta1"
+)
+
+func Test_EmergencyAccountReconciler_Reconcile_InterruptedIssuance(t *testing.T) {
+	ctx := log.IntoContext(context.Background(), testr.New(t))
+	clock := &mockClock{now: time.Date(2022, 12, 4, 22, 45, 0, 0, time.UTC)}
+
+	ea := &emcv1beta1.EmergencyAccount{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:       "test",
+			Namespace:  "test",
+			Finalizers: []string{EmergencyAccountFinalizer},
+		},
+		Spec: emcv1beta1.EmergencyAccountSpec{
+			ValidityDuration:        metav1.Duration{Duration: 24 * time.Hour},
+			MinValidityDurationLeft: metav1.Duration{Duration: 12 * time.Hour},
+			MinRecreateInterval:     metav1.Duration{Duration: time.Second},
+			TokenStores: []emcv1beta1.TokenStoreSpec{
+				{
+					Name: "testsecret",
+					Type: "secret",
+				},
+				{
+					Name: "testlog",
+					Type: "log",
+				},
+			},
+		},
+	}
+
+	c, control := fakeClient(t, clock, ea)
+
+	subject := &EmergencyAccountReconciler{
+		Client: c,
+		Scheme: c.Scheme(),
+		Clock:  clock,
+	}
+	reconcileOnce := func() error {
+		t.Helper()
+		_, err := subject.Reconcile(ctx, reconcile.Request{NamespacedName: client.ObjectKeyFromObject(ea)})
+		require.NoError(t, c.Get(ctx, client.ObjectKeyFromObject(ea), ea))
+		return err
+	}
+	requirePendingTokens := func(n int) {
+		t.Helper()
+		secrets, err := subject.listPendingTokens(ctx, ea)
+		require.NoError(t, err)
+		require.Len(t, secrets, n)
+	}
+	conflict := apierrors.NewConflict(schema.GroupResource{Group: emcv1beta1.GroupVersion.Group, Resource: "emergencyaccounts"}, ea.Name, fmt.Errorf("test conflict"))
+
+	// Persisting the intent fails, no token is requested
+	control.statusUpdateErr = func(client.Object) error { return conflict }
+	require.Error(t, reconcileOnce())
+	require.Equal(t, 0, control.tokenRequests, "should not request a token without persisted intent")
+	require.Empty(t, ea.Status.Tokens)
+	control.statusUpdateErr = nil
+
+	// Requesting the token fails, the intent is removed
+	control.tokenRequestErr = fmt.Errorf("token request failed")
+	require.Error(t, reconcileOnce())
+	require.Equal(t, 1, control.tokenRequests)
+	require.Empty(t, ea.Status.Tokens, "intent should be removed")
+	requirePendingTokens(0)
+	control.tokenRequestErr = nil
+
+	// Saving the token fails, the intent is removed and the token is not stored
+	clock.Advance(time.Second)
+	control.createErr = func(obj client.Object) error {
+		if _, ok := obj.GetLabels()[PendingTokenUIDLabel]; ok {
+			return fmt.Errorf("save failed")
+		}
+		return nil
+	}
+	require.Error(t, reconcileOnce())
+	require.Equal(t, 2, control.tokenRequests)
+	require.Empty(t, ea.Status.Tokens, "intent should be removed")
+	var secrets corev1.SecretList
+	require.NoError(t, c.List(ctx, &secrets, client.InNamespace(ea.Namespace)))
+	require.Empty(t, secrets.Items, "token should not be stored")
+	control.createErr = nil
+
+	// Persisting the stored token fails, the issuance is resumed
+	clock.Advance(time.Second)
+	control.statusUpdateErr = func(obj client.Object) error {
+		ea := obj.(*emcv1beta1.EmergencyAccount)
+		if slices.ContainsFunc(ea.Status.Tokens, func(ts emcv1beta1.TokenStatus) bool { return ts.Phase == emcv1beta1.TokenPhaseIssued }) {
+			return conflict
+		}
+		return nil
+	}
+	require.Error(t, reconcileOnce())
+	require.Equal(t, 3, control.tokenRequests)
+	require.Len(t, ea.Status.Tokens, 1, "intent should be persisted")
+	uid := ea.Status.Tokens[0].UID
+	require.Equal(t, emcv1beta1.TokenPhaseIssuing, ea.Status.Tokens[0].Phase)
+	require.Empty(t, ea.Status.Tokens[0].Refs)
+	requirePendingTokens(1)
+	control.statusUpdateErr = nil
+
+	clock.Advance(time.Second)
+	require.NoError(t, reconcileOnce())
+	require.Equal(t, 3, control.tokenRequests, "should not request a new token")
+	require.Len(t, ea.Status.Tokens, 1)
+	ts := ea.Status.Tokens[0]
+	require.Equal(t, uid, ts.UID)
+	require.Equal(t, emcv1beta1.TokenPhaseIssued, ts.Phase)
+	require.Len(t, ts.Refs, 2)
+	require.Equal(t, emcv1beta1.TokenStoreStateStored, ts.Refs[0].State)
+	require.Equal(t, emcv1beta1.TokenStoreStateStored, ts.Refs[1].State)
+	require.WithinDuration(t, clock.Now().Add(24*time.Hour), ts.ExpirationTimestamp.Time, 2*time.Second)
+	requireCondition(t, ea, emcv1beta1.ConditionTokensVerified, metav1.ConditionTrue)
+	requirePendingTokens(1)
+
+	require.NoError(t, reconcileOnce())
+	requirePendingTokens(0)
+
+	// Issuance interrupted before the token was saved, the intent is removed
+	ea.Status.Tokens = append(ea.Status.Tokens, emcv1beta1.TokenStatus{UID: "interrupted", Phase: emcv1beta1.TokenPhaseIssuing})
+	require.NoError(t, c.Status().Update(ctx, ea))
+	require.NoError(t, reconcileOnce())
+	require.Len(t, ea.Status.Tokens, 1)
+	require.Equal(t, uid, ea.Status.Tokens[0].UID)
+	require.Equal(t, 3, control.tokenRequests, "should not request a new token")
+}
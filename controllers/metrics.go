@@ -16,12 +16,25 @@ var (
 		},
 		[]string{"emergency_account"},
 	)
+
+	failedAccessChecks = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: MetricsNamespace,
+			Name:      "failed_access_checks",
+			Help:      "The number of failed access checks for the service account of the emergency account.",
+		},
+		[]string{"emergency_account"},
+	)
 )
 
 func deleteVerifiedTokensValidUntil(emergencyAccount string) {
 	verifiedTokensValidUntil.Delete(prometheus.Labels{"emergency_account": emergencyAccount})
 }
 
+func deleteFailedAccessChecks(emergencyAccount string) {
+	failedAccessChecks.Delete(prometheus.Labels{"emergency_account": emergencyAccount})
+}
+
 func init() {
-	metrics.Registry.MustRegister(verifiedTokensValidUntil)
+	metrics.Registry.MustRegister(verifiedTokensValidUntil, failedAccessChecks)
 }
@@ -0,0 +1,75 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+
+	emcv1beta1 "github.com/appuio/emergency-credentials-controller/api/v1beta1"
+	"github.com/appuio/emergency-credentials-controller/pkg/utils"
+)
+
+//+kubebuilder:rbac:groups="",resources=configmaps,verbs=get;list;watch,namespace="system"
+
+const (
+	// RootCAConfigMapName is the name of the ConfigMap containing the CA bundle of the API server.
+	// It is published to every namespace by the kube-controller-manager.
+	RootCAConfigMapName = "kube-root-ca.crt"
+	// RootCAConfigMapKey is the key of the CA bundle in the root CA ConfigMap.
+	RootCAConfigMapKey = "ca.crt"
+)
+
+// renderPayload renders the payload written to the store in the configured output format.
+func (r *EmergencyAccountReconciler) renderPayload(ctx context.Context, instance *emcv1beta1.EmergencyAccount, spec emcv1beta1.TokenStoreSpec, token string) (string, error) {
+	switch spec.Output.Format {
+	case "", emcv1beta1.OutputFormatToken:
+		return token, nil
+	case emcv1beta1.OutputFormatKubeconfig:
+		return r.renderKubeconfig(ctx, instance, spec.Output.Kubeconfig, token)
+	}
+	return "", fmt.Errorf("unknown output format %q", spec.Output.Format)
+}
+
+// renderKubeconfig renders a kubeconfig with a cluster and context for every configured server using the token or client certificate as user credential.
+func (r *EmergencyAccountReconciler) renderKubeconfig(ctx context.Context, instance *emcv1beta1.EmergencyAccount, spec emcv1beta1.KubeconfigOutputSpec, token string) (string, error) {
+	if len(spec.Servers) == 0 {
+		return "", fmt.Errorf("no servers configured for kubeconfig")
+	}
+
+	ca, err := r.rootCABundle(ctx, instance)
+	if err != nil {
+		return "", err
+	}
+
+	kc, err := utils.NewKubeconfig(instance.Name, instance.Namespace, spec.Servers, []byte(ca), token)
+	if err != nil {
+		return "", err
+	}
+	return string(kc), nil
+}
+
+// rootCABundle returns the CA bundle of the cluster from the root CA ConfigMap in the namespace of the EmergencyAccount.
+func (r *EmergencyAccountReconciler) rootCABundle(ctx context.Context, instance *emcv1beta1.EmergencyAccount) (string, error) {
+	var cm corev1.ConfigMap
+	if err := r.Get(ctx, types.NamespacedName{Name: RootCAConfigMapName, Namespace: instance.Namespace}, &cm); err != nil {
+		return "", fmt.Errorf("unable to get CA bundle: %w", err)
+	}
+	ca, ok := cm.Data[RootCAConfigMapKey]
+	if !ok {
+		return "", fmt.Errorf("ConfigMap %q does not contain key %q", RootCAConfigMapName, RootCAConfigMapKey)
+	}
+	return ca, nil
+}
+
+// tokenFromPayload extracts the token from a payload retrieved from the store.
+func tokenFromPayload(spec emcv1beta1.TokenStoreSpec, payload string) (string, error) {
+	switch spec.Output.Format {
+	case "", emcv1beta1.OutputFormatToken:
+		return payload, nil
+	case emcv1beta1.OutputFormatKubeconfig:
+		return utils.CredentialFromKubeconfig([]byte(payload))
+	}
+	return "", fmt.Errorf("unknown output format %q", spec.Output.Format)
+}
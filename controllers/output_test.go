@@ -0,0 +1,99 @@
+package controllers
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/go-logr/logr/testr"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/clientcmd"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	emcv1beta1 "github.com/appuio/emergency-credentials-controller/api/v1beta1"
+)
+
+func Test_EmergencyAccountReconciler_Reconcile_KubeconfigOutput(t *testing.T) {
+	ctx := log.IntoContext(context.Background(), testr.New(t))
+	clock := &mockClock{now: time.Date(2022, 12, 4, 22, 45, 0, 0, time.UTC)}
+
+	ea := &emcv1beta1.EmergencyAccount{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:       "test",
+			Namespace:  "test",
+			Finalizers: []string{EmergencyAccountFinalizer},
+		},
+		Spec: emcv1beta1.EmergencyAccountSpec{
+			ValidityDuration:        metav1.Duration{Duration: 24 * time.Hour},
+			MinValidityDurationLeft: metav1.Duration{Duration: 12 * time.Hour},
+			MinRecreateInterval:     metav1.Duration{Duration: 5 * time.Minute},
+			TokenStores: []emcv1beta1.TokenStoreSpec{
+				{
+					Name: "testsecret",
+					Type: "secret",
+					Output: emcv1beta1.OutputSpec{
+						Format: emcv1beta1.OutputFormatKubeconfig,
+						Kubeconfig: emcv1beta1.KubeconfigOutputSpec{
+							Servers: []string{"https://api.example.com:6443", "https://api-int.example.com:6443"},
+						},
+					},
+				},
+			},
+		},
+	}
+	ca := &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      RootCAConfigMapName,
+			Namespace: "test",
+		},
+		Data: map[string]string{
+			RootCAConfigMapKey: "-----BEGIN CERTIFICATE-----\ntest\n-----END CERTIFICATE-----\n",
+		},
+	}
+
+	c, _ := fakeClient(t, clock, ea, ca)
+
+	subject := &EmergencyAccountReconciler{
+		Client: c,
+		Scheme: c.Scheme(),
+		Clock:  clock,
+	}
+	_, err := subject.Reconcile(ctx, reconcile.Request{NamespacedName: client.ObjectKeyFromObject(ea)})
+	require.NoError(t, err)
+	require.NoError(t, c.Get(ctx, client.ObjectKeyFromObject(ea), ea))
+
+	require.Len(t, ea.Status.Tokens, 1)
+	ref := ea.Status.Tokens[0].Refs[0]
+	require.Equal(t, emcv1beta1.TokenStoreStateStored, ref.State)
+	requireCondition(t, ea, emcv1beta1.ConditionTokensVerified, metav1.ConditionTrue)
+
+	var secret corev1.Secret
+	require.NoError(t, c.Get(ctx, types.NamespacedName{Name: ref.Ref, Namespace: ea.Namespace}, &secret))
+	kc, err := clientcmd.Load(secret.Data["token"])
+	require.NoError(t, err)
+	require.Equal(t, "test-0", kc.CurrentContext)
+	require.Len(t, kc.Clusters, 2)
+	require.Equal(t, "https://api.example.com:6443", kc.Clusters["test-0"].Server)
+	require.Equal(t, "https://api-int.example.com:6443", kc.Clusters["test-1"].Server)
+	require.Equal(t, ca.Data[RootCAConfigMapKey], string(kc.Clusters["test-1"].CertificateAuthorityData))
+	require.Equal(t, "test/test", kc.Contexts["test-1"].AuthInfo)
+	require.NotEmpty(t, kc.AuthInfos["test/test"].Token)
+
+	// Missing CA bundle fails storing the token
+	require.NoError(t, c.Delete(ctx, ca))
+	ea.Spec.TokenStores[0].Output.Kubeconfig.Servers = []string{"https://api.example.com:6443"}
+	require.NoError(t, c.Update(ctx, ea))
+	clock.Advance(10 * time.Minute)
+	_, err = subject.Reconcile(ctx, reconcile.Request{NamespacedName: client.ObjectKeyFromObject(ea)})
+	require.NoError(t, err)
+	require.NoError(t, c.Get(ctx, client.ObjectKeyFromObject(ea), ea))
+	require.Len(t, ea.Status.Tokens, 2)
+	ref = ea.Status.Tokens[1].Refs[0]
+	require.Equal(t, emcv1beta1.TokenStoreStatePending, ref.State)
+	require.Contains(t, ref.Error, "unable to get CA bundle")
+}
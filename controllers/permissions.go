@@ -0,0 +1,182 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+
+	rbacv1 "k8s.io/api/rbac/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	emcv1beta1 "github.com/appuio/emergency-credentials-controller/api/v1beta1"
+	"github.com/appuio/emergency-credentials-controller/controllers/stores"
+)
+
+// The controller needs to be able to bind and escalate to grant the configured permissions.
+// The validating webhook checks that the requesting user is allowed to grant them, see checkEscalation.
+//+kubebuilder:rbac:groups=rbac.authorization.k8s.io,resources=clusterroles;roles,verbs=get;list;watch;create;update;patch;delete;bind;escalate
+//+kubebuilder:rbac:groups=rbac.authorization.k8s.io,resources=clusterrolebindings;rolebindings,verbs=get;list;watch;create;update;patch;delete
+
+const (
+	// EmergencyAccountNameLabel is set on objects managed for an EmergencyAccount that can't be owned by it.
+	// It contains the name of the EmergencyAccount.
+	// The label is shared with the secrets the secret store replicates into other namespaces.
+	EmergencyAccountNameLabel = stores.EmergencyAccountNameLabel
+	// EmergencyAccountNamespaceLabel is set on objects managed for an EmergencyAccount that can't be owned by it.
+	// It contains the namespace of the EmergencyAccount.
+	EmergencyAccountNamespaceLabel = stores.EmergencyAccountNamespaceLabel
+)
+
+// managedLabels returns the labels identifying objects managed for the EmergencyAccount.
+func managedLabels(instance *emcv1beta1.EmergencyAccount) map[string]string {
+	return map[string]string{
+		EmergencyAccountNameLabel:      instance.Name,
+		EmergencyAccountNamespaceLabel: instance.Namespace,
+	}
+}
+
+// permissionObjectName returns the name of a (Cluster)Role or (Cluster)RoleBinding managed for the EmergencyAccount.
+func permissionObjectName(instance *emcv1beta1.EmergencyAccount, suffix string) string {
+	name := "emergencyaccount:" + instance.Namespace + ":" + instance.Name
+	if suffix != "" {
+		name += ":" + suffix
+	}
+	return name
+}
+
+// reconcilePermissions creates or updates the (Cluster)Roles and (Cluster)RoleBindings granting the configured permissions to the identity of the credentials.
+// Managed objects no longer configured are deleted.
+// The objects are labeled with the EmergencyAccount since cluster scoped or objects in other namespaces can't be owned by it.
+func (r *EmergencyAccountReconciler) reconcilePermissions(ctx context.Context, instance *emcv1beta1.EmergencyAccount, id identity) error {
+	l := log.FromContext(ctx).WithName("EmergencyAccountReconciler.reconcilePermissions")
+
+	subjects := []rbacv1.Subject{id.Subject}
+
+	type desiredObject struct {
+		obj    client.Object
+		mutate func()
+	}
+	desired := []desiredObject{}
+	binding := func(namespace, suffix, roleKind, roleName string) desiredObject {
+		om := metav1.ObjectMeta{Name: permissionObjectName(instance, suffix), Namespace: namespace}
+		ref := rbacv1.RoleRef{APIGroup: rbacv1.GroupName, Kind: roleKind, Name: roleName}
+		if namespace == "" {
+			b := &rbacv1.ClusterRoleBinding{ObjectMeta: om}
+			return desiredObject{obj: b, mutate: func() {
+				b.RoleRef = ref
+				b.Subjects = subjects
+			}}
+		}
+		b := &rbacv1.RoleBinding{ObjectMeta: om}
+		return desiredObject{obj: b, mutate: func() {
+			b.RoleRef = ref
+			b.Subjects = subjects
+		}}
+	}
+
+	perms := instance.Spec.Permissions
+	for _, cr := range perms.ClusterRoles {
+		desired = append(desired, binding("", cr, "ClusterRole", cr))
+	}
+	if len(perms.Rules) > 0 {
+		cr := &rbacv1.ClusterRole{ObjectMeta: metav1.ObjectMeta{Name: permissionObjectName(instance, "")}}
+		desired = append(desired,
+			desiredObject{obj: cr, mutate: func() { cr.Rules = perms.Rules }},
+			binding("", "", "ClusterRole", cr.Name),
+		)
+	}
+	for _, np := range perms.Namespaced {
+		for _, cr := range np.ClusterRoles {
+			desired = append(desired, binding(np.Namespace, cr, "ClusterRole", cr))
+		}
+		if len(np.Rules) > 0 {
+			role := &rbacv1.Role{ObjectMeta: metav1.ObjectMeta{Name: permissionObjectName(instance, ""), Namespace: np.Namespace}}
+			rules := np.Rules
+			desired = append(desired,
+				desiredObject{obj: role, mutate: func() { role.Rules = rules }},
+				binding(np.Namespace, "", "Role", role.Name),
+			)
+		}
+	}
+
+	keep := make(map[string]bool, len(desired))
+	for _, d := range desired {
+		op, err := controllerutil.CreateOrUpdate(ctx, r.Client, d.obj, func() error {
+			lbls := d.obj.GetLabels()
+			if lbls == nil {
+				lbls = map[string]string{}
+			}
+			for k, v := range managedLabels(instance) {
+				lbls[k] = v
+			}
+			d.obj.SetLabels(lbls)
+			d.mutate()
+			return nil
+		})
+		if err != nil {
+			return fmt.Errorf("unable to create or update %T %q: %w (op: %s)", d.obj, client.ObjectKeyFromObject(d.obj), err, op)
+		}
+		if op != controllerutil.OperationResultNone {
+			l.Info("reconciled permission object", "kind", fmt.Sprintf("%T", d.obj), "object", client.ObjectKeyFromObject(d.obj), "op", op)
+		}
+		keep[permissionObjectKey(d.obj)] = true
+	}
+
+	return r.deleteManagedPermissions(ctx, instance, keep)
+}
+
+// deleteManagedPermissions deletes all (Cluster)Roles and (Cluster)RoleBindings managed for the EmergencyAccount not in keep.
+func (r *EmergencyAccountReconciler) deleteManagedPermissions(ctx context.Context, instance *emcv1beta1.EmergencyAccount, keep map[string]bool) error {
+	l := log.FromContext(ctx).WithName("EmergencyAccountReconciler.deleteManagedPermissions")
+
+	lists := []client.ObjectList{
+		&rbacv1.ClusterRoleBindingList{},
+		&rbacv1.ClusterRoleList{},
+		&rbacv1.RoleBindingList{},
+		&rbacv1.RoleList{},
+	}
+	for _, list := range lists {
+		if err := r.List(ctx, list, client.MatchingLabels(managedLabels(instance))); err != nil {
+			return fmt.Errorf("unable to list %T: %w", list, err)
+		}
+		err := meta.EachListItem(list, func(o runtime.Object) error {
+			obj, ok := o.(client.Object)
+			if !ok || keep[permissionObjectKey(obj)] {
+				return nil
+			}
+			if err := r.Delete(ctx, obj); err != nil && !apierrors.IsNotFound(err) {
+				return fmt.Errorf("unable to delete %T %q: %w", obj, client.ObjectKeyFromObject(obj), err)
+			}
+			l.Info("deleted permission object", "kind", fmt.Sprintf("%T", obj), "object", client.ObjectKeyFromObject(obj))
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func permissionObjectKey(obj client.Object) string {
+	return fmt.Sprintf("%T/%s", obj, client.ObjectKeyFromObject(obj))
+}
+
+// mapManagedObject maps an object managed for an EmergencyAccount to the EmergencyAccount using its labels.
+func (r *EmergencyAccountReconciler) mapManagedObject(_ context.Context, obj client.Object) []reconcile.Request {
+	name, ok := obj.GetLabels()[EmergencyAccountNameLabel]
+	if !ok {
+		return nil
+	}
+	namespace, ok := obj.GetLabels()[EmergencyAccountNamespaceLabel]
+	if !ok {
+		return nil
+	}
+	return []reconcile.Request{{NamespacedName: types.NamespacedName{Name: name, Namespace: namespace}}}
+}
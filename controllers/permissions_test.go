@@ -0,0 +1,127 @@
+package controllers
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/go-logr/logr/testr"
+	"github.com/stretchr/testify/require"
+	rbacv1 "k8s.io/api/rbac/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	emcv1beta1 "github.com/appuio/emergency-credentials-controller/api/v1beta1"
+)
+
+func Test_EmergencyAccountReconciler_Reconcile_Permissions(t *testing.T) {
+	ctx := log.IntoContext(context.Background(), testr.New(t))
+	clock := &mockClock{now: time.Date(2022, 12, 4, 22, 45, 0, 0, time.UTC)}
+
+	ea := &emcv1beta1.EmergencyAccount{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:       "test",
+			Namespace:  "test",
+			Finalizers: []string{EmergencyAccountFinalizer},
+		},
+		Spec: emcv1beta1.EmergencyAccountSpec{
+			ValidityDuration:        metav1.Duration{Duration: 24 * time.Hour},
+			MinValidityDurationLeft: metav1.Duration{Duration: 12 * time.Hour},
+			MinRecreateInterval:     metav1.Duration{Duration: 5 * time.Minute},
+			Permissions: emcv1beta1.PermissionsSpec{
+				ClusterRoles: []string{"cluster-admin"},
+				Rules: []rbacv1.PolicyRule{{
+					APIGroups: []string{""},
+					Resources: []string{"nodes"},
+					Verbs:     []string{"get"},
+				}},
+				Namespaced: []emcv1beta1.NamespacedPermissionsSpec{{
+					Namespace:    "other",
+					ClusterRoles: []string{"admin"},
+					Rules: []rbacv1.PolicyRule{{
+						APIGroups: []string{""},
+						Resources: []string{"pods"},
+						Verbs:     []string{"delete"},
+					}},
+				}},
+			},
+			TokenStores: []emcv1beta1.TokenStoreSpec{
+				{
+					Name: "testlog",
+					Type: "log",
+				},
+			},
+		},
+	}
+
+	c, _ := fakeClient(t, clock, ea)
+
+	subject := &EmergencyAccountReconciler{
+		Client: c,
+		Scheme: c.Scheme(),
+		Clock:  clock,
+	}
+	reconcileOnce := func() {
+		t.Helper()
+		_, err := subject.Reconcile(ctx, reconcile.Request{NamespacedName: client.ObjectKeyFromObject(ea)})
+		require.NoError(t, err)
+		require.NoError(t, c.Get(ctx, client.ObjectKeyFromObject(ea), ea))
+	}
+	expectedSubjects := []rbacv1.Subject{{Kind: "ServiceAccount", Name: "test", Namespace: "test"}}
+
+	reconcileOnce()
+
+	var crb rbacv1.ClusterRoleBinding
+	require.NoError(t, c.Get(ctx, types.NamespacedName{Name: "emergencyaccount:test:test:cluster-admin"}, &crb))
+	require.Equal(t, "cluster-admin", crb.RoleRef.Name)
+	require.Equal(t, expectedSubjects, crb.Subjects)
+	require.Equal(t, managedLabels(ea), crb.Labels)
+
+	var cr rbacv1.ClusterRole
+	require.NoError(t, c.Get(ctx, types.NamespacedName{Name: "emergencyaccount:test:test"}, &cr))
+	require.Equal(t, ea.Spec.Permissions.Rules, cr.Rules)
+	require.NoError(t, c.Get(ctx, types.NamespacedName{Name: "emergencyaccount:test:test"}, &crb))
+	require.Equal(t, rbacv1.RoleRef{APIGroup: rbacv1.GroupName, Kind: "ClusterRole", Name: cr.Name}, crb.RoleRef)
+
+	var rb rbacv1.RoleBinding
+	require.NoError(t, c.Get(ctx, types.NamespacedName{Name: "emergencyaccount:test:test:admin", Namespace: "other"}, &rb))
+	require.Equal(t, "admin", rb.RoleRef.Name)
+	var role rbacv1.Role
+	require.NoError(t, c.Get(ctx, types.NamespacedName{Name: "emergencyaccount:test:test", Namespace: "other"}, &role))
+	require.Equal(t, ea.Spec.Permissions.Namespaced[0].Rules, role.Rules)
+	require.NoError(t, c.Get(ctx, types.NamespacedName{Name: "emergencyaccount:test:test", Namespace: "other"}, &rb))
+	require.Equal(t, "Role", rb.RoleRef.Kind)
+
+	require.Equal(t, []reconcile.Request{{NamespacedName: client.ObjectKeyFromObject(ea)}}, subject.mapManagedObject(ctx, &rb))
+
+	// Drift is corrected
+	require.NoError(t, c.Get(ctx, types.NamespacedName{Name: "emergencyaccount:test:test:cluster-admin"}, &crb))
+	crb.Subjects = nil
+	require.NoError(t, c.Update(ctx, &crb))
+	reconcileOnce()
+	require.NoError(t, c.Get(ctx, types.NamespacedName{Name: "emergencyaccount:test:test:cluster-admin"}, &crb))
+	require.Equal(t, expectedSubjects, crb.Subjects)
+
+	// Removed permissions are cleaned up
+	ea.Spec.Permissions.Namespaced = nil
+	require.NoError(t, c.Update(ctx, ea))
+	reconcileOnce()
+	require.True(t, apierrors.IsNotFound(c.Get(ctx, types.NamespacedName{Name: "emergencyaccount:test:test:admin", Namespace: "other"}, &rb)))
+	require.True(t, apierrors.IsNotFound(c.Get(ctx, types.NamespacedName{Name: "emergencyaccount:test:test", Namespace: "other"}, &role)))
+	require.NoError(t, c.Get(ctx, types.NamespacedName{Name: "emergencyaccount:test:test:cluster-admin"}, &crb))
+
+	// Everything is cleaned up on deletion
+	require.NoError(t, c.Delete(ctx, ea))
+	_, err := subject.Reconcile(ctx, reconcile.Request{NamespacedName: client.ObjectKeyFromObject(ea)})
+	require.NoError(t, err)
+	var crbs rbacv1.ClusterRoleBindingList
+	require.NoError(t, c.List(ctx, &crbs))
+	require.Empty(t, crbs.Items)
+	var crs rbacv1.ClusterRoleList
+	require.NoError(t, c.List(ctx, &crs))
+	require.Empty(t, crs.Items)
+}
@@ -0,0 +1,139 @@
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+
+	emcv1beta1 "github.com/appuio/emergency-credentials-controller/api/v1beta1"
+)
+
+// RevokeAnnotation triggers the revocation of all tokens of the EmergencyAccount if set to a nonce not yet revoked.
+// The ServiceAccount is recreated with a new UID, invalidating all tokens issued for it.
+// The revoked tokens are deleted from the stores supporting deletion and a new token is issued right away.
+const RevokeAnnotation = "emergency-credentials-controller.appuio.ch/revoke"
+
+// RevokeRequestedByAnnotation records the user that set the revoke annotation to its current nonce.
+// It is set by the mutating webhook from the admission request, changes by users are discarded.
+const RevokeRequestedByAnnotation = "emergency-credentials-controller.appuio.ch/revoke-requested-by"
+
+// revokeRequest is the value of the RevokeRequestedByAnnotation.
+type revokeRequest struct {
+	// Nonce is the nonce of the revoke annotation the user set.
+	Nonce string `json:"nonce"`
+	// Username is the name of the user that set the nonce.
+	Username string `json:"username"`
+}
+
+// revocationRequested returns true if the revoke annotation is set to a nonce not yet revoked.
+func revocationRequested(instance *emcv1beta1.EmergencyAccount) bool {
+	nonce := instance.Annotations[RevokeAnnotation]
+	if nonce == "" {
+		return false
+	}
+	return instance.Status.LastRevocation == nil || instance.Status.LastRevocation.Nonce != nonce
+}
+
+// revokeTokens deletes the ServiceAccount and marks all tokens as revoked.
+// Storing of revoked tokens is not retried anymore, the revoked tokens are deleted from the stores by deleteExpiredTokens.
+// Client certificates can't be invalidated, they are only removed from the stores.
+func (r *EmergencyAccountReconciler) revokeTokens(ctx context.Context, instance *emcv1beta1.EmergencyAccount) error {
+	l := log.FromContext(ctx).WithName("EmergencyAccountReconciler.revokeTokens")
+
+	revocation := &emcv1beta1.RevocationStatus{
+		Nonce:     instance.Annotations[RevokeAnnotation],
+		Timestamp: metav1.NewTime(r.Clock.Now()),
+	}
+	revocation.TriggeredBy, revocation.TriggeredTimestamp = annotationManager(instance, RevokeAnnotation)
+	if username := revocationRequester(instance); username != "" {
+		revocation.TriggeredBy = username
+	}
+
+	var sa corev1.ServiceAccount
+	err := r.Get(ctx, client.ObjectKeyFromObject(instance), &sa)
+	if err != nil && !apierrors.IsNotFound(err) {
+		return fmt.Errorf("unable to get ServiceAccount: %w", err)
+	}
+	if err == nil {
+		revocation.ServiceAccountUID = sa.UID
+		if err := r.Delete(ctx, &sa, client.Preconditions{UID: &sa.UID}); err != nil && !apierrors.IsNotFound(err) {
+			return fmt.Errorf("unable to delete ServiceAccount: %w", err)
+		}
+	}
+
+	for i := range instance.Status.Tokens {
+		ts := &instance.Status.Tokens[i]
+		ts.Revoked = true
+		failPendingRefs(ts, "token revoked")
+	}
+	instance.Status.LastRevocation = revocation
+
+	l.Info("revoked all tokens", "nonce", revocation.Nonce, "triggeredBy", revocation.TriggeredBy, "ntokens", len(instance.Status.Tokens))
+	return nil
+}
+
+// annotationManager returns the field manager that last set the given annotation and when, as recorded in the managed fields.
+func annotationManager(obj metav1.Object, annotation string) (string, *metav1.Time) {
+	var manager string
+	var at *metav1.Time
+	for _, mf := range obj.GetManagedFields() {
+		if mf.FieldsV1 == nil {
+			continue
+		}
+		var fields map[string]map[string]map[string]any
+		if err := json.Unmarshal(mf.FieldsV1.Raw, &fields); err != nil {
+			continue
+		}
+		if _, ok := fields["f:metadata"]["f:annotations"]["f:"+annotation]; !ok {
+			continue
+		}
+		if at != nil && (mf.Time == nil || !mf.Time.After(at.Time)) {
+			continue
+		}
+		manager, at = mf.Manager, mf.Time
+	}
+	return manager, at
+}
+
+// revocationRequester returns the user that set the revoke annotation to its current nonce as recorded by the mutating webhook.
+// Returns an empty string if the webhook did not record the current nonce.
+func revocationRequester(instance *emcv1beta1.EmergencyAccount) string {
+	var rr revokeRequest
+	if err := json.Unmarshal([]byte(instance.Annotations[RevokeRequestedByAnnotation]), &rr); err != nil {
+		return ""
+	}
+	if rr.Nonce != instance.Annotations[RevokeAnnotation] {
+		return ""
+	}
+	return rr.Username
+}
+
+// stampRevocationRequester records the user in the RevokeRequestedByAnnotation if the revoke annotation changed.
+// Otherwise the annotation is reset to its old value so users can't forge it.
+func stampRevocationRequester(instance *emcv1beta1.EmergencyAccount, oldAnnotations map[string]string, username string) error {
+	nonce := instance.Annotations[RevokeAnnotation]
+	if nonce == oldAnnotations[RevokeAnnotation] {
+		if old, ok := oldAnnotations[RevokeRequestedByAnnotation]; ok {
+			metav1.SetMetaDataAnnotation(&instance.ObjectMeta, RevokeRequestedByAnnotation, old)
+		} else {
+			delete(instance.Annotations, RevokeRequestedByAnnotation)
+		}
+		return nil
+	}
+	if nonce == "" {
+		delete(instance.Annotations, RevokeRequestedByAnnotation)
+		return nil
+	}
+	raw, err := json.Marshal(revokeRequest{Nonce: nonce, Username: username})
+	if err != nil {
+		return fmt.Errorf("unable to marshal revoke request: %w", err)
+	}
+	metav1.SetMetaDataAnnotation(&instance.ObjectMeta, RevokeRequestedByAnnotation, string(raw))
+	return nil
+}
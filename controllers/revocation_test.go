@@ -0,0 +1,180 @@
+package controllers
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/go-logr/logr/testr"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	emcv1beta1 "github.com/appuio/emergency-credentials-controller/api/v1beta1"
+)
+
+func Test_EmergencyAccountReconciler_Reconcile_Revocation(t *testing.T) {
+	ctx := log.IntoContext(context.Background(), testr.New(t))
+	clock := &mockClock{now: time.Date(2022, 12, 4, 22, 45, 0, 0, time.UTC)}
+
+	ea := &emcv1beta1.EmergencyAccount{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:       "test",
+			Namespace:  "test",
+			Finalizers: []string{EmergencyAccountFinalizer},
+		},
+		Spec: emcv1beta1.EmergencyAccountSpec{
+			ValidityDuration:        metav1.Duration{Duration: 24 * time.Hour},
+			MinValidityDurationLeft: metav1.Duration{Duration: 12 * time.Hour},
+			MinRecreateInterval:     metav1.Duration{Duration: 5 * time.Minute},
+			TokenStores: []emcv1beta1.TokenStoreSpec{
+				{
+					Name: "testsecret",
+					Type: "secret",
+				},
+			},
+		},
+	}
+
+	c, control := fakeClient(t, clock, ea)
+
+	subject := &EmergencyAccountReconciler{
+		Client: c,
+		Scheme: c.Scheme(),
+		Clock:  clock,
+	}
+	reconcileOnce := func() {
+		t.Helper()
+		_, err := subject.Reconcile(ctx, reconcile.Request{NamespacedName: client.ObjectKeyFromObject(ea)})
+		require.NoError(t, err)
+		require.NoError(t, c.Get(ctx, client.ObjectKeyFromObject(ea), ea))
+	}
+
+	reconcileOnce()
+	require.Len(t, ea.Status.Tokens, 1)
+	require.Nil(t, ea.Status.LastRevocation)
+	var sa corev1.ServiceAccount
+	require.NoError(t, c.Get(ctx, client.ObjectKeyFromObject(ea), &sa))
+	sa.Labels = map[string]string{"marker": "original"}
+	require.NoError(t, c.Update(ctx, &sa))
+
+	// Revocation ignores the minimum recreate interval
+	clock.Advance(time.Minute)
+	ea.Annotations = map[string]string{
+		RevokeAnnotation:            "leak-1",
+		RevokeRequestedByAnnotation: `{"nonce":"leak-1","username":"jane"}`,
+	}
+	require.NoError(t, c.Update(ctx, ea))
+	reconcileOnce()
+
+	require.NotNil(t, ea.Status.LastRevocation)
+	require.Equal(t, "leak-1", ea.Status.LastRevocation.Nonce)
+	require.Equal(t, "jane", ea.Status.LastRevocation.TriggeredBy, "should record the user recorded by the webhook")
+	require.Equal(t, clock.Now(), ea.Status.LastRevocation.Timestamp.Time.UTC())
+	require.Len(t, ea.Status.Tokens, 2, "should issue a new token right away")
+	require.True(t, ea.Status.Tokens[0].Revoked)
+	require.True(t, ea.Status.Tokens[0].Refs[0].Deleted, "should delete the revoked token from the store")
+	require.False(t, ea.Status.Tokens[1].Revoked)
+	require.Equal(t, 2, control.tokenRequests)
+	cond := requireCondition(t, ea, emcv1beta1.ConditionTokensVerified, metav1.ConditionTrue)
+	require.Equal(t, "1 of 2 tokens verified", cond.Message)
+
+	require.NoError(t, c.Get(ctx, client.ObjectKeyFromObject(ea), &sa))
+	require.Empty(t, sa.Labels["marker"], "should recreate the ServiceAccount")
+
+	// The same nonce does not revoke again
+	clock.Advance(time.Minute)
+	reconcileOnce()
+	require.Len(t, ea.Status.Tokens, 2)
+	require.False(t, ea.Status.Tokens[1].Revoked)
+	require.Equal(t, 2, control.tokenRequests)
+}
+
+func Test_stampRevocationRequester(t *testing.T) {
+	stamp := func(nonce, username string) string {
+		return `{"nonce":"` + nonce + `","username":"` + username + `"}`
+	}
+	tcs := map[string]struct {
+		old, new map[string]string
+		expected string
+	}{
+		"no revocation": {
+			new: map[string]string{"other": "value"},
+		},
+		"new nonce on create": {
+			new:      map[string]string{RevokeAnnotation: "leak-1"},
+			expected: stamp("leak-1", "jane"),
+		},
+		"changed nonce": {
+			old:      map[string]string{RevokeAnnotation: "leak-1", RevokeRequestedByAnnotation: stamp("leak-1", "john")},
+			new:      map[string]string{RevokeAnnotation: "leak-2", RevokeRequestedByAnnotation: stamp("leak-2", "john")},
+			expected: stamp("leak-2", "jane"),
+		},
+		"forged requester": {
+			old:      map[string]string{RevokeAnnotation: "leak-1", RevokeRequestedByAnnotation: stamp("leak-1", "john")},
+			new:      map[string]string{RevokeAnnotation: "leak-1", RevokeRequestedByAnnotation: stamp("leak-1", "jane")},
+			expected: stamp("leak-1", "john"),
+		},
+		"removed requester": {
+			old:      map[string]string{RevokeAnnotation: "leak-1", RevokeRequestedByAnnotation: stamp("leak-1", "john")},
+			new:      map[string]string{RevokeAnnotation: "leak-1"},
+			expected: stamp("leak-1", "john"),
+		},
+		"forged requester without nonce": {
+			new: map[string]string{RevokeRequestedByAnnotation: stamp("", "john")},
+		},
+		"removed nonce": {
+			old: map[string]string{RevokeAnnotation: "leak-1", RevokeRequestedByAnnotation: stamp("leak-1", "john")},
+		},
+	}
+	for name, tc := range tcs {
+		t.Run(name, func(t *testing.T) {
+			ea := &emcv1beta1.EmergencyAccount{ObjectMeta: metav1.ObjectMeta{Annotations: tc.new}}
+			require.NoError(t, stampRevocationRequester(ea, tc.old, "jane"))
+			require.Equal(t, tc.expected, ea.Annotations[RevokeRequestedByAnnotation])
+			if tc.expected == "" {
+				require.NotContains(t, ea.Annotations, RevokeRequestedByAnnotation)
+			}
+		})
+	}
+}
+
+func Test_revocationRequester(t *testing.T) {
+	ea := &emcv1beta1.EmergencyAccount{ObjectMeta: metav1.ObjectMeta{Annotations: map[string]string{
+		RevokeAnnotation:            "leak-2",
+		RevokeRequestedByAnnotation: `{"nonce":"leak-1","username":"john"}`,
+	}}}
+	require.Empty(t, revocationRequester(ea), "should ignore the requester of another nonce")
+	ea.Annotations[RevokeAnnotation] = "leak-1"
+	require.Equal(t, "john", revocationRequester(ea))
+}
+
+func Test_annotationManager(t *testing.T) {
+	early := metav1.NewTime(time.Date(2022, 12, 4, 22, 45, 0, 0, time.UTC))
+	late := metav1.NewTime(early.Add(time.Hour))
+	obj := &metav1.ObjectMeta{
+		ManagedFields: []metav1.ManagedFieldsEntry{
+			{
+				Manager:  "manager",
+				Time:     &late,
+				FieldsV1: &metav1.FieldsV1{Raw: []byte(`{"f:metadata":{"f:finalizers":{".":{}}},"f:spec":{"f:tokenStores":{}}}`)},
+			},
+			{
+				Manager:  "kubectl-annotate",
+				Time:     &early,
+				FieldsV1: &metav1.FieldsV1{Raw: []byte(`{"f:metadata":{"f:annotations":{".":{},"f:` + RevokeAnnotation + `":{}}}}`)},
+			},
+		},
+	}
+
+	manager, at := annotationManager(obj, RevokeAnnotation)
+	require.Equal(t, "kubectl-annotate", manager)
+	require.Equal(t, &early, at)
+
+	manager, at = annotationManager(obj, "other")
+	require.Empty(t, manager)
+	require.Nil(t, at)
+}
@@ -0,0 +1,291 @@
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"golang.org/x/exp/slices"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+
+	emcv1beta1 "github.com/appuio/emergency-credentials-controller/api/v1beta1"
+	"github.com/appuio/emergency-credentials-controller/controllers/stores"
+)
+
+const (
+	// PendingTokenUIDLabel is set on secrets holding a token until it is issued and stored in all stores.
+	// It contains the UID of the token in the EmergencyAccount status.
+	PendingTokenUIDLabel = "emergency-credentials-controller.appuio.ch/pending-token-uid"
+
+	// pendingTokenSecretKey is the key of the token in the pending token secret.
+	pendingTokenSecretKey = "token"
+	// pendingTokenEnvelopesKey is the key of the encrypted payloads by store name in the pending token secret.
+	// The token is only saved encrypted if all stores encrypt it.
+	pendingTokenEnvelopesKey = "envelopes"
+	// pendingTokenValidUntilAnnotation holds the expiration timestamp of the token in the pending token secret.
+	pendingTokenValidUntilAnnotation = "emergency-credentials-controller.appuio.ch/valid-until"
+
+	storeRetryBaseBackoff = 10 * time.Second
+	storeRetryMaxBackoff  = time.Hour
+	// storeRetryMaxAttempts limits how long the token is kept in the pending token secret for stores failing to store it.
+	storeRetryMaxAttempts = 10
+	// plaintextStoreRetryMaxAttempts limits the attempts if not all stores encrypt the token and it is kept in plaintext.
+	// The token is stored once and retried once, the pending token secret is deleted right after.
+	plaintextStoreRetryMaxAttempts = 2
+)
+
+// pendingToken is a token saved until it is stored in all stores.
+type pendingToken struct {
+	// token is the token, empty if the token was saved encrypted.
+	token string
+	// envelopes are the payloads encrypted for the stores, by store name.
+	envelopes map[string]string
+}
+
+// pendingTokenSecretName returns the name of the secret holding a token until it is stored in all stores.
+func pendingTokenSecretName(instance *emcv1beta1.EmergencyAccount, uid types.UID) string {
+	return fmt.Sprintf("%s-pending-%s", instance.Name, uid)
+}
+
+// savePendingToken saves the token in a secret owned by the EmergencyAccount so issuing and storing it can be resumed.
+// If all stores encrypt the token, only the payloads encrypted for the stores are saved.
+func (r *EmergencyAccountReconciler) savePendingToken(ctx context.Context, instance *emcv1beta1.EmergencyAccount, uid types.UID, token string, expiration time.Time) error {
+	data, err := r.pendingTokenData(ctx, instance, uid, token, expiration)
+	if err != nil {
+		return err
+	}
+	s := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      pendingTokenSecretName(instance, uid),
+			Namespace: instance.Namespace,
+		},
+	}
+	op, err := controllerutil.CreateOrUpdate(ctx, r.Client, s, func() error {
+		s.Labels = managedLabels(instance)
+		s.Labels[PendingTokenUIDLabel] = string(uid)
+		s.Annotations = map[string]string{pendingTokenValidUntilAnnotation: expiration.Format(time.RFC3339)}
+		s.Data = data
+		return controllerutil.SetControllerReference(instance, s, r.Scheme)
+	})
+	if err != nil {
+		return fmt.Errorf("unable to create or update pending token secret: %w (op: %s)", err, op)
+	}
+	return nil
+}
+
+// pendingTokenData returns the data of the pending token secret.
+// The token is encrypted for every store if all stores encrypt it, the controller can't read it back in that case.
+func (r *EmergencyAccountReconciler) pendingTokenData(ctx context.Context, instance *emcv1beta1.EmergencyAccount, uid types.UID, token string, expiration time.Time) (map[string][]byte, error) {
+	if !encryptsAllStores(instance) {
+		return map[string][]byte{pendingTokenSecretKey: []byte(token)}, nil
+	}
+
+	envelopes := make(map[string]string, len(instance.Spec.TokenStores))
+	for _, spec := range instance.Spec.TokenStores {
+		st, err := r.storeFromSpec(spec)
+		if err != nil {
+			return nil, fmt.Errorf("unable to create store %q: %w", spec.Name, err)
+		}
+		es, ok := st.(stores.EnvelopeStorer)
+		if !ok {
+			return nil, fmt.Errorf("store %q does not encrypt tokens", spec.Name)
+		}
+		r.injectTokenMetadata(st, uid, expiration)
+		payload, err := r.renderPayload(ctx, instance, spec, token)
+		if err != nil {
+			return nil, fmt.Errorf("unable to render payload for store %q: %w", spec.Name, err)
+		}
+		envelopes[spec.Name], err = es.EncryptToken(*instance, payload)
+		if err != nil {
+			return nil, fmt.Errorf("unable to encrypt token for store %q: %w", spec.Name, err)
+		}
+	}
+	raw, err := json.Marshal(envelopes)
+	if err != nil {
+		return nil, fmt.Errorf("unable to marshal encrypted tokens: %w", err)
+	}
+	return map[string][]byte{pendingTokenEnvelopesKey: raw}, nil
+}
+
+// encryptsAllStores returns true if every store encrypts the token, the pending token is then kept encrypted.
+func encryptsAllStores(instance *emcv1beta1.EmergencyAccount) bool {
+	return len(instance.Spec.TokenStores) > 0 && !slices.ContainsFunc(instance.Spec.TokenStores, func(spec emcv1beta1.TokenStoreSpec) bool {
+		return !spec.Encryption.Encrypt
+	})
+}
+
+// listPendingTokens lists the pending token secrets of the EmergencyAccount.
+func (r *EmergencyAccountReconciler) listPendingTokens(ctx context.Context, instance *emcv1beta1.EmergencyAccount) ([]corev1.Secret, error) {
+	var secrets corev1.SecretList
+	if err := r.List(ctx, &secrets, client.InNamespace(instance.Namespace), client.MatchingLabels(managedLabels(instance)), client.HasLabels{PendingTokenUIDLabel}); err != nil {
+		return nil, fmt.Errorf("unable to list pending token secrets: %w", err)
+	}
+	return secrets.Items, nil
+}
+
+// loadPendingToken loads the token from the pending token secret.
+func (r *EmergencyAccountReconciler) loadPendingToken(ctx context.Context, instance *emcv1beta1.EmergencyAccount, uid types.UID) (pendingToken, error) {
+	var s corev1.Secret
+	if err := r.Get(ctx, types.NamespacedName{Name: pendingTokenSecretName(instance, uid), Namespace: instance.Namespace}, &s); err != nil {
+		return pendingToken{}, fmt.Errorf("unable to get pending token secret: %w", err)
+	}
+	pt, _, err := pendingTokenFromSecret(s)
+	return pt, err
+}
+
+// hasPendingTokenData returns true if the pending token secret contains the token, plain or encrypted.
+func hasPendingTokenData(s corev1.Secret) bool {
+	_, plain := s.Data[pendingTokenSecretKey]
+	_, encrypted := s.Data[pendingTokenEnvelopesKey]
+	return plain || encrypted
+}
+
+// pendingTokenFromSecret returns the token and its expiration timestamp from the pending token secret.
+func pendingTokenFromSecret(s corev1.Secret) (pendingToken, time.Time, error) {
+	var pt pendingToken
+	if raw, ok := s.Data[pendingTokenEnvelopesKey]; ok {
+		if err := json.Unmarshal(raw, &pt.envelopes); err != nil {
+			return pendingToken{}, time.Time{}, fmt.Errorf("unable to unmarshal encrypted tokens: %w", err)
+		}
+	} else if token, ok := s.Data[pendingTokenSecretKey]; ok {
+		pt.token = string(token)
+	} else {
+		return pendingToken{}, time.Time{}, fmt.Errorf("pending token secret does not contain token")
+	}
+	exp, err := time.Parse(time.RFC3339, s.Annotations[pendingTokenValidUntilAnnotation])
+	if err != nil {
+		return pendingToken{}, time.Time{}, fmt.Errorf("unable to parse expiration timestamp of pending token: %w", err)
+	}
+	return pt, exp, nil
+}
+
+// retryPendingStores retries storing the most recent token in the stores it is pending for once the backoff elapsed.
+// Pending stores of older or expired tokens are marked as failed, the token is not retried anymore.
+// The pending token secrets are cleaned up by reconcilePendingTokens once the status is persisted.
+func (r *EmergencyAccountReconciler) retryPendingStores(ctx context.Context, instance *emcv1beta1.EmergencyAccount) {
+	now := r.Clock.Now()
+
+	for i := range instance.Status.Tokens {
+		ts := &instance.Status.Tokens[i]
+		if !hasPendingRefs(*ts) {
+			continue
+		}
+
+		if ts.Revoked {
+			failPendingRefs(ts, "token revoked")
+		} else if i != len(instance.Status.Tokens)-1 {
+			failPendingRefs(ts, "superseded by a newer token")
+		} else if ts.ExpirationTimestamp.Time.Before(now) {
+			failPendingRefs(ts, "token expired")
+		} else {
+			r.retryPendingRefs(ctx, instance, ts)
+		}
+	}
+}
+
+// retryPendingRefs retries storing the token in the stores it is pending for once the backoff elapsed.
+// Stores still failing after storeRetryMaxAttempts are marked as failed, the pending token secret is then deleted.
+// A token kept in plaintext is only retried once, see plaintextStoreRetryMaxAttempts.
+func (r *EmergencyAccountReconciler) retryPendingRefs(ctx context.Context, instance *emcv1beta1.EmergencyAccount, ts *emcv1beta1.TokenStatus) {
+	l := log.FromContext(ctx).WithName("EmergencyAccountReconciler.retryPendingRefs").WithValues("token", ts.UID)
+
+	maxAttempts, reason := storeRetryMaxAttempts, ""
+	if !encryptsAllStores(instance) {
+		maxAttempts, reason = plaintextStoreRetryMaxAttempts, ", the token is not kept in plaintext for further retries"
+	}
+
+	var pt *pendingToken
+	for j := range ts.Refs {
+		ref := &ts.Refs[j]
+		if ref.State != emcv1beta1.TokenStoreStatePending {
+			continue
+		}
+		if ref.Attempts < maxAttempts {
+			if ref.LastAttemptTimestamp.Add(storeRetryBackoff(ref.Attempts)).After(r.Clock.Now()) {
+				continue
+			}
+			si := slices.IndexFunc(instance.Spec.TokenStores, func(store emcv1beta1.TokenStoreSpec) bool {
+				return store.Name == ref.Store
+			})
+			if si == -1 {
+				ref.State = emcv1beta1.TokenStoreStateFailed
+				ref.Error = "store removed from configuration"
+				continue
+			}
+			if pt == nil {
+				loaded, err := r.loadPendingToken(ctx, instance, ts.UID)
+				if err != nil {
+					l.Error(err, "unable to load pending token")
+					failPendingRefs(ts, fmt.Sprintf("unable to load pending token: %s", err))
+					return
+				}
+				pt = &loaded
+			}
+			l.Info("retrying to store token", "store", ref.Store, "attempts", ref.Attempts)
+			r.storeToken(ctx, instance, instance.Spec.TokenStores[si], ts, *pt, ref)
+		}
+		if ref.State == emcv1beta1.TokenStoreStatePending && ref.Attempts >= maxAttempts {
+			ref.State = emcv1beta1.TokenStoreStateFailed
+			ref.Error = fmt.Sprintf("giving up after %d attempts%s: %s", ref.Attempts, reason, ref.Error)
+		}
+	}
+}
+
+// nextStoreRetry returns the duration until the next retry of a pending store of the most recent token is due.
+// Returns false if no store is pending.
+func (r *EmergencyAccountReconciler) nextStoreRetry(instance *emcv1beta1.EmergencyAccount) (time.Duration, bool) {
+	if len(instance.Status.Tokens) == 0 {
+		return 0, false
+	}
+	ts := instance.Status.Tokens[len(instance.Status.Tokens)-1]
+
+	var next time.Duration
+	found := false
+	for _, ref := range ts.Refs {
+		if ref.State != emcv1beta1.TokenStoreStatePending {
+			continue
+		}
+		d := max(ref.LastAttemptTimestamp.Add(storeRetryBackoff(ref.Attempts)).Sub(r.Clock.Now()), time.Second)
+		if !found || d < next {
+			next = d
+		}
+		found = true
+	}
+	return next, found
+}
+
+// storeRetryBackoff returns the exponential backoff after the given number of attempts.
+func storeRetryBackoff(attempts int) time.Duration {
+	if attempts < 1 {
+		return 0
+	}
+	d := storeRetryBaseBackoff
+	for i := 1; i < attempts && d < storeRetryMaxBackoff; i++ {
+		d *= 2
+	}
+	return min(d, storeRetryMaxBackoff)
+}
+
+// hasPendingRefs returns true if storing the token is pending for any store.
+func hasPendingRefs(ts emcv1beta1.TokenStatus) bool {
+	return slices.ContainsFunc(ts.Refs, func(ref emcv1beta1.TokenStatusRef) bool {
+		return ref.State == emcv1beta1.TokenStoreStatePending
+	})
+}
+
+// failPendingRefs marks all pending stores of the token as failed.
+func failPendingRefs(ts *emcv1beta1.TokenStatus, reason string) {
+	for i := range ts.Refs {
+		if ts.Refs[i].State != emcv1beta1.TokenStoreStatePending {
+			continue
+		}
+		ts.Refs[i].State = emcv1beta1.TokenStoreStateFailed
+		ts.Refs[i].Error = fmt.Sprintf("%s: %s", reason, ts.Refs[i].Error)
+	}
+}
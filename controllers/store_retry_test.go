@@ -0,0 +1,354 @@
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"filippo.io/age"
+	"filippo.io/age/armor"
+	"github.com/go-logr/logr/testr"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	emcv1beta1 "github.com/appuio/emergency-credentials-controller/api/v1beta1"
+	"github.com/appuio/emergency-credentials-controller/controllers/stores"
+)
+
+func Test_EmergencyAccountReconciler_Reconcile_PartialStoreFailure(t *testing.T) {
+	ctx := log.IntoContext(context.Background(), testr.New(t))
+	clock := &mockClock{now: time.Date(2022, 12, 4, 22, 45, 0, 0, time.UTC)}
+
+	ea := &emcv1beta1.EmergencyAccount{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:       "test",
+			Namespace:  "test",
+			Finalizers: []string{EmergencyAccountFinalizer},
+		},
+		Spec: emcv1beta1.EmergencyAccountSpec{
+			ValidityDuration:        metav1.Duration{Duration: 24 * time.Hour},
+			MinValidityDurationLeft: metav1.Duration{Duration: 12 * time.Hour},
+			CheckInterval:           metav1.Duration{Duration: 5 * time.Minute},
+			MinRecreateInterval:     metav1.Duration{Duration: time.Second},
+			TokenStores: []emcv1beta1.TokenStoreSpec{
+				{
+					Name: "testlog",
+					Type: "log",
+				},
+				{
+					Name: "testsecret",
+					Type: "secret",
+				},
+			},
+		},
+	}
+
+	c, control := fakeClient(t, clock, ea)
+	// Fail the secret store, but not the pending token secret
+	control.createErr = func(obj client.Object) error {
+		if _, ok := obj.(*corev1.Secret); ok && !strings.Contains(obj.GetName(), "-pending-") {
+			return fmt.Errorf("store unavailable")
+		}
+		return nil
+	}
+
+	subject := &EmergencyAccountReconciler{
+		Client: c,
+		Scheme: c.Scheme(),
+		Clock:  clock,
+	}
+	reconcileOnce := func() reconcile.Result {
+		t.Helper()
+		res, err := subject.Reconcile(ctx, reconcile.Request{NamespacedName: client.ObjectKeyFromObject(ea)})
+		require.NoError(t, err)
+		require.NoError(t, c.Get(ctx, client.ObjectKeyFromObject(ea), ea))
+		return res
+	}
+
+	res := reconcileOnce()
+	require.Len(t, ea.Status.Tokens, 1, "token should be created")
+	ts := ea.Status.Tokens[0]
+	require.Equal(t, emcv1beta1.TokenStoreStateStored, ts.Refs[0].State)
+	require.Equal(t, emcv1beta1.TokenStoreStatePending, ts.Refs[1].State)
+	require.Contains(t, ts.Refs[1].Error, "store unavailable")
+	require.Equal(t, 1, ts.Refs[1].Attempts)
+	require.Len(t, ea.Status.LastTokenStoreHashes, 2, "configuration hashes should be persisted")
+	require.Equal(t, storeRetryBaseBackoff, res.RequeueAfter, "should requeue for the retry")
+	requireCondition(t, ea, emcv1beta1.ConditionStoresHealthy, metav1.ConditionFalse)
+	pendingKey := types.NamespacedName{Name: pendingTokenSecretName(ea, ts.UID), Namespace: ea.Namespace}
+	require.NoError(t, c.Get(ctx, pendingKey, &corev1.Secret{}), "token should be kept for retries")
+
+	// Backoff not elapsed, no retry and no new token
+	clock.Advance(5 * time.Second)
+	reconcileOnce()
+	require.Len(t, ea.Status.Tokens, 1, "should not create a new token while storing is retried")
+	require.Equal(t, 1, ea.Status.Tokens[0].Refs[1].Attempts)
+
+	// Retry succeeds
+	control.createErr = nil
+	clock.Advance(5 * time.Second)
+	reconcileOnce()
+	require.Len(t, ea.Status.Tokens, 1, "should store the same token")
+	ts = ea.Status.Tokens[0]
+	require.Equal(t, emcv1beta1.TokenStoreStateStored, ts.Refs[1].State)
+	require.Empty(t, ts.Refs[1].Error)
+	require.Equal(t, 2, ts.Refs[1].Attempts)
+	require.NotEmpty(t, ts.Refs[1].Ref)
+	requireCondition(t, ea, emcv1beta1.ConditionStoresHealthy, metav1.ConditionTrue)
+	requireCondition(t, ea, emcv1beta1.ConditionTokensVerified, metav1.ConditionTrue)
+	// The pending token is deleted once the status is persisted
+	reconcileOnce()
+	require.True(t, apierrors.IsNotFound(c.Get(ctx, pendingKey, &corev1.Secret{})), "pending token should be deleted")
+}
+
+func Test_EmergencyAccountReconciler_Reconcile_PartialStoreFailure_Encrypted(t *testing.T) {
+	ctx := log.IntoContext(context.Background(), testr.New(t))
+	clock := &mockClock{now: time.Date(2022, 12, 4, 22, 45, 0, 0, time.UTC)}
+	identity, err := age.GenerateX25519Identity()
+	require.NoError(t, err)
+
+	ea := &emcv1beta1.EmergencyAccount{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:       "test",
+			Namespace:  "test",
+			Finalizers: []string{EmergencyAccountFinalizer},
+		},
+		Spec: emcv1beta1.EmergencyAccountSpec{
+			ValidityDuration:        metav1.Duration{Duration: 24 * time.Hour},
+			MinValidityDurationLeft: metav1.Duration{Duration: 12 * time.Hour},
+			CheckInterval:           metav1.Duration{Duration: 5 * time.Minute},
+			MinRecreateInterval:     metav1.Duration{Duration: time.Second},
+			TokenStores: []emcv1beta1.TokenStoreSpec{
+				{
+					Name: "testsecret",
+					Type: "secret",
+					Encryption: emcv1beta1.EncryptionSpec{
+						Encrypt:       true,
+						Scheme:        emcv1beta1.EncryptionSchemeAge,
+						AgeRecipients: []string{identity.Recipient().String()},
+					},
+				},
+			},
+		},
+	}
+
+	c, control := fakeClient(t, clock, ea)
+	control.createErr = func(obj client.Object) error {
+		if _, ok := obj.(*corev1.Secret); ok && !strings.Contains(obj.GetName(), "-pending-") {
+			return fmt.Errorf("store unavailable")
+		}
+		return nil
+	}
+
+	subject := &EmergencyAccountReconciler{
+		Client: c,
+		Scheme: c.Scheme(),
+		Clock:  clock,
+	}
+	reconcileOnce := func() {
+		t.Helper()
+		_, err := subject.Reconcile(ctx, reconcile.Request{NamespacedName: client.ObjectKeyFromObject(ea)})
+		require.NoError(t, err)
+		require.NoError(t, c.Get(ctx, client.ObjectKeyFromObject(ea), ea))
+	}
+
+	reconcileOnce()
+	require.Len(t, ea.Status.Tokens, 1, "token should be created")
+	ts := ea.Status.Tokens[0]
+	require.Equal(t, emcv1beta1.TokenStoreStatePending, ts.Refs[0].State)
+
+	var pending corev1.Secret
+	pendingKey := types.NamespacedName{Name: pendingTokenSecretName(ea, ts.UID), Namespace: ea.Namespace}
+	require.NoError(t, c.Get(ctx, pendingKey, &pending))
+	require.NotContains(t, pending.Data, pendingTokenSecretKey, "token should not be saved in plain text if all stores encrypt it")
+	require.Contains(t, pending.Data, pendingTokenEnvelopesKey)
+	require.NotContains(t, string(pending.Data[pendingTokenEnvelopesKey]), "eyJhbGci", "should not contain the token")
+
+	// Encrypted tokens are retried beyond the limit of plaintext tokens
+	clock.Advance(storeRetryBaseBackoff)
+	reconcileOnce()
+	require.Equal(t, emcv1beta1.TokenStoreStatePending, ea.Status.Tokens[0].Refs[0].State)
+	require.Equal(t, plaintextStoreRetryMaxAttempts, ea.Status.Tokens[0].Refs[0].Attempts)
+	require.NoError(t, c.Get(ctx, pendingKey, &pending), "encrypted token should be kept for retries")
+
+	// Retry stores the saved envelope
+	control.createErr = nil
+	clock.Advance(2 * storeRetryBaseBackoff)
+	reconcileOnce()
+	ts = ea.Status.Tokens[0]
+	require.Equal(t, emcv1beta1.TokenStoreStateStored, ts.Refs[0].State)
+	require.Empty(t, ts.Refs[0].Error)
+
+	var stored corev1.Secret
+	require.NoError(t, c.Get(ctx, types.NamespacedName{Name: ts.Refs[0].Ref, Namespace: ea.Namespace}, &stored))
+	var et stores.EncryptedToken
+	require.NoError(t, json.Unmarshal(stored.Data["token"], &et))
+	require.Equal(t, string(ts.UID), et.Metadata.TokenUID)
+	require.Len(t, et.Secrets, 1)
+	r, err := age.Decrypt(armor.NewReader(strings.NewReader(et.Secrets[0].Data)), identity)
+	require.NoError(t, err)
+	decrypted, err := io.ReadAll(r)
+	require.NoError(t, err)
+	require.True(t, strings.HasPrefix(string(decrypted), "eyJhbGci"), "should store the encrypted token")
+}
+
+func Test_EmergencyAccountReconciler_retryPendingStores_MaxAttempts(t *testing.T) {
+	ctx := log.IntoContext(context.Background(), testr.New(t))
+	clock := &mockClock{now: time.Date(2022, 12, 4, 22, 45, 0, 0, time.UTC)}
+	encrypted := emcv1beta1.EncryptionSpec{Encrypt: true, Scheme: emcv1beta1.EncryptionSchemeAge}
+
+	tcs := map[string]struct {
+		encryption emcv1beta1.EncryptionSpec
+		attempts   int
+		failed     bool
+		errMsg     string
+	}{
+		"encrypted": {
+			encryption: encrypted,
+			attempts:   storeRetryMaxAttempts,
+			failed:     true,
+			errMsg:     "giving up after 10 attempts",
+		},
+		"encrypted below limit": {
+			encryption: encrypted,
+			attempts:   plaintextStoreRetryMaxAttempts,
+		},
+		"plaintext": {
+			attempts: plaintextStoreRetryMaxAttempts,
+			failed:   true,
+			errMsg:   "not kept in plaintext",
+		},
+	}
+
+	for name, tc := range tcs {
+		t.Run(name, func(t *testing.T) {
+			ea := &emcv1beta1.EmergencyAccount{
+				ObjectMeta: metav1.ObjectMeta{Name: "test", Namespace: "test"},
+				Spec: emcv1beta1.EmergencyAccountSpec{
+					TokenStores: []emcv1beta1.TokenStoreSpec{{Name: "testsecret", Type: "secret", Encryption: tc.encryption}},
+				},
+				Status: emcv1beta1.EmergencyAccountStatus{
+					Tokens: []emcv1beta1.TokenStatus{
+						{UID: "token", ExpirationTimestamp: metav1.NewTime(clock.Now().Add(time.Hour)), Refs: []emcv1beta1.TokenStatusRef{
+							{Store: "testsecret", State: emcv1beta1.TokenStoreStatePending, Error: "store unavailable", Attempts: tc.attempts, LastAttemptTimestamp: metav1.NewTime(clock.Now())},
+						}},
+					},
+				},
+			}
+			c, _ := fakeClient(t, clock, ea)
+			subject := &EmergencyAccountReconciler{Client: c, Scheme: c.Scheme(), Clock: clock}
+
+			subject.retryPendingStores(ctx, ea)
+			ref := ea.Status.Tokens[0].Refs[0]
+			require.Equal(t, tc.attempts, ref.Attempts, "should not retry")
+			if !tc.failed {
+				require.Equal(t, emcv1beta1.TokenStoreStatePending, ref.State, "should retry once the backoff elapsed")
+				return
+			}
+			require.Equal(t, emcv1beta1.TokenStoreStateFailed, ref.State)
+			require.Contains(t, ref.Error, tc.errMsg)
+			require.Contains(t, ref.Error, "store unavailable")
+			require.False(t, hasPendingRefs(ea.Status.Tokens[0]), "pending token secret should be deleted")
+		})
+	}
+}
+
+func Test_EmergencyAccountReconciler_Reconcile_PartialStoreFailure_Plaintext(t *testing.T) {
+	ctx := log.IntoContext(context.Background(), testr.New(t))
+	clock := &mockClock{now: time.Date(2022, 12, 4, 22, 45, 0, 0, time.UTC)}
+
+	ea := &emcv1beta1.EmergencyAccount{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:       "test",
+			Namespace:  "test",
+			Finalizers: []string{EmergencyAccountFinalizer},
+		},
+		Spec: emcv1beta1.EmergencyAccountSpec{
+			ValidityDuration:        metav1.Duration{Duration: 24 * time.Hour},
+			MinValidityDurationLeft: metav1.Duration{Duration: 12 * time.Hour},
+			CheckInterval:           metav1.Duration{Duration: 5 * time.Minute},
+			MinRecreateInterval:     metav1.Duration{Duration: time.Hour},
+			TokenStores:             []emcv1beta1.TokenStoreSpec{{Name: "testsecret", Type: "secret"}},
+		},
+	}
+
+	c, control := fakeClient(t, clock, ea)
+	control.createErr = func(obj client.Object) error {
+		if _, ok := obj.(*corev1.Secret); ok && !strings.Contains(obj.GetName(), "-pending-") {
+			return fmt.Errorf("store unavailable")
+		}
+		return nil
+	}
+
+	subject := &EmergencyAccountReconciler{
+		Client: c,
+		Scheme: c.Scheme(),
+		Clock:  clock,
+	}
+	reconcileOnce := func() {
+		t.Helper()
+		_, err := subject.Reconcile(ctx, reconcile.Request{NamespacedName: client.ObjectKeyFromObject(ea)})
+		require.NoError(t, err)
+		require.NoError(t, c.Get(ctx, client.ObjectKeyFromObject(ea), ea))
+	}
+
+	reconcileOnce()
+	require.Len(t, ea.Status.Tokens, 1, "token should be created")
+	pendingKey := types.NamespacedName{Name: pendingTokenSecretName(ea, ea.Status.Tokens[0].UID), Namespace: ea.Namespace}
+	require.NoError(t, c.Get(ctx, pendingKey, &corev1.Secret{}), "token should be kept for the first retry")
+
+	// The first retry fails, the plaintext token is not kept for further retries
+	clock.Advance(storeRetryBaseBackoff)
+	reconcileOnce()
+	ref := ea.Status.Tokens[0].Refs[0]
+	require.Equal(t, emcv1beta1.TokenStoreStateFailed, ref.State)
+	require.Contains(t, ref.Error, "not kept in plaintext")
+	reconcileOnce()
+	require.True(t, apierrors.IsNotFound(c.Get(ctx, pendingKey, &corev1.Secret{})), "pending token should be deleted after the first retry")
+}
+
+func Test_EmergencyAccountReconciler_retryPendingStores_Superseded(t *testing.T) {
+	ctx := log.IntoContext(context.Background(), testr.New(t))
+	clock := &mockClock{now: time.Date(2022, 12, 4, 22, 45, 0, 0, time.UTC)}
+
+	pending := emcv1beta1.TokenStatusRef{Store: "testsecret", State: emcv1beta1.TokenStoreStatePending, Error: "store unavailable", Attempts: 1}
+	ea := &emcv1beta1.EmergencyAccount{
+		ObjectMeta: metav1.ObjectMeta{Name: "test", Namespace: "test"},
+		Spec: emcv1beta1.EmergencyAccountSpec{
+			TokenStores: []emcv1beta1.TokenStoreSpec{{Name: "testsecret", Type: "secret"}},
+		},
+		Status: emcv1beta1.EmergencyAccountStatus{
+			Tokens: []emcv1beta1.TokenStatus{
+				{UID: "old", ExpirationTimestamp: metav1.NewTime(clock.Now().Add(time.Hour)), Refs: []emcv1beta1.TokenStatusRef{pending}},
+				{UID: "expired", ExpirationTimestamp: metav1.NewTime(clock.Now().Add(-time.Hour)), Refs: []emcv1beta1.TokenStatusRef{pending}},
+			},
+		},
+	}
+	c, _ := fakeClient(t, clock, ea)
+	subject := &EmergencyAccountReconciler{Client: c, Scheme: c.Scheme(), Clock: clock}
+
+	subject.retryPendingStores(ctx, ea)
+	require.Equal(t, emcv1beta1.TokenStoreStateFailed, ea.Status.Tokens[0].Refs[0].State)
+	require.Contains(t, ea.Status.Tokens[0].Refs[0].Error, "superseded")
+	require.Equal(t, emcv1beta1.TokenStoreStateFailed, ea.Status.Tokens[1].Refs[0].State)
+	require.Contains(t, ea.Status.Tokens[1].Refs[0].Error, "expired")
+	_, pendingLeft := subject.nextStoreRetry(ea)
+	require.False(t, pendingLeft)
+}
+
+func Test_storeRetryBackoff(t *testing.T) {
+	require.Equal(t, time.Duration(0), storeRetryBackoff(0))
+	require.Equal(t, 10*time.Second, storeRetryBackoff(1))
+	require.Equal(t, 40*time.Second, storeRetryBackoff(3))
+	require.Equal(t, time.Hour, storeRetryBackoff(100))
+}
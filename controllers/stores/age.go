@@ -0,0 +1,131 @@
+package stores
+
+import (
+	"fmt"
+	"io"
+	"strings"
+
+	"filippo.io/age"
+	"filippo.io/age/agessh"
+	"filippo.io/age/armor"
+	"github.com/appuio/emergency-credentials-controller/pkg/utils"
+	"golang.org/x/crypto/ssh"
+
+	emcv1beta1 "github.com/appuio/emergency-credentials-controller/api/v1beta1"
+)
+
+// ageRecipient is a parsed age recipient together with the information identifying it in the envelope.
+type ageRecipient struct {
+	age.Recipient
+
+	// id is the recipient as written in a recipients file, without the comment of SSH public keys.
+	id string
+	// fingerprint is the SHA256 fingerprint of SSH public keys.
+	fingerprint string
+	// comment is the comment of SSH public keys, usually the owner of the key.
+	comment string
+}
+
+// encryptAge encrypts the messages for the given age recipients, the i-th message is encrypted for the i-th recipient.
+func encryptAge(messages []string, recipients []string) ([]EncryptedTokenSecret, error) {
+	rs, err := ageRecipients(recipients)
+	if err != nil {
+		return nil, err
+	}
+
+	encrypted := make([]EncryptedTokenSecret, 0, len(rs))
+	for i, r := range rs {
+		enc, err := encryptForAgeRecipient(messages[i], r)
+		if err != nil {
+			return nil, err
+		}
+		encrypted = append(encrypted, EncryptedTokenSecret{
+			Scheme:      emcv1beta1.EncryptionSchemeAge,
+			Data:        enc,
+			Recipient:   r.id,
+			Fingerprint: r.fingerprint,
+			UserID:      r.comment,
+		})
+	}
+	return encrypted, nil
+}
+
+// encryptForAgeRecipient encrypts the token for the given recipient and returns the armored age file.
+func encryptForAgeRecipient(token string, r ageRecipient) (string, error) {
+	buf := new(strings.Builder)
+	aw := armor.NewWriter(buf)
+	w, err := age.Encrypt(aw, r)
+	if err != nil {
+		return "", fmt.Errorf("unable to encrypt token for recipient %s: %w", r.id, err)
+	}
+	if _, err := io.WriteString(w, token); err != nil {
+		return "", fmt.Errorf("unable to encrypt token for recipient %s: %w", r.id, err)
+	}
+	if err := w.Close(); err != nil {
+		return "", fmt.Errorf("unable to encrypt token for recipient %s: %w", r.id, err)
+	}
+	if err := aw.Close(); err != nil {
+		return "", fmt.Errorf("unable to armor encrypted token for recipient %s: %w", r.id, err)
+	}
+	return buf.String(), nil
+}
+
+// ageRecipients parses the given age recipients.
+// Every entry may contain multiple recipients in the format of an age recipients file.
+func ageRecipients(recipients []string) ([]ageRecipient, error) {
+	if len(recipients) == 0 {
+		return nil, fmt.Errorf("no age recipients given")
+	}
+	parsed := []ageRecipient{}
+	for i, entry := range recipients {
+		rs, err := utils.SplitAgeRecipients(entry)
+		if err != nil {
+			return nil, fmt.Errorf("unable to parse age recipients %d: %w", i, err)
+		}
+		if len(rs) == 0 {
+			return nil, fmt.Errorf("age recipients %d does not contain a recipient", i)
+		}
+		for _, r := range rs {
+			ar, err := parseAgeRecipient(r)
+			if err != nil {
+				return nil, fmt.Errorf("unable to parse age recipients %d: %w", i, err)
+			}
+			parsed = append(parsed, ar)
+		}
+	}
+	return parsed, nil
+}
+
+// parseAgeRecipient parses a single native X25519 recipient or SSH public key.
+func parseAgeRecipient(s string) (ageRecipient, error) {
+	if strings.HasPrefix(s, "age1") {
+		r, err := age.ParseX25519Recipient(s)
+		if err != nil {
+			return ageRecipient{}, err
+		}
+		return ageRecipient{Recipient: r, id: r.String()}, nil
+	}
+
+	pk, comment, _, _, err := ssh.ParseAuthorizedKey([]byte(s))
+	if err != nil {
+		return ageRecipient{}, fmt.Errorf("malformed SSH public key: %w", err)
+	}
+	var r age.Recipient
+	switch pk.Type() {
+	case ssh.KeyAlgoRSA:
+		r, err = agessh.NewRSARecipient(pk)
+	case ssh.KeyAlgoED25519:
+		r, err = agessh.NewEd25519Recipient(pk)
+	default:
+		return ageRecipient{}, fmt.Errorf("unsupported SSH public key type %q", pk.Type())
+	}
+	if err != nil {
+		return ageRecipient{}, fmt.Errorf("unsupported SSH public key %s: %w", ssh.FingerprintSHA256(pk), err)
+	}
+	return ageRecipient{
+		Recipient:   r,
+		id:          strings.TrimSpace(string(ssh.MarshalAuthorizedKey(pk))),
+		fingerprint: ssh.FingerprintSHA256(pk),
+		comment:     comment,
+	}, nil
+}
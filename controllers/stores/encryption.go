@@ -0,0 +1,416 @@
+package stores
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/ProtonMail/gopenpgp/v2/crypto"
+	"github.com/appuio/emergency-credentials-controller/pkg/shamir"
+	"github.com/appuio/emergency-credentials-controller/pkg/utils"
+	"go.uber.org/multierr"
+	"k8s.io/utils/ptr"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	emcv1beta1 "github.com/appuio/emergency-credentials-controller/api/v1beta1"
+)
+
+// EncryptingStore wraps a store and encrypts the tokens before they are handed to the wrapped store.
+// The wrapped store holds the encrypted envelope, the token can only be read by the configured recipients.
+// Use WithEncryption to wrap a store, it preserves the optional TokenRetriever and TokenDeleter interfaces of the wrapped store.
+type EncryptingStore struct {
+	store    TokenStorer
+	spec     emcv1beta1.EncryptionSpec
+	metadata TokenMetadata
+}
+
+var _ TokenStorer = &EncryptingStore{}
+var _ ClientInjector = &EncryptingStore{}
+var _ SecretReferencer = &EncryptingStore{}
+var _ SpecValidator = &EncryptingStore{}
+var _ MetadataInjector = &EncryptingStore{}
+var _ TokenSyncer = &EncryptingStore{}
+var _ EnvelopeStorer = &EncryptingStore{}
+
+// encryptingRetriever is an EncryptingStore wrapping a store supporting token retrieval.
+type encryptingRetriever struct{ *EncryptingStore }
+
+// encryptingDeleter is an EncryptingStore wrapping a store supporting token deletion.
+type encryptingDeleter struct{ *EncryptingStore }
+
+// encryptingRetrieverDeleter is an EncryptingStore wrapping a store supporting token retrieval and deletion.
+type encryptingRetrieverDeleter struct{ *EncryptingStore }
+
+var _ TokenRetriever = encryptingRetriever{}
+var _ TokenDeleter = encryptingDeleter{}
+var _ TokenRetriever = encryptingRetrieverDeleter{}
+var _ TokenDeleter = encryptingRetrieverDeleter{}
+
+// WithEncryption wraps the store to encrypt tokens with the given encryption settings.
+// The store is returned as is if encryption is not enabled.
+func WithEncryption(st TokenStorer, spec emcv1beta1.EncryptionSpec) TokenStorer {
+	if !spec.Encrypt {
+		return st
+	}
+	es := &EncryptingStore{store: st, spec: spec}
+	_, retriever := st.(TokenRetriever)
+	_, deleter := st.(TokenDeleter)
+	switch {
+	case retriever && deleter:
+		return encryptingRetrieverDeleter{es}
+	case retriever:
+		return encryptingRetriever{es}
+	case deleter:
+		return encryptingDeleter{es}
+	}
+	return es
+}
+
+// StoreToken encrypts the token and stores the encrypted envelope in the wrapped store.
+func (es *EncryptingStore) StoreToken(ctx context.Context, ea emcv1beta1.EmergencyAccount, token string) (string, error) {
+	enc, err := es.EncryptToken(ea, token)
+	if err != nil {
+		return "", err
+	}
+	return es.StoreEnvelope(ctx, ea, enc)
+}
+
+// EncryptToken encrypts the token for the configured recipients.
+// The injected metadata is recorded in the envelope.
+func (es *EncryptingStore) EncryptToken(ea emcv1beta1.EmergencyAccount, token string) (string, error) {
+	enc, err := encrypt(token, es.spec, encryptedTokenMetadata(ea, es.metadata))
+	if err != nil {
+		return "", fmt.Errorf("unable to encrypt token: %w", err)
+	}
+	return enc, nil
+}
+
+// StoreEnvelope stores an envelope returned by EncryptToken in the wrapped store.
+func (es *EncryptingStore) StoreEnvelope(ctx context.Context, ea emcv1beta1.EmergencyAccount, envelope string) (string, error) {
+	if err := verifyEncryptedToken("envelope", envelope); !errors.Is(err, ErrTokenNotRetrievable) {
+		return "", err
+	}
+	return es.store.StoreToken(ctx, ea, envelope)
+}
+
+// InjectClient injects the client into the wrapped store if it supports it.
+func (es *EncryptingStore) InjectClient(c client.Client) {
+	if ij, ok := es.store.(ClientInjector); ok {
+		ij.InjectClient(c)
+	}
+}
+
+// InjectTokenMetadata injects the metadata of the token to store.
+// The metadata is recorded in the envelope and passed on to the wrapped store if it supports it.
+func (es *EncryptingStore) InjectTokenMetadata(md TokenMetadata) {
+	es.metadata = md
+	if mi, ok := es.store.(MetadataInjector); ok {
+		mi.InjectTokenMetadata(md)
+	}
+}
+
+// ReferencedSecrets returns the secrets referenced by the wrapped store.
+func (es *EncryptingStore) ReferencedSecrets() []string {
+	if sr, ok := es.store.(SecretReferencer); ok {
+		return sr.ReferencedSecrets()
+	}
+	return nil
+}
+
+// ValidateSpec validates the encryption settings and the configuration of the wrapped store.
+func (es *EncryptingStore) ValidateSpec() error {
+	if err := validateEncryption(es.spec); err != nil {
+		return err
+	}
+	if sv, ok := es.store.(SpecValidator); ok {
+		return sv.ValidateSpec()
+	}
+	return nil
+}
+
+// SyncToken syncs the copies of the envelope if the wrapped store supports it.
+func (es *EncryptingStore) SyncToken(ctx context.Context, ea emcv1beta1.EmergencyAccount, ref string) error {
+	if ts, ok := es.store.(TokenSyncer); ok {
+		return ts.SyncToken(ctx, ea, ref)
+	}
+	return nil
+}
+
+// retrieveToken retrieves the envelope from the wrapped store and verifies it is an encrypted token.
+// ErrTokenNotRetrievable is returned after a successful check, the controller can't decrypt the token.
+func (es *EncryptingStore) retrieveToken(ctx context.Context, ea emcv1beta1.EmergencyAccount, ref string) (string, error) {
+	payload, err := es.store.(TokenRetriever).RetrieveToken(ctx, ea, ref)
+	if err != nil {
+		return "", err
+	}
+	return "", verifyEncryptedToken(ref, payload)
+}
+
+// deleteToken deletes the envelope from the wrapped store.
+func (es *EncryptingStore) deleteToken(ctx context.Context, ea emcv1beta1.EmergencyAccount, ref string) error {
+	return es.store.(TokenDeleter).DeleteToken(ctx, ea, ref)
+}
+
+// RetrieveToken implements TokenRetriever.
+func (es encryptingRetriever) RetrieveToken(ctx context.Context, ea emcv1beta1.EmergencyAccount, ref string) (string, error) {
+	return es.retrieveToken(ctx, ea, ref)
+}
+
+// DeleteToken implements TokenDeleter.
+func (es encryptingDeleter) DeleteToken(ctx context.Context, ea emcv1beta1.EmergencyAccount, ref string) error {
+	return es.deleteToken(ctx, ea, ref)
+}
+
+// RetrieveToken implements TokenRetriever.
+func (es encryptingRetrieverDeleter) RetrieveToken(ctx context.Context, ea emcv1beta1.EmergencyAccount, ref string) (string, error) {
+	return es.retrieveToken(ctx, ea, ref)
+}
+
+// DeleteToken implements TokenDeleter.
+func (es encryptingRetrieverDeleter) DeleteToken(ctx context.Context, ea emcv1beta1.EmergencyAccount, ref string) error {
+	return es.deleteToken(ctx, ea, ref)
+}
+
+// validateEncryption validates the recipients of the configured encryption scheme and the secret sharing threshold.
+func validateEncryption(spec emcv1beta1.EncryptionSpec) error {
+	n, err := recipientCount(spec)
+	if err != nil {
+		return err
+	}
+	if spec.Threshold == 0 {
+		return nil
+	}
+	if spec.Threshold < 2 {
+		return fmt.Errorf("threshold must be at least 2, got %d", spec.Threshold)
+	}
+	if spec.Threshold > n {
+		return fmt.Errorf("threshold %d exceeds the number of recipients %d", spec.Threshold, n)
+	}
+	if n > shamir.MaxShares {
+		return fmt.Errorf("secret sharing supports at most %d recipients, got %d", shamir.MaxShares, n)
+	}
+	return nil
+}
+
+// recipientCount returns the number of recipients of the configured encryption scheme.
+func recipientCount(spec emcv1beta1.EncryptionSpec) (int, error) {
+	switch spec.Scheme {
+	case "", emcv1beta1.EncryptionSchemePGP:
+		keys, err := publicKeys(spec.PGPKeys)
+		return len(keys), err
+	case emcv1beta1.EncryptionSchemeAge:
+		rs, err := ageRecipients(spec.AgeRecipients)
+		return len(rs), err
+	}
+	return 0, fmt.Errorf("unknown encryption scheme %q", spec.Scheme)
+}
+
+// verifyEncryptedToken verifies the payload retrieved from a store is an encrypted token holding at least one secret.
+// Returns ErrTokenNotRetrievable if the payload is an encrypted token.
+func verifyEncryptedToken(ref, payload string) error {
+	var et EncryptedToken
+	if err := json.Unmarshal([]byte(payload), &et); err != nil {
+		return fmt.Errorf("unable to unmarshal encrypted token: %w", err)
+	}
+	if len(et.Secrets) == 0 {
+		return fmt.Errorf("encrypted token %q does not contain any secrets", ref)
+	}
+	return fmt.Errorf("encrypted token %q: %w", ref, ErrTokenNotRetrievable)
+}
+
+// encryptedTokenMetadata returns the envelope metadata of the token stored for the EmergencyAccount.
+func encryptedTokenMetadata(ea emcv1beta1.EmergencyAccount, md TokenMetadata) EncryptedTokenMetadata {
+	etm := EncryptedTokenMetadata{
+		Cluster:          md.Cluster,
+		Namespace:        ea.Namespace,
+		EmergencyAccount: ea.Name,
+		TokenUID:         string(md.UID),
+	}
+	if !md.ExpirationTimestamp.IsZero() {
+		etm.ExpirationTimestamp = ptr.To(md.ExpirationTimestamp.UTC())
+	}
+	return etm
+}
+
+// EncryptedTokenVersion is the format version of the encrypted token envelope written by the controller.
+// Envelopes without a version were written before the envelope carried metadata.
+const EncryptedTokenVersion = 1
+
+// SharedEncryptedTokenVersion is the format version of envelopes holding shares of the token.
+// Every secret holds a single base64 encoded share of the token, `threshold` decrypted shares reconstruct the token with `shamir.Combine`.
+const SharedEncryptedTokenVersion = 2
+
+// EncryptedToken is the JSON structure of an encrypted token.
+type EncryptedToken struct {
+	// Version is the format version of the envelope.
+	Version int `json:"version,omitempty"`
+	// Metadata is non-secret metadata of the encrypted token.
+	Metadata EncryptedTokenMetadata `json:"metadata,omitempty"`
+	// Threshold is the number of shares required to reconstruct the token.
+	// Only set for envelopes holding shares of the token.
+	Threshold int `json:"threshold,omitempty"`
+	// Secrets holds the token, or a share of the token, encrypted for every recipient.
+	Secrets []EncryptedTokenSecret `json:"secrets"`
+}
+
+// EncryptedTokenMetadata is the non-secret metadata of an encrypted token.
+// It allows recovery tooling to identify the token and to detect stale copies without decrypting it.
+type EncryptedTokenMetadata struct {
+	// Cluster is the name of the cluster the token authenticates against, if configured.
+	Cluster string `json:"cluster,omitempty"`
+	// Namespace is the namespace of the EmergencyAccount.
+	Namespace string `json:"namespace,omitempty"`
+	// EmergencyAccount is the name of the EmergencyAccount.
+	EmergencyAccount string `json:"emergencyAccount,omitempty"`
+	// TokenUID is the UID of the token in the EmergencyAccount status.
+	TokenUID string `json:"tokenUID,omitempty"`
+	// ExpirationTimestamp is the time the token expires.
+	ExpirationTimestamp *time.Time `json:"expirationTimestamp,omitempty"`
+}
+
+// EncryptedTokenSecret is the JSON structure of the token encrypted for a single recipient.
+type EncryptedTokenSecret struct {
+	// Scheme is the scheme the token is encrypted with.
+	// Secrets without a scheme were written before age support and are PGP encrypted.
+	Scheme emcv1beta1.EncryptionScheme `json:"scheme,omitempty"`
+	// Data is the armored PGP message or the armored age file.
+	Data string `json:"data"`
+	// Recipient is the age recipient, SSH public keys are recorded without their comment.
+	Recipient string `json:"recipient,omitempty"`
+	// Fingerprint is the hex encoded fingerprint of the recipient's primary PGP key or the SHA256 fingerprint of the recipient's SSH key.
+	Fingerprint string `json:"fingerprint,omitempty"`
+	// KeyID is the hex encoded key ID of the recipient's primary PGP key.
+	KeyID string `json:"keyID,omitempty"`
+	// UserID is the primary user ID of the recipient's PGP key, for example `Jane Doe <jane@example.com>`, or the comment of the recipient's SSH key.
+	UserID string `json:"userID,omitempty"`
+}
+
+// encrypt encrypts the token with the configured encryption scheme.
+// The token is encrypted for each recipient and the resulting messages are returned in a JSON envelope together with the metadata.
+// If a threshold is configured, the token is split into one share per recipient and every share is encrypted for a single recipient.
+func encrypt(token string, spec emcv1beta1.EncryptionSpec, md EncryptedTokenMetadata) (string, error) {
+	if err := validateEncryption(spec); err != nil {
+		return "", err
+	}
+	n, err := recipientCount(spec)
+	if err != nil {
+		return "", err
+	}
+
+	et := EncryptedToken{
+		Version:  EncryptedTokenVersion,
+		Metadata: md,
+	}
+	messages := make([]string, n)
+	for i := range messages {
+		messages[i] = token
+	}
+	if spec.Threshold > 0 {
+		shares, err := shamir.Split([]byte(token), n, spec.Threshold)
+		if err != nil {
+			return "", fmt.Errorf("unable to split token: %w", err)
+		}
+		for i, share := range shares {
+			messages[i] = base64.StdEncoding.EncodeToString(share)
+		}
+		et.Version = SharedEncryptedTokenVersion
+		et.Threshold = spec.Threshold
+	}
+
+	switch spec.Scheme {
+	case "", emcv1beta1.EncryptionSchemePGP:
+		et.Secrets, err = encryptPGP(messages, spec.PGPKeys)
+	case emcv1beta1.EncryptionSchemeAge:
+		et.Secrets, err = encryptAge(messages, spec.AgeRecipients)
+	}
+	if err != nil {
+		return "", err
+	}
+
+	s, err := json.Marshal(et)
+	if err != nil {
+		return "", fmt.Errorf("unable to marshal encrypted token: %w", err)
+	}
+
+	return string(s), nil
+}
+
+// encryptPGP encrypts the messages for the given PGP public keys, the i-th message is encrypted for the i-th key.
+func encryptPGP(messages []string, pgpKeys []string) ([]EncryptedTokenSecret, error) {
+	keys, err := publicKeys(pgpKeys)
+	if err != nil {
+		return nil, err
+	}
+
+	encrypted := make([]EncryptedTokenSecret, 0, len(keys))
+	errs := []error{}
+	for i, key := range keys {
+		enc, err := encryptForKey(messages[i], key)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		secret := EncryptedTokenSecret{
+			Scheme:      emcv1beta1.EncryptionSchemePGP,
+			Data:        enc,
+			Fingerprint: key.GetFingerprint(),
+			KeyID:       key.GetHexKeyID(),
+		}
+		if id := key.GetEntity().PrimaryIdentity(); id != nil {
+			secret.UserID = id.Name
+		}
+		encrypted = append(encrypted, secret)
+	}
+	if multierr.Combine(errs...) != nil {
+		return nil, fmt.Errorf("unable to fully encrypt token: %w", multierr.Combine(errs...))
+	}
+	return encrypted, nil
+}
+
+// encryptForKey encrypts the token for the given public key and returns the armored message.
+func encryptForKey(token string, key *crypto.Key) (string, error) {
+	kr, err := crypto.NewKeyRing(key)
+	if err != nil {
+		return "", fmt.Errorf("unable to create key ring for key %s: %w", key.GetHexKeyID(), err)
+	}
+	msg, err := kr.Encrypt(crypto.NewPlainMessageFromString(token), nil)
+	if err != nil {
+		return "", fmt.Errorf("unable to encrypt token for key %s: %w", key.GetHexKeyID(), err)
+	}
+	return msg.GetArmored()
+}
+
+// publicKeys parses the given PGP public keys.
+// Every entry may contain multiple armored key blocks, every block must be a public key usable for encryption.
+func publicKeys(pgpKeys []string) ([]*crypto.Key, error) {
+	if len(pgpKeys) == 0 {
+		return nil, fmt.Errorf("no PGP public keys given")
+	}
+	keys := []*crypto.Key{}
+	for i, key := range pgpKeys {
+		sk, err := utils.SplitPublicKeyBlocks(key)
+		if err != nil {
+			return nil, fmt.Errorf("unable to parse PGP public key %d: %w", i, err)
+		}
+		if len(sk) == 0 {
+			return nil, fmt.Errorf("PGP public key %d does not contain a public key block", i)
+		}
+		for _, block := range sk {
+			k, err := crypto.NewKeyFromArmored(block)
+			if err != nil {
+				return nil, fmt.Errorf("unable to parse PGP public key %d: %w", i, err)
+			}
+			if k.IsPrivate() {
+				return nil, fmt.Errorf("PGP public key %d (%s) is a private key", i, k.GetHexKeyID())
+			}
+			if !k.CanEncrypt() {
+				return nil, fmt.Errorf("PGP public key %d (%s) can not be used for encryption", i, k.GetHexKeyID())
+			}
+			keys = append(keys, k)
+		}
+	}
+	return keys, nil
+}
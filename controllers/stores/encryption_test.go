@@ -0,0 +1,199 @@
+package stores_test
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"filippo.io/age"
+	"filippo.io/age/armor"
+	"github.com/ProtonMail/gopenpgp/v2/helper"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+
+	emcv1beta1 "github.com/appuio/emergency-credentials-controller/api/v1beta1"
+	"github.com/appuio/emergency-credentials-controller/controllers/stores"
+	"github.com/appuio/emergency-credentials-controller/pkg/shamir"
+)
+
+func Test_EncryptingStore_SecretStore(t *testing.T) {
+	const token = "token"
+	c := fakeClient(t)
+	identity, err := age.GenerateX25519Identity()
+	require.NoError(t, err)
+
+	ea := emcv1beta1.EmergencyAccount{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "test",
+			Namespace: "default",
+		},
+	}
+
+	st, err := stores.FromSpec(emcv1beta1.TokenStoreSpec{
+		Type: "secret",
+		Encryption: emcv1beta1.EncryptionSpec{
+			Encrypt:       true,
+			Scheme:        emcv1beta1.EncryptionSchemeAge,
+			AgeRecipients: []string{identity.Recipient().String()},
+		},
+	})
+	require.NoError(t, err)
+	require.NoError(t, st.(stores.SpecValidator).ValidateSpec())
+	st.(stores.ClientInjector).InjectClient(c)
+	expiration := time.Date(2023, 10, 30, 17, 57, 0, 0, time.UTC)
+	st.(stores.MetadataInjector).InjectTokenMetadata(stores.TokenMetadata{
+		UID:                 "token-uid",
+		ExpirationTimestamp: expiration,
+	})
+
+	ref, err := st.StoreToken(context.Background(), ea, token)
+	require.NoError(t, err)
+	require.Equal(t, "test-1698688620", ref, "should name the secret after the expiration in the metadata")
+
+	var secret corev1.Secret
+	require.NoError(t, c.Get(context.Background(), types.NamespacedName{Name: ref, Namespace: ea.Namespace}, &secret))
+	var et stores.EncryptedToken
+	require.NoError(t, json.Unmarshal(secret.Data["token"], &et))
+	require.Equal(t, "token-uid", et.Metadata.TokenUID)
+	require.Equal(t, &expiration, et.Metadata.ExpirationTimestamp)
+	require.Len(t, et.Secrets, 1)
+	r, err := age.Decrypt(armor.NewReader(strings.NewReader(et.Secrets[0].Data)), identity)
+	require.NoError(t, err)
+	decrypted, err := io.ReadAll(r)
+	require.NoError(t, err)
+	require.Equal(t, token, string(decrypted))
+
+	tr, ok := st.(stores.TokenRetriever)
+	require.True(t, ok, "should keep the retriever of the wrapped store")
+	_, err = tr.RetrieveToken(context.Background(), ea, ref)
+	require.ErrorIs(t, err, stores.ErrTokenNotRetrievable)
+
+	secret.Data["token"] = []byte(token)
+	require.NoError(t, c.Update(context.Background(), &secret))
+	_, err = tr.RetrieveToken(context.Background(), ea, ref)
+	require.ErrorContains(t, err, "unable to unmarshal encrypted token", "unencrypted payload should fail verification")
+
+	td, ok := st.(stores.TokenDeleter)
+	require.True(t, ok, "should keep the deleter of the wrapped store")
+	require.NoError(t, td.DeleteToken(context.Background(), ea, ref))
+	_, err = tr.RetrieveToken(context.Background(), ea, ref)
+	require.ErrorContains(t, err, "unable to get secret")
+}
+
+func Test_WithEncryption_OptionalInterfaces(t *testing.T) {
+	spec := emcv1beta1.EncryptionSpec{Encrypt: true}
+
+	st := stores.WithEncryption(stores.NewLogStore(emcv1beta1.LogStoreSpec{}), spec)
+	require.IsType(t, &stores.EncryptingStore{}, st)
+	require.NotImplements(t, (*stores.TokenRetriever)(nil), st)
+	require.NotImplements(t, (*stores.TokenDeleter)(nil), st)
+
+	st = stores.WithEncryption(stores.NewS3Store(emcv1beta1.S3StoreSpec{}), spec)
+	require.Implements(t, (*stores.TokenRetriever)(nil), st)
+	require.NotImplements(t, (*stores.TokenDeleter)(nil), st)
+
+	st = stores.WithEncryption(stores.NewSecretStore(emcv1beta1.SecretStoreSpec{}), emcv1beta1.EncryptionSpec{})
+	require.IsType(t, &stores.SecretStore{}, st, "should not wrap the store without encryption")
+}
+
+func Test_FromSpec_Encryption(t *testing.T) {
+	_, err := stores.FromSpec(emcv1beta1.TokenStoreSpec{
+		Type:       "s3",
+		Encryption: emcv1beta1.EncryptionSpec{Encrypt: true},
+		S3Spec: emcv1beta1.S3StoreSpec{
+			Encryption: emcv1beta1.S3EncryptionSpec{Encrypt: true},
+		},
+	})
+	require.ErrorContains(t, err, "can't be combined")
+
+	st, err := stores.FromSpec(emcv1beta1.TokenStoreSpec{
+		Type:       "log",
+		Encryption: emcv1beta1.EncryptionSpec{Encrypt: true, Scheme: emcv1beta1.EncryptionSchemeAge},
+	})
+	require.NoError(t, err)
+	require.ErrorContains(t, st.(stores.SpecValidator).ValidateSpec(), "no age recipients given")
+}
+
+func Test_EncryptingStore_SecretSharing(t *testing.T) {
+	const (
+		token      = "token"
+		passphrase = "passphrase"
+	)
+	privateKeys := make([]string, 3)
+	publicKeys := make([]string, 3)
+	for i := range privateKeys {
+		var err error
+		privateKeys[i], publicKeys[i], err = generateKeyPair(fmt.Sprintf("custodian%d", i), fmt.Sprintf("custodian%d@test.ch", i), passphrase, "x25519", 0)
+		require.NoError(t, err)
+	}
+	mm := &MinioMock{}
+	st := stores.WithEncryption(stores.NewS3StoreWithClientFactory(emcv1beta1.S3StoreSpec{
+		S3: emcv1beta1.S3Spec{Bucket: "bucket"},
+	}, mm.ClientFactory), emcv1beta1.EncryptionSpec{
+		Encrypt:   true,
+		PGPKeys:   publicKeys,
+		Threshold: 2,
+	})
+
+	_, err := st.StoreToken(context.Background(), emcv1beta1.EmergencyAccount{ObjectMeta: metav1.ObjectMeta{Name: "object"}}, token)
+	require.NoError(t, err)
+
+	var et stores.EncryptedToken
+	require.NoError(t, json.Unmarshal(mm.get("bucket", "object"), &et))
+	require.Equal(t, stores.SharedEncryptedTokenVersion, et.Version)
+	require.Equal(t, 2, et.Threshold)
+	require.Len(t, et.Secrets, 3)
+
+	shares := make([][]byte, len(et.Secrets))
+	for i, secret := range et.Secrets {
+		msg, err := helper.DecryptMessageArmored(privateKeys[i], []byte(passphrase), secret.Data)
+		require.NoError(t, err, "share %d should be encrypted for custodian %d only", i, i)
+		require.NotContains(t, msg, token)
+		shares[i], err = base64.StdEncoding.DecodeString(msg)
+		require.NoError(t, err)
+	}
+	for _, pair := range [][2]int{{0, 1}, {0, 2}, {2, 1}} {
+		combined, err := shamir.Combine([][]byte{shares[pair[0]], shares[pair[1]]})
+		require.NoError(t, err)
+		require.Equal(t, token, string(combined))
+	}
+}
+
+func Test_EncryptingStore_ValidateSpec_Threshold(t *testing.T) {
+	_, pubk1, err := generateKeyPair("test1", "test1@test.ch", "passphrase", "x25519", 0)
+	require.NoError(t, err)
+	_, pubk2, err := generateKeyPair("test2", "test2@test.ch", "passphrase", "x25519", 0)
+	require.NoError(t, err)
+
+	tcs := map[string]struct {
+		threshold int
+		errMsg    string
+	}{
+		"disabled":           {threshold: 0},
+		"all recipients":     {threshold: 2},
+		"single share":       {threshold: 1, errMsg: "threshold must be at least 2"},
+		"exceeds recipients": {threshold: 3, errMsg: "threshold 3 exceeds the number of recipients 2"},
+	}
+	for name, tc := range tcs {
+		t.Run(name, func(t *testing.T) {
+			st := stores.WithEncryption(stores.NewLogStore(emcv1beta1.LogStoreSpec{}), emcv1beta1.EncryptionSpec{
+				Encrypt:   true,
+				PGPKeys:   []string{pubk1 + "\n" + pubk2},
+				Threshold: tc.threshold,
+			})
+			err := st.(stores.SpecValidator).ValidateSpec()
+			if tc.errMsg == "" {
+				require.NoError(t, err)
+				return
+			}
+			require.ErrorContains(t, err, tc.errMsg)
+		})
+	}
+}
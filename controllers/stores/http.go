@@ -0,0 +1,43 @@
+package stores
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"net/http"
+	"time"
+)
+
+// httpClientTimeout limits the time of a request to a remote endpoint.
+// The reconcile context has no deadline, a hanging endpoint would otherwise block the reconcile worker.
+const httpClientTimeout = 30 * time.Second
+
+// newHTTPClient creates an HTTP client for stores writing to a remote endpoint.
+// The CA bundle is trusted instead of the system CAs if set, the client certificates are presented for mutual TLS.
+// Every client has its own transport, callers must close its idle connections after use.
+func newHTTPClient(caBundle string, insecure bool, certificates ...tls.Certificate) (*http.Client, error) {
+	tlsConfig := &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		InsecureSkipVerify: insecure,
+		Certificates:       certificates,
+	}
+	if caBundle != "" {
+		pool, err := certPool(caBundle)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.RootCAs = pool
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+	return &http.Client{Transport: transport, Timeout: httpClientTimeout}, nil
+}
+
+// certPool parses a PEM encoded CA bundle.
+func certPool(caBundle string) (*x509.CertPool, error) {
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM([]byte(caBundle)) {
+		return nil, errors.New("CA bundle does not contain a PEM encoded certificate")
+	}
+	return pool, nil
+}
@@ -0,0 +1,278 @@
+package stores
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/types"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/tools/clientcmd"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+
+	emcv1beta1 "github.com/appuio/emergency-credentials-controller/api/v1beta1"
+)
+
+// DefaultRemoteKubeconfigKey is the default key of the kubeconfig in the kubeconfig secret.
+const DefaultRemoteKubeconfigKey = "kubeconfig"
+
+// RemoteClientFactory creates a client for the remote cluster.
+// The client c can be used to read referenced secrets from the given namespace.
+type RemoteClientFactory func(ctx context.Context, c client.Client, namespace string, spec emcv1beta1.RemoteSecretStoreSpec) (client.Client, error)
+
+// RemoteSecretStore stores the tokens in secrets on a remote cluster.
+// The secrets are named `<cluster>-<namespace>-<name>-<expiration unix timestamp>` to share the remote namespace between clusters.
+// The secrets can't be owned by the EmergencyAccount, the EmergencyAccount and the cluster are recorded in annotations instead.
+// Secrets recorded for another EmergencyAccount or cluster are never updated, read, or deleted.
+type RemoteSecretStore struct {
+	spec                emcv1beta1.RemoteSecretStoreSpec
+	remoteClientFactory RemoteClientFactory
+	client              client.Client
+	metadata            TokenMetadata
+}
+
+var _ TokenStorer = &RemoteSecretStore{}
+var _ TokenRetriever = &RemoteSecretStore{}
+var _ TokenDeleter = &RemoteSecretStore{}
+var _ ClientInjector = &RemoteSecretStore{}
+var _ MetadataInjector = &RemoteSecretStore{}
+var _ SecretReferencer = &RemoteSecretStore{}
+var _ SpecValidator = &RemoteSecretStore{}
+
+// NewRemoteSecretStore creates a new RemoteSecretStore
+func NewRemoteSecretStore(spec emcv1beta1.RemoteSecretStoreSpec) *RemoteSecretStore {
+	return NewRemoteSecretStoreWithClientFactory(spec, DefaultRemoteClientFactory)
+}
+
+// NewRemoteSecretStoreWithClientFactory creates a new RemoteSecretStore with the given client factory.
+func NewRemoteSecretStoreWithClientFactory(spec emcv1beta1.RemoteSecretStoreSpec, remoteClientFactory RemoteClientFactory) *RemoteSecretStore {
+	return &RemoteSecretStore{spec: spec, remoteClientFactory: remoteClientFactory}
+}
+
+// InjectClient injects the client into the RemoteSecretStore.
+// The client is used to read the kubeconfig secret.
+func (rs *RemoteSecretStore) InjectClient(c client.Client) {
+	rs.client = c
+}
+
+// InjectTokenMetadata injects the metadata of the token to store.
+// The expiration of the token is taken from the metadata, the stored payload might be encrypted.
+// The cluster of the metadata is part of the secret name and checked before reading or deleting a secret.
+func (rs *RemoteSecretStore) InjectTokenMetadata(md TokenMetadata) {
+	rs.metadata = md
+}
+
+// ReferencedSecrets returns the name of the kubeconfig secret.
+func (rs *RemoteSecretStore) ReferencedSecrets() []string {
+	return []string{rs.spec.KubeconfigSecretRef.Name}
+}
+
+// ValidateSpec validates the namespace and the kubeconfig secret reference.
+func (rs *RemoteSecretStore) ValidateSpec() error {
+	if rs.spec.Namespace == "" {
+		return errors.New("a remote namespace is required")
+	}
+	if rs.spec.KubeconfigSecretRef.Name == "" {
+		return errors.New("a kubeconfig secret is required")
+	}
+	return nil
+}
+
+// DefaultRemoteClientFactory is the default factory for creating a client for the remote cluster.
+// The kubeconfig is read from the referenced secret.
+func DefaultRemoteClientFactory(ctx context.Context, c client.Client, namespace string, spec emcv1beta1.RemoteSecretStoreSpec) (client.Client, error) {
+	key := spec.KubeconfigSecretRef.Key
+	if key == "" {
+		key = DefaultRemoteKubeconfigKey
+	}
+	ref := namespace + "/" + spec.KubeconfigSecretRef.Name + "/" + key
+	data, err := readSecretKeys(ctx, c, namespace, spec.KubeconfigSecretRef.Name, key)
+	if apierrors.IsNotFound(err) {
+		remoteClients.evict(ref)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to read kubeconfig: %w", err)
+	}
+	cfg, err := clientcmd.RESTConfigFromKubeConfig([]byte(data[key]))
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse kubeconfig: %w", err)
+	}
+	return remoteClients.get(ref, data[key], func() (client.Client, error) {
+		return client.New(cfg, client.Options{Scheme: clientgoscheme.Scheme})
+	})
+}
+
+// remoteClients caches the clients created by the DefaultRemoteClientFactory.
+// Creating a client sets up a new HTTP client and discovery for every call otherwise.
+var remoteClients = newRemoteClientCache()
+
+// remoteClientCache caches remote clients by the hash of their kubeconfig.
+// Secrets holding the same kubeconfig share a client.
+// The client of a secret is evicted once the secret holds another kubeconfig or is deleted and no other secret holds the same kubeconfig.
+type remoteClientCache struct {
+	mu sync.Mutex
+	// clients holds the clients by the hash of their kubeconfig.
+	clients map[[sha256.Size]byte]client.Client
+	// refs holds the hash of the kubeconfig last read from a secret by `<namespace>/<name>/<key>` of the secret.
+	refs map[string][sha256.Size]byte
+}
+
+func newRemoteClientCache() *remoteClientCache {
+	return &remoteClientCache{
+		clients: map[[sha256.Size]byte]client.Client{},
+		refs:    map[string][sha256.Size]byte{},
+	}
+}
+
+// get returns the cached client for the kubeconfig or creates a new one.
+// The client previously used for the secret ref is evicted if the kubeconfig changed.
+func (c *remoteClientCache) get(ref, kubeconfig string, newClient func() (client.Client, error)) (client.Client, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	hash := sha256.Sum256([]byte(kubeconfig))
+	rc, ok := c.clients[hash]
+	if !ok {
+		var err error
+		rc, err = newClient()
+		if err != nil {
+			return nil, err
+		}
+		c.clients[hash] = rc
+	}
+	old, ok := c.refs[ref]
+	c.refs[ref] = hash
+	if ok && old != hash {
+		c.evictUnused(old)
+	}
+	return rc, nil
+}
+
+// evict forgets the secret ref and evicts its client if no other secret holds the same kubeconfig.
+func (c *remoteClientCache) evict(ref string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	hash, ok := c.refs[ref]
+	if !ok {
+		return
+	}
+	delete(c.refs, ref)
+	c.evictUnused(hash)
+}
+
+// evictUnused removes the client with the given hash if no secret ref holds it anymore.
+func (c *remoteClientCache) evictUnused(hash [sha256.Size]byte) {
+	for _, h := range c.refs {
+		if h == hash {
+			return
+		}
+	}
+	delete(c.clients, hash)
+}
+
+// StoreToken stores the token in a secret in the remote namespace.
+func (rs *RemoteSecretStore) StoreToken(ctx context.Context, ea emcv1beta1.EmergencyAccount, token string) (string, error) {
+	rc, err := rs.remoteClient(ctx, ea)
+	if err != nil {
+		return "", err
+	}
+	exp, err := tokenExpiration(token, rs.metadata)
+	if err != nil {
+		return "", err
+	}
+	return storeTokenSecret(ctx, rc, rs.secretName(ea, exp), rs.spec.Namespace, DefaultSecretKey, token, exp, func(s *corev1.Secret) error {
+		if s.ResourceVersion != "" {
+			if err := rs.checkOwner(*s, ea); err != nil {
+				return err
+			}
+		}
+		s.Annotations[EmergencyAccountAnnotation] = ea.Namespace + "/" + ea.Name
+		if rs.metadata.Cluster != "" {
+			s.Annotations[ClusterAnnotation] = rs.metadata.Cluster
+		}
+		return nil
+	})
+}
+
+// RetrieveToken reads the token from the secret in the remote namespace.
+func (rs *RemoteSecretStore) RetrieveToken(ctx context.Context, ea emcv1beta1.EmergencyAccount, ref string) (string, error) {
+	rc, err := rs.remoteClient(ctx, ea)
+	if err != nil {
+		return "", err
+	}
+	s, err := rs.getSecret(ctx, rc, ea, ref)
+	if err != nil {
+		return "", err
+	}
+	token, ok := s.Data[DefaultSecretKey]
+	if !ok {
+		return "", fmt.Errorf("secret does not contain token")
+	}
+	return string(token), nil
+}
+
+// DeleteToken deletes the secret in the remote namespace.
+func (rs *RemoteSecretStore) DeleteToken(ctx context.Context, ea emcv1beta1.EmergencyAccount, ref string) error {
+	rc, err := rs.remoteClient(ctx, ea)
+	if err != nil {
+		return err
+	}
+	s, err := rs.getSecret(ctx, rc, ea, ref)
+	if apierrors.IsNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if err := rc.Delete(ctx, &s, client.Preconditions{UID: &s.UID}); err != nil && !apierrors.IsNotFound(err) {
+		return fmt.Errorf("unable to delete secret: %w", err)
+	}
+	log.FromContext(ctx).Info("deleted token", "secret", s.Name, "namespace", s.Namespace)
+	return nil
+}
+
+// secretName returns the name of the secret holding the token.
+// The name contains the cluster and the namespace of the EmergencyAccount, the remote namespace can hold the tokens of multiple clusters.
+func (rs *RemoteSecretStore) secretName(ea emcv1beta1.EmergencyAccount, exp time.Time) string {
+	name := ea.Namespace + "-" + ea.Name + "-" + strconv.Itoa(int(exp.Unix()))
+	if rs.metadata.Cluster == "" {
+		return name
+	}
+	return rs.metadata.Cluster + "-" + name
+}
+
+// getSecret reads the referenced secret and checks it was created for the EmergencyAccount and cluster.
+func (rs *RemoteSecretStore) getSecret(ctx context.Context, rc client.Client, ea emcv1beta1.EmergencyAccount, ref string) (corev1.Secret, error) {
+	var s corev1.Secret
+	if err := rc.Get(ctx, types.NamespacedName{Name: ref, Namespace: rs.spec.Namespace}, &s); err != nil {
+		return s, fmt.Errorf("unable to get secret: %w", err)
+	}
+	return s, rs.checkOwner(s, ea)
+}
+
+// checkOwner returns an error if the annotations of the secret don't record the EmergencyAccount and the cluster.
+func (rs *RemoteSecretStore) checkOwner(s corev1.Secret, ea emcv1beta1.EmergencyAccount) error {
+	if owner := s.Annotations[EmergencyAccountAnnotation]; owner != ea.Namespace+"/"+ea.Name {
+		return fmt.Errorf("secret %s/%s belongs to EmergencyAccount %q", s.Namespace, s.Name, owner)
+	}
+	if cluster := s.Annotations[ClusterAnnotation]; cluster != rs.metadata.Cluster {
+		return fmt.Errorf("secret %s/%s belongs to cluster %q", s.Namespace, s.Name, cluster)
+	}
+	return nil
+}
+
+func (rs *RemoteSecretStore) remoteClient(ctx context.Context, ea emcv1beta1.EmergencyAccount) (client.Client, error) {
+	rc, err := rs.remoteClientFactory(ctx, rs.client, ea.Namespace, rs.spec)
+	if err != nil {
+		return nil, fmt.Errorf("unable to create remote client: %w", err)
+	}
+	return rc, nil
+}
@@ -0,0 +1,47 @@
+package stores
+
+import (
+	"crypto/sha256"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+func Test_remoteClientCache(t *testing.T) {
+	c := newRemoteClientCache()
+	created := 0
+	newClient := func() (client.Client, error) {
+		created++
+		return fake.NewClientBuilder().Build(), nil
+	}
+
+	a, err := c.get("default/a/kubeconfig", "config-1", newClient)
+	require.NoError(t, err)
+	b, err := c.get("default/b/kubeconfig", "config-1", newClient)
+	require.NoError(t, err)
+	require.Same(t, a, b, "should share the client of secrets holding the same kubeconfig")
+	require.Equal(t, 1, created)
+	require.Len(t, c.clients, 1)
+
+	rotated, err := c.get("default/a/kubeconfig", "config-2", newClient)
+	require.NoError(t, err)
+	require.NotSame(t, a, rotated)
+	require.Len(t, c.clients, 2, "should keep the client still used by another secret")
+
+	_, err = c.get("default/b/kubeconfig", "config-3", newClient)
+	require.NoError(t, err)
+	require.Len(t, c.clients, 2, "should evict the client no longer used by any secret")
+	require.NotContains(t, c.clients, sha256.Sum256([]byte("config-1")))
+
+	c.evict("default/a/kubeconfig")
+	require.Len(t, c.clients, 1, "should evict the client of a deleted secret")
+	require.NotContains(t, c.clients, sha256.Sum256([]byte("config-2")))
+	c.evict("default/missing/kubeconfig")
+	require.Len(t, c.clients, 1)
+
+	_, err = c.get("default/b/kubeconfig", "config-3", newClient)
+	require.NoError(t, err)
+	require.Equal(t, 3, created, "should reuse the cached client")
+}
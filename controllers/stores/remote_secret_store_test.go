@@ -0,0 +1,192 @@
+package stores_test
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	emcv1beta1 "github.com/appuio/emergency-credentials-controller/api/v1beta1"
+	"github.com/appuio/emergency-credentials-controller/controllers/stores"
+)
+
+func Test_RemoteSecretStore(t *testing.T) {
+	local := fakeClient(t)
+	remote := fakeClient(t)
+	ea := emcv1beta1.EmergencyAccount{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "test",
+			Namespace: "default",
+		},
+	}
+	spec := emcv1beta1.RemoteSecretStoreSpec{
+		Namespace:           "c-test",
+		KubeconfigSecretRef: emcv1beta1.RemoteKubeconfigSecretRef{Name: "management-kubeconfig"},
+	}
+
+	st := stores.NewRemoteSecretStoreWithClientFactory(spec, func(_ context.Context, c client.Client, namespace string, s emcv1beta1.RemoteSecretStoreSpec) (client.Client, error) {
+		require.Same(t, local, c, "should pass the local client to read the kubeconfig secret")
+		require.Equal(t, "default", namespace)
+		require.Equal(t, spec, s)
+		return remote, nil
+	})
+	require.NoError(t, st.ValidateSpec())
+	require.Equal(t, []string{"management-kubeconfig"}, st.ReferencedSecrets())
+	st.InjectClient(local)
+	expiration := time.Date(2023, 10, 30, 17, 57, 0, 0, time.UTC)
+	st.InjectTokenMetadata(stores.TokenMetadata{
+		Cluster:             "c-test",
+		ExpirationTimestamp: expiration,
+	})
+
+	ref, err := st.StoreToken(context.Background(), ea, "token")
+	require.NoError(t, err)
+	require.Equal(t, "c-test-default-test-1698688620", ref, "should name the secret after the cluster and the EmergencyAccount")
+
+	var secret corev1.Secret
+	require.NoError(t, remote.Get(context.Background(), types.NamespacedName{Name: ref, Namespace: "c-test"}, &secret))
+	require.Equal(t, "token", string(secret.Data["token"]))
+	require.Equal(t, map[string]string{
+		"emergency-credentials-controller.appuio.ch/valid-until":       "2023-10-30T17:57:00Z",
+		"emergency-credentials-controller.appuio.ch/emergency-account": "default/test",
+		"emergency-credentials-controller.appuio.ch/cluster":           "c-test",
+	}, secret.Annotations)
+	require.Empty(t, secret.OwnerReferences, "should not set an owner reference to an object of another cluster")
+	require.Error(t, local.Get(context.Background(), types.NamespacedName{Name: ref, Namespace: "default"}, &corev1.Secret{}), "should not write to the local cluster")
+
+	token, err := st.RetrieveToken(context.Background(), ea, ref)
+	require.NoError(t, err)
+	require.Equal(t, "token", token)
+
+	require.NoError(t, st.DeleteToken(context.Background(), ea, ref))
+	_, err = st.RetrieveToken(context.Background(), ea, ref)
+	require.ErrorContains(t, err, "unable to get secret")
+	require.NoError(t, st.DeleteToken(context.Background(), ea, ref), "deleting a missing token should not fail")
+
+	foreign := map[string]map[string]string{
+		"other account": {
+			"emergency-credentials-controller.appuio.ch/emergency-account": "default/other",
+			"emergency-credentials-controller.appuio.ch/cluster":           "c-test",
+		},
+		"other cluster": {
+			"emergency-credentials-controller.appuio.ch/emergency-account": "default/test",
+			"emergency-credentials-controller.appuio.ch/cluster":           "c-other",
+		},
+		"no cluster": {
+			"emergency-credentials-controller.appuio.ch/emergency-account": "default/test",
+		},
+	}
+	for name, annotations := range foreign {
+		require.NoError(t, remote.Create(context.Background(), &corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Name: ref, Namespace: "c-test", Annotations: annotations},
+			Data:       map[string][]byte{"token": []byte("foreign")},
+		}), name)
+
+		_, err = st.StoreToken(context.Background(), ea, "token")
+		require.ErrorContains(t, err, "belongs to", name)
+		_, err = st.RetrieveToken(context.Background(), ea, ref)
+		require.ErrorContains(t, err, "belongs to", name)
+		require.ErrorContains(t, st.DeleteToken(context.Background(), ea, ref), "belongs to", name)
+
+		require.NoError(t, remote.Get(context.Background(), types.NamespacedName{Name: ref, Namespace: "c-test"}, &secret), name)
+		require.Equal(t, "foreign", string(secret.Data["token"]), "should not overwrite the secret of another EmergencyAccount or cluster (%s)", name)
+		require.Equal(t, annotations, secret.Annotations, name)
+		require.NoError(t, remote.Delete(context.Background(), &secret), name)
+	}
+
+	legacy := corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: "test-1698688620", Namespace: "c-test", Annotations: map[string]string{
+			"emergency-credentials-controller.appuio.ch/emergency-account": "default/test",
+			"emergency-credentials-controller.appuio.ch/cluster":           "c-test",
+		}},
+		Data: map[string][]byte{"token": []byte("legacy")},
+	}
+	require.NoError(t, remote.Create(context.Background(), &legacy))
+	token, err = st.RetrieveToken(context.Background(), ea, legacy.Name)
+	require.NoError(t, err, "should read secrets named `<name>-<expiration>` by earlier versions")
+	require.Equal(t, "legacy", token)
+	require.NoError(t, st.DeleteToken(context.Background(), ea, legacy.Name))
+	require.Error(t, remote.Get(context.Background(), client.ObjectKeyFromObject(&legacy), &corev1.Secret{}), "should delete secrets named by earlier versions")
+
+	require.ErrorContains(t, stores.NewRemoteSecretStore(emcv1beta1.RemoteSecretStoreSpec{}).ValidateSpec(), "a remote namespace is required")
+	require.ErrorContains(t, stores.NewRemoteSecretStore(emcv1beta1.RemoteSecretStoreSpec{Namespace: "c-test"}).ValidateSpec(), "a kubeconfig secret is required")
+}
+
+func Test_DefaultRemoteClientFactory(t *testing.T) {
+	c := fakeClient(t,
+		&corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Name: "valid", Namespace: "default"},
+			Data: map[string][]byte{"custom": []byte(`apiVersion: v1
+kind: Config
+clusters:
+- name: management
+  cluster:
+    server: https://management.example.com:6443
+users:
+- name: controller
+  user:
+    token: token
+contexts:
+- name: management
+  context:
+    cluster: management
+    user: controller
+current-context: management
+`)},
+		},
+		&corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Name: "invalid", Namespace: "default"},
+			Data:       map[string][]byte{"kubeconfig": []byte("not a kubeconfig")},
+		},
+	)
+
+	rc, err := stores.DefaultRemoteClientFactory(context.Background(), c, "default", emcv1beta1.RemoteSecretStoreSpec{
+		KubeconfigSecretRef: emcv1beta1.RemoteKubeconfigSecretRef{Name: "valid", Key: "custom"},
+	})
+	require.NoError(t, err)
+	cached, err := stores.DefaultRemoteClientFactory(context.Background(), c, "default", emcv1beta1.RemoteSecretStoreSpec{
+		KubeconfigSecretRef: emcv1beta1.RemoteKubeconfigSecretRef{Name: "valid", Key: "custom"},
+	})
+	require.NoError(t, err)
+	require.Same(t, rc, cached, "should reuse the client for the same kubeconfig")
+	var copied corev1.Secret
+	require.NoError(t, c.Get(context.Background(), types.NamespacedName{Name: "valid", Namespace: "default"}, &copied))
+	copied.ObjectMeta = metav1.ObjectMeta{Name: "copy", Namespace: "default"}
+	require.NoError(t, c.Create(context.Background(), &copied))
+	shared, err := stores.DefaultRemoteClientFactory(context.Background(), c, "default", emcv1beta1.RemoteSecretStoreSpec{
+		KubeconfigSecretRef: emcv1beta1.RemoteKubeconfigSecretRef{Name: "copy", Key: "custom"},
+	})
+	require.NoError(t, err)
+	require.Same(t, rc, shared, "should share the client of secrets holding the same kubeconfig")
+
+	var valid corev1.Secret
+	require.NoError(t, c.Get(context.Background(), types.NamespacedName{Name: "valid", Namespace: "default"}, &valid))
+	valid.Data["custom"] = []byte(strings.Replace(string(valid.Data["custom"]), "token: token", "token: rotated", 1))
+	require.NoError(t, c.Update(context.Background(), &valid))
+	rotated, err := stores.DefaultRemoteClientFactory(context.Background(), c, "default", emcv1beta1.RemoteSecretStoreSpec{
+		KubeconfigSecretRef: emcv1beta1.RemoteKubeconfigSecretRef{Name: "valid", Key: "custom"},
+	})
+	require.NoError(t, err)
+	require.NotSame(t, rc, rotated, "should create a new client if the kubeconfig changed")
+
+	_, err = stores.DefaultRemoteClientFactory(context.Background(), c, "default", emcv1beta1.RemoteSecretStoreSpec{
+		KubeconfigSecretRef: emcv1beta1.RemoteKubeconfigSecretRef{Name: "valid"},
+	})
+	require.ErrorContains(t, err, `does not contain key "kubeconfig"`)
+
+	_, err = stores.DefaultRemoteClientFactory(context.Background(), c, "default", emcv1beta1.RemoteSecretStoreSpec{
+		KubeconfigSecretRef: emcv1beta1.RemoteKubeconfigSecretRef{Name: "invalid"},
+	})
+	require.ErrorContains(t, err, "unable to parse kubeconfig")
+
+	_, err = stores.DefaultRemoteClientFactory(context.Background(), c, "other", emcv1beta1.RemoteSecretStoreSpec{
+		KubeconfigSecretRef: emcv1beta1.RemoteKubeconfigSecretRef{Name: "valid"},
+	})
+	require.ErrorContains(t, err, "unable to get secret")
+}
@@ -2,33 +2,60 @@ package stores
 
 import (
 	"context"
-	"encoding/json"
 	"fmt"
 	"io"
 	"strings"
 	"text/template"
 
-	"github.com/Masterminds/sprig/v3"
-	"github.com/ProtonMail/gopenpgp/v2/helper"
-	"github.com/appuio/emergency-credentials-controller/pkg/utils"
 	"github.com/minio/minio-go/v7"
 	"github.com/minio/minio-go/v7/pkg/credentials"
-	"go.uber.org/multierr"
+	"sigs.k8s.io/controller-runtime/pkg/client"
 
 	emcv1beta1 "github.com/appuio/emergency-credentials-controller/api/v1beta1"
 )
 
 // MinioClient partially implements the minio.Client interface.
+// GetObject returns an io.ReadCloser instead of a *minio.Object to allow mocking.
 type MinioClient interface {
 	PutObject(ctx context.Context, bucketName string, objectName string, reader io.Reader, objectSize int64, opts minio.PutObjectOptions) (info minio.UploadInfo, err error)
+	GetObject(ctx context.Context, bucketName string, objectName string, opts minio.GetObjectOptions) (io.ReadCloser, error)
+	StatObject(ctx context.Context, bucketName string, objectName string, opts minio.StatObjectOptions) (minio.ObjectInfo, error)
 }
 
+// minioClient adapts a *minio.Client to the MinioClient interface.
+type minioClient struct {
+	*minio.Client
+}
+
+// GetObject returns the object as an io.ReadCloser.
+func (c minioClient) GetObject(ctx context.Context, bucketName string, objectName string, opts minio.GetObjectOptions) (io.ReadCloser, error) {
+	return c.Client.GetObject(ctx, bucketName, objectName, opts)
+}
+
+// MinioClientFactory creates a MinioClient for the given spec.
+// The client can be used to read referenced secrets from the given namespace.
+type MinioClientFactory func(ctx context.Context, c client.Client, namespace string, spec emcv1beta1.S3StoreSpec) (MinioClient, error)
+
 type S3Store struct {
-	minioClientFactory func(emcv1beta1.S3StoreSpec) (MinioClient, error)
+	minioClientFactory MinioClientFactory
 	spec               emcv1beta1.S3StoreSpec
+	client             client.Client
+	metadata           TokenMetadata
 }
 
 var _ TokenStorer = &S3Store{}
+var _ TokenRetriever = &S3Store{}
+var _ ClientInjector = &S3Store{}
+var _ SecretReferencer = &S3Store{}
+var _ SpecValidator = &S3Store{}
+var _ MetadataInjector = &S3Store{}
+
+const (
+	// DefaultS3AccessKeyIdKey is the default key of the access key id in the credentials secret.
+	DefaultS3AccessKeyIdKey = "accessKeyId"
+	// DefaultS3SecretAccessKeyKey is the default key of the secret access key in the credentials secret.
+	DefaultS3SecretAccessKeyKey = "secretAccessKey"
+)
 
 // NewS3Store creates a new S3Store
 func NewS3Store(spec emcv1beta1.S3StoreSpec) *S3Store {
@@ -36,52 +63,87 @@ func NewS3Store(spec emcv1beta1.S3StoreSpec) *S3Store {
 }
 
 // NewS3StoreWithClientFactory creates a new S3Store with the given client factory.
-func NewS3StoreWithClientFactory(spec emcv1beta1.S3StoreSpec, minioClientFactory func(emcv1beta1.S3StoreSpec) (MinioClient, error)) *S3Store {
+func NewS3StoreWithClientFactory(spec emcv1beta1.S3StoreSpec, minioClientFactory MinioClientFactory) *S3Store {
 	return &S3Store{spec: spec, minioClientFactory: minioClientFactory}
 }
 
+// InjectClient injects the client into the S3Store.
+// The client is used to read the credentials secret.
+func (ss *S3Store) InjectClient(c client.Client) {
+	ss.client = c
+}
+
+// InjectTokenMetadata injects the metadata of the token to store.
+// The metadata is recorded in the envelope of encrypted tokens.
+func (ss *S3Store) InjectTokenMetadata(md TokenMetadata) {
+	ss.metadata = md
+}
+
+// ReferencedSecrets returns the name of the credentials secret if one is configured.
+func (ss *S3Store) ReferencedSecrets() []string {
+	if ss.spec.S3.CredentialsSecretRef == nil {
+		return nil
+	}
+	return []string{ss.spec.S3.CredentialsSecretRef.Name}
+}
+
 // DefaultClientFactory is the default factory for creating a MinioClient.
-func DefaultClientFactory(spec emcv1beta1.S3StoreSpec) (MinioClient, error) {
-	return minio.New(spec.S3.Endpoint, &minio.Options{
-		Creds:  credentials.NewStaticV4(spec.S3.AccessKeyId, spec.S3.SecretAccessKey, ""),
+// The credentials are read from the referenced secret if set, otherwise the inline credentials are used.
+func DefaultClientFactory(ctx context.Context, c client.Client, namespace string, spec emcv1beta1.S3StoreSpec) (MinioClient, error) {
+	accessKeyId, secretAccessKey := spec.S3.AccessKeyId, spec.S3.SecretAccessKey
+	if ref := spec.S3.CredentialsSecretRef; ref != nil {
+		var err error
+		accessKeyId, secretAccessKey, err = credentialsFromSecret(ctx, c, namespace, *ref)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	mc, err := minio.New(spec.S3.Endpoint, &minio.Options{
+		Creds:  credentials.NewStaticV4(accessKeyId, secretAccessKey, ""),
 		Secure: !spec.S3.Insecure,
 		Region: spec.S3.Region,
 	})
+	if err != nil {
+		return nil, err
+	}
+	return minioClient{mc}, nil
+}
+
+// credentialsFromSecret reads the S3 credentials from the referenced secret.
+func credentialsFromSecret(ctx context.Context, c client.Client, namespace string, ref emcv1beta1.S3CredentialsSecretRef) (accessKeyId, secretAccessKey string, err error) {
+	idKey := ref.AccessKeyIdKey
+	if idKey == "" {
+		idKey = DefaultS3AccessKeyIdKey
+	}
+	secretKey := ref.SecretAccessKeyKey
+	if secretKey == "" {
+		secretKey = DefaultS3SecretAccessKeyKey
+	}
+
+	data, err := readSecretKeys(ctx, c, namespace, ref.Name, idKey, secretKey)
+	if err != nil {
+		return "", "", fmt.Errorf("unable to read credentials: %w", err)
+	}
+	return data[idKey], data[secretKey], nil
 }
 
 // StoreToken stores the token in the S3 bucket.
-// If encryption is enabled, the token is encrypted with the given PGP public keys.
+// If encryption is enabled, the token is encrypted with the given PGP public keys or age recipients.
+// The returned reference contains the object name and the digest of the stored payload.
 func (ss *S3Store) StoreToken(ctx context.Context, ea emcv1beta1.EmergencyAccount, token string) (string, error) {
-	objectname := ea.Name
-	if ss.spec.ObjectNameTemplate != "" {
-		t, err := template.New("fileName").Funcs(sprig.TxtFuncMap()).Parse(ss.spec.ObjectNameTemplate)
-		if err != nil {
-			return "", fmt.Errorf("unable to parse file name template: %w", err)
-		}
-		buf := new(strings.Builder)
-		if err := t.Execute(buf, struct {
-			Name             string
-			Namespace        string
-			EmergencyAccount emcv1beta1.EmergencyAccount
-			Context          map[string]string
-		}{
-			Name:             ea.Name,
-			Namespace:        ea.Namespace,
-			EmergencyAccount: ea,
-			Context:          ss.spec.ObjectNameTemplateContext,
-		}); err != nil {
-			return "", fmt.Errorf("unable to execute file name template: %w", err)
-		}
-		objectname = buf.String()
+	objectname, err := ss.ObjectName(ea)
+	if err != nil {
+		return "", err
 	}
 
-	cli, err := ss.minioClientFactory(ss.spec)
+	cli, err := ss.minioClientFactory(ctx, ss.client, ea.Namespace, ss.spec)
 	if err != nil {
 		return "", fmt.Errorf("unable to create S3 client: %w", err)
 	}
 
 	if ss.spec.Encryption.Encrypt {
-		token, err = encrypt(token, ss.spec.Encryption.PGPKeys)
+		token, err = encrypt(token, ss.spec.Encryption, encryptedTokenMetadata(ea, ss.metadata))
 		if err != nil {
 			return "", fmt.Errorf("unable to encrypt token: %w", err)
 		}
@@ -93,54 +155,79 @@ func (ss *S3Store) StoreToken(ctx context.Context, ea emcv1beta1.EmergencyAccoun
 		return "", fmt.Errorf("unable to store token: %w", err)
 	}
 
-	return info.Key, nil
+	return info.Key + refDigestSeparator + payloadDigest([]byte(token)), nil
 }
 
-// EncryptedToken is the JSON structure of an encrypted token.
-type EncryptedToken struct {
-	Secrets []EncryptedTokenSecret `json:"secrets"`
+// ObjectName returns the name of the object the token of the EmergencyAccount is stored in.
+// The name is rendered from the object name template if set, otherwise it is the name of the EmergencyAccount.
+func (ss *S3Store) ObjectName(ea emcv1beta1.EmergencyAccount) (string, error) {
+	if ss.spec.ObjectNameTemplate == "" {
+		return ea.Name, nil
+	}
+	t, err := ss.objectNameTemplate()
+	if err != nil {
+		return "", err
+	}
+	name, err := executeNameTemplate(t, ea, ss.spec.ObjectNameTemplateContext, ss.metadata.ExpirationTimestamp)
+	if err != nil {
+		return "", fmt.Errorf("unable to execute file name template: %w", err)
+	}
+	return name, nil
 }
 
-// EncryptedTokenSecret is the JSON structure of an encrypted token secret.
-type EncryptedTokenSecret struct {
-	Data string `json:"data"`
+// ValidateSpec validates the object name template and the encryption keys.
+func (ss *S3Store) ValidateSpec() error {
+	if ss.spec.ObjectNameTemplate != "" {
+		if _, err := ss.objectNameTemplate(); err != nil {
+			return err
+		}
+	}
+	if ss.spec.Encryption.Encrypt {
+		return validateEncryption(ss.spec.Encryption)
+	}
+	return nil
 }
 
-// encrypt encrypts the token with the given PGP public keys.
-// The token is encrypted with each key and the resulting encrypted tokens are returned as a JSON array.
-func encrypt(token string, pgpKeys []string) (string, error) {
-	if len(pgpKeys) == 0 {
-		return "", fmt.Errorf("no PGP public keys given")
+// objectNameTemplate parses the object name template.
+func (ss *S3Store) objectNameTemplate() (*template.Template, error) {
+	t, err := parseNameTemplate("fileName", ss.spec.ObjectNameTemplate)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse file name template: %w", err)
 	}
-	keys := []string{}
-	for _, key := range pgpKeys {
-		sk, err := utils.SplitPublicKeyBlocks(key)
-		if err != nil {
-			return "", fmt.Errorf("unable to parse PGP public key: %w", err)
-		}
-		keys = append(keys, sk...)
+	return t, nil
+}
+
+// RetrieveToken retrieves the token from the S3 bucket.
+// The stored payload is compared against the digest in the reference, a deleted or overwritten object fails the retrieval.
+// If encryption is enabled, the token can't be retrieved and ErrTokenNotRetrievable is returned after a successful integrity check.
+func (ss *S3Store) RetrieveToken(ctx context.Context, ea emcv1beta1.EmergencyAccount, ref string) (string, error) {
+	objectname, digest := splitRefDigest(ref)
+
+	cli, err := ss.minioClientFactory(ctx, ss.client, ea.Namespace, ss.spec)
+	if err != nil {
+		return "", fmt.Errorf("unable to create S3 client: %w", err)
 	}
 
-	encrypted := make([]EncryptedTokenSecret, 0, len(keys))
-	errs := []error{}
-	for _, key := range keys {
-		enc, err := helper.EncryptMessageArmored((key), token)
-		if err != nil {
-			errs = append(errs, err)
-			continue
-		}
-		encrypted = append(encrypted, EncryptedTokenSecret{Data: enc})
+	if _, err := cli.StatObject(ctx, ss.spec.S3.Bucket, objectname, minio.StatObjectOptions{}); err != nil {
+		return "", fmt.Errorf("unable to stat object %q: %w", objectname, err)
+	}
+	obj, err := cli.GetObject(ctx, ss.spec.S3.Bucket, objectname, minio.GetObjectOptions{})
+	if err != nil {
+		return "", fmt.Errorf("unable to get object %q: %w", objectname, err)
 	}
-	if multierr.Combine(errs...) != nil {
-		return "", fmt.Errorf("unable to fully encrypt token: %w", multierr.Combine(errs...))
+	defer obj.Close()
+	payload, err := io.ReadAll(obj)
+	if err != nil {
+		return "", fmt.Errorf("unable to read object %q: %w", objectname, err)
 	}
 
-	s, err := json.Marshal(EncryptedToken{
-		Secrets: encrypted,
-	})
-	if err != nil {
-		return "", fmt.Errorf("unable to marshal encrypted token: %w", err)
+	if digest != "" && payloadDigest(payload) != digest {
+		return "", fmt.Errorf("object %q does not match the stored digest, it was modified or overwritten", objectname)
+	}
+
+	if ss.spec.Encryption.Encrypt {
+		return "", verifyEncryptedToken(objectname, string(payload))
 	}
 
-	return string(s), nil
+	return string(payload), nil
 }
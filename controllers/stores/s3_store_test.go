@@ -1,21 +1,31 @@
 package stores_test
 
 import (
+	"bytes"
 	"context"
+	"crypto/ed25519"
+	"crypto/rand"
 	"crypto/sha256"
 	"encoding/json"
 	"fmt"
 	"io"
 	"strings"
 	"testing"
+	"time"
 
+	"filippo.io/age"
+	"filippo.io/age/agessh"
+	"filippo.io/age/armor"
 	"github.com/ProtonMail/gopenpgp/v2/crypto"
 	"github.com/ProtonMail/gopenpgp/v2/helper"
 	emcv1beta1 "github.com/appuio/emergency-credentials-controller/api/v1beta1"
 	"github.com/appuio/emergency-credentials-controller/controllers/stores"
 	"github.com/minio/minio-go/v7"
 	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ssh"
+	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
 )
 
 func Test_S3Store_StoreToken(t *testing.T) {
@@ -65,16 +75,285 @@ func Test_S3Store_StoreToken(t *testing.T) {
 			},
 		}, mm.ClientFactory)
 
+		expiration := time.Date(2023, 10, 30, 17, 57, 0, 0, time.UTC)
+		st.InjectTokenMetadata(stores.TokenMetadata{
+			Cluster:             "c-test",
+			UID:                 "token-uid",
+			ExpirationTimestamp: expiration,
+		})
 		_, err = st.StoreToken(context.Background(), emcv1beta1.EmergencyAccount{
 			ObjectMeta: metav1.ObjectMeta{
-				Name: object,
+				Name:      object,
+				Namespace: "ns",
 			},
 		}, token)
 		require.NoError(t, err)
 		requireDecryptAll(t, string(mm.get(bucket, object)), token, passphrase, []string{privk1, privk2, privk3})
+
+		var et stores.EncryptedToken
+		require.NoError(t, json.Unmarshal(mm.get(bucket, object), &et))
+		require.Equal(t, stores.EncryptedTokenVersion, et.Version)
+		require.Equal(t, stores.EncryptedTokenMetadata{
+			Cluster:             "c-test",
+			Namespace:           "ns",
+			EmergencyAccount:    object,
+			TokenUID:            "token-uid",
+			ExpirationTimestamp: &expiration,
+		}, et.Metadata)
+		require.Len(t, et.Secrets, 3)
+		for i, privk := range []string{privk1, privk2, privk3} {
+			key, err := crypto.NewKeyFromArmored(privk)
+			require.NoError(t, err)
+			secret := et.Secrets[i]
+			require.Equal(t, key.GetFingerprint(), secret.Fingerprint)
+			require.Equal(t, key.GetHexKeyID(), secret.KeyID)
+			require.Equal(t, fmt.Sprintf("test%d <test%d@test.ch>", i+1, i+1), secret.UserID)
+			requireDecrypt(t, secret.Data, token, passphrase, []string{privk})
+		}
+	})
+
+	t.Run("encrypted with age", func(t *testing.T) {
+		x25519, err := age.GenerateX25519Identity()
+		require.NoError(t, err)
+		sshPub, sshPriv, err := ed25519.GenerateKey(rand.Reader)
+		require.NoError(t, err)
+		sshKey, err := ssh.NewPublicKey(sshPub)
+		require.NoError(t, err)
+		sshIdentity, err := agessh.NewEd25519Identity(sshPriv)
+		require.NoError(t, err)
+		sshRecipient := strings.TrimSpace(string(ssh.MarshalAuthorizedKey(sshKey)))
+
+		mm := &MinioMock{}
+		st := stores.NewS3StoreWithClientFactory(emcv1beta1.S3StoreSpec{
+			S3: emcv1beta1.S3Spec{
+				Bucket: bucket,
+			},
+			Encryption: emcv1beta1.S3EncryptionSpec{
+				Encrypt: true,
+				Scheme:  emcv1beta1.EncryptionSchemeAge,
+				AgeRecipients: []string{
+					"# on-call\n" + x25519.Recipient().String(),
+					sshRecipient + " jane@example.com",
+				},
+			},
+		}, mm.ClientFactory)
+
+		_, err = st.StoreToken(context.Background(), emcv1beta1.EmergencyAccount{
+			ObjectMeta: metav1.ObjectMeta{
+				Name: object,
+			},
+		}, token)
+		require.NoError(t, err)
+
+		var et stores.EncryptedToken
+		require.NoError(t, json.Unmarshal(mm.get(bucket, object), &et))
+		require.Equal(t, stores.EncryptedTokenVersion, et.Version)
+		require.Len(t, et.Secrets, 2)
+		require.Equal(t, emcv1beta1.EncryptionSchemeAge, et.Secrets[0].Scheme)
+		require.Equal(t, x25519.Recipient().String(), et.Secrets[0].Recipient)
+		require.Equal(t, emcv1beta1.EncryptionSchemeAge, et.Secrets[1].Scheme)
+		require.Equal(t, sshRecipient, et.Secrets[1].Recipient)
+		require.Equal(t, ssh.FingerprintSHA256(sshKey), et.Secrets[1].Fingerprint)
+		require.Equal(t, "jane@example.com", et.Secrets[1].UserID)
+		for i, identity := range []age.Identity{x25519, sshIdentity} {
+			r, err := age.Decrypt(armor.NewReader(strings.NewReader(et.Secrets[i].Data)), identity)
+			require.NoError(t, err)
+			msg, err := io.ReadAll(r)
+			require.NoError(t, err)
+			require.Equal(t, token, string(msg))
+		}
 	})
 }
 
+func Test_S3Store_ValidateSpec(t *testing.T) {
+	privk, pubk, err := generateKeyPair("test1", "test1@test.ch", "passphrase", "x25519", 0)
+	require.NoError(t, err)
+
+	tcs := map[string]struct {
+		spec   emcv1beta1.S3StoreSpec
+		errMsg string
+	}{
+		"valid": {
+			spec: emcv1beta1.S3StoreSpec{
+				ObjectNameTemplate: "em-{{ .Name | sha256sum }}",
+				Encryption:         emcv1beta1.S3EncryptionSpec{Encrypt: true, PGPKeys: []string{pubk}},
+			},
+		},
+		"broken template": {
+			spec:   emcv1beta1.S3StoreSpec{ObjectNameTemplate: "em-{{ .Name "},
+			errMsg: "unable to parse file name template",
+		},
+		"unknown template function": {
+			spec:   emcv1beta1.S3StoreSpec{ObjectNameTemplate: "em-{{ .Name | notafunc }}"},
+			errMsg: "unable to parse file name template",
+		},
+		"encrypt without keys": {
+			spec:   emcv1beta1.S3StoreSpec{Encryption: emcv1beta1.S3EncryptionSpec{Encrypt: true}},
+			errMsg: "no PGP public keys given",
+		},
+		"malformed key": {
+			spec: emcv1beta1.S3StoreSpec{Encryption: emcv1beta1.S3EncryptionSpec{Encrypt: true, PGPKeys: []string{
+				"-----BEGIN PGP PUBLIC KEY BLOCK-----\nnotakey\n-----END PGP PUBLIC KEY BLOCK-----",
+			}}},
+			errMsg: "unable to parse PGP public key 0",
+		},
+		"private key": {
+			spec:   emcv1beta1.S3StoreSpec{Encryption: emcv1beta1.S3EncryptionSpec{Encrypt: true, PGPKeys: []string{pubk, privk}}},
+			errMsg: "PGP public key 1 does not contain a public key block",
+		},
+		"valid age": {
+			spec: emcv1beta1.S3StoreSpec{Encryption: emcv1beta1.S3EncryptionSpec{Encrypt: true, Scheme: emcv1beta1.EncryptionSchemeAge, AgeRecipients: []string{
+				"age1ql3z7hjy54pw3hyww5ayyfg7zqgvc7w3j2elw8zmrj2kg5sfn9aqmcac8p\nssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIHsKLqeplhpW+uObz5dvMgjz1OxfM/XXUB+VHtZ6isGN jane@example.com",
+			}}},
+		},
+		"age without recipients": {
+			spec:   emcv1beta1.S3StoreSpec{Encryption: emcv1beta1.S3EncryptionSpec{Encrypt: true, Scheme: emcv1beta1.EncryptionSchemeAge, PGPKeys: []string{pubk}}},
+			errMsg: "no age recipients given",
+		},
+		"malformed age recipient": {
+			spec:   emcv1beta1.S3StoreSpec{Encryption: emcv1beta1.S3EncryptionSpec{Encrypt: true, Scheme: emcv1beta1.EncryptionSchemeAge, AgeRecipients: []string{"age1notarecipient"}}},
+			errMsg: "unable to parse age recipients 0",
+		},
+		"unsupported SSH key": {
+			spec: emcv1beta1.S3StoreSpec{Encryption: emcv1beta1.S3EncryptionSpec{Encrypt: true, Scheme: emcv1beta1.EncryptionSchemeAge, AgeRecipients: []string{
+				"ecdsa-sha2-nistp256 AAAAE2VjZHNhLXNoYTItbmlzdHAyNTYAAAAIbmlzdHAyNTY=",
+			}}},
+			errMsg: "unable to parse age recipients 0: line 1",
+		},
+		"comments only": {
+			spec:   emcv1beta1.S3StoreSpec{Encryption: emcv1beta1.S3EncryptionSpec{Encrypt: true, Scheme: emcv1beta1.EncryptionSchemeAge, AgeRecipients: []string{"# nobody"}}},
+			errMsg: "age recipients 0 does not contain a recipient",
+		},
+		"unknown scheme": {
+			spec:   emcv1beta1.S3StoreSpec{Encryption: emcv1beta1.S3EncryptionSpec{Encrypt: true, Scheme: "rot13"}},
+			errMsg: `unknown encryption scheme "rot13"`,
+		},
+		"keys ignored without encryption": {
+			spec: emcv1beta1.S3StoreSpec{Encryption: emcv1beta1.S3EncryptionSpec{PGPKeys: []string{"invalid"}}},
+		},
+	}
+
+	for name, tc := range tcs {
+		t.Run(name, func(t *testing.T) {
+			err := stores.NewS3Store(tc.spec).ValidateSpec()
+			if tc.errMsg == "" {
+				require.NoError(t, err)
+				return
+			}
+			require.ErrorContains(t, err, tc.errMsg)
+		})
+	}
+}
+
+func Test_S3Store_RetrieveToken(t *testing.T) {
+	const (
+		token      = "token"
+		bucket     = "bucket"
+		object     = "object"
+		passphrase = "passphrase"
+	)
+	ea := emcv1beta1.EmergencyAccount{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: object,
+		},
+	}
+
+	t.Run("without encryption", func(t *testing.T) {
+		mm := &MinioMock{}
+		st := stores.NewS3StoreWithClientFactory(emcv1beta1.S3StoreSpec{
+			S3: emcv1beta1.S3Spec{
+				Bucket: bucket,
+			},
+		}, mm.ClientFactory)
+
+		ref, err := st.StoreToken(context.Background(), ea, token)
+		require.NoError(t, err)
+		retrieved, err := st.RetrieveToken(context.Background(), ea, ref)
+		require.NoError(t, err)
+		require.Equal(t, token, retrieved)
+
+		_, err = st.StoreToken(context.Background(), ea, "newtoken")
+		require.NoError(t, err)
+		_, err = st.RetrieveToken(context.Background(), ea, ref)
+		require.ErrorContains(t, err, "does not match the stored digest", "overwritten object should fail verification")
+
+		mm.set(bucket, object, nil)
+		_, err = st.RetrieveToken(context.Background(), ea, ref)
+		require.ErrorContains(t, err, "unable to stat object", "deleted object should fail verification")
+
+		mm.set(bucket, object, []byte(token))
+		retrieved, err = st.RetrieveToken(context.Background(), ea, object)
+		require.NoError(t, err, "reference without digest should be retrievable")
+		require.Equal(t, token, retrieved)
+	})
+
+	t.Run("encrypted", func(t *testing.T) {
+		_, pubk, err := generateKeyPair("test1", "test1@test.ch", passphrase, "rsa", 2048)
+		require.NoError(t, err)
+
+		mm := &MinioMock{}
+		st := stores.NewS3StoreWithClientFactory(emcv1beta1.S3StoreSpec{
+			S3: emcv1beta1.S3Spec{
+				Bucket: bucket,
+			},
+			Encryption: emcv1beta1.S3EncryptionSpec{
+				Encrypt: true,
+				PGPKeys: []string{pubk},
+			},
+		}, mm.ClientFactory)
+
+		ref, err := st.StoreToken(context.Background(), ea, token)
+		require.NoError(t, err)
+		_, err = st.RetrieveToken(context.Background(), ea, ref)
+		require.ErrorIs(t, err, stores.ErrTokenNotRetrievable)
+
+		stored := mm.get(bucket, object)
+		mm.set(bucket, object, append(bytes.Clone(stored[:len(stored)-2]), []byte("x}")...))
+		_, err = st.RetrieveToken(context.Background(), ea, ref)
+		require.ErrorContains(t, err, "does not match the stored digest", "corrupted object should fail verification")
+		require.NotErrorIs(t, err, stores.ErrTokenNotRetrievable)
+	})
+}
+
+func Test_DefaultClientFactory_CredentialsSecretRef(t *testing.T) {
+	c := fakeClient(t, &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "s3-creds",
+			Namespace: "default",
+		},
+		Data: map[string][]byte{
+			"accessKeyId": []byte("id"),
+			"custom":      []byte("secret"),
+		},
+	})
+
+	spec := emcv1beta1.S3StoreSpec{
+		S3: emcv1beta1.S3Spec{
+			Endpoint: "localhost:9000",
+			CredentialsSecretRef: &emcv1beta1.S3CredentialsSecretRef{
+				Name:               "s3-creds",
+				SecretAccessKeyKey: "custom",
+			},
+		},
+	}
+
+	_, err := stores.DefaultClientFactory(context.Background(), c, "default", spec)
+	require.NoError(t, err)
+
+	_, err = stores.DefaultClientFactory(context.Background(), c, "other", spec)
+	require.ErrorContains(t, err, `unable to read credentials: unable to get secret "s3-creds"`)
+
+	spec.S3.CredentialsSecretRef.SecretAccessKeyKey = "missing"
+	_, err = stores.DefaultClientFactory(context.Background(), c, "default", spec)
+	require.ErrorContains(t, err, `secret "s3-creds" does not contain key "missing"`)
+
+	_, err = stores.DefaultClientFactory(context.Background(), nil, "default", spec)
+	require.ErrorContains(t, err, `no client injected, unable to read secret "s3-creds"`)
+
+	require.Equal(t, []string{"s3-creds"}, stores.NewS3Store(spec).ReferencedSecrets())
+	require.Empty(t, stores.NewS3Store(emcv1beta1.S3StoreSpec{}).ReferencedSecrets())
+}
+
 func requireDecryptAll(t *testing.T, token, expectedMsg, passphrase string, keys []string) {
 	t.Helper()
 
@@ -105,7 +384,7 @@ type MinioMock struct {
 }
 
 // ClientFactory returns itself.
-func (mm *MinioMock) ClientFactory(emcv1beta1.S3StoreSpec) (stores.MinioClient, error) {
+func (mm *MinioMock) ClientFactory(context.Context, client.Client, string, emcv1beta1.S3StoreSpec) (stores.MinioClient, error) {
 	return mm, nil
 }
 
@@ -129,6 +408,32 @@ func (mm *MinioMock) PutObject(ctx context.Context, bucketName string, objectNam
 	return info, nil
 }
 
+// GetObject implements the MinioClient interface.
+func (mm *MinioMock) GetObject(ctx context.Context, bucketName string, objectName string, opts minio.GetObjectOptions) (io.ReadCloser, error) {
+	f := mm.get(bucketName, objectName)
+	if f == nil {
+		return nil, fmt.Errorf("object %q not found", objectName)
+	}
+	return io.NopCloser(bytes.NewReader(f)), nil
+}
+
+// StatObject implements the MinioClient interface.
+func (mm *MinioMock) StatObject(ctx context.Context, bucketName string, objectName string, opts minio.StatObjectOptions) (minio.ObjectInfo, error) {
+	f := mm.get(bucketName, objectName)
+	if f == nil {
+		return minio.ObjectInfo{}, fmt.Errorf("object %q not found", objectName)
+	}
+	return minio.ObjectInfo{Key: objectName, Size: int64(len(f))}, nil
+}
+
+func (mm *MinioMock) set(bucketName string, objectName string, data []byte) {
+	if data == nil {
+		delete(mm.files[bucketName], objectName)
+		return
+	}
+	mm.files[bucketName][objectName] = data
+}
+
 func (mm *MinioMock) get(bucketName string, objectName string) []byte {
 	if mm.files == nil {
 		return nil
@@ -3,12 +3,16 @@ package stores
 import (
 	"context"
 	"fmt"
+	"slices"
 	"strconv"
+	"text/template"
 	"time"
 
 	emcv1beta1 "github.com/appuio/emergency-credentials-controller/api/v1beta1"
 	"github.com/appuio/emergency-credentials-controller/pkg/utils"
+	"go.uber.org/multierr"
 	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/types"
 	"sigs.k8s.io/controller-runtime/pkg/client"
@@ -16,16 +20,45 @@ import (
 	"sigs.k8s.io/controller-runtime/pkg/log"
 )
 
-//+kubebuilder:rbac:groups="",resources=secrets,verbs=get;list;watch;create;update;patch,namespace="system"
+// Secrets in other namespaces require Roles in the --secret-namespaces, replication the opt-in config/components/secret-replication ClusterRole.
+//+kubebuilder:rbac:groups="",resources=secrets,verbs=get;list;watch;create;update;patch;delete,namespace="system"
+//+kubebuilder:rbac:groups="",resources=namespaces,verbs=get;list;watch
+
+const (
+	// DefaultSecretKey is the default key of the token in the data of the secret.
+	DefaultSecretKey = "token"
+
+	// ValidUntilAnnotation records the expiration of the token in the secret.
+	ValidUntilAnnotation = "emergency-credentials-controller.appuio.ch/valid-until"
+	// EmergencyAccountAnnotation records the EmergencyAccount a secret not owned by the EmergencyAccount was created for as `<namespace>/<name>`.
+	EmergencyAccountAnnotation = "emergency-credentials-controller.appuio.ch/emergency-account"
+	// ClusterAnnotation records the cluster a secret on a remote cluster was created for.
+	ClusterAnnotation = "emergency-credentials-controller.appuio.ch/cluster"
+	// ReplicaOfAnnotation records the secret a replicated secret is a copy of as `<namespace>/<name>`.
+	ReplicaOfAnnotation = "emergency-credentials-controller.appuio.ch/replica-of"
+
+	// EmergencyAccountNameLabel is set on objects managed for an EmergencyAccount that can't be owned by it, like replicated secrets.
+	// It contains the name of the EmergencyAccount.
+	EmergencyAccountNameLabel = "emergency-credentials-controller.appuio.ch/emergency-account"
+	// EmergencyAccountNamespaceLabel is set on objects managed for an EmergencyAccount that can't be owned by it, like replicated secrets.
+	// It contains the namespace of the EmergencyAccount.
+	EmergencyAccountNamespaceLabel = "emergency-credentials-controller.appuio.ch/emergency-account-namespace"
+)
 
 type SecretStore struct {
 	SecretStoreSpec emcv1beta1.SecretStoreSpec
 	Client          client.Client
+
+	metadata TokenMetadata
 }
 
 var _ TokenStorer = &SecretStore{}
 var _ ClientInjector = &SecretStore{}
 var _ TokenRetriever = &SecretStore{}
+var _ TokenDeleter = &SecretStore{}
+var _ MetadataInjector = &SecretStore{}
+var _ SpecValidator = &SecretStore{}
+var _ TokenSyncer = &SecretStore{}
 
 func NewSecretStore(sts emcv1beta1.SecretStoreSpec) *SecretStore {
 	return &SecretStore{
@@ -38,54 +71,368 @@ func (ss *SecretStore) InjectClient(c client.Client) {
 	ss.Client = c
 }
 
+// InjectTokenMetadata injects the metadata of the token to store.
+// The expiration of the token is taken from the metadata, the stored payload might be encrypted.
+func (ss *SecretStore) InjectTokenMetadata(md TokenMetadata) {
+	ss.metadata = md
+}
+
+// ValidateSpec validates the name template and the namespace selector of the replication.
+func (ss *SecretStore) ValidateSpec() error {
+	if ss.SecretStoreSpec.NameTemplate != "" {
+		if _, err := ss.nameTemplate(); err != nil {
+			return err
+		}
+	}
+	if sel := ss.SecretStoreSpec.Replication.NamespaceSelector; sel != nil {
+		if _, err := metav1.LabelSelectorAsSelector(sel); err != nil {
+			return fmt.Errorf("invalid replication namespace selector: %w", err)
+		}
+	}
+	return nil
+}
+
+// StoreToken stores the token in a secret named after the EmergencyAccount and the expiration of the token, or after the name template if set.
+// The token can also be a client certificate or a kubeconfig, the expiration is read from the contained credential if no metadata was injected.
+// Secrets named by a template might be overwritten by later tokens, the digest of the token is added to the returned reference to detect this.
+// The secret is copied into the replication namespaces.
 func (ss *SecretStore) StoreToken(ctx context.Context, ea emcv1beta1.EmergencyAccount, token string) (string, error) {
-	t, err := utils.ParseJWTWithoutVerify(token)
+	exp, err := tokenExpiration(token, ss.metadata)
+	if err != nil {
+		return "", err
+	}
+	name, err := ss.secretName(ea, exp)
 	if err != nil {
-		return "", fmt.Errorf("unable to parse token: %w", err)
+		return "", err
 	}
+	namespace := ss.namespace(ea)
 
-	exp, err := t.Claims.GetExpirationTime()
+	var primary *corev1.Secret
+	name, err = storeTokenSecret(ctx, ss.Client, name, namespace, ss.key(), token, exp, func(s *corev1.Secret) error {
+		primary = s
+		if s.Labels == nil && len(ss.SecretStoreSpec.Labels) > 0 {
+			s.Labels = map[string]string{}
+		}
+		for k, v := range ss.SecretStoreSpec.Labels {
+			s.Labels[k] = v
+		}
+		s.Type = ss.SecretStoreSpec.Type
+		if s.Type == "" {
+			s.Type = corev1.SecretTypeOpaque
+		}
+		if namespace != ea.Namespace {
+			s.Annotations[EmergencyAccountAnnotation] = ea.Namespace + "/" + ea.Name
+			return nil
+		}
+		return controllerutil.SetControllerReference(&ea, s, ss.Client.Scheme())
+	})
 	if err != nil {
-		return "", fmt.Errorf("unable to get expiration time from token: %w", err)
+		return "", err
+	}
+	if err := ss.syncReplicas(ctx, ea, *primary); err != nil {
+		return "", err
 	}
+	if ss.SecretStoreSpec.NameTemplate == "" {
+		return name, nil
+	}
+	return name + refDigestSeparator + payloadDigest([]byte(token)), nil
+}
 
+// SyncToken copies the referenced secret into the replication namespaces.
+// Copies in namespaces no longer replicated to are deleted.
+// An overwritten secret is not copied, the copies of the previous token are kept.
+func (ss *SecretStore) SyncToken(ctx context.Context, ea emcv1beta1.EmergencyAccount, ref string) error {
+	name, digest := splitRefDigest(ref)
+	var primary corev1.Secret
+	if err := ss.Client.Get(ctx, types.NamespacedName{Name: name, Namespace: ss.namespace(ea)}, &primary); err != nil {
+		return fmt.Errorf("unable to get secret: %w", err)
+	}
+	if digest != "" && payloadDigest(primary.Data[ss.key()]) != digest {
+		return nil
+	}
+	return ss.syncReplicas(ctx, ea, primary)
+}
+
+// RetrieveToken retrieves the token from the referenced secret.
+// The token is compared against the digest in the reference, an overwritten secret fails the retrieval.
+// Every copy in the replication namespaces must hold the same token.
+func (ss *SecretStore) RetrieveToken(ctx context.Context, ea emcv1beta1.EmergencyAccount, ref string) (string, error) {
+	name, digest := splitRefDigest(ref)
+	token, err := retrieveTokenSecret(ctx, ss.Client, name, ss.namespace(ea), ss.key())
+	if err != nil {
+		return "", err
+	}
+	if digest != "" && payloadDigest([]byte(token)) != digest {
+		return "", fmt.Errorf("secret %q does not match the stored digest, it was overwritten by another token", name)
+	}
+
+	namespaces, err := ss.replicaNamespaces(ctx, ea)
+	if err != nil {
+		return "", err
+	}
+	for _, ns := range namespaces {
+		replica, err := retrieveTokenSecret(ctx, ss.Client, name, ns, ss.key())
+		if err != nil {
+			return "", fmt.Errorf("unable to retrieve copy in namespace %q: %w", ns, err)
+		}
+		if replica != token {
+			return "", fmt.Errorf("copy of secret %q in namespace %q does not match the secret", name, ns)
+		}
+	}
+	return token, nil
+}
+
+// DeleteToken deletes the secret holding the token and its copies.
+// A secret overwritten by another token is kept.
+func (ss *SecretStore) DeleteToken(ctx context.Context, ea emcv1beta1.EmergencyAccount, ref string) error {
+	name, digest := splitRefDigest(ref)
+	if err := ss.deleteReplicas(ctx, ea, name, func(s corev1.Secret) bool {
+		return digest == "" || payloadDigest(s.Data[ss.key()]) == digest
+	}); err != nil {
+		return err
+	}
+	if digest != "" {
+		token, err := retrieveTokenSecret(ctx, ss.Client, name, ss.namespace(ea), ss.key())
+		if apierrors.IsNotFound(err) {
+			return nil
+		}
+		if err == nil && payloadDigest([]byte(token)) != digest {
+			log.FromContext(ctx).Info("secret holds another token, not deleting", "secret", name)
+			return nil
+		}
+	}
+	return deleteTokenSecret(ctx, ss.Client, name, ss.namespace(ea))
+}
+
+// syncReplicas copies the primary secret into the replication namespaces and deletes copies in namespaces no longer replicated to.
+func (ss *SecretStore) syncReplicas(ctx context.Context, ea emcv1beta1.EmergencyAccount, primary corev1.Secret) error {
+	namespaces, err := ss.replicaNamespaces(ctx, ea)
+	if err != nil {
+		return err
+	}
+
+	var errs []error
+	for _, ns := range namespaces {
+		errs = append(errs, ss.syncReplica(ctx, ea, primary, ns))
+	}
+	errs = append(errs, ss.deleteReplicas(ctx, ea, primary.Name, func(s corev1.Secret) bool {
+		return !slices.Contains(namespaces, s.Namespace)
+	}))
+	return multierr.Combine(errs...)
+}
+
+// syncReplica creates or updates the copy of the primary secret in the given namespace.
+func (ss *SecretStore) syncReplica(ctx context.Context, ea emcv1beta1.EmergencyAccount, primary corev1.Secret, namespace string) error {
 	s := corev1.Secret{
 		ObjectMeta: metav1.ObjectMeta{
-			Name:      ea.Name + "-" + strconv.Itoa(int(exp.Unix())),
-			Namespace: ea.Namespace,
+			Name:      primary.Name,
+			Namespace: namespace,
 		},
 	}
-
 	op, err := controllerutil.CreateOrUpdate(ctx, ss.Client, &s, func() error {
+		s.Data = primary.Data
+		s.Type = primary.Type
+
+		if s.Labels == nil {
+			s.Labels = map[string]string{}
+		}
+		for k, v := range ss.SecretStoreSpec.Labels {
+			s.Labels[k] = v
+		}
+		s.Labels[EmergencyAccountNameLabel] = ea.Name
+		s.Labels[EmergencyAccountNamespaceLabel] = ea.Namespace
+
+		if s.Annotations == nil {
+			s.Annotations = map[string]string{}
+		}
+		s.Annotations[ValidUntilAnnotation] = primary.Annotations[ValidUntilAnnotation]
+		s.Annotations[EmergencyAccountAnnotation] = ea.Namespace + "/" + ea.Name
+		s.Annotations[ReplicaOfAnnotation] = primary.Namespace + "/" + primary.Name
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("unable to create or update copy in namespace %q: %w (op: %s, secret: %s)", namespace, err, op, s.Name)
+	}
+	if op != controllerutil.OperationResultNone {
+		log.FromContext(ctx).Info("synced copy of token", "secret", s.Name, "namespace", s.Namespace, "op", op)
+	}
+	return nil
+}
+
+// deleteReplicas deletes the copies of the secret with the given name for which del returns true.
+func (ss *SecretStore) deleteReplicas(ctx context.Context, ea emcv1beta1.EmergencyAccount, name string, del func(corev1.Secret) bool) error {
+	replicas, err := ListReplicas(ctx, ss.Client, ea)
+	if err != nil {
+		return err
+	}
+	replicaOf := ss.namespace(ea) + "/" + name
+	var errs []error
+	for _, s := range replicas {
+		if s.Name != name || s.Annotations[ReplicaOfAnnotation] != replicaOf || !del(s) {
+			continue
+		}
+		errs = append(errs, deleteTokenSecret(ctx, ss.Client, s.Name, s.Namespace))
+	}
+	return multierr.Combine(errs...)
+}
+
+// replicaNamespaces returns the sorted namespaces the secret is copied into.
+// The namespace of the secret itself is never included.
+func (ss *SecretStore) replicaNamespaces(ctx context.Context, ea emcv1beta1.EmergencyAccount) ([]string, error) {
+	spec := ss.SecretStoreSpec.Replication
+	namespaces := slices.Clone(spec.Namespaces)
+	if spec.NamespaceSelector != nil {
+		sel, err := metav1.LabelSelectorAsSelector(spec.NamespaceSelector)
+		if err != nil {
+			return nil, fmt.Errorf("invalid replication namespace selector: %w", err)
+		}
+		var nsl corev1.NamespaceList
+		if err := ss.Client.List(ctx, &nsl, client.MatchingLabelsSelector{Selector: sel}); err != nil {
+			return nil, fmt.Errorf("unable to list replication namespaces: %w", err)
+		}
+		for _, ns := range nsl.Items {
+			namespaces = append(namespaces, ns.Name)
+		}
+	}
+	primary := ss.namespace(ea)
+	namespaces = slices.DeleteFunc(namespaces, func(ns string) bool {
+		return ns == "" || ns == primary
+	})
+	slices.Sort(namespaces)
+	return slices.Compact(namespaces), nil
+}
+
+// ListReplicas lists the copies of secrets replicated for the EmergencyAccount in all namespaces.
+func ListReplicas(ctx context.Context, c client.Client, ea emcv1beta1.EmergencyAccount) ([]corev1.Secret, error) {
+	var sl corev1.SecretList
+	if err := c.List(ctx, &sl, client.MatchingLabels{
+		EmergencyAccountNameLabel:      ea.Name,
+		EmergencyAccountNamespaceLabel: ea.Namespace,
+	}); err != nil {
+		return nil, fmt.Errorf("unable to list copies of secrets: %w", err)
+	}
+	return slices.DeleteFunc(sl.Items, func(s corev1.Secret) bool {
+		_, ok := s.Annotations[ReplicaOfAnnotation]
+		return !ok
+	}), nil
+}
+
+// secretName returns the name of the secret holding the token with the given expiration.
+func (ss *SecretStore) secretName(ea emcv1beta1.EmergencyAccount, exp time.Time) (string, error) {
+	if ss.SecretStoreSpec.NameTemplate == "" {
+		return defaultTokenSecretName(ea, exp), nil
+	}
+	t, err := ss.nameTemplate()
+	if err != nil {
+		return "", err
+	}
+	name, err := executeNameTemplate(t, ea, ss.SecretStoreSpec.NameTemplateContext, exp)
+	if err != nil {
+		return "", fmt.Errorf("unable to execute name template: %w", err)
+	}
+	return name, nil
+}
+
+// defaultTokenSecretName returns the name of the secret holding the token if no name template is set.
+// Every token is stored in its own secret named after the EmergencyAccount and the expiration of the token.
+func defaultTokenSecretName(ea emcv1beta1.EmergencyAccount, exp time.Time) string {
+	return ea.Name + "-" + strconv.Itoa(int(exp.Unix()))
+}
+
+// nameTemplate parses the name template.
+func (ss *SecretStore) nameTemplate() (*template.Template, error) {
+	t, err := parseNameTemplate("name", ss.SecretStoreSpec.NameTemplate)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse name template: %w", err)
+	}
+	return t, nil
+}
+
+func (ss *SecretStore) namespace(ea emcv1beta1.EmergencyAccount) string {
+	if ss.SecretStoreSpec.Namespace == "" {
+		return ea.Namespace
+	}
+	return ss.SecretStoreSpec.Namespace
+}
+
+func (ss *SecretStore) key() string {
+	if ss.SecretStoreSpec.Key == "" {
+		return DefaultSecretKey
+	}
+	return ss.SecretStoreSpec.Key
+}
+
+// tokenExpiration returns the expiration of the token.
+// The expiration is taken from the metadata, or read from the credential if no metadata was injected.
+func tokenExpiration(token string, md TokenMetadata) (time.Time, error) {
+	if !md.ExpirationTimestamp.IsZero() {
+		return md.ExpirationTimestamp, nil
+	}
+	exp, err := utils.CredentialExpiration([]byte(token))
+	if err != nil {
+		return time.Time{}, fmt.Errorf("unable to get expiration time from token: %w", err)
+	}
+	return exp, nil
+}
+
+// storeTokenSecret creates or updates the secret holding the token under the given key.
+// The expiration of the token is recorded in the valid-until annotation.
+// mutate is called to further modify the secret before it is written.
+func storeTokenSecret(ctx context.Context, c client.Client, name, namespace, key, token string, exp time.Time, mutate func(*corev1.Secret) error) (string, error) {
+	s := corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: namespace,
+		},
+	}
+
+	op, err := controllerutil.CreateOrUpdate(ctx, c, &s, func() error {
 		if s.Data == nil {
 			s.Data = map[string][]byte{}
 		}
-		s.Data["token"] = []byte(token)
+		s.Data[key] = []byte(token)
 
 		if s.Annotations == nil {
 			s.Annotations = map[string]string{}
 		}
-		s.Annotations["emergency-credentials-controller.appuio.ch/valid-until"] = exp.Format(time.RFC3339)
+		s.Annotations[ValidUntilAnnotation] = exp.Format(time.RFC3339)
 
-		return controllerutil.SetControllerReference(&ea, &s, ss.Client.Scheme())
+		return mutate(&s)
 	})
 	if err != nil {
 		return "", fmt.Errorf("unable to create or update secret: %w (op: %s, secret: %s)", err, op, s.Name)
 	}
-	log.FromContext(ctx).Info("stored token", "secret", s.Name, "op", op)
+	log.FromContext(ctx).Info("stored token", "secret", s.Name, "namespace", s.Namespace, "op", op)
 
 	return s.Name, nil
 }
 
-func (ss *SecretStore) RetrieveToken(ctx context.Context, ea emcv1beta1.EmergencyAccount, ref string) (string, error) {
+// retrieveTokenSecret reads the token from the given key of the referenced secret.
+func retrieveTokenSecret(ctx context.Context, c client.Client, name, namespace, key string) (string, error) {
 	var s corev1.Secret
-	err := ss.Client.Get(ctx, types.NamespacedName{Name: ref, Namespace: ea.Namespace}, &s)
+	err := c.Get(ctx, types.NamespacedName{Name: name, Namespace: namespace}, &s)
 	if err != nil {
 		return "", fmt.Errorf("unable to get secret: %w", err)
 	}
-	token, ok := s.Data["token"]
+	token, ok := s.Data[key]
 	if !ok {
 		return "", fmt.Errorf("secret does not contain token")
 	}
 	return string(token), nil
 }
+
+// deleteTokenSecret deletes the referenced secret.
+// A missing secret is not an error.
+func deleteTokenSecret(ctx context.Context, c client.Client, name, namespace string) error {
+	s := corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: namespace,
+		},
+	}
+	if err := c.Delete(ctx, &s); err != nil && !apierrors.IsNotFound(err) {
+		return fmt.Errorf("unable to delete secret: %w", err)
+	}
+	log.FromContext(ctx).Info("deleted token", "secret", s.Name, "namespace", s.Namespace)
+	return nil
+}
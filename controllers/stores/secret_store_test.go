@@ -2,13 +2,17 @@ package stores_test
 
 import (
 	"context"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/appuio/emergency-credentials-controller/api/v1beta1"
 	"github.com/appuio/emergency-credentials-controller/controllers/stores"
 	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
 	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/client/fake"
@@ -37,6 +41,11 @@ func Test_SecretStore_E2E(t *testing.T) {
 	token, err := ss.RetrieveToken(context.Background(), ea, ref)
 	require.NoError(t, err)
 	require.Equal(t, testToken, token)
+
+	require.NoError(t, ss.DeleteToken(context.Background(), ea, ref))
+	_, err = ss.RetrieveToken(context.Background(), ea, ref)
+	require.Error(t, err)
+	require.NoError(t, ss.DeleteToken(context.Background(), ea, ref), "deleting a missing token should not fail")
 }
 
 func fakeClient(t *testing.T, initObjs ...client.Object) client.WithWatch {
@@ -51,3 +60,174 @@ func fakeClient(t *testing.T, initObjs ...client.Object) client.WithWatch {
 		WithObjects(initObjs...).
 		Build()
 }
+
+func Test_SecretStore_Spec(t *testing.T) {
+	c := fakeClient(t)
+	ea := emcv1beta1.EmergencyAccount{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "test",
+			Namespace: "default",
+		},
+	}
+	expiration := time.Date(2023, 10, 30, 17, 57, 0, 0, time.UTC)
+
+	ss := stores.NewSecretStore(emcv1beta1.SecretStoreSpec{
+		NameTemplate:        "{{ .Name }}-{{ .Context.suffix }}",
+		NameTemplateContext: map[string]string{"suffix": "current"},
+		Namespace:           "backup",
+		Labels:              map[string]string{"backup.example.com/include": "true"},
+		Key:                 "kubeconfig",
+		Type:                "example.com/emergency-credentials",
+	})
+	require.NoError(t, ss.ValidateSpec())
+	ss.InjectClient(c)
+	ss.InjectTokenMetadata(stores.TokenMetadata{ExpirationTimestamp: expiration})
+
+	ref, err := ss.StoreToken(context.Background(), ea, "token1")
+	require.NoError(t, err)
+	require.True(t, strings.HasPrefix(ref, "test-current@sha256:"), "should add the digest to the reference of a templated name, got %q", ref)
+
+	var secret corev1.Secret
+	require.NoError(t, c.Get(context.Background(), types.NamespacedName{Name: "test-current", Namespace: "backup"}, &secret))
+	require.Equal(t, map[string][]byte{"kubeconfig": []byte("token1")}, secret.Data)
+	require.Equal(t, map[string]string{"backup.example.com/include": "true"}, secret.Labels)
+	require.Equal(t, corev1.SecretType("example.com/emergency-credentials"), secret.Type)
+	require.Equal(t, "default/test", secret.Annotations[stores.EmergencyAccountAnnotation])
+	require.Equal(t, "2023-10-30T17:57:00Z", secret.Annotations[stores.ValidUntilAnnotation])
+	require.Empty(t, secret.OwnerReferences, "should not set an owner reference across namespaces")
+
+	token, err := ss.RetrieveToken(context.Background(), ea, ref)
+	require.NoError(t, err)
+	require.Equal(t, "token1", token)
+
+	ref2, err := ss.StoreToken(context.Background(), ea, "token2")
+	require.NoError(t, err)
+	_, err = ss.RetrieveToken(context.Background(), ea, ref)
+	require.ErrorContains(t, err, "overwritten by another token", "the previous token should not be reported as stored")
+	token, err = ss.RetrieveToken(context.Background(), ea, ref2)
+	require.NoError(t, err)
+	require.Equal(t, "token2", token)
+
+	require.NoError(t, ss.DeleteToken(context.Background(), ea, ref))
+	_, err = ss.RetrieveToken(context.Background(), ea, ref2)
+	require.NoError(t, err, "deleting the previous token should keep the secret holding the current token")
+	require.NoError(t, ss.DeleteToken(context.Background(), ea, ref2))
+	_, err = ss.RetrieveToken(context.Background(), ea, ref2)
+	require.ErrorContains(t, err, "unable to get secret")
+	require.NoError(t, ss.DeleteToken(context.Background(), ea, ref2), "deleting a missing token should not fail")
+
+	require.ErrorContains(t, stores.NewSecretStore(emcv1beta1.SecretStoreSpec{NameTemplate: "{{ .Name"}).ValidateSpec(), "unable to parse name template")
+}
+
+func Test_SecretStore_NameTemplate_Expiration(t *testing.T) {
+	c := fakeClient(t)
+	ea := emcv1beta1.EmergencyAccount{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "test",
+			Namespace: "default",
+		},
+	}
+
+	ss := stores.NewSecretStore(emcv1beta1.SecretStoreSpec{
+		NameTemplate: `{{ .Name }}-{{ .ExpirationTimestamp.Format "20060102" }}`,
+	})
+	ss.InjectClient(c)
+	ss.InjectTokenMetadata(stores.TokenMetadata{ExpirationTimestamp: time.Date(2023, 10, 30, 17, 57, 0, 0, time.UTC)})
+
+	ref, err := ss.StoreToken(context.Background(), ea, "token")
+	require.NoError(t, err)
+
+	var secret corev1.Secret
+	require.NoError(t, c.Get(context.Background(), types.NamespacedName{Name: "test-20231030", Namespace: "default"}, &secret))
+	require.Equal(t, corev1.SecretTypeOpaque, secret.Type)
+	require.Len(t, secret.OwnerReferences, 1, "should be owned by the EmergencyAccount in the same namespace")
+	token, err := ss.RetrieveToken(context.Background(), ea, ref)
+	require.NoError(t, err)
+	require.Equal(t, "token", token)
+}
+
+func Test_SecretStore_Replication(t *testing.T) {
+	c := fakeClient(t,
+		&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "app-a", Labels: map[string]string{"emergency-credentials": "true"}}},
+		&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "app-b"}},
+	)
+	ea := emcv1beta1.EmergencyAccount{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "test",
+			Namespace: "default",
+		},
+	}
+	spec := emcv1beta1.SecretStoreSpec{
+		Labels: map[string]string{"backup.example.com/include": "true"},
+		Replication: emcv1beta1.SecretReplicationSpec{
+			Namespaces: []string{"backup", "default"},
+			NamespaceSelector: &metav1.LabelSelector{
+				MatchLabels: map[string]string{"emergency-credentials": "true"},
+			},
+		},
+	}
+
+	ss := stores.NewSecretStore(spec)
+	require.NoError(t, ss.ValidateSpec())
+	ss.InjectClient(c)
+	ss.InjectTokenMetadata(stores.TokenMetadata{ExpirationTimestamp: time.Date(2023, 10, 30, 17, 57, 0, 0, time.UTC)})
+
+	ref, err := ss.StoreToken(context.Background(), ea, "token")
+	require.NoError(t, err)
+	require.Equal(t, "test-1698688620", ref)
+
+	replicas, err := stores.ListReplicas(context.Background(), c, ea)
+	require.NoError(t, err)
+	require.Len(t, replicas, 2, "should copy the secret into the listed and the selected namespaces, except the namespace of the secret")
+	for _, r := range replicas {
+		require.Contains(t, []string{"app-a", "backup"}, r.Namespace)
+		require.Equal(t, ref, r.Name)
+		require.Equal(t, map[string][]byte{stores.DefaultSecretKey: []byte("token")}, r.Data)
+		require.Equal(t, "true", r.Labels["backup.example.com/include"])
+		require.Equal(t, "default/"+ref, r.Annotations[stores.ReplicaOfAnnotation])
+		require.Equal(t, "default/test", r.Annotations[stores.EmergencyAccountAnnotation])
+		require.Equal(t, "2023-10-30T17:57:00Z", r.Annotations[stores.ValidUntilAnnotation])
+		require.Empty(t, r.OwnerReferences)
+	}
+
+	token, err := ss.RetrieveToken(context.Background(), ea, ref)
+	require.NoError(t, err)
+	require.Equal(t, "token", token)
+
+	var tampered corev1.Secret
+	require.NoError(t, c.Get(context.Background(), types.NamespacedName{Name: ref, Namespace: "app-a"}, &tampered))
+	tampered.Data[stores.DefaultSecretKey] = []byte("other")
+	require.NoError(t, c.Update(context.Background(), &tampered))
+	_, err = ss.RetrieveToken(context.Background(), ea, ref)
+	require.ErrorContains(t, err, `copy of secret "test-1698688620" in namespace "app-a" does not match the secret`)
+	require.NoError(t, ss.SyncToken(context.Background(), ea, ref))
+	_, err = ss.RetrieveToken(context.Background(), ea, ref)
+	require.NoError(t, err, "syncing should restore the copy")
+
+	require.NoError(t, c.Delete(context.Background(), &corev1.Secret{ObjectMeta: metav1.ObjectMeta{Name: ref, Namespace: "backup"}}))
+	_, err = ss.RetrieveToken(context.Background(), ea, ref)
+	require.ErrorContains(t, err, `unable to retrieve copy in namespace "backup"`)
+
+	spec.Replication.Namespaces = []string{"backup"}
+	spec.Replication.NamespaceSelector = nil
+	ss = stores.NewSecretStore(spec)
+	ss.InjectClient(c)
+	require.NoError(t, ss.SyncToken(context.Background(), ea, ref))
+	replicas, err = stores.ListReplicas(context.Background(), c, ea)
+	require.NoError(t, err)
+	require.Len(t, replicas, 1, "should delete the copy in the no longer selected namespace")
+	require.Equal(t, "backup", replicas[0].Namespace)
+	_, err = ss.RetrieveToken(context.Background(), ea, ref)
+	require.NoError(t, err)
+
+	require.NoError(t, ss.DeleteToken(context.Background(), ea, ref))
+	replicas, err = stores.ListReplicas(context.Background(), c, ea)
+	require.NoError(t, err)
+	require.Empty(t, replicas, "should delete the copies with the secret")
+
+	require.ErrorContains(t, stores.NewSecretStore(emcv1beta1.SecretStoreSpec{
+		Replication: emcv1beta1.SecretReplicationSpec{
+			NamespaceSelector: &metav1.LabelSelector{MatchExpressions: []metav1.LabelSelectorRequirement{{Key: "a", Operator: "Invalid"}}},
+		},
+	}).ValidateSpec(), "invalid replication namespace selector")
+}
@@ -2,9 +2,18 @@ package stores
 
 import (
 	"context"
+	"crypto/sha256"
+	"errors"
 	"fmt"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/Masterminds/sprig/v3"
 
 	emcv1beta1 "github.com/appuio/emergency-credentials-controller/api/v1beta1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 )
 
@@ -16,19 +25,164 @@ type TokenRetriever interface {
 	RetrieveToken(ctx context.Context, ea emcv1beta1.EmergencyAccount, ref string) (token string, err error)
 }
 
+// ErrTokenNotRetrievable is returned by TokenRetriever.RetrieveToken if the integrity of the stored token was verified,
+// but the token itself can not be retrieved, for example because it is encrypted.
+var ErrTokenNotRetrievable = errors.New("token not retrievable")
+
+// TokenDeleter is implemented by stores that can delete stored tokens.
+// Deleting a token that does not exist anymore must not return an error.
+type TokenDeleter interface {
+	DeleteToken(ctx context.Context, ea emcv1beta1.EmergencyAccount, ref string) error
+}
+
+// TokenSyncer is implemented by stores keeping copies of stored tokens.
+// SyncToken is called for every valid token before it is retrieved for verification.
+type TokenSyncer interface {
+	SyncToken(ctx context.Context, ea emcv1beta1.EmergencyAccount, ref string) error
+}
+
+// EnvelopeStorer is implemented by stores encrypting the tokens before storing them.
+// The envelope can be kept in place of the token and stored later without access to the token.
+type EnvelopeStorer interface {
+	EncryptToken(ea emcv1beta1.EmergencyAccount, token string) (envelope string, err error)
+	StoreEnvelope(ctx context.Context, ea emcv1beta1.EmergencyAccount, envelope string) (ref string, err error)
+}
+
 type ClientInjector interface {
 	InjectClient(client.Client)
 }
 
+// TokenMetadata is non-secret metadata of a stored token.
+type TokenMetadata struct {
+	// Cluster is the name of the cluster the token authenticates against.
+	// Empty if not configured.
+	Cluster string
+	// UID is the UID of the token in the EmergencyAccount status.
+	UID types.UID
+	// ExpirationTimestamp is the time the token expires.
+	ExpirationTimestamp time.Time
+}
+
+// MetadataInjector is implemented by stores that record metadata of the stored token alongside it.
+// The metadata of the token is injected before every call to StoreToken.
+// The cluster alone is injected when the store is created, to read and delete tokens of the cluster.
+type MetadataInjector interface {
+	InjectTokenMetadata(TokenMetadata)
+}
+
+// SecretReferencer is implemented by stores that read parts of their configuration from secrets.
+// The content of the referenced secrets is considered part of the store configuration.
+type SecretReferencer interface {
+	// ReferencedSecrets returns the names of the referenced secrets in the namespace of the EmergencyAccount.
+	ReferencedSecrets() []string
+}
+
+// SpecValidator is implemented by stores that can validate their configuration without accessing the store.
+type SpecValidator interface {
+	// ValidateSpec returns an error if the store configuration is invalid.
+	ValidateSpec() error
+}
+
+// FromSpec creates the store from the spec.
+// The store is wrapped to encrypt the tokens if encryption is configured.
 func FromSpec(sts emcv1beta1.TokenStoreSpec) (TokenStorer, error) {
+	st, err := storeFromSpec(sts)
+	if err != nil {
+		return nil, err
+	}
+	if sts.Encryption.Encrypt && sts.Type == "s3" && sts.S3Spec.Encryption.Encrypt {
+		return nil, fmt.Errorf("encryption of the token store can't be combined with the deprecated encryption of the S3 store")
+	}
+	return WithEncryption(st, sts.Encryption), nil
+}
+
+func storeFromSpec(sts emcv1beta1.TokenStoreSpec) (TokenStorer, error) {
 	if sts.Type == "secret" {
 		return NewSecretStore(sts.SecretSpec), nil
 	}
+	if sts.Type == "remoteSecret" {
+		return NewRemoteSecretStore(sts.RemoteSecretSpec), nil
+	}
 	if sts.Type == "log" {
 		return NewLogStore(sts.LogSpec), nil
 	}
 	if sts.Type == "s3" {
 		return NewS3Store(sts.S3Spec), nil
 	}
+	if sts.Type == "vault" {
+		return NewVaultStore(sts.VaultSpec), nil
+	}
+	if sts.Type == "webhook" {
+		return NewWebhookStore(sts.WebhookSpec), nil
+	}
 	return nil, fmt.Errorf("unknown token store type %s", sts.Type)
 }
+
+// parseNameTemplate parses a template naming the stored token, sprig functions are available.
+func parseNameTemplate(name, text string) (*template.Template, error) {
+	return template.New(name).Funcs(sprig.TxtFuncMap()).Parse(text)
+}
+
+// executeNameTemplate renders a template naming the stored token of the EmergencyAccount.
+// The template can access the name and namespace of the EmergencyAccount, the full object, the expiration of the token if known, and the additional context.
+func executeNameTemplate(t *template.Template, ea emcv1beta1.EmergencyAccount, templateContext map[string]string, expiration time.Time) (string, error) {
+	buf := new(strings.Builder)
+	err := t.Execute(buf, struct {
+		Name                string
+		Namespace           string
+		EmergencyAccount    emcv1beta1.EmergencyAccount
+		ExpirationTimestamp time.Time
+		Context             map[string]string
+	}{
+		Name:                ea.Name,
+		Namespace:           ea.Namespace,
+		EmergencyAccount:    ea,
+		ExpirationTimestamp: expiration,
+		Context:             templateContext,
+	})
+	return buf.String(), err
+}
+
+// readSecretKeys reads the given keys from the referenced secret in the namespace of the EmergencyAccount.
+func readSecretKeys(ctx context.Context, c client.Client, namespace, name string, keys ...string) (map[string]string, error) {
+	if c == nil {
+		return nil, fmt.Errorf("no client injected, unable to read secret %q", name)
+	}
+	var s corev1.Secret
+	if err := c.Get(ctx, types.NamespacedName{Name: name, Namespace: namespace}, &s); err != nil {
+		return nil, fmt.Errorf("unable to get secret %q: %w", name, err)
+	}
+	data := make(map[string]string, len(keys))
+	for _, key := range keys {
+		v, ok := s.Data[key]
+		if !ok {
+			return nil, fmt.Errorf("secret %q does not contain key %q", name, key)
+		}
+		data[key] = string(v)
+	}
+	return data, nil
+}
+
+// refDigestSeparator separates the name of the stored object from the digest of the stored payload in a reference.
+const refDigestSeparator = "@sha256:"
+
+// splitRefDigest splits a reference into the name of the stored object and the payload digest.
+// The digest is empty if the reference does not contain one.
+func splitRefDigest(ref string) (name, digest string) {
+	if i := strings.LastIndex(ref, refDigestSeparator); i >= 0 {
+		return ref[:i], ref[i+len(refDigestSeparator):]
+	}
+	return ref, ""
+}
+
+// RefLocation returns the location a reference points to, without the digest of the stored payload.
+// Tokens stored at the same location overwrite each other, for example with a stable object name.
+func RefLocation(ref string) string {
+	name, _ := splitRefDigest(ref)
+	return name
+}
+
+// payloadDigest returns the hex encoded SHA256 digest of the payload.
+func payloadDigest(payload []byte) string {
+	return fmt.Sprintf("%x", sha256.Sum256(payload))
+}
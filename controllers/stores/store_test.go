@@ -30,3 +30,35 @@ func Test_FromSpec_Unknown(t *testing.T) {
 	})
 	require.Error(t, err)
 }
+
+func Test_FromSpec_VaultStore(t *testing.T) {
+	s, err := stores.FromSpec(emcv1beta1.TokenStoreSpec{
+		Type: "vault",
+	})
+	require.NoError(t, err)
+	require.IsType(t, &stores.VaultStore{}, s)
+}
+
+func Test_FromSpec_WebhookStore(t *testing.T) {
+	s, err := stores.FromSpec(emcv1beta1.TokenStoreSpec{
+		Type: "webhook",
+	})
+	require.NoError(t, err)
+	require.IsType(t, &stores.WebhookStore{}, s)
+	require.NotImplements(t, (*stores.TokenRetriever)(nil), s)
+
+	s, err = stores.FromSpec(emcv1beta1.TokenStoreSpec{
+		Type:        "webhook",
+		WebhookSpec: emcv1beta1.WebhookStoreSpec{RetrieveURL: "https://example.com/retrieve"},
+	})
+	require.NoError(t, err)
+	require.Implements(t, (*stores.TokenRetriever)(nil), s)
+}
+
+func Test_FromSpec_RemoteSecretStore(t *testing.T) {
+	s, err := stores.FromSpec(emcv1beta1.TokenStoreSpec{
+		Type: "remoteSecret",
+	})
+	require.NoError(t, err)
+	require.IsType(t, &stores.RemoteSecretStore{}, s)
+}
@@ -0,0 +1,379 @@
+package stores
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+
+	emcv1beta1 "github.com/appuio/emergency-credentials-controller/api/v1beta1"
+)
+
+const (
+	// DefaultVaultMount is the default mount path of the KV version 2 secrets engine.
+	DefaultVaultMount = "secret"
+	// DefaultVaultKey is the default key of the token in the data of the written secret.
+	DefaultVaultKey = "token"
+	// DefaultVaultTokenKey is the default key of the Vault token in the token secret.
+	DefaultVaultTokenKey = "token"
+	// DefaultVaultAppRoleMount is the default mount path of the AppRole auth method.
+	DefaultVaultAppRoleMount = "approle"
+	// DefaultVaultRoleIDKey is the default key of the role ID in the AppRole secret.
+	DefaultVaultRoleIDKey = "roleId"
+	// DefaultVaultSecretIDKey is the default key of the secret ID in the AppRole secret.
+	DefaultVaultSecretIDKey = "secretId"
+)
+
+// VaultStore stores the tokens in a HashiCorp Vault KV version 2 secrets engine.
+type VaultStore struct {
+	spec   emcv1beta1.VaultStoreSpec
+	client client.Client
+}
+
+var _ TokenStorer = &VaultStore{}
+var _ TokenRetriever = &VaultStore{}
+var _ ClientInjector = &VaultStore{}
+var _ SecretReferencer = &VaultStore{}
+var _ SpecValidator = &VaultStore{}
+
+// NewVaultStore creates a new VaultStore
+func NewVaultStore(spec emcv1beta1.VaultStoreSpec) *VaultStore {
+	return &VaultStore{spec: spec}
+}
+
+// InjectClient injects the client into the VaultStore.
+// The client is used to read the authentication secret.
+func (vs *VaultStore) InjectClient(c client.Client) {
+	vs.client = c
+}
+
+// ReferencedSecrets returns the name of the authentication secret.
+func (vs *VaultStore) ReferencedSecrets() []string {
+	auth := vs.spec.Vault.Auth
+	if auth.TokenSecretRef != nil {
+		return []string{auth.TokenSecretRef.Name}
+	}
+	if auth.AppRole != nil {
+		return []string{auth.AppRole.SecretRef.Name}
+	}
+	return nil
+}
+
+// vaultRefVersionSeparator separates the path of the secret from its version in the reference.
+const vaultRefVersionSeparator = "?version="
+
+// StoreToken writes the token to the KV secrets engine.
+// The returned reference contains the path and the version of the written secret.
+func (vs *VaultStore) StoreToken(ctx context.Context, ea emcv1beta1.EmergencyAccount, token string) (string, error) {
+	path, err := vs.Path(ea)
+	if err != nil {
+		return "", err
+	}
+
+	vc, err := vs.login(ctx, ea.Namespace)
+	if err != nil {
+		return "", fmt.Errorf("unable to authenticate against Vault: %w", err)
+	}
+	defer vc.close(ctx)
+
+	var resp struct {
+		Data struct {
+			Version int `json:"version"`
+		} `json:"data"`
+	}
+	if err := vc.do(ctx, http.MethodPost, vs.dataPath(path), nil, map[string]any{
+		"data": map[string]string{vs.key(): token},
+	}, &resp); err != nil {
+		return "", fmt.Errorf("unable to store token: %w", err)
+	}
+
+	return path + vaultRefVersionSeparator + strconv.Itoa(resp.Data.Version), nil
+}
+
+// RetrieveToken reads the referenced version of the secret from the KV secrets engine.
+// A deleted or destroyed version fails the retrieval.
+func (vs *VaultStore) RetrieveToken(ctx context.Context, ea emcv1beta1.EmergencyAccount, ref string) (string, error) {
+	path, version, ok := strings.Cut(ref, vaultRefVersionSeparator)
+	if !ok {
+		return "", fmt.Errorf("reference %q does not contain a version", ref)
+	}
+	if _, err := strconv.Atoi(version); err != nil {
+		return "", fmt.Errorf("reference %q contains an invalid version: %w", ref, err)
+	}
+
+	vc, err := vs.login(ctx, ea.Namespace)
+	if err != nil {
+		return "", fmt.Errorf("unable to authenticate against Vault: %w", err)
+	}
+	defer vc.close(ctx)
+
+	var resp struct {
+		Data struct {
+			Data     map[string]any `json:"data"`
+			Metadata struct {
+				DeletionTime string `json:"deletion_time"`
+				Destroyed    bool   `json:"destroyed"`
+			} `json:"metadata"`
+		} `json:"data"`
+	}
+	if err := vc.do(ctx, http.MethodGet, vs.dataPath(path), url.Values{"version": {version}}, nil, &resp); err != nil {
+		return "", fmt.Errorf("unable to read secret %q: %w", ref, err)
+	}
+	if resp.Data.Metadata.Destroyed || resp.Data.Metadata.DeletionTime != "" {
+		return "", fmt.Errorf("secret %q was deleted", ref)
+	}
+	token, ok := resp.Data.Data[vs.key()].(string)
+	if !ok {
+		return "", fmt.Errorf("secret %q does not contain key %q", ref, vs.key())
+	}
+	return token, nil
+}
+
+// Path returns the path of the secret the token of the EmergencyAccount is written to.
+// The path is rendered from the path template if set, otherwise it is the name of the EmergencyAccount.
+func (vs *VaultStore) Path(ea emcv1beta1.EmergencyAccount) (string, error) {
+	if vs.spec.PathTemplate == "" {
+		return ea.Name, nil
+	}
+	t, err := vs.pathTemplate()
+	if err != nil {
+		return "", err
+	}
+	path, err := executeNameTemplate(t, ea, vs.spec.PathTemplateContext, time.Time{})
+	if err != nil {
+		return "", fmt.Errorf("unable to execute path template: %w", err)
+	}
+	return path, nil
+}
+
+// ValidateSpec validates the address, the path template, and the authentication settings.
+func (vs *VaultStore) ValidateSpec() error {
+	if err := validateVaultAddress(vs.spec.Vault.Address); err != nil {
+		return err
+	}
+	if vs.spec.PathTemplate != "" {
+		if _, err := vs.pathTemplate(); err != nil {
+			return err
+		}
+	}
+	auth := vs.spec.Vault.Auth
+	if (auth.TokenSecretRef == nil) == (auth.AppRole == nil) {
+		return errors.New("exactly one of tokenSecretRef and appRole must be set")
+	}
+	if vs.spec.Vault.CABundle != "" {
+		if _, err := certPool(vs.spec.Vault.CABundle); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// validateVaultAddress returns an error if the address is not an https URL.
+// Credentials and tokens must not be sent to Vault in cleartext.
+func validateVaultAddress(address string) error {
+	u, err := url.Parse(address)
+	if err != nil || u.Scheme != "https" || u.Host == "" {
+		return fmt.Errorf("address %q must be an https URL", address)
+	}
+	return nil
+}
+
+// pathTemplate parses the path template.
+func (vs *VaultStore) pathTemplate() (*template.Template, error) {
+	t, err := parseNameTemplate("path", vs.spec.PathTemplate)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse path template: %w", err)
+	}
+	return t, nil
+}
+
+// dataPath returns the API path of the data of the secret at the given path.
+func (vs *VaultStore) dataPath(path string) string {
+	mount := vs.spec.Vault.Mount
+	if mount == "" {
+		mount = DefaultVaultMount
+	}
+	return strings.Trim(mount, "/") + "/data/" + strings.TrimPrefix(path, "/")
+}
+
+func (vs *VaultStore) key() string {
+	if vs.spec.Vault.Key == "" {
+		return DefaultVaultKey
+	}
+	return vs.spec.Vault.Key
+}
+
+// login returns a Vault client authenticated with the configured auth method.
+// The credentials are read from the secrets in the given namespace.
+// The client must be closed after use to revoke the token created by the AppRole login.
+func (vs *VaultStore) login(ctx context.Context, namespace string) (*vaultClient, error) {
+	vc, err := newVaultClient(vs.spec.Vault)
+	if err != nil {
+		return nil, err
+	}
+	if err := vs.authenticate(ctx, vc, namespace); err != nil {
+		vc.httpClient.CloseIdleConnections()
+		return nil, err
+	}
+	return vc, nil
+}
+
+// authenticate sets the token of the client from the configured auth method.
+func (vs *VaultStore) authenticate(ctx context.Context, vc *vaultClient, namespace string) error {
+	auth := vs.spec.Vault.Auth
+	if ref := auth.TokenSecretRef; ref != nil {
+		key := ref.TokenKey
+		if key == "" {
+			key = DefaultVaultTokenKey
+		}
+		data, err := readSecretKeys(ctx, vs.client, namespace, ref.Name, key)
+		if err != nil {
+			return err
+		}
+		vc.token = data[key]
+		return nil
+	}
+	if ar := auth.AppRole; ar != nil {
+		mount, roleIDKey, secretIDKey := ar.Mount, ar.SecretRef.RoleIDKey, ar.SecretRef.SecretIDKey
+		if mount == "" {
+			mount = DefaultVaultAppRoleMount
+		}
+		if roleIDKey == "" {
+			roleIDKey = DefaultVaultRoleIDKey
+		}
+		if secretIDKey == "" {
+			secretIDKey = DefaultVaultSecretIDKey
+		}
+		data, err := readSecretKeys(ctx, vs.client, namespace, ar.SecretRef.Name, roleIDKey, secretIDKey)
+		if err != nil {
+			return err
+		}
+		var resp struct {
+			Auth struct {
+				ClientToken string `json:"client_token"`
+			} `json:"auth"`
+		}
+		if err := vc.do(ctx, http.MethodPost, "auth/"+strings.Trim(mount, "/")+"/login", nil, map[string]string{
+			"role_id":   data[roleIDKey],
+			"secret_id": data[secretIDKey],
+		}, &resp); err != nil {
+			return fmt.Errorf("unable to log in with AppRole: %w", err)
+		}
+		if resp.Auth.ClientToken == "" {
+			return errors.New("AppRole login did not return a token")
+		}
+		vc.token = resp.Auth.ClientToken
+		vc.loggedIn = true
+		return nil
+	}
+	return errors.New("no auth method configured")
+}
+
+// vaultClient is a minimal client for the Vault HTTP API.
+type vaultClient struct {
+	address    string
+	namespace  string
+	token      string
+	httpClient *http.Client
+	// loggedIn is true if the token was created by a login and must be revoked after use.
+	loggedIn bool
+}
+
+// newVaultClient creates an unauthenticated client for the configured Vault server.
+func newVaultClient(spec emcv1beta1.VaultSpec) (*vaultClient, error) {
+	if err := validateVaultAddress(spec.Address); err != nil {
+		return nil, err
+	}
+	hc, err := newHTTPClient(spec.CABundle, spec.Insecure)
+	if err != nil {
+		return nil, err
+	}
+	return &vaultClient{
+		address:    strings.TrimSuffix(spec.Address, "/"),
+		namespace:  spec.Namespace,
+		httpClient: hc,
+	}, nil
+}
+
+// close revokes the token of the client if it was created by a login and closes the idle connections.
+// Otherwise every login leaves a token in Vault until its TTL expires.
+// Errors are logged only, the token expires eventually.
+func (vc *vaultClient) close(ctx context.Context) {
+	defer vc.httpClient.CloseIdleConnections()
+	if !vc.loggedIn {
+		return
+	}
+	if err := vc.do(ctx, http.MethodPost, "auth/token/revoke-self", nil, nil, nil); err != nil {
+		log.FromContext(ctx).Error(err, "unable to revoke Vault token", "address", vc.address)
+		return
+	}
+	vc.token, vc.loggedIn = "", false
+}
+
+// do sends a request to the Vault API and decodes the JSON response into out.
+// Errors returned by Vault are included in the returned error.
+func (vc *vaultClient) do(ctx context.Context, method, path string, query url.Values, in, out any) error {
+	var body io.Reader
+	if in != nil {
+		raw, err := json.Marshal(in)
+		if err != nil {
+			return fmt.Errorf("unable to marshal request: %w", err)
+		}
+		body = bytes.NewReader(raw)
+	}
+	u := vc.address + "/v1/" + path
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+	req, err := http.NewRequestWithContext(ctx, method, u, body)
+	if err != nil {
+		return fmt.Errorf("unable to create request: %w", err)
+	}
+	if in != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if vc.token != "" {
+		req.Header.Set("X-Vault-Token", vc.token)
+	}
+	if vc.namespace != "" {
+		req.Header.Set("X-Vault-Namespace", vc.namespace)
+	}
+
+	resp, err := vc.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	raw, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("unable to read response: %w", err)
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		var verr struct {
+			Errors []string `json:"errors"`
+		}
+		if json.Unmarshal(raw, &verr) == nil && len(verr.Errors) > 0 {
+			return fmt.Errorf("vault returned %s: %s", resp.Status, strings.Join(verr.Errors, ", "))
+		}
+		return fmt.Errorf("vault returned %s", resp.Status)
+	}
+	if out == nil {
+		return nil
+	}
+	if err := json.Unmarshal(raw, out); err != nil {
+		return fmt.Errorf("unable to unmarshal response: %w", err)
+	}
+	return nil
+}
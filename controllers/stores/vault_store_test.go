@@ -0,0 +1,287 @@
+package stores_test
+
+import (
+	"context"
+	"encoding/json"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	emcv1beta1 "github.com/appuio/emergency-credentials-controller/api/v1beta1"
+	"github.com/appuio/emergency-credentials-controller/controllers/stores"
+)
+
+func Test_VaultStore_StoreToken(t *testing.T) {
+	vm := newVaultMock()
+	srv := httptest.NewTLSServer(vm)
+	t.Cleanup(srv.Close)
+
+	c := fakeClient(t, &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: "approle", Namespace: "default"},
+		Data: map[string][]byte{
+			"roleId":   []byte("role"),
+			"secretId": []byte("secret"),
+		},
+	})
+	ea := emcv1beta1.EmergencyAccount{
+		ObjectMeta: metav1.ObjectMeta{Name: "emergency", Namespace: "default"},
+	}
+
+	st := stores.NewVaultStore(emcv1beta1.VaultStoreSpec{
+		PathTemplate:        "{{ .Context.cluster }}/{{ .Namespace }}/{{ .Name }}",
+		PathTemplateContext: map[string]string{"cluster": "c-test"},
+		Vault: emcv1beta1.VaultSpec{
+			Address:   srv.URL,
+			Namespace: "team",
+			Mount:     "kv",
+			CABundle:  string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw})),
+			Auth: emcv1beta1.VaultAuthSpec{
+				AppRole: &emcv1beta1.VaultAppRoleAuthSpec{
+					SecretRef: emcv1beta1.VaultAppRoleSecretRef{Name: "approle"},
+				},
+			},
+		},
+	})
+	require.NoError(t, st.ValidateSpec())
+	require.Equal(t, []string{"approle"}, st.ReferencedSecrets())
+
+	_, err := st.StoreToken(context.Background(), ea, "token")
+	require.ErrorContains(t, err, "no client injected")
+	st.InjectClient(c)
+
+	ref, err := st.StoreToken(context.Background(), ea, "token")
+	require.NoError(t, err)
+	require.Equal(t, "c-test/default/emergency?version=1", ref)
+	require.Equal(t, "team", vm.namespace, "should send the Vault namespace")
+
+	retrieved, err := st.RetrieveToken(context.Background(), ea, ref)
+	require.NoError(t, err)
+	require.Equal(t, "token", retrieved)
+
+	ref2, err := st.StoreToken(context.Background(), ea, "token2")
+	require.NoError(t, err)
+	require.Equal(t, "c-test/default/emergency?version=2", ref2)
+	retrieved, err = st.RetrieveToken(context.Background(), ea, ref)
+	require.NoError(t, err, "older versions should stay retrievable")
+	require.Equal(t, "token", retrieved)
+
+	vm.deleteVersion("kv/data/c-test/default/emergency", 1)
+	_, err = st.RetrieveToken(context.Background(), ea, ref)
+	require.ErrorContains(t, err, "was deleted")
+
+	_, err = st.RetrieveToken(context.Background(), ea, "c-test/default/emergency?version=3")
+	require.ErrorContains(t, err, "404")
+
+	_, err = st.RetrieveToken(context.Background(), ea, "c-test/default/emergency")
+	require.ErrorContains(t, err, "does not contain a version")
+
+	require.Positive(t, vm.logins)
+	require.Equal(t, vm.logins, vm.revoked, "should revoke the token of every AppRole login")
+}
+
+func Test_VaultStore_TokenSecretRef(t *testing.T) {
+	vm := newVaultMock()
+	srv := httptest.NewTLSServer(vm)
+	t.Cleanup(srv.Close)
+
+	c := fakeClient(t, &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: "vault-token", Namespace: "default"},
+		Data: map[string][]byte{
+			"custom": []byte("root"),
+		},
+	})
+	ea := emcv1beta1.EmergencyAccount{
+		ObjectMeta: metav1.ObjectMeta{Name: "emergency", Namespace: "default"},
+	}
+
+	spec := emcv1beta1.VaultStoreSpec{
+		Vault: emcv1beta1.VaultSpec{
+			Address:  srv.URL,
+			CABundle: string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw})),
+			Auth: emcv1beta1.VaultAuthSpec{
+				TokenSecretRef: &emcv1beta1.VaultTokenSecretRef{Name: "vault-token", TokenKey: "custom"},
+			},
+		},
+	}
+	st := stores.NewVaultStore(spec)
+	st.InjectClient(c)
+
+	ref, err := st.StoreToken(context.Background(), ea, "token")
+	require.NoError(t, err)
+	require.Equal(t, "emergency?version=1", ref)
+	require.Equal(t, "token", vm.data["secret/data/emergency"][0]["token"])
+
+	spec.Vault.Auth.TokenSecretRef.TokenKey = ""
+	st = stores.NewVaultStore(spec)
+	st.InjectClient(c)
+	_, err = st.RetrieveToken(context.Background(), ea, ref)
+	require.ErrorContains(t, err, `does not contain key "token"`)
+
+	vm.clientToken = "other"
+	spec.Vault.Auth.TokenSecretRef.TokenKey = "custom"
+	st = stores.NewVaultStore(spec)
+	st.InjectClient(c)
+	_, err = st.RetrieveToken(context.Background(), ea, ref)
+	require.ErrorContains(t, err, "permission denied")
+	require.Zero(t, vm.revoked, "should not revoke the configured token")
+
+	plain := httptest.NewServer(vm)
+	t.Cleanup(plain.Close)
+	spec.Vault.Address = plain.URL
+	st = stores.NewVaultStore(spec)
+	st.InjectClient(c)
+	_, err = st.StoreToken(context.Background(), ea, "token")
+	require.ErrorContains(t, err, "must be an https URL", "should not send tokens in cleartext")
+}
+
+func Test_VaultStore_ValidateSpec(t *testing.T) {
+	auth := emcv1beta1.VaultAuthSpec{TokenSecretRef: &emcv1beta1.VaultTokenSecretRef{Name: "vault-token"}}
+	tcs := map[string]struct {
+		spec   emcv1beta1.VaultStoreSpec
+		errMsg string
+	}{
+		"valid": {
+			spec: emcv1beta1.VaultStoreSpec{PathTemplate: "{{ .Name }}", Vault: emcv1beta1.VaultSpec{Address: "https://vault.example.com:8200", Auth: auth}},
+		},
+		"invalid address": {
+			spec:   emcv1beta1.VaultStoreSpec{Vault: emcv1beta1.VaultSpec{Address: "vault.example.com", Auth: auth}},
+			errMsg: "must be an https URL",
+		},
+		"http address": {
+			spec:   emcv1beta1.VaultStoreSpec{Vault: emcv1beta1.VaultSpec{Address: "http://vault.example.com:8200", Auth: auth}},
+			errMsg: "must be an https URL",
+		},
+		"invalid template": {
+			spec:   emcv1beta1.VaultStoreSpec{PathTemplate: "{{ .Name", Vault: emcv1beta1.VaultSpec{Address: "https://vault.example.com", Auth: auth}},
+			errMsg: "unable to parse path template",
+		},
+		"no auth": {
+			spec:   emcv1beta1.VaultStoreSpec{Vault: emcv1beta1.VaultSpec{Address: "https://vault.example.com"}},
+			errMsg: "exactly one of tokenSecretRef and appRole must be set",
+		},
+		"both auth": {
+			spec: emcv1beta1.VaultStoreSpec{Vault: emcv1beta1.VaultSpec{Address: "https://vault.example.com", Auth: emcv1beta1.VaultAuthSpec{
+				TokenSecretRef: auth.TokenSecretRef,
+				AppRole:        &emcv1beta1.VaultAppRoleAuthSpec{SecretRef: emcv1beta1.VaultAppRoleSecretRef{Name: "approle"}},
+			}}},
+			errMsg: "exactly one of tokenSecretRef and appRole must be set",
+		},
+		"invalid CA bundle": {
+			spec:   emcv1beta1.VaultStoreSpec{Vault: emcv1beta1.VaultSpec{Address: "https://vault.example.com", CABundle: "not a certificate", Auth: auth}},
+			errMsg: "CA bundle does not contain a PEM encoded certificate",
+		},
+	}
+	for name, tc := range tcs {
+		t.Run(name, func(t *testing.T) {
+			err := stores.NewVaultStore(tc.spec).ValidateSpec()
+			if tc.errMsg == "" {
+				require.NoError(t, err)
+				return
+			}
+			require.ErrorContains(t, err, tc.errMsg)
+		})
+	}
+}
+
+// vaultMock is an in-memory stand-in for the Vault AppRole auth method and a KV version 2 secrets engine.
+type vaultMock struct {
+	mu sync.Mutex
+	// clientToken is the only token accepted by the KV secrets engine.
+	clientToken string
+	// namespace is the Vault namespace of the last request.
+	namespace string
+	// logins counts the AppRole logins, revoked the revoked tokens.
+	logins, revoked int
+	// data holds the versions of the secrets by API path, version n is at index n-1.
+	data    map[string][]map[string]string
+	deleted map[string]bool
+}
+
+func newVaultMock() *vaultMock {
+	return &vaultMock{
+		clientToken: "root",
+		data:        map[string][]map[string]string{},
+		deleted:     map[string]bool{},
+	}
+}
+
+func (vm *vaultMock) deleteVersion(path string, version int) {
+	vm.mu.Lock()
+	defer vm.mu.Unlock()
+	vm.deleted[path+"@"+strconv.Itoa(version)] = true
+}
+
+func (vm *vaultMock) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	vm.mu.Lock()
+	defer vm.mu.Unlock()
+	vm.namespace = r.Header.Get("X-Vault-Namespace")
+	path := strings.TrimPrefix(r.URL.Path, "/v1/")
+
+	if path == "auth/approle/login" {
+		var login map[string]string
+		if err := json.NewDecoder(r.Body).Decode(&login); err != nil || login["role_id"] != "role" || login["secret_id"] != "secret" {
+			vaultError(w, http.StatusBadRequest, "invalid role or secret ID")
+			return
+		}
+		vm.logins++
+		vaultResponse(w, map[string]any{"auth": map[string]any{"client_token": vm.clientToken}})
+		return
+	}
+
+	if r.Header.Get("X-Vault-Token") != vm.clientToken {
+		vaultError(w, http.StatusForbidden, "permission denied")
+		return
+	}
+	if path == "auth/token/revoke-self" {
+		vm.revoked++
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	switch r.Method {
+	case http.MethodPost:
+		var req struct {
+			Data map[string]string `json:"data"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			vaultError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		vm.data[path] = append(vm.data[path], req.Data)
+		vaultResponse(w, map[string]any{"data": map[string]any{"version": len(vm.data[path])}})
+	case http.MethodGet:
+		versions := vm.data[path]
+		version, err := strconv.Atoi(r.URL.Query().Get("version"))
+		if err != nil || version < 1 || version > len(versions) {
+			vaultError(w, http.StatusNotFound)
+			return
+		}
+		metadata := map[string]any{"version": version, "deletion_time": "", "destroyed": false}
+		data := any(versions[version-1])
+		if vm.deleted[path+"@"+strconv.Itoa(version)] {
+			metadata["deletion_time"] = "2023-10-30T17:57:00Z"
+			data = nil
+		}
+		vaultResponse(w, map[string]any{"data": map[string]any{"data": data, "metadata": metadata}})
+	default:
+		vaultError(w, http.StatusMethodNotAllowed)
+	}
+}
+
+func vaultResponse(w http.ResponseWriter, body any) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(body)
+}
+
+func vaultError(w http.ResponseWriter, status int, errs ...string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(map[string]any{"errors": append([]string{}, errs...)})
+}
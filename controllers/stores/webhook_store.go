@@ -0,0 +1,285 @@
+package stores
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	emcv1beta1 "github.com/appuio/emergency-credentials-controller/api/v1beta1"
+	"github.com/appuio/emergency-credentials-controller/pkg/utils"
+)
+
+const (
+	// WebhookSignatureHeader is the header holding the HMAC-SHA256 signature of webhook requests.
+	WebhookSignatureHeader = "X-Emergency-Credentials-Signature"
+	// WebhookSignaturePrefix prefixes the hex encoded signature in the signature header.
+	WebhookSignaturePrefix = "sha256="
+	// DefaultWebhookSigningKey is the default key of the HMAC key in the signing secret.
+	DefaultWebhookSigningKey = "secret"
+	// WebhookRefQueryParameter is the query parameter holding the reference of the token in retrieve requests.
+	WebhookRefQueryParameter = "ref"
+
+	// webhookCAKey is the key of the optional CA bundle in the client certificate secret.
+	webhookCAKey = "ca.crt"
+)
+
+// WebhookPayload is the JSON payload POSTed by the webhook store.
+// The retrieve endpoint answers with the same payload.
+type WebhookPayload struct {
+	// Token is the token, or the encrypted envelope if encryption is enabled.
+	Token string `json:"token"`
+	// EmergencyAccount is the name of the EmergencyAccount the token was issued for.
+	EmergencyAccount string `json:"emergencyAccount,omitempty"`
+	// Namespace is the namespace of the EmergencyAccount.
+	Namespace string `json:"namespace,omitempty"`
+	// Cluster is the name of the cluster the token authenticates against.
+	Cluster string `json:"cluster,omitempty"`
+	// TokenUID is the UID of the token in the EmergencyAccount status.
+	TokenUID types.UID `json:"tokenUID,omitempty"`
+	// ExpirationTimestamp is the time the token expires.
+	ExpirationTimestamp *time.Time `json:"expirationTimestamp,omitempty"`
+}
+
+// WebhookResponse is the JSON response expected from the webhook endpoint.
+type WebhookResponse struct {
+	// Ref is the reference of the stored token, required.
+	// It is recorded in the status of the EmergencyAccount and passed to the retrieve endpoint.
+	Ref string `json:"ref"`
+}
+
+// WebhookStore sends the tokens to an HTTPS endpoint.
+type WebhookStore struct {
+	spec     emcv1beta1.WebhookStoreSpec
+	client   client.Client
+	metadata TokenMetadata
+}
+
+// webhookRetriever is a WebhookStore with a retrieve endpoint.
+type webhookRetriever struct{ *WebhookStore }
+
+var _ TokenStorer = &WebhookStore{}
+var _ ClientInjector = &WebhookStore{}
+var _ MetadataInjector = &WebhookStore{}
+var _ SecretReferencer = &WebhookStore{}
+var _ SpecValidator = &WebhookStore{}
+var _ TokenRetriever = webhookRetriever{}
+
+// NewWebhookStore creates a new WebhookStore.
+// The returned store implements TokenRetriever if a retrieve URL is configured.
+func NewWebhookStore(spec emcv1beta1.WebhookStoreSpec) TokenStorer {
+	ws := &WebhookStore{spec: spec}
+	if spec.RetrieveURL != "" {
+		return webhookRetriever{ws}
+	}
+	return ws
+}
+
+// InjectClient injects the client into the WebhookStore.
+// The client is used to read the signing and client certificate secrets.
+func (ws *WebhookStore) InjectClient(c client.Client) {
+	ws.client = c
+}
+
+// InjectTokenMetadata injects the metadata of the token to store.
+// The metadata is sent alongside the token.
+func (ws *WebhookStore) InjectTokenMetadata(md TokenMetadata) {
+	ws.metadata = md
+}
+
+// ReferencedSecrets returns the names of the signing secret and the client certificate secret.
+func (ws *WebhookStore) ReferencedSecrets() []string {
+	secrets := []string{ws.spec.SigningSecretRef.Name}
+	if ref := ws.spec.ClientCertificateSecretRef; ref != nil {
+		secrets = append(secrets, ref.Name)
+	}
+	return secrets
+}
+
+// ValidateSpec validates the URLs, the signing secret reference, and the CA bundle.
+func (ws *WebhookStore) ValidateSpec() error {
+	if err := validateWebhookURL(ws.spec.URL); err != nil {
+		return err
+	}
+	if ws.spec.RetrieveURL != "" {
+		if err := validateWebhookURL(ws.spec.RetrieveURL); err != nil {
+			return err
+		}
+	}
+	if ws.spec.SigningSecretRef.Name == "" {
+		return fmt.Errorf("a signing secret is required")
+	}
+	if ws.spec.CABundle != "" {
+		if _, err := certPool(ws.spec.CABundle); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func validateWebhookURL(u string) error {
+	parsed, err := url.Parse(u)
+	if err != nil || parsed.Scheme != "https" || parsed.Host == "" {
+		return fmt.Errorf("url %q must be an https URL", u)
+	}
+	return nil
+}
+
+// StoreToken POSTs the token and its metadata to the endpoint.
+// The reference returned by the endpoint is returned.
+func (ws *WebhookStore) StoreToken(ctx context.Context, ea emcv1beta1.EmergencyAccount, token string) (string, error) {
+	payload := WebhookPayload{
+		Token:            token,
+		EmergencyAccount: ea.Name,
+		Namespace:        ea.Namespace,
+		Cluster:          ws.metadata.Cluster,
+		TokenUID:         ws.metadata.UID,
+	}
+	exp := ws.metadata.ExpirationTimestamp
+	if exp.IsZero() {
+		// The expiration can't be read from encrypted tokens, it's only informational for the receiver.
+		exp, _ = utils.CredentialExpiration([]byte(token))
+	}
+	if !exp.IsZero() {
+		payload.ExpirationTimestamp = &exp
+	}
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return "", fmt.Errorf("unable to marshal payload: %w", err)
+	}
+
+	hc, key, err := ws.httpClient(ctx, ea.Namespace)
+	if err != nil {
+		return "", err
+	}
+	defer hc.CloseIdleConnections()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, ws.spec.URL, bytes.NewReader(body))
+	if err != nil {
+		return "", fmt.Errorf("unable to create request: %w", err)
+	}
+	ws.setHeaders(req, key, body)
+	req.Header.Set("Content-Type", "application/json")
+
+	var resp WebhookResponse
+	if err := doWebhookRequest(hc, req, &resp); err != nil {
+		return "", fmt.Errorf("unable to store token: %w", err)
+	}
+	// Tokens without a reference are not verified, the endpoint must tell where it stored the token.
+	if resp.Ref == "" {
+		return "", errors.New("endpoint did not return a reference for the stored token")
+	}
+	return resp.Ref, nil
+}
+
+// RetrieveToken retrieves the token from the retrieve endpoint.
+func (wr webhookRetriever) RetrieveToken(ctx context.Context, ea emcv1beta1.EmergencyAccount, ref string) (string, error) {
+	u, err := url.Parse(wr.spec.RetrieveURL)
+	if err != nil {
+		return "", fmt.Errorf("unable to parse retrieve url: %w", err)
+	}
+	q := u.Query()
+	q.Set(WebhookRefQueryParameter, ref)
+	u.RawQuery = q.Encode()
+
+	hc, key, err := wr.httpClient(ctx, ea.Namespace)
+	if err != nil {
+		return "", err
+	}
+	defer hc.CloseIdleConnections()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return "", fmt.Errorf("unable to create request: %w", err)
+	}
+	wr.setHeaders(req, key, []byte(ref))
+
+	var payload WebhookPayload
+	if err := doWebhookRequest(hc, req, &payload); err != nil {
+		return "", fmt.Errorf("unable to retrieve token %q: %w", ref, err)
+	}
+	return payload.Token, nil
+}
+
+// setHeaders sets the configured headers and the signature of the signed data.
+func (ws *WebhookStore) setHeaders(req *http.Request, key []byte, signed []byte) {
+	for k, v := range ws.spec.Headers {
+		req.Header.Set(k, v)
+	}
+	req.Header.Set(WebhookSignatureHeader, WebhookSignaturePrefix+WebhookSignature(key, signed))
+}
+
+// WebhookSignature returns the hex encoded HMAC-SHA256 of the data.
+// Receivers can use it to verify the signature header.
+func WebhookSignature(key, data []byte) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(data)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// httpClient returns the HTTP client for the endpoint and the HMAC key.
+// The secrets are read from the given namespace, the idle connections of the client must be closed after use.
+func (ws *WebhookStore) httpClient(ctx context.Context, namespace string) (*http.Client, []byte, error) {
+	signingKey := ws.spec.SigningSecretRef.Key
+	if signingKey == "" {
+		signingKey = DefaultWebhookSigningKey
+	}
+	signing, err := readSecretKeys(ctx, ws.client, namespace, ws.spec.SigningSecretRef.Name, signingKey)
+	if err != nil {
+		return nil, nil, fmt.Errorf("unable to read signing key: %w", err)
+	}
+
+	caBundle := ws.spec.CABundle
+	var certs []tls.Certificate
+	if ref := ws.spec.ClientCertificateSecretRef; ref != nil {
+		var s corev1.Secret
+		if err := ws.client.Get(ctx, types.NamespacedName{Name: ref.Name, Namespace: namespace}, &s); err != nil {
+			return nil, nil, fmt.Errorf("unable to get client certificate secret %q: %w", ref.Name, err)
+		}
+		cert, err := tls.X509KeyPair(s.Data[corev1.TLSCertKey], s.Data[corev1.TLSPrivateKeyKey])
+		if err != nil {
+			return nil, nil, fmt.Errorf("unable to parse client certificate of secret %q: %w", ref.Name, err)
+		}
+		certs = append(certs, cert)
+		if ca := s.Data[webhookCAKey]; len(ca) > 0 {
+			caBundle += "\n" + string(ca)
+		}
+	}
+
+	hc, err := newHTTPClient(caBundle, false, certs...)
+	if err != nil {
+		return nil, nil, err
+	}
+	return hc, []byte(signing[signingKey]), nil
+}
+
+// doWebhookRequest sends the request and decodes the JSON response into out.
+func doWebhookRequest(hc *http.Client, req *http.Request, out any) error {
+	resp, err := hc.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	raw, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return fmt.Errorf("unable to read response: %w", err)
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("endpoint returned %s: %s", resp.Status, bytes.TrimSpace(raw))
+	}
+	if err := json.Unmarshal(raw, out); err != nil {
+		return fmt.Errorf("unable to unmarshal response: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,244 @@
+package stores_test
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	emcv1beta1 "github.com/appuio/emergency-credentials-controller/api/v1beta1"
+	"github.com/appuio/emergency-credentials-controller/controllers/stores"
+)
+
+func Test_WebhookStore(t *testing.T) {
+	const signingKey = "hmac-key"
+	certPEM, keyPEM, cert := generateClientCertificate(t)
+
+	wm := &webhookMock{key: []byte(signingKey), tokens: map[string]string{}}
+	srv := httptest.NewUnstartedServer(wm)
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(cert)
+	srv.TLS = &tls.Config{ClientAuth: tls.RequireAndVerifyClientCert, ClientCAs: clientCAs}
+	var open atomic.Int32
+	srv.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+		switch state {
+		case http.StateNew:
+			open.Add(1)
+		case http.StateClosed, http.StateHijacked:
+			open.Add(-1)
+		}
+	}
+	srv.StartTLS()
+	t.Cleanup(srv.Close)
+
+	c := fakeClient(t,
+		&corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Name: "webhook-signing", Namespace: "default"},
+			Data:       map[string][]byte{"secret": []byte(signingKey)},
+		},
+		&corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Name: "webhook-client", Namespace: "default"},
+			Type:       corev1.SecretTypeTLS,
+			Data: map[string][]byte{
+				corev1.TLSCertKey:       certPEM,
+				corev1.TLSPrivateKeyKey: keyPEM,
+				"ca.crt":                pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw}),
+			},
+		},
+	)
+	ea := emcv1beta1.EmergencyAccount{
+		ObjectMeta: metav1.ObjectMeta{Name: "emergency", Namespace: "default"},
+	}
+	spec := emcv1beta1.WebhookStoreSpec{
+		URL:                        srv.URL + "/store",
+		RetrieveURL:                srv.URL + "/retrieve",
+		Headers:                    map[string]string{"X-Ticket-Queue": "ops"},
+		SigningSecretRef:           emcv1beta1.WebhookSigningSecretRef{Name: "webhook-signing"},
+		ClientCertificateSecretRef: &emcv1beta1.WebhookClientCertificateSecretRef{Name: "webhook-client"},
+	}
+
+	st := stores.NewWebhookStore(spec)
+	require.NoError(t, st.(stores.SpecValidator).ValidateSpec())
+	require.Equal(t, []string{"webhook-signing", "webhook-client"}, st.(stores.SecretReferencer).ReferencedSecrets())
+	st.(stores.ClientInjector).InjectClient(c)
+	expiration := time.Date(2023, 10, 30, 17, 57, 0, 0, time.UTC)
+	st.(stores.MetadataInjector).InjectTokenMetadata(stores.TokenMetadata{
+		Cluster:             "c-test",
+		UID:                 "token-uid",
+		ExpirationTimestamp: expiration,
+	})
+
+	ref, err := st.StoreToken(context.Background(), ea, "token")
+	require.NoError(t, err)
+	require.Equal(t, "ref-1", ref)
+	require.Equal(t, "ops", wm.header.Get("X-Ticket-Queue"))
+	require.Equal(t, stores.WebhookPayload{
+		Token:               "token",
+		EmergencyAccount:    "emergency",
+		Namespace:           "default",
+		Cluster:             "c-test",
+		TokenUID:            "token-uid",
+		ExpirationTimestamp: &expiration,
+	}, wm.payload)
+
+	tr, ok := st.(stores.TokenRetriever)
+	require.True(t, ok, "should implement TokenRetriever with a retrieve URL")
+	retrieved, err := tr.RetrieveToken(context.Background(), ea, ref)
+	require.NoError(t, err)
+	require.Equal(t, "token", retrieved)
+	_, err = tr.RetrieveToken(context.Background(), ea, "ref-2")
+	require.ErrorContains(t, err, "404")
+	require.Eventually(t, func() bool { return open.Load() == 0 }, time.Second, 10*time.Millisecond, "should close the connections after use")
+
+	emptySpec := spec
+	emptySpec.URL = srv.URL + "/empty"
+	empty := stores.NewWebhookStore(emptySpec)
+	empty.(stores.ClientInjector).InjectClient(c)
+	_, err = empty.StoreToken(context.Background(), ea, "token")
+	require.ErrorContains(t, err, "did not return a reference")
+
+	wm.mu.Lock()
+	wm.key = []byte("other")
+	wm.mu.Unlock()
+	_, err = st.StoreToken(context.Background(), ea, "token")
+	require.ErrorContains(t, err, "invalid signature")
+
+	spec.ClientCertificateSecretRef = nil
+	spec.CABundle = string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw}))
+	st = stores.NewWebhookStore(spec)
+	st.(stores.ClientInjector).InjectClient(c)
+	_, err = st.StoreToken(context.Background(), ea, "token")
+	require.Error(t, err, "should fail without a client certificate")
+}
+
+func Test_WebhookStore_ValidateSpec(t *testing.T) {
+	signing := emcv1beta1.WebhookSigningSecretRef{Name: "webhook-signing"}
+	tcs := map[string]struct {
+		spec   emcv1beta1.WebhookStoreSpec
+		errMsg string
+	}{
+		"valid": {
+			spec: emcv1beta1.WebhookStoreSpec{URL: "https://example.com/store", RetrieveURL: "https://example.com/retrieve", SigningSecretRef: signing},
+		},
+		"http url": {
+			spec:   emcv1beta1.WebhookStoreSpec{URL: "http://example.com/store", SigningSecretRef: signing},
+			errMsg: "must be an https URL",
+		},
+		"invalid retrieve url": {
+			spec:   emcv1beta1.WebhookStoreSpec{URL: "https://example.com/store", RetrieveURL: "/retrieve", SigningSecretRef: signing},
+			errMsg: "must be an https URL",
+		},
+		"no signing secret": {
+			spec:   emcv1beta1.WebhookStoreSpec{URL: "https://example.com/store"},
+			errMsg: "a signing secret is required",
+		},
+		"invalid CA bundle": {
+			spec:   emcv1beta1.WebhookStoreSpec{URL: "https://example.com/store", SigningSecretRef: signing, CABundle: "not a certificate"},
+			errMsg: "CA bundle does not contain a PEM encoded certificate",
+		},
+	}
+	for name, tc := range tcs {
+		t.Run(name, func(t *testing.T) {
+			err := stores.NewWebhookStore(tc.spec).(stores.SpecValidator).ValidateSpec()
+			if tc.errMsg == "" {
+				require.NoError(t, err)
+				return
+			}
+			require.ErrorContains(t, err, tc.errMsg)
+		})
+	}
+}
+
+// webhookMock is a receiver verifying the signature and storing the tokens by reference.
+type webhookMock struct {
+	mu  sync.Mutex
+	key []byte
+	// header and payload are the headers and the payload of the last store request.
+	header  http.Header
+	payload stores.WebhookPayload
+	tokens  map[string]string
+}
+
+func (wm *webhookMock) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	wm.mu.Lock()
+	defer wm.mu.Unlock()
+
+	switch r.URL.Path {
+	case "/store":
+		body, err := io.ReadAll(r.Body)
+		if err != nil || r.Header.Get(stores.WebhookSignatureHeader) != stores.WebhookSignaturePrefix+stores.WebhookSignature(wm.key, body) {
+			http.Error(w, "invalid signature", http.StatusUnauthorized)
+			return
+		}
+		wm.header = r.Header.Clone()
+		if err := json.Unmarshal(body, &wm.payload); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		ref := fmt.Sprintf("ref-%d", len(wm.tokens)+1)
+		wm.tokens[ref] = wm.payload.Token
+		_ = json.NewEncoder(w).Encode(stores.WebhookResponse{Ref: ref})
+	case "/empty":
+		_, _ = w.Write([]byte("{}"))
+	case "/retrieve":
+		ref := r.URL.Query().Get(stores.WebhookRefQueryParameter)
+		if r.Header.Get(stores.WebhookSignatureHeader) != stores.WebhookSignaturePrefix+stores.WebhookSignature(wm.key, []byte(ref)) {
+			http.Error(w, "invalid signature", http.StatusUnauthorized)
+			return
+		}
+		token, ok := wm.tokens[ref]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		_ = json.NewEncoder(w).Encode(stores.WebhookPayload{Token: token})
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// generateClientCertificate generates a self-signed client certificate and returns it PEM encoded and parsed.
+func generateClientCertificate(t *testing.T) (certPEM, keyPEM []byte, cert *x509.Certificate) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "emergency-credentials-controller"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	require.NoError(t, err)
+	cert, err = x509.ParseCertificate(der)
+	require.NoError(t, err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}),
+		cert
+}
@@ -0,0 +1,49 @@
+package controllers
+
+import (
+	"fmt"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	emcv1beta1 "github.com/appuio/emergency-credentials-controller/api/v1beta1"
+)
+
+//+kubebuilder:rbac:groups=events.k8s.io,resources=events,verbs=create;patch,namespace="system"
+
+// clampedValidityTolerance is the difference between the requested and the granted validity tolerated before the validity is considered clamped.
+// It covers the time passing between requesting and receiving the credential.
+const clampedValidityTolerance = time.Minute
+
+// recordGrantedValidity compares the validity granted for a newly issued credential with the requested validity.
+// A clamped validity is recorded in the status, reported through the ValidityClamped condition, and an event.
+func (r *EmergencyAccountReconciler) recordGrantedValidity(instance *emcv1beta1.EmergencyAccount, expiration time.Time) {
+	requested := instance.Spec.ValidityDuration.Duration
+	granted := expiration.Sub(r.Clock.Now()).Round(time.Second)
+
+	if granted >= requested-clampedValidityTolerance {
+		instance.Status.GrantedValidityDuration = nil
+		r.setCondition(instance, emcv1beta1.ConditionValidityClamped, metav1.ConditionFalse, emcv1beta1.ReasonValidityGranted, "Requested validity granted")
+		return
+	}
+
+	instance.Status.GrantedValidityDuration = &metav1.Duration{Duration: granted}
+	msg := fmt.Sprintf("Requested validity of %s clamped to %s, minValidityDurationLeft scaled down to %s", requested, granted, minValidityDurationLeft(instance))
+	r.setCondition(instance, emcv1beta1.ConditionValidityClamped, metav1.ConditionTrue, emcv1beta1.ReasonValidityClamped, msg)
+	if r.Recorder != nil {
+		r.Recorder.Eventf(instance, nil, corev1.EventTypeWarning, emcv1beta1.ReasonValidityClamped, "IssueCredential", "%s", msg)
+	}
+}
+
+// minValidityDurationLeft returns the minimum validity left required for a credential to not be rotated.
+// If the API server clamped the validity of the last issued credential, the configured duration is scaled down by the same ratio.
+func minValidityDurationLeft(instance *emcv1beta1.EmergencyAccount) time.Duration {
+	minLeft := instance.Spec.MinValidityDurationLeft.Duration
+	requested := instance.Spec.ValidityDuration.Duration
+	granted := instance.Status.GrantedValidityDuration
+	if granted == nil || requested <= 0 || granted.Duration >= requested {
+		return minLeft
+	}
+	return time.Duration(float64(minLeft) * float64(granted.Duration) / float64(requested)).Round(time.Second)
+}
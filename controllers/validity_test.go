@@ -0,0 +1,99 @@
+package controllers
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/go-logr/logr/testr"
+	"github.com/stretchr/testify/require"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/events"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	emcv1beta1 "github.com/appuio/emergency-credentials-controller/api/v1beta1"
+)
+
+func Test_EmergencyAccountReconciler_Reconcile_ClampedValidity(t *testing.T) {
+	ctx := log.IntoContext(context.Background(), testr.New(t))
+	clock := &mockClock{now: time.Date(2022, 12, 4, 22, 45, 0, 0, time.UTC)}
+
+	ea := &emcv1beta1.EmergencyAccount{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:       "test",
+			Namespace:  "test",
+			Finalizers: []string{EmergencyAccountFinalizer},
+		},
+		Spec: emcv1beta1.EmergencyAccountSpec{
+			ValidityDuration:        metav1.Duration{Duration: 30 * 24 * time.Hour},
+			MinValidityDurationLeft: metav1.Duration{Duration: 7 * 24 * time.Hour},
+			MinRecreateInterval:     metav1.Duration{Duration: 5 * time.Minute},
+			TokenStores: []emcv1beta1.TokenStoreSpec{
+				{
+					Name: "testsecret",
+					Type: "secret",
+				},
+			},
+		},
+	}
+
+	c, control := fakeClient(t, clock, ea)
+	control.maxTokenExpiration = 24 * time.Hour
+	recorder := events.NewFakeRecorder(10)
+
+	subject := &EmergencyAccountReconciler{
+		Client:   c,
+		Scheme:   c.Scheme(),
+		Recorder: recorder,
+		Clock:    clock,
+	}
+	reconcileOnce := func() {
+		t.Helper()
+		_, err := subject.Reconcile(ctx, reconcile.Request{NamespacedName: client.ObjectKeyFromObject(ea)})
+		require.NoError(t, err)
+		require.NoError(t, c.Get(ctx, client.ObjectKeyFromObject(ea), ea))
+	}
+
+	reconcileOnce()
+	require.Len(t, ea.Status.Tokens, 1)
+	require.Equal(t, &metav1.Duration{Duration: 24 * time.Hour}, ea.Status.GrantedValidityDuration)
+	cond := requireCondition(t, ea, emcv1beta1.ConditionValidityClamped, metav1.ConditionTrue)
+	require.Equal(t, "Requested validity of 720h0m0s clamped to 24h0m0s, minValidityDurationLeft scaled down to 5h36m0s", cond.Message)
+	require.Len(t, recorder.Events, 1)
+	require.Contains(t, <-recorder.Events, "Warning ValidityClamped Requested validity of 720h0m0s clamped to 24h0m0s")
+
+	// The scaled down threshold prevents rotating on every check
+	clock.Advance(time.Hour)
+	reconcileOnce()
+	require.Len(t, ea.Status.Tokens, 1, "should not rotate the token")
+
+	clock.Advance(18 * time.Hour)
+	reconcileOnce()
+	require.Len(t, ea.Status.Tokens, 2, "should rotate once the scaled down threshold is reached")
+
+	// The clamped validity is cleared once the requested validity is granted
+	control.maxTokenExpiration = 0
+	clock.Advance(24 * time.Hour)
+	reconcileOnce()
+	require.Len(t, ea.Status.Tokens, 3)
+	require.Nil(t, ea.Status.GrantedValidityDuration)
+	requireCondition(t, ea, emcv1beta1.ConditionValidityClamped, metav1.ConditionFalse)
+}
+
+func Test_minValidityDurationLeft(t *testing.T) {
+	ea := &emcv1beta1.EmergencyAccount{
+		Spec: emcv1beta1.EmergencyAccountSpec{
+			ValidityDuration:        metav1.Duration{Duration: 100 * time.Hour},
+			MinValidityDurationLeft: metav1.Duration{Duration: 40 * time.Hour},
+		},
+	}
+	require.Equal(t, 40*time.Hour, minValidityDurationLeft(ea))
+
+	ea.Status.GrantedValidityDuration = &metav1.Duration{Duration: 10 * time.Hour}
+	require.Equal(t, 4*time.Hour, minValidityDurationLeft(ea))
+
+	ea.Status.GrantedValidityDuration = &metav1.Duration{Duration: 200 * time.Hour}
+	require.Equal(t, 40*time.Hour, minValidityDurationLeft(ea))
+}
@@ -3,6 +3,7 @@ package main
 import (
 	"flag"
 	"os"
+	"strings"
 	"time"
 
 	// Import all Kubernetes client auth plugins (e.g. Azure, GCP, OIDC, etc.)
@@ -11,11 +12,16 @@ import (
 	"k8s.io/client-go/rest"
 
 	authenticationv1 "k8s.io/api/authentication/v1"
+	certificatesv1 "k8s.io/api/certificates/v1"
+	corev1 "k8s.io/api/core/v1"
+	rbacv1 "k8s.io/api/rbac/v1"
+	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/apimachinery/pkg/runtime"
 	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
 	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
 	ctrl "sigs.k8s.io/controller-runtime"
 	"sigs.k8s.io/controller-runtime/pkg/cache"
+	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/healthz"
 	"sigs.k8s.io/controller-runtime/pkg/log/zap"
 	"sigs.k8s.io/controller-runtime/pkg/metrics/server"
@@ -43,12 +49,24 @@ func main() {
 	var enableLeaderElection bool
 	var probeAddr string
 	var namespace string
+	var enableWebhooks bool
+	var clusterName string
+	var secretNamespaces string
+	var clientCAFile string
+	var enableSecretReplication bool
 	flag.StringVar(&metricsAddr, "metrics-bind-address", ":8080", "The address the metric endpoint binds to.")
 	flag.StringVar(&probeAddr, "health-probe-bind-address", ":8081", "The address the probe endpoint binds to.")
 	flag.BoolVar(&enableLeaderElection, "leader-elect", false,
 		"Enable leader election for controller manager. "+
 			"Enabling this will ensure there is only one active controller manager.")
 	flag.StringVar(&namespace, "namespace", "default", "The namespace to watch for EmergencyAccount resources.")
+	flag.StringVar(&clusterName, "cluster-name", "", "The name of the cluster recorded in the metadata of stored tokens.")
+	flag.StringVar(&secretNamespaces, "secret-namespaces", "", "Comma separated list of additional namespaces the secret store can write to.")
+	flag.StringVar(&clientCAFile, "client-ca-file", "", "Path to the PEM encoded CA bundle issued client certificates are verified against. "+
+		"Defaults to the client CA of the API server in the kube-system/extension-apiserver-authentication ConfigMap.")
+	flag.BoolVar(&enableSecretReplication, "enable-secret-replication", false, "Enable copying the secrets of the secret store into other namespaces. "+
+		"Requires permissions to manage secrets in all namespaces.")
+	flag.BoolVar(&enableWebhooks, "enable-webhooks", false, "Enable the validating and mutating webhooks for EmergencyAccount resources. Requires a serving certificate.")
 	opts := zap.Options{
 		Development: true,
 	}
@@ -57,6 +75,23 @@ func main() {
 
 	ctrl.SetLogger(zap.New(zap.UseFlagOptions(&opts)))
 
+	var extraSecretNamespaces []string
+	for _, ns := range strings.Split(secretNamespaces, ",") {
+		if ns = strings.TrimSpace(ns); ns != "" {
+			extraSecretNamespaces = append(extraSecretNamespaces, ns)
+		}
+	}
+
+	var clientCABundle string
+	if clientCAFile != "" {
+		ca, err := os.ReadFile(clientCAFile)
+		if err != nil {
+			setupLog.Error(err, "unable to read client CA bundle", "file", clientCAFile)
+			os.Exit(1)
+		}
+		clientCABundle = string(ca)
+	}
+
 	setupLog.Info("limiting manager and cache to namespace", "namespace", namespace)
 	mgr, err := ctrl.NewManager(ctrl.GetConfigOrDie(), ctrl.Options{
 		Scheme: scheme,
@@ -79,10 +114,30 @@ func main() {
 		// LeaderElectionReleaseOnCancel: true,
 
 		// Limit the manager to only watch the namespace the controller is running in.
+		// RBAC objects granting permissions to the emergency accounts and CertificateSigningRequests are watched in all namespaces, limited to the managed objects.
+		// Secrets are additionally watched in the namespaces the secret store can write to, and in all namespaces limited to the managed copies if the secret store replication is enabled.
 		NewCache: func(config *rest.Config, opts cache.Options) (cache.Cache, error) {
 			opts.DefaultNamespaces = map[string]cache.Config{
 				namespace: {},
 			}
+			secretCache := map[string]cache.Config{
+				namespace: {},
+			}
+			for _, ns := range extraSecretNamespaces {
+				secretCache[ns] = cache.Config{}
+			}
+			managed := labels.SelectorFromSet(labels.Set{controllers.EmergencyAccountNamespaceLabel: namespace})
+			if enableSecretReplication {
+				secretCache[cache.AllNamespaces] = cache.Config{LabelSelector: managed}
+			}
+			opts.ByObject = map[client.Object]cache.ByObject{
+				&rbacv1.ClusterRole{}:                       {Label: managed},
+				&rbacv1.ClusterRoleBinding{}:                {Label: managed},
+				&rbacv1.Role{}:                              {Label: managed, Namespaces: map[string]cache.Config{cache.AllNamespaces: {}}},
+				&rbacv1.RoleBinding{}:                       {Label: managed, Namespaces: map[string]cache.Config{cache.AllNamespaces: {}}},
+				&certificatesv1.CertificateSigningRequest{}: {Label: managed},
+				&corev1.Secret{}:                            {Namespaces: secretCache},
+			}
 			return cache.New(config, opts)
 		},
 	})
@@ -92,14 +147,30 @@ func main() {
 	}
 
 	if err = (&controllers.EmergencyAccountReconciler{
-		Client: mgr.GetClient(),
-		Scheme: mgr.GetScheme(),
+		Client:            mgr.GetClient(),
+		Scheme:            mgr.GetScheme(),
+		Recorder:          mgr.GetEventRecorder("emergency-credentials-controller"),
+		ClusterName:       clusterName,
+		ClientCABundle:    clientCABundle,
+		APIReader:         mgr.GetAPIReader(),
+		SecretReplication: enableSecretReplication,
 
 		Clock: realClock{},
 	}).SetupWithManager(mgr); err != nil {
 		setupLog.Error(err, "unable to create controller", "controller", "EmergencyAccount")
 		os.Exit(1)
 	}
+	if enableWebhooks {
+		if err = (&controllers.EmergencyAccountValidator{
+			Namespace:         namespace,
+			SecretNamespaces:  extraSecretNamespaces,
+			SecretReplication: enableSecretReplication,
+			Client:            mgr.GetClient(),
+		}).SetupWebhookWithManager(mgr); err != nil {
+			setupLog.Error(err, "unable to create webhook", "webhook", "EmergencyAccount")
+			os.Exit(1)
+		}
+	}
 	//+kubebuilder:scaffold:builder
 
 	if err := mgr.AddHealthzCheck("healthz", healthz.Ping); err != nil {
@@ -0,0 +1,150 @@
+// Package shamir implements Shamir's secret sharing over GF(2^8).
+// Every byte of the secret is shared with its own random polynomial, a share holds the evaluations of all polynomials at the same point.
+// The point is appended as the last byte of the share, the format is compatible with the shares of HashiCorp Vault.
+package shamir
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// MaxShares is the maximum number of shares a secret can be split into.
+const MaxShares = 255
+
+// randReader is the source of the polynomial coefficients, tests replace it to split with known coefficients.
+var randReader io.Reader = rand.Reader
+
+// Split splits the secret into the given number of shares, any threshold of them reconstruct the secret.
+func Split(secret []byte, shares, threshold int) ([][]byte, error) {
+	if len(secret) == 0 {
+		return nil, errors.New("secret must not be empty")
+	}
+	if threshold < 2 {
+		return nil, fmt.Errorf("threshold must be at least 2, got %d", threshold)
+	}
+	if shares < threshold {
+		return nil, fmt.Errorf("shares (%d) must not be less than the threshold (%d)", shares, threshold)
+	}
+	if shares > MaxShares {
+		return nil, fmt.Errorf("shares (%d) must not exceed %d", shares, MaxShares)
+	}
+
+	out := make([][]byte, shares)
+	for i := range out {
+		out[i] = make([]byte, len(secret)+1)
+		out[i][len(secret)] = byte(i + 1)
+	}
+
+	coefficients := make([]byte, threshold-1)
+	for j, b := range secret {
+		if _, err := io.ReadFull(randReader, coefficients); err != nil {
+			return nil, fmt.Errorf("unable to generate polynomial: %w", err)
+		}
+		for i := range out {
+			out[i][j] = evaluate(b, coefficients, out[i][len(secret)])
+		}
+	}
+	return out, nil
+}
+
+// Combine reconstructs the secret from the given shares.
+// At least the threshold number of shares used to split the secret must be given, fewer shares result in a wrong secret.
+func Combine(shares [][]byte) ([]byte, error) {
+	if len(shares) < 2 {
+		return nil, errors.New("at least two shares are required")
+	}
+	l := len(shares[0])
+	if l < 2 {
+		return nil, errors.New("shares must be at least two bytes long")
+	}
+	xs := make([]byte, len(shares))
+	seen := map[byte]bool{}
+	for i, s := range shares {
+		if len(s) != l {
+			return nil, errors.New("all shares must have the same length")
+		}
+		x := s[l-1]
+		if x == 0 {
+			return nil, fmt.Errorf("share %d is invalid", i)
+		}
+		if seen[x] {
+			return nil, fmt.Errorf("share %d is a duplicate", i)
+		}
+		seen[x] = true
+		xs[i] = x
+	}
+
+	secret := make([]byte, l-1)
+	ys := make([]byte, len(shares))
+	for j := range secret {
+		for i, s := range shares {
+			ys[i] = s[j]
+		}
+		secret[j] = interpolate(xs, ys)
+	}
+	return secret, nil
+}
+
+// evaluate evaluates the polynomial with the given intercept and coefficients at x.
+func evaluate(intercept byte, coefficients []byte, x byte) byte {
+	var out byte
+	for i := len(coefficients) - 1; i >= 0; i-- {
+		out = mul(out, x) ^ coefficients[i]
+	}
+	return mul(out, x) ^ intercept
+}
+
+// interpolate returns the value at 0 of the polynomial through the given points.
+func interpolate(xs, ys []byte) byte {
+	var out byte
+	for i := range xs {
+		basis := byte(1)
+		for j := range xs {
+			if i == j {
+				continue
+			}
+			basis = mul(basis, div(xs[j], xs[j]^xs[i]))
+		}
+		out ^= mul(ys[i], basis)
+	}
+	return out
+}
+
+var logTable, expTable [256]byte
+
+func init() {
+	// 3 generates the multiplicative group of GF(2^8) with the AES polynomial x^8 + x^4 + x^3 + x + 1
+	x := byte(1)
+	for i := 0; i < 255; i++ {
+		expTable[i] = x
+		logTable[x] = byte(i)
+		x ^= xtime(x)
+	}
+	expTable[255] = expTable[0]
+}
+
+// xtime multiplies by x in GF(2^8).
+func xtime(b byte) byte {
+	if b&0x80 != 0 {
+		return b<<1 ^ 0x1b
+	}
+	return b << 1
+}
+
+// mul multiplies two elements of GF(2^8).
+func mul(a, b byte) byte {
+	if a == 0 || b == 0 {
+		return 0
+	}
+	return expTable[(int(logTable[a])+int(logTable[b]))%255]
+}
+
+// div divides two elements of GF(2^8), b must not be 0.
+func div(a, b byte) byte {
+	if a == 0 {
+		return 0
+	}
+	return expTable[(int(logTable[a])-int(logTable[b])+255)%255]
+}
@@ -0,0 +1,108 @@
+package shamir
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// referenceMul multiplies two elements of GF(2^8) bit by bit, reducing by the AES polynomial x^8 + x^4 + x^3 + x + 1.
+func referenceMul(a, b byte) byte {
+	var r byte
+	for ; b != 0; b >>= 1 {
+		if b&1 != 0 {
+			r ^= a
+		}
+		carry := a&0x80 != 0
+		a <<= 1
+		if carry {
+			a ^= 0x1b
+		}
+	}
+	return r
+}
+
+func Test_mul(t *testing.T) {
+	// Examples of FIPS-197, section 4.2
+	require.Equal(t, byte(0xc1), mul(0x57, 0x83))
+	require.Equal(t, byte(0xfe), mul(0x57, 0x13))
+	for i, expected := range []byte{0xae, 0x47, 0x8e, 0x07} {
+		require.Equal(t, expected, mul(0x57, 2<<i), "{57} • {%02x}", 2<<i)
+	}
+	// {53} and {ca} are inverses, FIPS-197 section 5.1.1
+	require.Equal(t, byte(0x01), mul(0x53, 0xca))
+	require.Equal(t, byte(0xca), div(1, 0x53))
+
+	// Test vectors of the GF(2^8) arithmetic of HashiCorp Vault's shamir package
+	require.Equal(t, byte(9), mul(3, 7))
+	require.Equal(t, byte(0), mul(3, 0))
+	require.Equal(t, byte(0), mul(0, 3))
+	require.Equal(t, byte(0), div(0, 7))
+	require.Equal(t, byte(1), div(3, 3))
+	require.Equal(t, byte(2), div(6, 3))
+
+	for a := 0; a < 256; a++ {
+		for b := 0; b < 256; b++ {
+			p := mul(byte(a), byte(b))
+			require.Equal(t, referenceMul(byte(a), byte(b)), p, "%02x • %02x", a, b)
+			if b != 0 {
+				require.Equal(t, byte(a), div(p, byte(b)), "%02x • %02x / %02x", a, b, b)
+			}
+		}
+	}
+}
+
+func Test_Split_KnownAnswer(t *testing.T) {
+	orig := randReader
+	t.Cleanup(func() { randReader = orig })
+	// The coefficients of the polynomials are 0x6f + 0x83x + 0x01x^2 for "o" and 0x6b + 0x02x for "k".
+	randReader = bytes.NewReader([]byte{0x83, 0x01, 0x02, 0x00})
+
+	shares, err := Split([]byte("ok"), 4, 3)
+	require.NoError(t, err)
+	require.Equal(t, [][]byte{
+		{0xed, 0x69, 0x01},
+		{0x76, 0x6f, 0x02},
+		{0xf4, 0x6d, 0x03},
+		{0x45, 0x63, 0x04},
+	}, shares)
+
+	randReader = bytes.NewReader([]byte{0x83})
+	_, err = Split([]byte("ok"), 4, 3)
+	require.ErrorContains(t, err, "unable to generate polynomial")
+}
+
+// Test_ThresholdMinusOne checks that fewer shares than the threshold reveal nothing about the secret.
+// Every secret is consistent with exactly one polynomial through the shares, so every secret is equally likely.
+func Test_ThresholdMinusOne(t *testing.T) {
+	t.Run("threshold 2", func(t *testing.T) {
+		var matches [256]int
+		for s := 0; s < 256; s++ {
+			for c := 0; c < 256; c++ {
+				if evaluate(byte(s), []byte{byte(c)}, 0x2a) == 0x8f {
+					matches[s]++
+				}
+			}
+		}
+		for s, m := range matches {
+			require.Equal(t, 1, m, "secret %02x", s)
+		}
+	})
+
+	t.Run("threshold 3", func(t *testing.T) {
+		var matches [256]int
+		coefficients := make([]byte, 2)
+		for s := 0; s < 256; s++ {
+			for c := 0; c < 256*256; c++ {
+				coefficients[0], coefficients[1] = byte(c), byte(c>>8)
+				if evaluate(byte(s), coefficients, 0x01) == 0xed && evaluate(byte(s), coefficients, 0x02) == 0x76 {
+					matches[s]++
+				}
+			}
+		}
+		for s, m := range matches {
+			require.Equal(t, 1, m, "secret %02x", s)
+		}
+	})
+}
@@ -0,0 +1,68 @@
+package shamir_test
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/appuio/emergency-credentials-controller/pkg/shamir"
+)
+
+func Test_SplitCombine(t *testing.T) {
+	secret := []byte("eyJhbGciOiJSUzI1NiJ9.break-glass")
+
+	shares, err := shamir.Split(secret, 5, 3)
+	require.NoError(t, err)
+	require.Len(t, shares, 5)
+	for _, s := range shares {
+		require.Len(t, s, len(secret)+1)
+	}
+
+	for _, subset := range [][]int{{0, 1, 2}, {4, 2, 0}, {1, 3, 4}, {0, 1, 2, 3, 4}} {
+		parts := make([][]byte, 0, len(subset))
+		for _, i := range subset {
+			parts = append(parts, shares[i])
+		}
+		combined, err := shamir.Combine(parts)
+		require.NoError(t, err)
+		require.Equal(t, secret, combined, "shares %v", subset)
+	}
+
+	combined, err := shamir.Combine(shares[:2])
+	require.NoError(t, err)
+	require.NotEqual(t, secret, combined, "fewer shares than the threshold should not reconstruct the secret")
+}
+
+func Test_Combine_KnownAnswer(t *testing.T) {
+	// Shares of "hi" in the format of HashiCorp Vault with the x coordinates 0x2a and 0xc3 as the last byte.
+	// The polynomials are 0x68 + 0x5ax for "h" and 0x69 + 0xa5x for "i".
+	combined, err := shamir.Combine([][]byte{
+		{0x8f, 0x00, 0x2a},
+		{0x15, 0xd4, 0xc3},
+	})
+	require.NoError(t, err)
+	require.Equal(t, []byte("hi"), combined)
+}
+
+func Test_Split_Invalid(t *testing.T) {
+	_, err := shamir.Split(nil, 3, 2)
+	require.ErrorContains(t, err, "must not be empty")
+	_, err = shamir.Split([]byte("s"), 3, 1)
+	require.ErrorContains(t, err, "threshold must be at least 2")
+	_, err = shamir.Split([]byte("s"), 2, 3)
+	require.ErrorContains(t, err, "must not be less than the threshold")
+	_, err = shamir.Split([]byte("s"), 256, 3)
+	require.ErrorContains(t, err, "must not exceed 255")
+}
+
+func Test_Combine_Invalid(t *testing.T) {
+	shares, err := shamir.Split([]byte("secret"), 3, 2)
+	require.NoError(t, err)
+
+	_, err = shamir.Combine(shares[:1])
+	require.ErrorContains(t, err, "at least two shares")
+	_, err = shamir.Combine([][]byte{shares[0], shares[0]})
+	require.ErrorContains(t, err, "duplicate")
+	_, err = shamir.Combine([][]byte{shares[0], shares[1][1:]})
+	require.ErrorContains(t, err, "same length")
+}
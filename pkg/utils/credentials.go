@@ -0,0 +1,155 @@
+package utils
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"k8s.io/client-go/tools/clientcmd"
+	clientcmdapi "k8s.io/client-go/tools/clientcmd/api"
+)
+
+// CredentialExpiration returns the expiration time of a credential.
+// The credential can be a token, a PEM encoded client certificate and key, or a kubeconfig containing one of them.
+func CredentialExpiration(credential []byte) (time.Time, error) {
+	if t, err := ParseJWTWithoutVerify(string(credential)); err == nil {
+		exp, err := t.Claims.GetExpirationTime()
+		if err != nil {
+			return time.Time{}, fmt.Errorf("unable to get expiration time from token: %w", err)
+		}
+		if exp == nil {
+			return time.Time{}, errors.New("token has no expiration time")
+		}
+		return exp.Time, nil
+	}
+	if bytes.Contains(credential, []byte("-----BEGIN CERTIFICATE-----")) {
+		cert, err := ParseClientCertificate(credential)
+		if err != nil {
+			return time.Time{}, err
+		}
+		return cert.Leaf.NotAfter, nil
+	}
+	kc, err := CredentialFromKubeconfig(credential)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("credential is neither a token, a client certificate, nor a kubeconfig: %w", err)
+	}
+	return CredentialExpiration([]byte(kc))
+}
+
+// CredentialFromKubeconfig returns the credential of the user of the current context in the given kubeconfig.
+// The credential is either the token or the PEM encoded client certificate followed by the key.
+func CredentialFromKubeconfig(kubeconfig []byte) (string, error) {
+	cfg, err := clientcmd.Load(kubeconfig)
+	if err != nil {
+		return "", fmt.Errorf("unable to load kubeconfig: %w", err)
+	}
+	ctx, ok := cfg.Contexts[cfg.CurrentContext]
+	if !ok {
+		return "", fmt.Errorf("current context %q not found in kubeconfig", cfg.CurrentContext)
+	}
+	user, ok := cfg.AuthInfos[ctx.AuthInfo]
+	if !ok {
+		return "", fmt.Errorf("user %q not found in kubeconfig", ctx.AuthInfo)
+	}
+	if user.Token != "" {
+		return user.Token, nil
+	}
+	if len(user.ClientCertificateData) > 0 && len(user.ClientKeyData) > 0 {
+		return string(user.ClientCertificateData) + string(user.ClientKeyData), nil
+	}
+	return "", fmt.Errorf("user %q has neither a token nor a client certificate", ctx.AuthInfo)
+}
+
+// SplitCertificateBundle splits a PEM bundle into the certificates and the private key.
+func SplitCertificateBundle(bundle []byte) (certPEM []byte, keyPEM []byte, err error) {
+	rest := bundle
+	for {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			break
+		}
+		if block.Type == "CERTIFICATE" {
+			certPEM = append(certPEM, pem.EncodeToMemory(block)...)
+			continue
+		}
+		if keyPEM != nil {
+			return nil, nil, errors.New("bundle contains more than one private key")
+		}
+		keyPEM = pem.EncodeToMemory(block)
+	}
+	if certPEM == nil {
+		return nil, nil, errors.New("bundle contains no certificate")
+	}
+	if keyPEM == nil {
+		return nil, nil, errors.New("bundle contains no private key")
+	}
+	return certPEM, keyPEM, nil
+}
+
+// ParseClientCertificate parses a PEM bundle of a client certificate and its private key.
+// Returns an error if the key does not match the certificate.
+func ParseClientCertificate(bundle []byte) (tls.Certificate, error) {
+	certPEM, keyPEM, err := SplitCertificateBundle(bundle)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("unable to parse client certificate: %w", err)
+	}
+	if cert.Leaf == nil {
+		cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0])
+		if err != nil {
+			return tls.Certificate{}, fmt.Errorf("unable to parse client certificate: %w", err)
+		}
+	}
+	return cert, nil
+}
+
+// NewKubeconfig returns a kubeconfig with a cluster and context for every server using the credential as user credential.
+// The credential is either a token or the PEM encoded client certificate followed by the key.
+// The user is named `<namespace>/<name>`, the contexts `<name>-<index>`, and the first server is used for the current context.
+// The clusters trust the system CAs if no CA bundle is given.
+func NewKubeconfig(name, namespace string, servers []string, caData []byte, credential string) ([]byte, error) {
+	if len(servers) == 0 {
+		return nil, errors.New("no servers given")
+	}
+
+	user := namespace + "/" + name
+	cfg := clientcmdapi.NewConfig()
+	cfg.AuthInfos[user] = &clientcmdapi.AuthInfo{Token: credential}
+	if strings.Contains(credential, "-----BEGIN CERTIFICATE-----") {
+		certPEM, keyPEM, err := SplitCertificateBundle([]byte(credential))
+		if err != nil {
+			return nil, fmt.Errorf("unable to split client certificate: %w", err)
+		}
+		cfg.AuthInfos[user] = &clientcmdapi.AuthInfo{ClientCertificateData: certPEM, ClientKeyData: keyPEM}
+	}
+	for i, server := range servers {
+		ctxName := fmt.Sprintf("%s-%d", name, i)
+		cfg.Clusters[ctxName] = &clientcmdapi.Cluster{
+			Server:                   server,
+			CertificateAuthorityData: caData,
+		}
+		cfg.Contexts[ctxName] = &clientcmdapi.Context{
+			Cluster:   ctxName,
+			AuthInfo:  user,
+			Namespace: namespace,
+		}
+		if i == 0 {
+			cfg.CurrentContext = ctxName
+		}
+	}
+
+	kc, err := clientcmd.Write(*cfg)
+	if err != nil {
+		return nil, fmt.Errorf("unable to write kubeconfig: %w", err)
+	}
+	return kc, nil
+}
@@ -2,6 +2,7 @@ package utils
 
 import (
 	"errors"
+	"fmt"
 	"strings"
 
 	"github.com/golang-jwt/jwt/v5"
@@ -44,3 +45,21 @@ func SplitPublicKeyBlocks(in string) ([]string, error) {
 
 	return blocks, nil
 }
+
+// SplitAgeRecipients splits a string in the format of an age recipients file into a slice of recipients.
+// Empty lines and lines starting with `#` are ignored.
+// Returns an error and the already found recipients if a line is not an age X25519 recipient or a supported SSH public key.
+func SplitAgeRecipients(in string) ([]string, error) {
+	var recipients []string
+	for i, line := range strings.Split(in, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if !strings.HasPrefix(line, "age1") && !strings.HasPrefix(line, "ssh-ed25519 ") && !strings.HasPrefix(line, "ssh-rsa ") {
+			return recipients, fmt.Errorf("line %d is not an age recipient or a ssh-ed25519 or ssh-rsa public key", i+1)
+		}
+		recipients = append(recipients, line)
+	}
+	return recipients, nil
+}
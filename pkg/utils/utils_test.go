@@ -62,3 +62,33 @@ Public Key Block 1
 	require.Error(t, err)
 	require.Equal(t, expected, result)
 }
+
+func Test_SplitAgeRecipients(t *testing.T) {
+	input := `
+# on-call
+age1ql3z7hjy54pw3hyww5ayyfg7zqgvc7w3j2elw8zmrj2kg5sfn9aqmcac8p
+  ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIHsKLqeplhpW+uObz5dvMgjz1OxfM/XXUB+VHtZ6isGN jane@example.com
+
+ssh-rsa AAAAB3NzaC1yc2EAAAADAQABAAABAQC john@example.com
+`
+
+	expected := []string{
+		"age1ql3z7hjy54pw3hyww5ayyfg7zqgvc7w3j2elw8zmrj2kg5sfn9aqmcac8p",
+		"ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIHsKLqeplhpW+uObz5dvMgjz1OxfM/XXUB+VHtZ6isGN jane@example.com",
+		"ssh-rsa AAAAB3NzaC1yc2EAAAADAQABAAABAQC john@example.com",
+	}
+
+	result, err := utils.SplitAgeRecipients(input)
+	require.NoError(t, err)
+	require.Equal(t, expected, result)
+}
+
+func Test_SplitAgeRecipients_Unsupported(t *testing.T) {
+	input := `age1ql3z7hjy54pw3hyww5ayyfg7zqgvc7w3j2elw8zmrj2kg5sfn9aqmcac8p
+ecdsa-sha2-nistp256 AAAAE2VjZHNhLXNoYTItbmlzdHAyNTYAAAAIbmlzdHAyNTY=
+`
+
+	result, err := utils.SplitAgeRecipients(input)
+	require.ErrorContains(t, err, "line 2")
+	require.Equal(t, []string{"age1ql3z7hjy54pw3hyww5ayyfg7zqgvc7w3j2elw8zmrj2kg5sfn9aqmcac8p"}, result)
+}